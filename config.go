@@ -0,0 +1,301 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+	"gopkg.in/yaml.v2"
+)
+
+// fileConfig is the configuration file of the proxy. Its fields mirror the
+// flags of the same name, the flags given on the command line taking
+// precedence over the file.
+type fileConfig struct {
+	InsecureListenAddress  *string  `yaml:"insecure-listen-address"`
+	SecureListenAddress    *string  `yaml:"secure-listen-address"`
+	InternalListenAddress  *string  `yaml:"internal-listen-address"`
+	Upstream               *string  `yaml:"upstream"`
+	Label                  *string  `yaml:"label"`
+	LabelParameter         *string  `yaml:"label-parameter"`
+	HeaderName             *string  `yaml:"header-name"`
+	AllowedLabelValues     []string `yaml:"allowed-label-values"`
+	EnableLabelAPIs        *bool    `yaml:"enable-label-apis"`
+	RulesWithActiveAlerts  *bool    `yaml:"rules-with-active-alerts"`
+	AlertsErrorOnReplace   *bool    `yaml:"alerts-error-on-replace"`
+	SilencesErrorOnReplace *bool    `yaml:"silences-error-on-replace"`
+	MatchErrorOnConflict   *bool    `yaml:"match-error-on-conflict"`
+}
+
+// loadConfig reads the configuration file. Unknown fields are rejected.
+func loadConfig(path string) (*fileConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the configuration file: %w", err)
+	}
+
+	var cfg fileConfig
+	if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid configuration file %q: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// restartFlagValues returns the values of the flags set in the file which
+// can't be changed without a restart, by flag name.
+func (c *fileConfig) restartFlagValues() map[string]string {
+	v := map[string]string{}
+	for name, s := range map[string]*string{
+		"insecure-listen-address": c.InsecureListenAddress,
+		"secure-listen-address":   c.SecureListenAddress,
+		"internal-listen-address": c.InternalListenAddress,
+		"upstream":                c.Upstream,
+	} {
+		if s != nil {
+			v[name] = *s
+		}
+	}
+	return v
+}
+
+// apply sets the flags of the flag set which can't be changed without a
+// restart from the file, except the flags given on the command line. The other
+// settings are merged with reloadableConfig.merge.
+func (c *fileConfig) apply(fs *flag.FlagSet, cmdline map[string]struct{}) error {
+	for name, v := range c.restartFlagValues() {
+		if _, ok := cmdline[name]; ok {
+			continue
+		}
+		if err := fs.Set(name, v); err != nil {
+			return fmt.Errorf("invalid value %q for %s in the configuration file: %w", v, name, err)
+		}
+	}
+	return nil
+}
+
+// restartRequired returns the names of the settings which can't be changed
+// without a restart and differ in the next file, except the flags given on the
+// command line.
+func (c *fileConfig) restartRequired(next *fileConfig, cmdline map[string]struct{}) []string {
+	prev, cur := c.restartFlagValues(), next.restartFlagValues()
+	var names []string
+	for _, name := range []string{"insecure-listen-address", "secure-listen-address", "internal-listen-address", "upstream"} {
+		if _, ok := cmdline[name]; ok {
+			continue
+		}
+		if prev[name] != cur[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// reloadableConfig holds the settings which can be changed by reloading the
+// configuration file.
+type reloadableConfig struct {
+	label                  string
+	labelParameter         string
+	headerName             string
+	allowedLabelValues     labelValues
+	enableLabelAPIs        bool
+	rulesWithActiveAlerts  bool
+	alertsErrorOnReplace   bool
+	silencesErrorOnReplace bool
+	matchErrorOnConflict   bool
+}
+
+// merge returns the settings overridden by the file, except the flags given
+// on the command line.
+func (c reloadableConfig) merge(f *fileConfig, cmdline map[string]struct{}) (reloadableConfig, error) {
+	fromFile := func(name string) bool {
+		_, ok := cmdline[name]
+		return !ok
+	}
+	str := func(name string, dst, v *string) {
+		if v != nil && fromFile(name) {
+			*dst = *v
+		}
+	}
+	boolean := func(name string, dst, v *bool) {
+		if v != nil && fromFile(name) {
+			*dst = *v
+		}
+	}
+
+	str("label", &c.label, f.Label)
+	str("label-parameter", &c.labelParameter, f.LabelParameter)
+	str("header-name", &c.headerName, f.HeaderName)
+	if f.AllowedLabelValues != nil && fromFile("allowed-label-value") {
+		var values labelValues
+		for _, v := range f.AllowedLabelValues {
+			if err := values.Set(v); err != nil {
+				return c, fmt.Errorf("invalid value %q for allowed-label-values in the configuration file: %w", v, err)
+			}
+		}
+		c.allowedLabelValues = values
+	}
+	boolean("enable-label-apis", &c.enableLabelAPIs, f.EnableLabelAPIs)
+	boolean("rules-with-active-alerts", &c.rulesWithActiveAlerts, f.RulesWithActiveAlerts)
+	boolean("alerts-error-on-replace", &c.alertsErrorOnReplace, f.AlertsErrorOnReplace)
+	boolean("silences-error-on-replace", &c.silencesErrorOnReplace, f.SilencesErrorOnReplace)
+	boolean("match-error-on-conflict", &c.matchErrorOnConflict, f.MatchErrorOnConflict)
+
+	if c.label == "" {
+		return c, fmt.Errorf("the label cannot be empty")
+	}
+	return c, nil
+}
+
+func (c reloadableConfig) values() map[string]string {
+	return map[string]string{
+		"label":                     c.label,
+		"label-parameter":           c.labelParameter,
+		"header-name":               c.headerName,
+		"allowed-label-values":      c.allowedLabelValues.String(),
+		"enable-label-apis":         strconv.FormatBool(c.enableLabelAPIs),
+		"rules-with-active-alerts":  strconv.FormatBool(c.rulesWithActiveAlerts),
+		"alerts-error-on-replace":   strconv.FormatBool(c.alertsErrorOnReplace),
+		"silences-error-on-replace": strconv.FormatBool(c.silencesErrorOnReplace),
+		"match-error-on-conflict":   strconv.FormatBool(c.matchErrorOnConflict),
+	}
+}
+
+// diff returns the changes between the settings and the next ones.
+func (c reloadableConfig) diff(next reloadableConfig) []string {
+	prev, cur := c.values(), next.values()
+	var changes []string
+	for name, v := range prev {
+		if v != cur[name] {
+			changes = append(changes, fmt.Sprintf("%s: %q -> %q", name, v, cur[name]))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// proxyRoutes are the routes of the proxy built by injectproxy.NewRoutes.
+type proxyRoutes interface {
+	http.Handler
+	ExplainHandler() http.Handler
+}
+
+// errRestartRequired is returned when reloading the configuration file would
+// change settings which can't be changed without a restart.
+var errRestartRequired = errors.New("restart required")
+
+// reloadableRoutes serves the requests with the routes built from the last
+// configuration loaded. The routes are swapped atomically so that the new
+// requests use the new configuration while the in-flight ones complete with
+// the previous routes.
+type reloadableRoutes struct {
+	path    string
+	cmdline map[string]struct{}
+	// base holds the settings of the command line and the defaults.
+	base reloadableConfig
+	// extract returns the ExtractLabeler of the settings.
+	extract func(reloadableConfig) (injectproxy.ExtractLabeler, error)
+	// build returns the routes of the settings extracting the label value
+	// with the given ExtractLabeler.
+	build func(reloadableConfig, injectproxy.ExtractLabeler) (proxyRoutes, error)
+	// extractor is shared by the successive routes, each one extracting the
+	// label value with a snapshot of the ExtractLabeler of its settings. When
+	// a reload fails, it denies all the requests with 503 unless it keeps the
+	// previous configuration.
+	extractor *injectproxy.ReloadableExtractLabeler
+
+	// mtx serializes the reloads.
+	mtx     sync.Mutex
+	file    *fileConfig
+	current reloadableConfig
+	routes  atomic.Value
+}
+
+func (r *reloadableRoutes) load() proxyRoutes {
+	return r.routes.Load().(proxyRoutes)
+}
+
+func (r *reloadableRoutes) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.load().ServeHTTP(w, req)
+}
+
+// ExplainHandler returns the explain handler of the current routes.
+func (r *reloadableRoutes) ExplainHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.load().ExplainHandler().ServeHTTP(w, req)
+	})
+}
+
+// swap builds the routes of the settings and swaps them with the current
+// routes. The routes extract the label value with their own snapshot of the
+// ExtractLabeler so that the label name and the value source change together.
+// They are stored before the extractor is reloaded, otherwise the previous
+// routes could serve requests in between after a failed reload.
+func (r *reloadableRoutes) swap(file *fileConfig, next reloadableConfig) error {
+	el, err := r.extract(next)
+	if err != nil {
+		return err
+	}
+	routes, err := r.build(next, r.extractor.Snapshot(el))
+	if err != nil {
+		return err
+	}
+	r.routes.Store(routes)
+	r.extractor.Reload(func() (injectproxy.ExtractLabeler, error) { return el, nil })
+	r.file, r.current = file, next
+	return nil
+}
+
+// reload reads the configuration file again and swaps the routes. The reloads
+// changing the listen addresses or the upstream URL are rejected since they
+// require a restart, the current configuration being kept. When the file is
+// invalid, all the requests are denied with 503 until a valid file is loaded,
+// unless the extractor keeps the previous configuration. It returns the
+// changes applied.
+func (r *reloadableRoutes) reload() ([]string, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	file, err := loadConfig(r.path)
+	if err != nil {
+		return nil, r.fail(err)
+	}
+	if names := r.file.restartRequired(file, r.cmdline); len(names) > 0 {
+		return nil, fmt.Errorf("changing %s: %w", strings.Join(names, ", "), errRestartRequired)
+	}
+	next, err := r.base.merge(file, r.cmdline)
+	if err != nil {
+		return nil, r.fail(err)
+	}
+
+	changes := r.current.diff(next)
+	if err := r.swap(file, next); err != nil {
+		return nil, r.fail(err)
+	}
+	return changes, nil
+}
+
+// fail records the failed reload in the extractor and returns the error.
+func (r *reloadableRoutes) fail(err error) error {
+	return r.extractor.Reload(func() (injectproxy.ExtractLabeler, error) { return nil, err })
+}
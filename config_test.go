@@ -0,0 +1,148 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+)
+
+func TestReload(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	type step struct {
+		config string
+
+		expErr        bool
+		expRestart    bool
+		expCode       int
+		expCodeTenant int
+	}
+	for _, tc := range []struct {
+		name         string
+		keepPrevious bool
+		steps        []step
+	}{
+		{
+			name: "invalid file denies the requests",
+			steps: []step{
+				{config: "label: tenant\nunknown: true\n", expErr: true, expCode: http.StatusServiceUnavailable, expCodeTenant: http.StatusServiceUnavailable},
+				{config: "label: tenant\n", expCode: http.StatusBadRequest, expCodeTenant: http.StatusOK},
+			},
+		},
+		{
+			name: "invalid settings deny the requests",
+			steps: []step{
+				{config: "label: ''\n", expErr: true, expCode: http.StatusServiceUnavailable, expCodeTenant: http.StatusServiceUnavailable},
+				{config: "label: namespace\n", expCode: http.StatusOK, expCodeTenant: http.StatusBadRequest},
+			},
+		},
+		{
+			name:         "invalid file keeps the previous configuration",
+			keepPrevious: true,
+			steps: []step{
+				{config: "label: tenant\nunknown: true\n", expErr: true, expCode: http.StatusOK, expCodeTenant: http.StatusBadRequest},
+				{config: "label: tenant\n", expCode: http.StatusBadRequest, expCodeTenant: http.StatusOK},
+			},
+		},
+		{
+			name: "restart required keeps the current configuration",
+			steps: []step{
+				{config: "label: tenant\nupstream: http://other.example.com\n", expErr: true, expRestart: true, expCode: http.StatusOK, expCodeTenant: http.StatusBadRequest},
+			},
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "prom-label-proxy")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "config.yaml")
+
+			write := func(config string) {
+				if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			write("label: namespace\n")
+			file, err := loadConfig(path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			current, err := reloadableConfig{}.merge(file, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			extractor := injectproxy.NewReloadableExtractLabeler(nil)
+			extractor.KeepPrevious = tc.keepPrevious
+			routes := &reloadableRoutes{
+				path: path,
+				extract: func(c reloadableConfig) (injectproxy.ExtractLabeler, error) {
+					return injectproxy.HTTPFormEnforcer{ParameterName: c.label}, nil
+				},
+				build: func(c reloadableConfig, el injectproxy.ExtractLabeler) (proxyRoutes, error) {
+					return injectproxy.NewRoutes(upstreamURL, c.label, injectproxy.WithExtractLabeler(el))
+				},
+				extractor: extractor,
+			}
+			if err := routes.swap(file, current); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			query := func(param string) int {
+				w := httptest.NewRecorder()
+				routes.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&"+param+"=default", nil))
+				return w.Code
+			}
+			if code := query("namespace"); code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d", http.StatusOK, code)
+			}
+
+			for i, s := range tc.steps {
+				write(s.config)
+				_, err := routes.reload()
+				if s.expErr != (err != nil) {
+					t.Fatalf("step %d: expected error %v, got %v", i, s.expErr, err)
+				}
+				if s.expRestart != errors.Is(err, errRestartRequired) {
+					t.Fatalf("step %d: expected restart required %v, got %v", i, s.expRestart, err)
+				}
+				if code := query("namespace"); code != s.expCode {
+					t.Fatalf("step %d: expected status code %d with the namespace parameter, got %d", i, s.expCode, code)
+				}
+				if code := query("tenant"); code != s.expCodeTenant {
+					t.Fatalf("step %d: expected status code %d with the tenant parameter, got %d", i, s.expCodeTenant, code)
+				}
+			}
+		})
+	}
+}
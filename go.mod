@@ -3,10 +3,18 @@ module github.com/prometheus-community/prom-label-proxy
 go 1.13
 
 require (
+	github.com/andybalholm/brotli v1.0.4
 	github.com/efficientgo/tools/core v0.0.0-20210201224146-3d78f4d30648
+	github.com/go-ldap/ldap/v3 v3.4.1
 	github.com/go-openapi/runtime v0.19.15
 	github.com/go-openapi/strfmt v0.19.5
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/alertmanager v0.20.0
 	github.com/prometheus/prometheus v1.8.2-0.20200507164740-ecee9c8abfd1
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.7.0
+	go.opentelemetry.io/otel/sdk v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
+	gopkg.in/square/go-jose.v2 v2.6.0
+	gopkg.in/yaml.v2 v2.2.8
 )
@@ -0,0 +1,302 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/alertmanager/api/v2/models"
+	"github.com/prometheus/alertmanager/pkg/labels"
+)
+
+func (r *routes) alerts(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET", "HEAD":
+		r.listAlerts(w, req)
+	case "POST":
+		r.postAlerts(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// alertStateParams are the boolean parameters of the Alertmanager alerts
+// endpoint selecting the alerts by state.
+var alertStateParams = []string{"active", "silenced", "inhibited", "unprocessed"}
+
+// listAlerts ensures that the request contains the filters matching exactly
+// the enforced label values. Filters targeting an enforced label with a
+// different matcher are rejected. The other parameters (e.g. active, silenced, inhibited
+// or receiver) are forwarded as-is once validated.
+func (r *routes) listAlerts(w http.ResponseWriter, req *http.Request) {
+	var (
+		q        = req.URL.Query()
+		enforced = enforcedLabels(req.Context())
+		modified = enforced.filters()
+	)
+	for _, p := range alertStateParams {
+		if v := q.Get(p); v != "" {
+			if _, err := strconv.ParseBool(v); err != nil {
+				http.Error(w, fmt.Sprintf("bad request: invalid %s parameter %q", p, v), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	for _, filter := range q["filter"] {
+		m, err := labels.ParseMatcher(filter)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad request: can't parse filter %q: %v", filter, err), http.StatusBadRequest)
+			return
+		}
+		if lvalue, ok := enforced.value(m.Name); ok {
+			if m.Type != labels.MatchEqual || m.Value != lvalue {
+				http.Error(w, fmt.Sprintf("bad request: filter %q conflicts with the enforced label", filter), http.StatusBadRequest)
+				return
+			}
+			continue
+		}
+		modified = append(modified, filter)
+	}
+
+	q["filter"] = modified
+	req.URL.RawQuery = q.Encode()
+
+	r.handler.ServeHTTP(w, req)
+}
+
+// postAlerts enforces the labels on the alerts pushed to Alertmanager: the
+// labels are set on every alert of the batch. Unless alertsErrorOnReplace is
+// enabled, a different value of a label is replaced, otherwise the request is
+// rejected.
+func (r *routes) postAlerts(w http.ResponseWriter, req *http.Request) {
+	var (
+		alerts   models.PostableAlerts
+		enforced = enforcedLabels(req.Context())
+	)
+	if err := json.NewDecoder(req.Body).Decode(&alerts); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: can't decode: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	for i, alert := range alerts {
+		if alert == nil {
+			http.Error(w, fmt.Sprintf("bad request: alert %d is null", i), http.StatusBadRequest)
+			return
+		}
+		if alert.Labels == nil {
+			alert.Labels = models.LabelSet{}
+		}
+		for _, l := range enforced {
+			if v, ok := alert.Labels[l.name]; ok && v != l.value && r.alertsErrorOnReplace {
+				http.Error(w, fmt.Sprintf("bad request: alert %d has the label %s=%q conflicting with the enforced label", i, l.name, v), http.StatusBadRequest)
+				return
+			}
+			alert.Labels[l.name] = l.value
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(alerts); err != nil {
+		http.Error(w, fmt.Sprintf("can't encode: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	req = req.Clone(req.Context())
+	req.Body = ioutil.NopCloser(&buf)
+	req.Header["Content-Length"] = []string{strconv.Itoa(buf.Len())}
+	req.ContentLength = int64(buf.Len())
+
+	r.handler.ServeHTTP(w, req)
+}
+
+// filterAlertmanagerAlerts removes the alerts which don't match the enforced
+// label values from the Alertmanager response. The backend should already have
+// applied the injected filter, this is a defense in depth.
+func (r *routes) filterAlertmanagerAlerts(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK || resp.Request.Method == http.MethodPost {
+		// Pass non-200 responses and the responses to the pushed alerts as-is.
+		return nil
+	}
+
+	defer resp.Body.Close()
+	var alerts models.GettableAlerts
+	reader, err := bodyReader(resp)
+	if err == nil {
+		defer reader.Close()
+		if err = json.NewDecoder(reader).Decode(&alerts); err == io.EOF {
+			err = errEmptyResponse
+		}
+	}
+	switch {
+	case err == errEmptyResponse:
+		if !r.emptyBodyAsEmptyData {
+			// The Alertmanager API returns the errors as JSON strings.
+			return r.badUpstreamResponse(resp, err.Error())
+		}
+		log.Printf("warning: Empty response body from the upstream for %s, returning an empty result", resp.Request.URL.Path)
+	case err != nil:
+		return errors.Wrap(err, "can't decode alerts")
+	}
+
+	var (
+		lvalue   = mustLabelValue(resp.Request.Context())
+		enforced = enforcedLabels(resp.Request.Context())
+		filtered = models.GettableAlerts{}
+	)
+	for _, alert := range alerts {
+		if !enforced.matchLabels(alert.Labels) {
+			continue
+		}
+		if r.strictAlerts {
+			refs := make(map[string]string, len(alert.Annotations))
+			for k, v := range alert.Annotations {
+				refs[k] = v
+			}
+			if r.referencesOtherValue(mustLabelValues(resp.Request.Context()), refs, string(alert.GeneratorURL)) {
+				continue
+			}
+		}
+		filtered = append(filtered, alert)
+	}
+	r.recordFiltering(resp.Request.Context(), "alertmanager_alerts", lvalue, len(alerts), len(filtered))
+	r.setFilteredCount(resp, len(alerts)-len(filtered))
+
+	if r.scopedAlertReferences {
+		if err := r.scopeAlertReferences(resp.Request.Context(), filtered); err != nil {
+			return err
+		}
+	}
+
+	return r.replaceBody(resp, filtered)
+}
+
+// scopeAlertReferences removes from the silencedBy and inhibitedBy fields of
+// the alerts' status the IDs of the silences and inhibiting alerts which don't
+// match the enforced label values. They are resolved with the Alertmanager
+// API.
+func (r *routes) scopeAlertReferences(ctx context.Context, alerts models.GettableAlerts) error {
+	enforced := enforcedLabels(ctx)
+	var silenced, inhibited bool
+	for _, alert := range alerts {
+		if alert.Status == nil {
+			continue
+		}
+		silenced = silenced || len(alert.Status.SilencedBy) > 0
+		inhibited = inhibited || len(alert.Status.InhibitedBy) > 0
+	}
+
+	silences := map[string]struct{}{}
+	if silenced {
+		matchers, err := r.listSilenceMatchers(ctx, enforced.filters())
+		if err != nil {
+			return errors.Wrap(err, "can't list silences")
+		}
+		for id, ms := range matchers {
+			if enforced.matchSilence(ms) {
+				silences[id] = struct{}{}
+			}
+		}
+	}
+
+	inhibitors := map[string]struct{}{}
+	if inhibited {
+		var fps []string
+		for _, alert := range alerts {
+			if alert.Status != nil {
+				fps = append(fps, alert.Status.InhibitedBy...)
+			}
+		}
+		resolved, err := r.resolveAlertFingerprints(ctx, fps)
+		if err != nil {
+			return errors.Wrap(err, "can't resolve inhibiting alerts")
+		}
+		for fp, ls := range resolved {
+			if enforced.matchLabels(ls) {
+				inhibitors[fp] = struct{}{}
+			}
+		}
+	}
+
+	for _, alert := range alerts {
+		if alert.Status == nil {
+			continue
+		}
+		alert.Status.SilencedBy = keepIDs(alert.Status.SilencedBy, silences)
+		alert.Status.InhibitedBy = keepIDs(alert.Status.InhibitedBy, inhibitors)
+	}
+
+	return nil
+}
+
+// keepIDs returns the IDs which are in the allowed set.
+func keepIDs(ids []string, allowed map[string]struct{}) []string {
+	kept := []string{}
+	for _, id := range ids {
+		if _, ok := allowed[id]; ok {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+// labelReference returns a regular expression matching an equality matcher on
+// the label in a PromQL expression (e.g. `namespace="default"`), capturing
+// the quoted value.
+func labelReference(label string) *regexp.Regexp {
+	return regexp.MustCompile(`(?:^|[^a-zA-Z0-9_])` + regexp.QuoteMeta(label) + `\s*=\s*"((?:[^"\\]|\\.)*)"`)
+}
+
+// referencesOtherValue returns true if the annotations or the generator URL of
+// an alert reference the enforced label with a value other than lvalues,
+// either as an annotation named after the label or as a matcher in an
+// annotation or in the expressions of the generator URL.
+func (r *routes) referencesOtherValue(lvalues []string, annotations map[string]string, generatorURL string) bool {
+	var refs []string
+	for k, v := range annotations {
+		if k == r.label && !contains(lvalues, v) {
+			return true
+		}
+		refs = append(refs, v)
+	}
+
+	if generatorURL != "" {
+		if u, err := url.Parse(generatorURL); err == nil {
+			for _, vs := range u.Query() {
+				refs = append(refs, vs...)
+			}
+		}
+	}
+
+	for _, ref := range refs {
+		for _, m := range r.labelRef.FindAllStringSubmatch(ref, -1) {
+			v, err := strconv.Unquote(`"` + m[1] + `"`)
+			if err != nil || !contains(lvalues, v) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,503 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/alertmanager/api/v2/models"
+)
+
+const alertmanagerAlerts = `[
+  {
+    "annotations": {},
+    "endsAt": "2020-06-05T10:03:11.000Z",
+    "fingerprint": "0f5bcb00b9e5a2c5",
+    "receivers": [{"name": "default"}],
+    "startsAt": "2020-06-05T09:58:11.000Z",
+    "status": {"inhibitedBy": [], "silencedBy": [], "state": "active"},
+    "updatedAt": "2020-06-05T09:58:11.000Z",
+    "labels": {"alertname": "Alert1", "namespace": "default"}
+  },
+  {
+    "annotations": {},
+    "endsAt": "2020-06-05T10:03:11.000Z",
+    "fingerprint": "7c9e5bd3e1c6a3f4",
+    "receivers": [{"name": "default"}],
+    "startsAt": "2020-06-05T09:58:11.000Z",
+    "status": {"inhibitedBy": [], "silencedBy": [], "state": "active"},
+    "updatedAt": "2020-06-05T09:58:11.000Z",
+    "labels": {"alertname": "Alert1", "namespace": "other"}
+  }
+]`
+
+// checkFiltersHandler verifies that the request contains the given filters
+// and returns the Alertmanager alerts.
+func checkFiltersHandler(filters ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got := req.URL.Query()["filter"]
+		sort.Strings(got)
+		sort.Strings(filters)
+		if strings.Join(got, ",") != strings.Join(filters, ",") {
+			http.Error(w, fmt.Sprintf("expected filters %q, got %q", filters, got), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(alertmanagerAlerts))
+	})
+}
+
+func TestListAlerts(t *testing.T) {
+	for _, tc := range []struct {
+		labelv  string
+		filters []string
+
+		expCode    int
+		expFilters []string
+	}{
+		{
+			// No "namespace" parameter returns an error.
+			expCode: http.StatusBadRequest,
+		},
+		{
+			// No "filter" parameter.
+			labelv:     "default",
+			expCode:    http.StatusOK,
+			expFilters: []string{`namespace="default"`},
+		},
+		{
+			// Many "filter" parameters.
+			labelv:     "default",
+			filters:    []string{`job="prometheus"`, `instance=~".+"`},
+			expCode:    http.StatusOK,
+			expFilters: []string{`job="prometheus"`, `instance=~".+"`, `namespace="default"`},
+		},
+		{
+			// "filter" parameter matching exactly the enforced label.
+			labelv:     "default",
+			filters:    []string{`namespace="default"`, `job="prometheus"`},
+			expCode:    http.StatusOK,
+			expFilters: []string{`namespace="default"`, `job="prometheus"`},
+		},
+		{
+			// "filter" parameter with a conflicting value for the enforced label.
+			labelv:  "default",
+			filters: []string{`namespace="other"`, `job="prometheus"`},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			// "filter" parameter with a regexp for the enforced label.
+			labelv:  "default",
+			filters: []string{`namespace=~"default|other"`},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			// Invalid "filter" parameter.
+			labelv:  "default",
+			filters: []string{`job="promethe`},
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(strings.Join(tc.filters, "&"), func(t *testing.T) {
+			m := newMockUpstream(checkFiltersHandler(tc.expFilters...))
+			defer m.Close()
+			r, err := NewRoutes(m.url, proxyLabel)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			u, err := url.Parse("http://alertmanager.example.com/api/v2/alerts")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			q := u.Query()
+			for _, m := range tc.filters {
+				q.Add("filter", m)
+			}
+			q.Set(proxyLabel, tc.labelv)
+			u.RawQuery = q.Encode()
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", u.String(), nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.expCode {
+				t.Logf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
+				t.Logf("%s", string(body))
+				t.FailNow()
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+
+			// The response shouldn't contain alerts from other namespaces.
+			var alerts models.GettableAlerts
+			if err := json.Unmarshal(body, &alerts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(alerts) != 1 {
+				t.Fatalf("expected 1 alert, got %d", len(alerts))
+			}
+			if alerts[0].Labels[proxyLabel] != tc.labelv {
+				t.Fatalf("expected alert with %s=%q, got %v", proxyLabel, tc.labelv, alerts[0].Labels)
+			}
+		})
+	}
+}
+
+func TestListAlertsParams(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		params url.Values
+
+		expCode int
+	}{
+		{
+			name:    "state and receiver parameters",
+			params:  url.Values{"active": {"true"}, "silenced": {"false"}, "inhibited": {"false"}, "unprocessed": {"true"}, "receiver": {"team-.*"}},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "invalid state parameter",
+			params:  url.Values{"silenced": {"maybe"}},
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				q := req.URL.Query()
+				for k, v := range tc.params {
+					if got := q[k]; strings.Join(got, ",") != strings.Join(v, ",") {
+						http.Error(w, fmt.Sprintf("expected parameter %s=%q, got %q", k, v, got), http.StatusInternalServerError)
+						return
+					}
+				}
+				checkFiltersHandler(`namespace="default"`, `job="prometheus"`).ServeHTTP(w, req)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{}
+			for k, v := range tc.params {
+				q[k] = v
+			}
+			q.Set("filter", `job="prometheus"`)
+			q.Set(proxyLabel, "default")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://alertmanager.example.com/api/v2/alerts?"+q.Encode(), nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+
+			var alerts models.GettableAlerts
+			if err := json.Unmarshal(body, &alerts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(alerts) != 1 || alerts[0].Labels[proxyLabel] != "default" {
+				t.Fatalf("expected only the alert with %s=\"default\", got %v", proxyLabel, alerts)
+			}
+		})
+	}
+}
+
+func TestPostAlerts(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		body           string
+		errorOnReplace bool
+
+		expCode   int
+		expLabels []map[string]string
+	}{
+		{
+			name:      "batch of alerts",
+			body:      `[{"labels":{"alertname":"Alert1"},"annotations":{"summary":"foo"}},{"labels":{"alertname":"Alert2","namespace":"default","severity":"critical"}}]`,
+			expCode:   http.StatusOK,
+			expLabels: []map[string]string{{"alertname": "Alert1", "namespace": "default"}, {"alertname": "Alert2", "namespace": "default", "severity": "critical"}},
+		},
+		{
+			name:      "alert with another value",
+			body:      `[{"labels":{"alertname":"Alert1","namespace":"other"}}]`,
+			expCode:   http.StatusOK,
+			expLabels: []map[string]string{{"alertname": "Alert1", "namespace": "default"}},
+		},
+		{
+			name:           "alert with another value and error on replace",
+			body:           `[{"labels":{"alertname":"Alert1"}},{"labels":{"alertname":"Alert1","namespace":"other"}}]`,
+			errorOnReplace: true,
+			expCode:        http.StatusBadRequest,
+		},
+		{
+			name:           "alert with the same value and error on replace",
+			body:           `[{"labels":{"alertname":"Alert1","namespace":"default"}}]`,
+			errorOnReplace: true,
+			expCode:        http.StatusOK,
+			expLabels:      []map[string]string{{"alertname": "Alert1", "namespace": "default"}},
+		},
+		{
+			name:    "invalid body",
+			body:    `{"labels":{}}`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "null alert",
+			body:    `[null]`,
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				body, _ := ioutil.ReadAll(req.Body)
+				if req.ContentLength != int64(len(body)) {
+					t.Errorf("expected Content-Length %d, got %d", len(body), req.ContentLength)
+				}
+				var alerts models.PostableAlerts
+				if err := json.Unmarshal(body, &alerts); err != nil {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+				if len(alerts) != len(tc.expLabels) {
+					t.Errorf("expected %d alerts, got %d", len(tc.expLabels), len(alerts))
+					return
+				}
+				for i, a := range alerts {
+					if got := map[string]string(a.Labels); !reflect.DeepEqual(got, tc.expLabels[i]) {
+						t.Errorf("expected labels %v, got %v", tc.expLabels[i], got)
+					}
+				}
+				// Alertmanager responds with an empty body.
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer m.Close()
+
+			var opts []Option
+			if tc.errorOnReplace {
+				opts = append(opts, WithAlertsErrorOnReplace())
+			}
+			r, err := NewRoutes(m.url, proxyLabel, opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "http://alertmanager.example.com/api/v2/alerts?"+proxyLabel+"=default", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestReferencesOtherValue(t *testing.T) {
+	r, err := NewRoutes(&url.URL{Scheme: "http", Host: "alertmanager.example.com"}, proxyLabel, WithStrictAlerts())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name         string
+		annotations  map[string]string
+		generatorURL string
+
+		exp bool
+	}{
+		{
+			name:         "no reference",
+			annotations:  map[string]string{"summary": "Target is down"},
+			generatorURL: "http://prometheus.example.com/graph?g0.expr=up+%3D%3D+0&g0.tab=1",
+		},
+		{
+			name:         "same value",
+			annotations:  map[string]string{"summary": `up{namespace="default"} is down`, proxyLabel: "default"},
+			generatorURL: "http://prometheus.example.com/graph?g0.expr=up%7Bnamespace%3D%22default%22%7D+%3D%3D+0&g0.tab=1",
+		},
+		{
+			name:        "other value in annotation",
+			annotations: map[string]string{"summary": `up{job="api",namespace="other"} is down`},
+			exp:         true,
+		},
+		{
+			name:        "other value as annotation",
+			annotations: map[string]string{proxyLabel: "other"},
+			exp:         true,
+		},
+		{
+			name:         "other value in generator URL",
+			generatorURL: "http://prometheus.example.com/graph?g0.expr=up%7Bnamespace%3D%22other%22%7D+%3D%3D+0&g0.tab=1",
+			exp:          true,
+		},
+		{
+			name:        "other label with the same suffix",
+			annotations: map[string]string{"summary": `up{kube_namespace="other"} is down`},
+		},
+		{
+			name:        "negative and regex matchers",
+			annotations: map[string]string{"summary": `up{namespace!="other",namespace=~"def.*"} is down`},
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			if got := r.referencesOtherValue([]string{"default"}, tc.annotations, tc.generatorURL); got != tc.exp {
+				t.Fatalf("expected %v, got %v", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestScopedAlertReferences(t *testing.T) {
+	const (
+		scopedAlerts = `[
+  {
+    "annotations": {},
+    "endsAt": "2020-06-05T10:03:11.000Z",
+    "fingerprint": "0f5bcb00b9e5a2c5",
+    "receivers": [{"name": "default"}],
+    "startsAt": "2020-06-05T09:58:11.000Z",
+    "status": {"inhibitedBy": ["7c9e5bd3e1c6a3f4", "a1b2c3d4e5f60718"], "silencedBy": ["silence-default", "silence-other", "silence-negative"], "state": "suppressed"},
+    "updatedAt": "2020-06-05T09:58:11.000Z",
+    "labels": {"alertname": "Alert1", "namespace": "default"}
+  }
+]`
+		allAlerts = `[
+  {"fingerprint": "0f5bcb00b9e5a2c5", "labels": {"alertname": "Alert1", "namespace": "default"}},
+  {"fingerprint": "7c9e5bd3e1c6a3f4", "labels": {"alertname": "Alert1", "namespace": "other"}},
+  {"fingerprint": "a1b2c3d4e5f60718", "labels": {"alertname": "Alert2", "namespace": "default"}}
+]`
+		silences = `[
+  {
+    "id": "silence-default",
+    "status": {"state": "active"},
+    "updatedAt": "2020-06-05T09:58:11.000Z",
+    "matchers": [{"name": "namespace", "value": "default", "isRegex": false}],
+    "startsAt": "2020-06-05T09:58:11.000Z",
+    "endsAt": "2020-06-05T10:58:11.000Z",
+    "createdBy": "me",
+    "comment": "default"
+  },
+  {
+    "id": "silence-other",
+    "status": {"state": "active"},
+    "updatedAt": "2020-06-05T09:58:11.000Z",
+    "matchers": [{"name": "namespace", "value": "default.*", "isRegex": true}],
+    "startsAt": "2020-06-05T09:58:11.000Z",
+    "endsAt": "2020-06-05T10:58:11.000Z",
+    "createdBy": "me",
+    "comment": "other"
+  },
+  {
+    "id": "silence-negative",
+    "status": {"state": "active"},
+    "updatedAt": "2020-06-05T09:58:11.000Z",
+    "matchers": [{"name": "namespace", "value": "default", "isRegex": false, "isEqual": false}],
+    "startsAt": "2020-06-05T09:58:11.000Z",
+    "endsAt": "2020-06-05T10:58:11.000Z",
+    "createdBy": "me",
+    "comment": "all the namespaces but default"
+  }
+]`
+	)
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+
+		expSilencedBy  []string
+		expInhibitedBy []string
+	}{
+		{
+			name:           "disabled",
+			expSilencedBy:  []string{"silence-default", "silence-other", "silence-negative"},
+			expInhibitedBy: []string{"7c9e5bd3e1c6a3f4", "a1b2c3d4e5f60718"},
+		},
+		{
+			name:           "enabled",
+			opts:           []Option{WithScopedAlertReferences()},
+			expSilencedBy:  []string{"silence-default"},
+			expInhibitedBy: []string{"a1b2c3d4e5f60718"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/api/v2/alerts", func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if len(req.URL.Query()["filter"]) == 0 {
+					w.Write([]byte(allAlerts))
+					return
+				}
+				w.Write([]byte(scopedAlerts))
+			})
+			mux.HandleFunc("/api/v2/silences", func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(silences))
+			})
+			m := newMockUpstream(mux)
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://alertmanager.example.com/api/v2/alerts?"+proxyLabel+"=default", nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, resp.StatusCode, string(body))
+			}
+
+			var alerts models.GettableAlerts
+			if err := json.Unmarshal(body, &alerts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(alerts) != 1 {
+				t.Fatalf("expected 1 alert, got %d", len(alerts))
+			}
+			if got := strings.Join(alerts[0].Status.SilencedBy, ","); got != strings.Join(tc.expSilencedBy, ",") {
+				t.Fatalf("expected silencedBy %v, got %v", tc.expSilencedBy, alerts[0].Status.SilencedBy)
+			}
+			if got := strings.Join(alerts[0].Status.InhibitedBy, ","); got != strings.Join(tc.expInhibitedBy, ",") {
+				t.Fatalf("expected inhibitedBy %v, got %v", tc.expInhibitedBy, alerts[0].Status.InhibitedBy)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditedPaths are the upstream paths for which the forwarded requests are
+// audited.
+var auditedPaths = []string{"/api/v1/query", "/api/v1/query_range", "/api/v1/query_exemplars", "/api/v1/series"}
+
+// auditRecord is the audit log entry of a request forwarded upstream.
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Label       string    `json:"label"`
+	LabelValues []string  `json:"labelValues"`
+	Source      string    `json:"source"`
+	// RawQuery and Body are the exact bytes sent upstream.
+	RawQuery string `json:"rawQuery"`
+	Body     string `json:"body,omitempty"`
+}
+
+// auditTransport is an http.RoundTripper recording the requests to the
+// audited paths right before sending them upstream.
+type auditTransport struct {
+	next   http.RoundTripper
+	label  string
+	source string
+
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+func (t *auditTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isAuditedPath(req.URL.Path) {
+		return t.next.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	t.record(auditRecord{
+		Time:        time.Now().UTC(),
+		Method:      req.Method,
+		Path:        req.URL.Path,
+		Label:       t.label,
+		LabelValues: mustLabelValues(req.Context()),
+		Source:      t.source,
+		RawQuery:    req.URL.RawQuery,
+		Body:        string(body),
+	})
+
+	return t.next.RoundTrip(req)
+}
+
+func (t *auditTransport) record(rec auditRecord) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("error: Failed to encode audit record: %v", err)
+		return
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if _, err := t.w.Write(append(b, '\n')); err != nil {
+		log.Printf("error: Failed to write audit record: %v", err)
+	}
+}
+
+func isAuditedPath(p string) bool {
+	for _, ap := range auditedPaths {
+		if strings.HasSuffix(p, ap) {
+			return true
+		}
+	}
+	return false
+}
+
+// extractionSource describes where the label value is read from.
+func extractionSource(el ExtractLabeler) string {
+	switch el := el.(type) {
+	case HTTPFormEnforcer:
+		return fmt.Sprintf("query parameter %q", el.ParameterName)
+	case HTTPHeaderEnforcer:
+		return fmt.Sprintf("header %q", el.Name)
+	default:
+		return fmt.Sprintf("%T", el)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	var sent []string
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v1/rules" {
+			req.ParseForm()
+			sent = append(sent, req.URL.RawQuery+"|"+req.PostForm.Encode())
+		}
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	var buf bytes.Buffer
+	r, err := NewRoutes(m.url, proxyLabel, WithAuditLog(&buf))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=default", nil),
+		httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query_range?namespace=default", strings.NewReader(url.Values{queryParam: {"up"}}.Encode())),
+		httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/series?match[]=up&namespace=default", nil),
+		// Not audited.
+		httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/rules?namespace=default", nil),
+	} {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	var records []auditRecord
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var rec auditRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		records = append(records, rec)
+	}
+
+	if len(records) != 3 || len(sent) != 3 {
+		t.Fatalf("expected 3 audit records and 3 upstream requests, got %d and %d", len(records), len(sent))
+	}
+	for i, exp := range []struct {
+		path  string
+		query string
+		body  string
+	}{
+		{path: "/api/v1/query", query: `up{namespace="default"}`},
+		{path: "/api/v1/query_range", body: `up{namespace="default"}`},
+		{path: "/api/v1/series"},
+	} {
+		rec := records[i]
+		if rec.Path != exp.path {
+			t.Errorf("expected path %q, got %q", exp.path, rec.Path)
+		}
+		if rec.Label != proxyLabel || len(rec.LabelValues) != 1 || rec.LabelValues[0] != "default" {
+			t.Errorf("expected label %s=default, got %s=%v", proxyLabel, rec.Label, rec.LabelValues)
+		}
+		if rec.Source != `query parameter "namespace"` {
+			t.Errorf("unexpected source %q", rec.Source)
+		}
+		if got := rec.RawQuery + "|" + rec.Body; got != sent[i] {
+			t.Errorf("expected audited request %q to be the request sent upstream %q", got, sent[i])
+		}
+		if exp.query != "" && !strings.Contains(rec.RawQuery, url.QueryEscape(exp.query)) {
+			t.Errorf("expected query %q in %q", exp.query, rec.RawQuery)
+		}
+		if exp.body != "" && !strings.Contains(rec.Body, url.QueryEscape(exp.body)) {
+			t.Errorf("expected query %q in body %q", exp.body, rec.Body)
+		}
+	}
+}
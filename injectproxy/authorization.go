@@ -0,0 +1,80 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// authorizationTransport is an http.RoundTripper removing the Authorization
+// header of the requests sent upstream and, if a token file is configured,
+// replacing it with the token of the proxy.
+type authorizationTransport struct {
+	next  http.RoundTripper
+	token *tokenFile
+}
+
+func (t *authorizationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Del("Authorization")
+	if t.token != nil {
+		token, err := t.token.get()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// tokenFile reads a bearer token from a file. The file is read again when it
+// changes, e.g. for rotated service account tokens.
+type tokenFile struct {
+	path string
+
+	mtx     sync.Mutex
+	modTime time.Time
+	token   string
+}
+
+func (f *tokenFile) get() (string, error) {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return "", errors.Wrap(err, "can't read the upstream bearer token")
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.token != "" && fi.ModTime().Equal(f.modTime) {
+		return f.token, nil
+	}
+
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", errors.Wrap(err, "can't read the upstream bearer token")
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", errors.Errorf("empty upstream bearer token in %s", f.path)
+	}
+	f.token, f.modTime = token, fi.ModTime()
+	return token, nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpstreamAuthorization(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prom-label-proxy")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("proxy-token\n"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+
+		expCode          int
+		expAuthorization string
+	}{
+		{
+			name:             "passthrough",
+			expCode:          http.StatusOK,
+			expAuthorization: "Bearer tenant-token",
+		},
+		{
+			name:    "strip",
+			opts:    []Option{WithStrippedAuthorization()},
+			expCode: http.StatusOK,
+		},
+		{
+			name:             "replace",
+			opts:             []Option{WithUpstreamBearerTokenFile(tokenFile)},
+			expCode:          http.StatusOK,
+			expAuthorization: "Bearer proxy-token",
+		},
+		{
+			name:    "replace with missing token file",
+			opts:    []Option{WithUpstreamBearerTokenFile(filepath.Join(dir, "missing"))},
+			expCode: http.StatusBadGateway,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if got := req.Header.Get("Authorization"); got != tc.expAuthorization {
+					t.Errorf("expected Authorization header %q, got %q", tc.expAuthorization, got)
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/query?query=up&"+proxyLabel+"=default", nil)
+			req.Header.Set("Authorization", "Bearer tenant-token")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				body, _ := ioutil.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if req.Header.Get("Authorization") != "Bearer tenant-token" {
+				t.Fatalf("expected the client request to be unmodified")
+			}
+		})
+	}
+}
+
+func TestTokenFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prom-label-proxy")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "token")
+	f := &tokenFile{path: path}
+	for i, tc := range []struct {
+		content string
+		expErr  bool
+		expTok  string
+	}{
+		{content: "", expErr: true},
+		{content: "a\n", expTok: "a"},
+		{content: "b", expTok: "b"},
+	} {
+		if err := ioutil.WriteFile(path, []byte(tc.content), 0600); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// Make sure that the modification time changes.
+		mtime := time.Now().Add(time.Duration(i) * time.Second)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		tok, err := f.get()
+		if tc.expErr {
+			if err == nil {
+				t.Fatalf("%d: expected error, got token %q", i, tok)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if tok != tc.expTok {
+			t.Fatalf("%d: expected token %q, got %q", i, tc.expTok, tok)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// defaultResponseBufferLimit is the default size above which the modified
+// responses are buffered in a temporary file instead of memory.
+const defaultResponseBufferLimit = 32 << 20
+
+// spillBuffer is a buffer keeping the data in memory up to limit bytes and
+// spilling it to a temporary file beyond that.
+type spillBuffer struct {
+	limit int
+	buf   bytes.Buffer
+	f     *os.File
+	n     int64
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.f == nil && b.buf.Len()+len(p) > b.limit {
+		f, err := ioutil.TempFile("", "prom-label-proxy-")
+		if err != nil {
+			return 0, err
+		}
+		b.f = f
+		if _, err := b.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+
+	var (
+		n   int
+		err error
+	)
+	if b.f != nil {
+		n, err = b.f.Write(p)
+	} else {
+		n, err = b.buf.Write(p)
+	}
+	b.n += int64(n)
+	return n, err
+}
+
+// Len returns the number of bytes written to the buffer.
+func (b *spillBuffer) Len() int64 {
+	return b.n
+}
+
+// Reader returns a reader of the buffered data. Closing the reader removes
+// the temporary file if any.
+func (b *spillBuffer) Reader() (io.ReadCloser, error) {
+	if b.f == nil {
+		return ioutil.NopCloser(&b.buf), nil
+	}
+
+	if _, err := b.f.Seek(0, io.SeekStart); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *spillBuffer) Read(p []byte) (int, error) {
+	return b.f.Read(p)
+}
+
+// Close removes the temporary file if any.
+func (b *spillBuffer) Close() error {
+	if b.f == nil {
+		return nil
+	}
+	b.f.Close()
+	return os.Remove(b.f.Name())
+}
+
+// replaceBody replaces the body of the response with the JSON encoding of v.
+// Encoded bodies larger than the configured limit are buffered in a temporary
+// file to bound the memory usage. If configured, the body is compressed again
+// when the upstream response was compressed and the client accepts it.
+func (r *routes) replaceBody(resp *http.Response, v interface{}) error {
+	if r.recompressResponses && resp.Uncompressed && acceptsGzip(resp.Request) {
+		buf, err := r.encodeGzip(v)
+		if err == nil {
+			return r.setBody(resp, buf, "gzip")
+		}
+		log.Printf("warning: Failed to recompress the response of %s, sending it uncompressed: %v", resp.Request.URL.Path, err)
+	}
+
+	buf := &spillBuffer{limit: r.responseBufferLimit}
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		buf.Close()
+		return errors.Wrap(err, "can't encode response")
+	}
+	return r.setBody(resp, buf, "")
+}
+
+// badUpstreamResponse replaces the response with a 502 error whose body is the
+// JSON encoding of v.
+func (r *routes) badUpstreamResponse(resp *http.Response, v interface{}) error {
+	resp.StatusCode = http.StatusBadGateway
+	resp.Status = fmt.Sprintf("%d %s", http.StatusBadGateway, http.StatusText(http.StatusBadGateway))
+	resp.Header.Set("Content-Type", "application/json; charset=utf-8")
+	return r.replaceBody(resp, v)
+}
+
+func (r *routes) encodeGzip(v interface{}) (*spillBuffer, error) {
+	buf := &spillBuffer{limit: r.responseBufferLimit}
+	gz := gzip.NewWriter(buf)
+	if err := json.NewEncoder(gz).Encode(v); err != nil {
+		buf.Close()
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		buf.Close()
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (r *routes) setBody(resp *http.Response, buf *spillBuffer, encoding string) error {
+	body, err := buf.Reader()
+	if err != nil {
+		return errors.Wrap(err, "can't read encoded response")
+	}
+	resp.Body = body
+	resp.Header["Content-Length"] = []string{fmt.Sprint(buf.Len())}
+	if encoding != "" {
+		resp.Header.Set("Content-Encoding", encoding)
+		resp.Uncompressed = false
+	}
+
+	return nil
+}
+
+// acceptsGzip returns whether the client accepts gzip-encoded responses.
+func acceptsGzip(req *http.Request) bool {
+	if req == nil {
+		return false
+	}
+	for _, v := range req.Header.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			parts := strings.Split(enc, ";")
+			if name := strings.TrimSpace(parts[0]); name != "gzip" && name != "*" {
+				continue
+			}
+			accepted := true
+			for _, p := range parts[1:] {
+				if q := strings.TrimSpace(p); strings.HasPrefix(q, "q=") {
+					if w, err := strconv.ParseFloat(q[2:], 64); err == nil && w == 0 {
+						accepted = false
+					}
+				}
+			}
+			if accepted {
+				return true
+			}
+		}
+	}
+	return false
+}
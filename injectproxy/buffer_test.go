@@ -0,0 +1,77 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSpillBuffer(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		writes []string
+		spill  bool
+	}{
+		{
+			name:   "in memory",
+			writes: []string{"abc", "def"},
+		},
+		{
+			name:   "spilled to file",
+			writes: []string{"abc", "def", "ghijkl"},
+			spill:  true,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			b := &spillBuffer{limit: 8}
+			for _, w := range tc.writes {
+				if _, err := b.Write([]byte(w)); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			if spilled := b.f != nil; spilled != tc.spill {
+				t.Fatalf("expected spilled to be %v, got %v", tc.spill, spilled)
+			}
+			exp := strings.Join(tc.writes, "")
+			if b.Len() != int64(len(exp)) {
+				t.Fatalf("expected length %d, got %d", len(exp), b.Len())
+			}
+
+			r, err := b.Reader()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(got) != exp {
+				t.Fatalf("expected %q, got %q", exp, string(got))
+			}
+
+			if err := r.Close(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if b.f != nil {
+				if _, err := os.Stat(b.f.Name()); !os.IsNotExist(err) {
+					t.Fatalf("expected temporary file to be removed, got %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultQueryCacheSize is the default maximum number of cached query
+// responses.
+const defaultQueryCacheSize = 1000
+
+// perRequestHeaders are the response headers which are specific to a request
+// and aren't cached.
+var perRequestHeaders = []string{requestIDHeader}
+
+// queryTimeParams are the time parameters of the query endpoints which are
+// rounded in the cache keys.
+var queryTimeParams = []string{"time", "start", "end"}
+
+// queryCache is a LRU cache of the responses of the query endpoints. The
+// entries expire after the TTL of the cache or the max-age of the response if
+// lower.
+type queryCache struct {
+	ttl  time.Duration
+	size int
+
+	mtx     sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+
+	// now returns the current time (for tests).
+	now func() time.Time
+}
+
+type queryCacheEntry struct {
+	key     string
+	expires time.Time
+	code    int
+	header  http.Header
+	body    []byte
+}
+
+func newQueryCache(ttl time.Duration, size int) *queryCache {
+	return &queryCache{
+		ttl:     ttl,
+		size:    size,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// get returns the cached response for the given key if it hasn't expired.
+func (c *queryCache) get(key string) (*queryCacheEntry, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*queryCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return entry, true
+}
+
+// add caches a response for the given duration, evicting the least recently
+// used entry if the cache is full.
+func (c *queryCache) add(key string, ttl time.Duration, code int, header http.Header, body []byte) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	entry := &queryCacheEntry{key: key, expires: c.now().Add(ttl), code: code, header: header, body: body}
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*queryCacheEntry).key)
+	}
+}
+
+// key returns the cache key of a query request once enforced. The
+// enforced label values are part of the key so that a response is never
+// served for other values. So is the Accept-Encoding header since the cached
+// body is encoded according to it.
+func (c *queryCache) key(req *http.Request, labels url.Values, values ...url.Values) string {
+	var sb strings.Builder
+	sb.WriteString(req.URL.Path)
+	sb.WriteByte(0)
+	sb.WriteString(strings.ToLower(strings.Join(strings.Fields(req.Header.Get("Accept-Encoding")), "")))
+	sb.WriteByte(0)
+	sb.WriteString(labels.Encode())
+	for _, v := range values {
+		v = cloneValues(v)
+		for _, p := range queryTimeParams {
+			if t := v.Get(p); t != "" {
+				v.Set(p, roundTime(t, c.ttl))
+			}
+		}
+		sb.WriteByte(0)
+		sb.WriteString(v.Encode())
+	}
+	return sb.String()
+}
+
+// ttlFor returns for how long the response can be cached given its
+// Cache-Control header, zero meaning that it can't be cached.
+func (c *queryCache) ttlFor(header http.Header) time.Duration {
+	directives := cacheControl(header)
+	if _, ok := directives["no-store"]; ok {
+		return 0
+	}
+	if _, ok := directives["no-cache"]; ok {
+		return 0
+	}
+	ttl := c.ttl
+	if v, ok := directives["max-age"]; ok {
+		secs, err := strconv.Atoi(v)
+		if err != nil {
+			return 0
+		}
+		if maxAge := time.Duration(secs) * time.Second; maxAge < ttl {
+			ttl = maxAge
+		}
+	}
+	return ttl
+}
+
+// roundTime rounds down a time parameter given either as a Unix timestamp or
+// in the RFC 3339 format to a multiple of the given duration. Invalid values
+// are returned as-is.
+func roundTime(s string, d time.Duration) string {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		step := d.Seconds()
+		return strconv.FormatFloat(math.Floor(f/step)*step, 'f', -1, 64)
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.Truncate(d).UTC().Format(time.RFC3339Nano)
+	}
+	return s
+}
+
+// cacheControl returns the directives of the Cache-Control header.
+func cacheControl(header http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, h := range header["Cache-Control"] {
+		for _, d := range strings.Split(h, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			name, value := d, ""
+			if i := strings.Index(d, "="); i >= 0 {
+				name, value = d[:i], strings.Trim(d[i+1:], `"`)
+			}
+			directives[strings.ToLower(name)] = value
+		}
+	}
+	return directives
+}
+
+func cloneValues(v url.Values) url.Values {
+	c := make(url.Values, len(v))
+	for k, vs := range v {
+		c[k] = append([]string(nil), vs...)
+	}
+	return c
+}
+
+// serveCachedQuery serves the query request from the cache if possible and
+// caches the upstream response otherwise.
+func (r *routes) serveCachedQuery(w http.ResponseWriter, req *http.Request, key string) {
+	directives := cacheControl(req.Header)
+	_, noCache := directives["no-cache"]
+	_, noStore := directives["no-store"]
+
+	if !noCache && !noStore {
+		if entry, ok := r.queryCache.get(key); ok {
+			for k, vs := range entry.header {
+				w.Header()[k] = vs
+			}
+			w.WriteHeader(entry.code)
+			w.Write(entry.body)
+			return
+		}
+	}
+
+	rec := &primaryRecorder{ResponseWriter: w, code: http.StatusOK, limit: r.responseBufferLimit}
+	r.handler.ServeHTTP(rec, req)
+	if noStore || rec.truncated || rec.code != http.StatusOK || rec.header == nil {
+		return
+	}
+	if ttl := r.queryCache.ttlFor(rec.header); ttl > 0 {
+		for _, h := range perRequestHeaders {
+			rec.header.Del(h)
+		}
+		r.queryCache.add(key, ttl, rec.code, rec.header, append([]byte(nil), rec.buf.Bytes()...))
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type cacheRequest struct {
+	labelv       string
+	query        string
+	time         string
+	cacheControl string
+	encoding     string
+	// advance is the duration elapsed before the request.
+	advance time.Duration
+
+	expHit bool
+}
+
+func TestQueryCache(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		size         int
+		cacheControl string
+		requests     []cacheRequest
+	}{
+		{
+			name: "same query",
+			requests: []cacheRequest{
+				{labelv: "default", query: "up"},
+				{labelv: "default", query: "up", expHit: true},
+				{labelv: "default", query: "up{}", expHit: true},
+			},
+		},
+		{
+			name: "other label value",
+			requests: []cacheRequest{
+				{labelv: "default", query: "up"},
+				{labelv: "other", query: "up"},
+				{labelv: "other", query: "up", expHit: true},
+			},
+		},
+		{
+			name: "other query",
+			requests: []cacheRequest{
+				{labelv: "default", query: "up"},
+				{labelv: "default", query: "down"},
+			},
+		},
+		{
+			name: "rounded time",
+			requests: []cacheRequest{
+				{labelv: "default", query: "up", time: "1600000001"},
+				{labelv: "default", query: "up", time: "1600000004.5", expHit: true},
+				{labelv: "default", query: "up", time: "1600000011"},
+			},
+		},
+		{
+			name: "expired",
+			requests: []cacheRequest{
+				{labelv: "default", query: "up"},
+				{labelv: "default", query: "up", advance: 9 * time.Second, expHit: true},
+				{labelv: "default", query: "up", advance: time.Second},
+			},
+		},
+		{
+			name: "evicted",
+			size: 1,
+			requests: []cacheRequest{
+				{labelv: "default", query: "up"},
+				{labelv: "default", query: "down"},
+				{labelv: "default", query: "up"},
+			},
+		},
+		{
+			name: "other encoding",
+			requests: []cacheRequest{
+				{labelv: "default", query: "up", encoding: "gzip"},
+				{labelv: "default", query: "up"},
+				{labelv: "default", query: "up", encoding: "gzip, deflate"},
+				{labelv: "default", query: "up", expHit: true},
+				{labelv: "default", query: "up", encoding: "gzip", expHit: true},
+			},
+		},
+		{
+			name: "request without cache",
+			requests: []cacheRequest{
+				{labelv: "default", query: "up"},
+				{labelv: "default", query: "up", cacheControl: "no-cache"},
+				{labelv: "default", query: "up", expHit: true},
+			},
+		},
+		{
+			name:         "response without store",
+			cacheControl: "no-store",
+			requests: []cacheRequest{
+				{labelv: "default", query: "up"},
+				{labelv: "default", query: "up"},
+			},
+		},
+		{
+			name:         "response with lower max age",
+			cacheControl: "max-age=2",
+			requests: []cacheRequest{
+				{labelv: "default", query: "up"},
+				{labelv: "default", query: "up", advance: time.Second, expHit: true},
+				{labelv: "default", query: "up", advance: time.Second},
+			},
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			var calls int32
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				if tc.cacheControl != "" {
+					w.Header().Set("Cache-Control", tc.cacheControl)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]},"query":` + strconv.Quote(req.URL.Query().Get(queryParam)) + `}`))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, WithQueryCache(10*time.Second, tc.size))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			now := time.Unix(1600000000, 0)
+			r.queryCache.now = func() time.Time { return now }
+
+			for i, cr := range tc.requests {
+				now = now.Add(cr.advance)
+
+				q := url.Values{}
+				q.Set(queryParam, cr.query)
+				q.Set(proxyLabel, cr.labelv)
+				if cr.time != "" {
+					q.Set("time", cr.time)
+				}
+				req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+q.Encode(), nil)
+				if cr.cacheControl != "" {
+					req.Header.Set("Cache-Control", cr.cacheControl)
+				}
+				if cr.encoding != "" {
+					req.Header.Set("Accept-Encoding", cr.encoding)
+				}
+
+				before := atomic.LoadInt32(&calls)
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+
+				resp := w.Result()
+				body, _ := ioutil.ReadAll(resp.Body)
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("request %d: expected status code %d, got %d: %s", i, http.StatusOK, resp.StatusCode, string(body))
+				}
+				if got := resp.Header.Get("Content-Type"); got != "application/json" {
+					t.Fatalf("request %d: expected Content-Type %q, got %q", i, "application/json", got)
+				}
+				if !strings.Contains(string(body), `namespace=\"`+cr.labelv+`\"`) {
+					t.Fatalf("request %d: expected response for %q, got %s", i, cr.labelv, string(body))
+				}
+				if hit := atomic.LoadInt32(&calls) == before; hit != cr.expHit {
+					t.Fatalf("request %d: expected cache hit %v, got %v", i, cr.expHit, hit)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryCacheRequestID(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	l, err := NewLogger(ioutil.Discard, LogFormatLogfmt, LogLevelInfo)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r, err := NewRoutes(m.url, proxyLabel, WithQueryCache(10*time.Second, 0), WithRequestLog(l, false))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, id := range []string{"first", "second"} {
+		req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&"+proxyLabel+"=default", nil)
+		req.Header.Set(requestIDHeader, id)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if got := w.Result().Header.Get(requestIDHeader); got != id {
+			t.Fatalf("expected request ID %q, got %q", id, got)
+		}
+	}
+}
+
+func TestQueryCacheSharedOnReload(t *testing.T) {
+	var calls int32
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	// The routes built again with the same options (e.g. on reload) keep
+	// serving the cached responses.
+	opt := WithQueryCache(10*time.Second, 0)
+	for i := 0; i < 2; i++ {
+		r, err := NewRoutes(m.url, proxyLabel, opt)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&"+proxyLabel+"=default", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("expected 1 upstream call, got %d", got)
+	}
+}
+
+func TestRoundTime(t *testing.T) {
+	for _, tc := range []struct {
+		in, exp string
+	}{
+		{in: "1600000004", exp: "1600000000"},
+		{in: "1600000004.25", exp: "1600000000"},
+		{in: "2020-09-13T12:26:44.5Z", exp: "2020-09-13T12:26:40Z"},
+		{in: "2020-09-13T14:26:44+02:00", exp: "2020-09-13T12:26:40Z"},
+		{in: "invalid", exp: "invalid"},
+	} {
+		if got := roundTime(tc.in, 10*time.Second); got != tc.exp {
+			t.Errorf("roundTime(%q): expected %q, got %q", tc.in, tc.exp, got)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// estimateSeries returns the number of series selected by the selectors of the
+// enforced query at the given time (the current time if empty), as counted by
+// the upstream. The selectors already have the label enforced so the count
+// only covers the series of the tenant. The series selected by several
+// selectors are counted several times.
+func (r *routes) estimateSeries(ctx context.Context, query, ts string) (int, error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		counts []string
+		seen   = map[string]struct{}{}
+	)
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+		// The offset and @ modifiers are ignored, the estimate being
+		// computed at the end of the range.
+		sel := matchersToString(vs.LabelMatchers...)
+		if _, ok := seen[sel]; !ok {
+			seen[sel] = struct{}{}
+			counts = append(counts, "(count("+sel+") or vector(0))")
+		}
+		return nil
+	})
+	if len(counts) == 0 {
+		return 0, nil
+	}
+
+	q := url.Values{queryParam: {strings.Join(counts, " + ")}}
+	if ts != "" {
+		q.Set("time", ts)
+	}
+	u := *r.upstream
+	u.Path = path.Join(u.Path, "/api/v1/query")
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := (&http.Client{Transport: r.transport}).Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+
+	apir, err := getAPIResponse(resp)
+	if err != nil {
+		return 0, err
+	}
+
+	var data struct {
+		Result []struct {
+			Value [2]interface{} `json:"value"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(apir.Data, &data); err != nil {
+		return 0, errors.Wrap(err, "can't decode the query result")
+	}
+	if len(data.Result) != 1 {
+		return 0, errors.Errorf("expected a single sample, got %d", len(data.Result))
+	}
+	v, ok := data.Result[0].Value[1].(string)
+	if !ok {
+		return 0, errors.New("invalid sample value")
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid sample value")
+	}
+	return int(n), nil
+}
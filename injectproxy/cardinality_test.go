@@ -0,0 +1,108 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMaxEstimatedSeries(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		path     string
+		query    string
+		estimate string
+		status   int
+
+		expEstimate string
+		expCode     int
+	}{
+		{
+			name:        "below the limit",
+			path:        "/api/v1/query_range",
+			query:       `rate(http_requests_total[5m]) / on() group_left up offset 1h`,
+			estimate:    `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1600000000,"100"]}]}}`,
+			expEstimate: `(count({namespace="default",__name__="http_requests_total"}) or vector(0)) + (count({namespace="default",__name__="up"}) or vector(0))`,
+			expCode:     http.StatusOK,
+		},
+		{
+			name:        "above the limit",
+			path:        "/api/v1/query_range",
+			query:       `up`,
+			estimate:    `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1600000000,"1001"]}]}}`,
+			expEstimate: `(count({namespace="default",__name__="up"}) or vector(0))`,
+			expCode:     http.StatusBadRequest,
+		},
+		{
+			name:        "estimate failure",
+			path:        "/api/v1/query_range",
+			query:       `up`,
+			status:      http.StatusServiceUnavailable,
+			expEstimate: `(count({namespace="default",__name__="up"}) or vector(0))`,
+			expCode:     http.StatusBadGateway,
+		},
+		{
+			name:    "instant query",
+			path:    "/api/v1/query",
+			query:   `up`,
+			expCode: http.StatusOK,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			var estimated bool
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path == "/api/v1/query" && strings.HasPrefix(req.URL.Query().Get(queryParam), "(count(") {
+					estimated = true
+					if got := req.URL.Query().Get(queryParam); got != tc.expEstimate {
+						t.Errorf("expected estimate query %s, got %s", tc.expEstimate, got)
+					}
+					if got := req.URL.Query().Get("time"); got != "1600000000" {
+						t.Errorf("expected time 1600000000, got %q", got)
+					}
+					if tc.status != 0 {
+						w.WriteHeader(tc.status)
+						return
+					}
+					w.Write([]byte(tc.estimate))
+					return
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, WithMaxEstimatedSeries(1000))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{proxyLabel: {"default"}, queryParam: {tc.query}, "start": {"1599996400"}, "end": {"1600000000"}, "step": {"60"}}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"?"+q.Encode(), nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if exp := tc.expEstimate != ""; estimated != exp {
+				t.Fatalf("expected estimate %t, got %t", exp, estimated)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// ClientCertField is the field of the client certificate holding the label
+// value.
+type ClientCertField string
+
+const (
+	// ClientCertCommonName is the common name of the certificate subject.
+	ClientCertCommonName ClientCertField = "cn"
+	// ClientCertDNSName is a DNS name of the subject alternative names.
+	ClientCertDNSName ClientCertField = "dns"
+	// ClientCertURI is a URI of the subject alternative names.
+	ClientCertURI ClientCertField = "uri"
+)
+
+// ClientCertEnforcer extracts the label value from the TLS client certificate
+// of the request, e.g. for mTLS-secured internal traffic where the identity
+// can't be spoofed like a header. The certificate must have been verified by
+// the TLS listener.
+//
+// The value is read from Field. When Regexp is set, the first value of the
+// field matching it is used and, if the expression has a capturing group, the
+// label value is the first submatch (e.g. `^spiffe://cluster\.local/ns/([^/]+)/`
+// extracts the namespace of a SPIFFE ID). Otherwise the first value of the
+// field is used. The requests without client certificate are rejected with
+// 401.
+type ClientCertEnforcer struct {
+	Field  ClientCertField
+	Regexp *regexp.Regexp
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (ce ClientCertEnforcer) ExtractLabel(req *http.Request) (string, error) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return "", &UnauthorizedError{Msg: "Unauthorized. A TLS client certificate must be provided."}
+	}
+	cert := req.TLS.PeerCertificates[0]
+
+	var candidates []string
+	switch ce.Field {
+	case ClientCertCommonName:
+		candidates = []string{cert.Subject.CommonName}
+	case ClientCertDNSName:
+		candidates = cert.DNSNames
+	case ClientCertURI:
+		for _, u := range cert.URIs {
+			candidates = append(candidates, u.String())
+		}
+	default:
+		return "", &UnavailableError{Msg: fmt.Sprintf("Service unavailable. Unknown client certificate field %q.", ce.Field)}
+	}
+
+	for _, c := range candidates {
+		if ce.Regexp == nil {
+			if c != "" {
+				return c, nil
+			}
+			continue
+		}
+		m := ce.Regexp.FindStringSubmatch(c)
+		if m == nil {
+			continue
+		}
+		v := m[0]
+		if len(m) > 1 {
+			v = m[1]
+		}
+		if v != "" {
+			return v, nil
+		}
+	}
+	return "", &ForbiddenLabelValueError{Msg: fmt.Sprintf("Forbidden. The client certificate has no label value in the %q field.", ce.Field)}
+}
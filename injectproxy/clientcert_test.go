@@ -0,0 +1,176 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newCertChain returns a client certificate with the given subject signed by
+// a self-signed CA, followed by the CA certificate.
+func newCertChain(t *testing.T, tmpl *x509.Certificate) []*x509.Certificate {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tmpl.SerialNumber = big.NewInt(2)
+	tmpl.NotBefore, tmpl.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	der, err = x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return []*x509.Certificate{cert, ca}
+}
+
+func TestClientCertEnforcer(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://cluster.local/ns/default/sa/prometheus")
+	chain := newCertChain(t, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "default"},
+		DNSNames: []string{"metrics.example.com", "prometheus.default.svc"},
+		URIs:     []*url.URL{spiffe},
+	})
+
+	for _, tc := range []struct {
+		name   string
+		field  ClientCertField
+		regexp string
+		noTLS  bool
+		chain  []*x509.Certificate
+
+		expCode int
+	}{
+		{
+			name:    "no TLS",
+			field:   ClientCertCommonName,
+			noTLS:   true,
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "no client certificate",
+			field:   ClientCertCommonName,
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "common name",
+			field:   ClientCertCommonName,
+			chain:   chain,
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "DNS name matching the regexp",
+			field:   ClientCertDNSName,
+			regexp:  `^prometheus\.([^.]+)\.svc$`,
+			chain:   chain,
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "DNS name not matching the regexp",
+			field:   ClientCertDNSName,
+			regexp:  `^thanos\.([^.]+)\.svc$`,
+			chain:   chain,
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "URI matching the regexp",
+			field:   ClientCertURI,
+			regexp:  `^spiffe://cluster\.local/ns/([^/]+)/`,
+			chain:   chain,
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "URI not matching the regexp",
+			field:   ClientCertURI,
+			regexp:  `^spiffe://example\.com/ns/([^/]+)/`,
+			chain:   chain,
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "missing field",
+			field:   ClientCertURI,
+			chain:   newCertChain(t, &x509.Certificate{Subject: pkix.Name{CommonName: "default"}}),
+			expCode: http.StatusForbidden,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(checkQueryHandler("", queryParam, `up{namespace="default"}`))
+			defer m.Close()
+
+			ce := ClientCertEnforcer{Field: tc.field}
+			if tc.regexp != "" {
+				ce.Regexp = regexp.MustCompile(tc.regexp)
+			}
+			r, err := NewRoutes(m.url, proxyLabel, WithExtractLabeler(ce))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "https://prometheus.example.com/api/v1/query?query=up", nil)
+			if tc.noTLS {
+				req.TLS = nil
+			} else {
+				req.TLS = &tls.ConnectionState{HandshakeComplete: true, PeerCertificates: tc.chain}
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
@@ -15,6 +15,9 @@ package injectproxy
 
 import (
 	"fmt"
+	"regexp/syntax"
+	"sort"
+	"strings"
 
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql/parser"
@@ -22,6 +25,49 @@ import (
 
 type Enforcer struct {
 	labelMatchers map[string]*labels.Matcher
+	// ordered holds the enforced matchers in the order they are injected.
+	ordered []*labels.Matcher
+
+	// The position of the enforced matchers in the serialized selectors.
+	matcherPosition MatcherPosition
+
+	// When true, selectors having any matcher on an enforced label are left
+	// untouched for that label.
+	skipIfLabelPresent bool
+
+	// Complexity limits of the queries, zero means no limit.
+	maxSelectors int
+	maxDepth     int
+
+	// When true, the matchers selecting too many metric names are rejected.
+	// Regular expressions on the metric name are accepted only when they
+	// match a finite set of names or when they start with a literal prefix
+	// of at least minNamePrefix characters (if not zero).
+	forbidBroadNames bool
+	minNamePrefix    int
+
+	// When true, the enforced labels are added to the on() clauses and
+	// removed from the ignoring() clauses of the binary operations between
+	// vectors.
+	matchOnLabels bool
+
+	// When true, the enforced labels are added to the by() clauses and
+	// removed from the without() clauses of the aggregations.
+	groupByLabels bool
+
+	// When true, the queries are only checked against the limits and the
+	// labels aren't injected, e.g. because another instance already
+	// enforced them.
+	checkOnly bool
+}
+
+// illegalQueryError is returned when a query is rejected by the enforcer.
+type illegalQueryError struct {
+	msg string
+}
+
+func (e illegalQueryError) Error() string {
+	return e.msg
 }
 
 func NewEnforcer(ms ...*labels.Matcher) *Enforcer {
@@ -30,9 +76,16 @@ func NewEnforcer(ms ...*labels.Matcher) *Enforcer {
 	for _, matcher := range ms {
 		entries[matcher.Name] = matcher
 	}
+	var ordered []*labels.Matcher
+	for _, matcher := range ms {
+		if entries[matcher.Name] == matcher {
+			ordered = append(ordered, matcher)
+		}
+	}
 
 	return &Enforcer{
 		labelMatchers: entries,
+		ordered:       ordered,
 	}
 }
 
@@ -58,6 +111,14 @@ func (ms Enforcer) EnforceNode(node parser.Node) error {
 		}
 
 	case *parser.AggregateExpr:
+		if n.Op == parser.COUNT_VALUES {
+			if err := ms.checkOutputLabel(n.Op.String(), n.Param); err != nil {
+				return err
+			}
+		}
+		if ms.groupByLabels {
+			ms.enforceGrouping(n)
+		}
 		if err := ms.EnforceNode(n.Expr); err != nil {
 			return err
 		}
@@ -71,7 +132,19 @@ func (ms Enforcer) EnforceNode(node parser.Node) error {
 			return err
 		}
 
+		if ms.matchOnLabels {
+			ms.enforceVectorMatching(n)
+		}
+
 	case *parser.Call:
+		switch n.Func.Name {
+		case "label_replace", "label_join":
+			if len(n.Args) > 1 {
+				if err := ms.checkOutputLabel(n.Func.Name, n.Args[1]); err != nil {
+					return err
+				}
+			}
+		}
 		if err := ms.EnforceNode(n.Args); err != nil {
 			return err
 		}
@@ -111,20 +184,305 @@ func (ms Enforcer) EnforceNode(node parser.Node) error {
 	return nil
 }
 
+// checkOutputLabel returns an error if the label produced by the given
+// aggregation or function (e.g. the label of count_values or the destination
+// label of label_replace) is an enforced label since the query could then
+// forge the enforced label in its results. Labels which can't be determined
+// statically are rejected too.
+func (ms Enforcer) checkOutputLabel(name string, param parser.Expr) error {
+	for {
+		p, ok := param.(*parser.ParenExpr)
+		if !ok {
+			break
+		}
+		param = p.Expr
+	}
+
+	s, ok := param.(*parser.StringLiteral)
+	if !ok {
+		return illegalQueryError{msg: fmt.Sprintf("the label produced by %s must be a string literal", name)}
+	}
+	if _, ok := ms.labelMatchers[s.Val]; ok {
+		return illegalQueryError{msg: fmt.Sprintf("%s can't produce the enforced label %q", name, s.Val)}
+	}
+	return nil
+}
+
+// enforceVectorMatching ensures that the enforced labels are part of the
+// labels matching the series of the binary operation, so that the series of
+// both sides are only matched when the enforced labels are equal. The results
+// of on() clauses keep the enforced labels too.
+func (ms Enforcer) enforceVectorMatching(n *parser.BinaryExpr) {
+	vm := n.VectorMatching
+	if vm == nil || n.LHS.Type() != parser.ValueTypeVector || n.RHS.Type() != parser.ValueTypeVector {
+		return
+	}
+
+	present := map[string]struct{}{}
+	var matching []string
+	for _, l := range vm.MatchingLabels {
+		if _, ok := ms.labelMatchers[l]; ok {
+			if !vm.On {
+				continue
+			}
+			present[l] = struct{}{}
+		}
+		matching = append(matching, l)
+	}
+
+	if vm.On {
+		for name := range ms.labelMatchers {
+			if _, ok := present[name]; !ok {
+				matching = append(matching, name)
+			}
+		}
+		sort.Strings(matching[len(vm.MatchingLabels):])
+	}
+	vm.MatchingLabels = matching
+}
+
+// enforceGrouping ensures that the enforced labels are kept in the results of
+// the aggregation.
+func (ms Enforcer) enforceGrouping(n *parser.AggregateExpr) {
+	present := map[string]struct{}{}
+	var grouping []string
+	for _, l := range n.Grouping {
+		if _, ok := ms.labelMatchers[l]; ok {
+			if n.Without {
+				continue
+			}
+			present[l] = struct{}{}
+		}
+		grouping = append(grouping, l)
+	}
+
+	if !n.Without {
+		for name := range ms.labelMatchers {
+			if _, ok := present[name]; !ok {
+				grouping = append(grouping, name)
+			}
+		}
+		sort.Strings(grouping[len(n.Grouping):])
+	}
+	n.Grouping = grouping
+}
+
 func (ms Enforcer) enforceMatchers(targets []*labels.Matcher) []*labels.Matcher {
-	var res []*labels.Matcher
+	var (
+		res     []*labels.Matcher
+		present = map[string]struct{}{}
+	)
 
 	for _, target := range targets {
 		if _, ok := ms.labelMatchers[target.Name]; ok {
-			continue
+			if !ms.skipIfLabelPresent {
+				continue
+			}
+			present[target.Name] = struct{}{}
 		}
 
 		res = append(res, target)
 	}
 
-	for _, enforcedMatcher := range ms.labelMatchers {
-		res = append(res, enforcedMatcher)
+	var enforced []*labels.Matcher
+	for _, enforcedMatcher := range ms.ordered {
+		if _, ok := present[enforcedMatcher.Name]; ok {
+			continue
+		}
+		enforced = append(enforced, enforcedMatcher)
+	}
+
+	return append(res, enforced...)
+}
+
+// checkComplexity returns an error if the given node exceeds the maximum
+// number of selectors or the maximum nesting depth of the enforcer.
+func (ms Enforcer) checkComplexity(node parser.Node) error {
+	if ms.maxSelectors <= 0 && ms.maxDepth <= 0 {
+		return nil
+	}
+
+	var selectors, depth int
+	parser.Inspect(node, func(n parser.Node, path []parser.Node) error {
+		if len(path)+1 > depth {
+			depth = len(path) + 1
+		}
+		if _, ok := n.(*parser.VectorSelector); ok {
+			selectors++
+		}
+		return nil
+	})
+
+	if ms.maxSelectors > 0 && selectors > ms.maxSelectors {
+		return illegalQueryError{msg: fmt.Sprintf("query has %d selectors, the maximum is %d", selectors, ms.maxSelectors)}
+	}
+	if ms.maxDepth > 0 && depth > ms.maxDepth {
+		return illegalQueryError{msg: fmt.Sprintf("query has a nesting depth of %d, the maximum is %d", depth, ms.maxDepth)}
+	}
+	return nil
+}
+
+// checkNameMatchers returns an error if any selector of the given node has a
+// matcher on the metric name which is too broad.
+func (ms Enforcer) checkNameMatchers(node parser.Node) error {
+	if !ms.forbidBroadNames {
+		return nil
+	}
+
+	var err error
+	parser.Inspect(node, func(n parser.Node, _ []parser.Node) error {
+		if vs, ok := n.(*parser.VectorSelector); ok && err == nil {
+			err = ms.checkSelectorNames(vs.LabelMatchers)
+		}
+		return nil
+	})
+	return err
+}
+
+// checkSelectorNames returns an error if any of the given matchers on the
+// metric name is too broad.
+func (ms Enforcer) checkSelectorNames(matchers []*labels.Matcher) error {
+	if !ms.forbidBroadNames {
+		return nil
 	}
 
-	return res
+	for _, m := range matchers {
+		if m.Name != labels.MetricName {
+			continue
+		}
+
+		switch m.Type {
+		case labels.MatchEqual:
+			continue
+		case labels.MatchNotEqual, labels.MatchNotRegexp:
+			return illegalQueryError{msg: fmt.Sprintf("negative matcher %s on the metric name is not allowed", m)}
+		}
+
+		re, err := syntax.Parse(m.Value, syntax.Perl)
+		if err != nil {
+			return illegalQueryError{msg: fmt.Sprintf("invalid matcher %s: %v", m, err)}
+		}
+		re = re.Simplify()
+		if finiteRegexp(re) {
+			continue
+		}
+		if ms.minNamePrefix > 0 && literalPrefixLen(re) >= ms.minNamePrefix {
+			continue
+		}
+		if ms.minNamePrefix > 0 {
+			return illegalQueryError{msg: fmt.Sprintf("matcher %s on the metric name is too broad, a literal prefix of at least %d characters is required", m, ms.minNamePrefix)}
+		}
+		return illegalQueryError{msg: fmt.Sprintf("matcher %s on the metric name is too broad, only alternations of metric names are allowed", m)}
+	}
+	return nil
+}
+
+// finiteRegexp returns true if the regular expression matches a finite set of
+// strings without wildcard (e.g. "foo|bar_(a|b)").
+func finiteRegexp(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpNoMatch, syntax.OpEmptyMatch, syntax.OpLiteral, syntax.OpCharClass,
+		syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText:
+		return true
+	case syntax.OpCapture, syntax.OpQuest, syntax.OpConcat, syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			if !finiteRegexp(sub) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// literalPrefixLen returns the length of the literal prefix shared by all the
+// strings matched by the regular expression.
+func literalPrefixLen(re *syntax.Regexp) int {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return len(re.Rune)
+	case syntax.OpCapture:
+		return literalPrefixLen(re.Sub[0])
+	case syntax.OpConcat:
+		var n int
+		for _, sub := range re.Sub {
+			switch sub.Op {
+			case syntax.OpBeginLine, syntax.OpBeginText:
+				continue
+			case syntax.OpLiteral:
+				n += len(sub.Rune)
+				continue
+			}
+			return n + literalPrefixLen(sub)
+		}
+		return n
+	case syntax.OpAlternate:
+		n := -1
+		for _, sub := range re.Sub {
+			if l := literalPrefixLen(sub); n < 0 || l < n {
+				n = l
+			}
+		}
+		if n < 0 {
+			return 0
+		}
+		return n
+	}
+	return 0
+}
+
+// reorderMatchers moves the enforced matchers of the selectors of a printed
+// query to the start (or the end) of the selectors since the PromQL printer
+// sorts the matchers. The quoted strings are skipped so that the braces and
+// commas of the label values and string literals are ignored.
+func reorderMatchers(q string, enforced []*labels.Matcher, first bool) string {
+	isEnforced := make(map[string]bool, len(enforced))
+	for _, m := range enforced {
+		isEnforced[m.String()] = true
+	}
+
+	var (
+		b          strings.Builder
+		inSelector bool
+		matchers   []string
+		// last is the start of the current matcher in a selector or of the
+		// text to copy as-is otherwise.
+		last int
+	)
+	for i := 0; i < len(q); i++ {
+		switch c := q[i]; c {
+		case '"', '\'', '`':
+			for i++; i < len(q) && q[i] != c; i++ {
+				if q[i] == '\\' && c != '`' {
+					i++
+				}
+			}
+		case '{':
+			if !inSelector {
+				b.WriteString(q[last : i+1])
+				inSelector, matchers, last = true, nil, i+1
+			}
+		case ',':
+			if inSelector {
+				matchers = append(matchers, q[last:i])
+				last = i + 1
+			}
+		case '}':
+			if inSelector {
+				matchers = append(matchers, q[last:i])
+				var head, tail []string
+				for _, m := range matchers {
+					if isEnforced[m] == first {
+						head = append(head, m)
+					} else {
+						tail = append(tail, m)
+					}
+				}
+				b.WriteString(strings.Join(append(head, tail...), ","))
+				inSelector, last = false, i
+			}
+		}
+	}
+	b.WriteString(q[last:])
+	return b.String()
 }
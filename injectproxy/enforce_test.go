@@ -152,6 +152,139 @@ var tests = []struct {
 			hasExpression(`metric1{namespace="NS",pod="POD"} + on(pod, namespace) sum by(pod) (metric2{label="baz",namespace="NS",pod="POD"})`),
 		),
 	},
+
+	{
+		name:       "skip if label present",
+		expression: `metric1{pod="baz"} + sum by (pod)(metric2{label="baz",pod="foo",namespace=~"bar|baz"})`,
+		enforcer: func() *Enforcer {
+			e := NewEnforcer(
+				&labels.Matcher{
+					Name:  "namespace",
+					Type:  labels.MatchEqual,
+					Value: "NS",
+				},
+				&labels.Matcher{
+					Name:  "pod",
+					Type:  labels.MatchEqual,
+					Value: "POD",
+				},
+			)
+			e.skipIfLabelPresent = true
+			return e
+		}(),
+		check: checks(
+			hasError(nil),
+			hasExpression(`metric1{namespace="NS",pod="baz"} + sum by(pod) (metric2{label="baz",namespace=~"bar|baz",pod="foo"})`),
+		),
+	},
+	{
+		name:       "count_values producing the enforced label",
+		expression: `count_values("namespace", metric1)`,
+		enforcer: NewEnforcer(
+			&labels.Matcher{
+				Name:  "namespace",
+				Type:  labels.MatchEqual,
+				Value: "NS",
+			},
+		),
+		check: hasError(illegalQueryError{msg: `count_values can't produce the enforced label "namespace"`}),
+	},
+	{
+		name:       "count_values producing the enforced label in parentheses",
+		expression: `count_values((("namespace")), metric1)`,
+		enforcer: NewEnforcer(
+			&labels.Matcher{
+				Name:  "namespace",
+				Type:  labels.MatchEqual,
+				Value: "NS",
+			},
+		),
+		check: hasError(illegalQueryError{msg: `count_values can't produce the enforced label "namespace"`}),
+	},
+	{
+		name:       "label_replace producing the enforced label",
+		expression: `label_replace(metric1, "namespace", "$1", "pod", "(.*)")`,
+		enforcer: NewEnforcer(
+			&labels.Matcher{
+				Name:  "namespace",
+				Type:  labels.MatchEqual,
+				Value: "NS",
+			},
+		),
+		check: hasError(illegalQueryError{msg: `label_replace can't produce the enforced label "namespace"`}),
+	},
+	{
+		name:       "nested label_join producing the enforced label",
+		expression: `sum(label_join(metric1, "namespace", "-", "pod"))`,
+		enforcer: NewEnforcer(
+			&labels.Matcher{
+				Name:  "namespace",
+				Type:  labels.MatchEqual,
+				Value: "NS",
+			},
+		),
+		check: hasError(illegalQueryError{msg: `label_join can't produce the enforced label "namespace"`}),
+	},
+	{
+		name:       "absent",
+		expression: `absent(up{job="x"})`,
+		enforcer: NewEnforcer(
+			&labels.Matcher{
+				Name:  "namespace",
+				Type:  labels.MatchEqual,
+				Value: "NS",
+			},
+		),
+		check: checks(
+			hasError(nil),
+			hasExpression(`absent(up{job="x",namespace="NS"})`),
+		),
+	},
+	{
+		name:       "absent over time",
+		expression: `absent_over_time(up{namespace="other"}[5m]) or absent(nonexistent)`,
+		enforcer: NewEnforcer(
+			&labels.Matcher{
+				Name:  "namespace",
+				Type:  labels.MatchEqual,
+				Value: "NS",
+			},
+		),
+		check: checks(
+			hasError(nil),
+			hasExpression(`absent_over_time(up{namespace="NS"}[5m]) or absent(nonexistent{namespace="NS"})`),
+		),
+	},
+	{
+		name:       "count_values producing another label",
+		expression: `count_values("value", metric1)`,
+		enforcer: NewEnforcer(
+			&labels.Matcher{
+				Name:  "namespace",
+				Type:  labels.MatchEqual,
+				Value: "NS",
+			},
+		),
+		check: checks(
+			hasError(nil),
+			hasExpression(`count_values("value", metric1{namespace="NS"})`),
+		),
+	},
+	{
+		name:       "label_replace producing another label",
+		expression: `label_replace(metric1, "dst", "$1", "namespace", "(.*)")`,
+		enforcer: NewEnforcer(
+			&labels.Matcher{
+				Name:  "namespace",
+				Type:  labels.MatchEqual,
+				Value: "NS",
+			},
+		),
+		check: checks(
+			hasError(nil),
+			hasExpression(`label_replace(metric1{namespace="NS"}, "dst", "$1", "namespace", "(.*)")`),
+		),
+	},
 }
 
 func TestEnforceNode(t *testing.T) {
@@ -169,3 +302,235 @@ func TestEnforceNode(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckNameMatchers(t *testing.T) {
+	for _, tc := range []struct {
+		query     string
+		minPrefix int
+		allowed   bool
+	}{
+		{query: `up`, allowed: true},
+		{query: `{job="prometheus"}`, allowed: true},
+		{query: `{__name__="up"}`, allowed: true},
+		{query: `{__name__=~"up|down"}`, allowed: true},
+		{query: `{__name__=~"node_(cpu|memory)_total"}`, allowed: true},
+		{query: `{__name__=~".+"}`},
+		{query: `{__name__=~".*",job="prometheus"}`},
+		{query: `{__name__=~"node_.*"}`},
+		{query: `{__name__!=""}`},
+		{query: `{__name__!~"up",job="prometheus"}`},
+		{query: `sum(rate({__name__=~".+"}[5m]))`},
+		{query: `up + {__name__=~"a.+"}`},
+		{query: `{__name__=~"node_.*"}`, minPrefix: 5, allowed: true},
+		{query: `{__name__=~"node_cpu.*|node_memory.*"}`, minPrefix: 5, allowed: true},
+		{query: `{__name__=~"node.*"}`, minPrefix: 5},
+		{query: `{__name__=~"(node|up).*"}`, minPrefix: 5},
+		{query: `{__name__=~".*_total"}`, minPrefix: 5},
+		{query: `{__name__!=""}`, minPrefix: 5},
+	} {
+		t.Run(fmt.Sprintf("%s/%d", tc.query, tc.minPrefix), func(t *testing.T) {
+			expr, err := parser.ParseExpr(tc.query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			e := NewEnforcer()
+			e.forbidBroadNames = true
+			e.minNamePrefix = tc.minPrefix
+			err = e.checkNameMatchers(expr)
+			if tc.allowed && err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if !tc.allowed {
+				if err == nil {
+					t.Fatal("expected an error, got none")
+				}
+				if _, ok := err.(illegalQueryError); !ok {
+					t.Fatalf("expected illegalQueryError, got %T", err)
+				}
+			}
+		})
+	}
+}
+
+func TestEnforceVectorMatching(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+
+		exp string
+	}{
+		{
+			query: `a / b`,
+			exp:   `a{namespace="NS"} / b{namespace="NS"}`,
+		},
+		{
+			query: `a / on(job) b`,
+			exp:   `a{namespace="NS"} / on(job, namespace) b{namespace="NS"}`,
+		},
+		{
+			query: `a / on(namespace, job) b`,
+			exp:   `a{namespace="NS"} / on(namespace, job) b{namespace="NS"}`,
+		},
+		{
+			query: `a and on() b`,
+			exp:   `a{namespace="NS"} and on(namespace) b{namespace="NS"}`,
+		},
+		{
+			query: `a * on(job) group_left(instance) b`,
+			exp:   `a{namespace="NS"} * on(job, namespace) group_left(instance) b{namespace="NS"}`,
+		},
+		{
+			query: `a / ignoring(namespace, job) b`,
+			exp:   `a{namespace="NS"} / ignoring(job) b{namespace="NS"}`,
+		},
+		{
+			query: `a / ignoring(namespace) b`,
+			exp:   `a{namespace="NS"} / b{namespace="NS"}`,
+		},
+		{
+			query: `sum(a) by (job) / on(job) sum(b) by (job)`,
+			exp:   `sum by(job) (a{namespace="NS"}) / on(job, namespace) sum by(job) (b{namespace="NS"})`,
+		},
+		{
+			query: `a * 2`,
+			exp:   `a{namespace="NS"} * 2`,
+		},
+		{
+			query: `(a / on(job) b) > bool 1`,
+			exp:   `(a{namespace="NS"} / on(job, namespace) b{namespace="NS"}) > bool 1`,
+		},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tc.query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			e := NewEnforcer(&labels.Matcher{Name: "namespace", Type: labels.MatchEqual, Value: "NS"})
+			e.matchOnLabels = true
+			if err := e.EnforceNode(expr); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := expr.String(); got != tc.exp {
+				t.Fatalf("expected %s, got %s", tc.exp, got)
+			}
+
+			// The enforced expression must be valid.
+			if _, err := parser.ParseExpr(expr.String()); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestEnforceGrouping(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+
+		exp string
+	}{
+		{
+			query: `sum by (pod) (a)`,
+			exp:   `sum by(pod, namespace) (a{namespace="NS"})`,
+		},
+		{
+			query: `sum by (namespace, pod) (a)`,
+			exp:   `sum by(namespace, pod) (a{namespace="NS"})`,
+		},
+		{
+			query: `sum(a)`,
+			exp:   `sum by(namespace) (a{namespace="NS"})`,
+		},
+		{
+			query: `sum without (namespace, pod) (a)`,
+			exp:   `sum without(pod) (a{namespace="NS"})`,
+		},
+		{
+			query: `sum without (pod) (a)`,
+			exp:   `sum without(pod) (a{namespace="NS"})`,
+		},
+		{
+			query: `topk(5, sum by (pod) (rate(a[5m])))`,
+			exp:   `topk by(namespace) (5, sum by(pod, namespace) (rate(a{namespace="NS"}[5m])))`,
+		},
+		{
+			query: `max by (pod) (sum by (pod, container) (a)) / on(pod) b`,
+			exp:   `max by(pod, namespace) (sum by(pod, container, namespace) (a{namespace="NS"})) / on(pod) b{namespace="NS"}`,
+		},
+		{
+			query: `avg_over_time(sum by (pod) (a)[5m:1m])`,
+			exp:   `avg_over_time(sum by(pod, namespace) (a{namespace="NS"})[5m:1m])`,
+		},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tc.query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			e := NewEnforcer(&labels.Matcher{Name: "namespace", Type: labels.MatchEqual, Value: "NS"})
+			e.groupByLabels = true
+			if err := e.EnforceNode(expr); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := expr.String(); got != tc.exp {
+				t.Fatalf("expected %s, got %s", tc.exp, got)
+			}
+
+			// The enforced expression must be valid.
+			if _, err := parser.ParseExpr(expr.String()); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestEnforcedMatcherPosition(t *testing.T) {
+	for _, tc := range []struct {
+		query    string
+		position MatcherPosition
+
+		exp string
+	}{
+		{
+			query:    `a{job="j",zone="z"}`,
+			position: MatcherPositionDefault,
+			exp:      `a{job="j",namespace="NS",tenant="T",zone="z"}`,
+		},
+		{
+			query:    `a{job="j",zone="z"}`,
+			position: MatcherPositionFirst,
+			exp:      `a{namespace="NS",tenant="T",job="j",zone="z"}`,
+		},
+		{
+			query:    `a{job="j",zone="z"}`,
+			position: MatcherPositionLast,
+			exp:      `a{job="j",zone="z",namespace="NS",tenant="T"}`,
+		},
+		{
+			query:    `rate(a{job="{a,b}",path=~"x\",}"}[5m]) + on() group_left label_replace(b, "dst", "{,}", "src", "(.*)")`,
+			position: MatcherPositionFirst,
+			exp:      `rate(a{namespace="NS",tenant="T",job="{a,b}",path=~"x\",}"}[5m]) + on() group_left() label_replace(b{namespace="NS",tenant="T"}, "dst", "{,}", "src", "(.*)")`,
+		},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			e := NewEnforcer(
+				&labels.Matcher{Name: "namespace", Type: labels.MatchEqual, Value: "NS"},
+				&labels.Matcher{Name: "tenant", Type: labels.MatchEqual, Value: "T"},
+			)
+			e.matcherPosition = tc.position
+			got, err := enforceQuery(e, tc.query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.exp {
+				t.Fatalf("expected %s, got %s", tc.exp, got)
+			}
+
+			// The enforced expression must be valid.
+			if _, err := parser.ParseExpr(got); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// eventQueueSize is the maximum number of events waiting to be published.
+// Events are dropped when the queue is full.
+const eventQueueSize = 1000
+
+// eventPublishTimeout is the maximum duration of the publication of an event.
+const eventPublishTimeout = 10 * time.Second
+
+// Event describes a request enforced by the proxy.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Label      string    `json:"label"`
+	LabelValue string    `json:"labelValue"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	// Query and EnforcedQuery are the PromQL query before and after the
+	// enforcement for the query endpoints.
+	Query         string `json:"query,omitempty"`
+	EnforcedQuery string `json:"enforcedQuery,omitempty"`
+	// Selectors and EnforcedSelectors are the series selectors before and
+	// after the enforcement for the endpoints taking selectors.
+	Selectors         []string `json:"selectors,omitempty"`
+	EnforcedSelectors []string `json:"enforcedSelectors,omitempty"`
+	// Dropped is the number of items removed from the response by the proxy
+	// for the filtered endpoints.
+	Dropped *int `json:"dropped,omitempty"`
+}
+
+// EventSink publishes the events of the enforced requests, e.g. to a message
+// bus feeding a security monitoring pipeline.
+type EventSink interface {
+	Publish(ctx context.Context, e *Event) error
+}
+
+// WebhookSink is an EventSink posting each event as a JSON document to a URL.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+// Publish implements the EventSink interface.
+func (ws *WebhookSink) Publish(ctx context.Context, e *Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ws.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := ws.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("unexpected status code %d from %s", resp.StatusCode, ws.URL)
+	}
+	return nil
+}
+
+// eventPublisher publishes the events asynchronously so that a slow or
+// failing sink never blocks the requests.
+type eventPublisher struct {
+	sink    EventSink
+	events  chan *Event
+	metrics *Metrics
+
+	once sync.Once
+}
+
+func newEventPublisher(sink EventSink) *eventPublisher {
+	return &eventPublisher{
+		sink:   sink,
+		events: make(chan *Event, eventQueueSize),
+	}
+}
+
+// start starts publishing the events with the metrics of the first routes
+// using the publisher. The next calls only return the publisher so that the
+// routes built again on reload don't start another goroutine.
+func (p *eventPublisher) start(metrics *Metrics) *eventPublisher {
+	p.once.Do(func() {
+		p.metrics = metrics
+		go p.run()
+	})
+	return p
+}
+
+func (p *eventPublisher) run() {
+	for e := range p.events {
+		ctx, cancel := context.WithTimeout(context.Background(), eventPublishTimeout)
+		if err := p.sink.Publish(ctx, e); err != nil {
+			log.Printf("warning: Failed to publish event: %v", err)
+			p.metrics.observeEvent(eventFailed)
+		} else {
+			p.metrics.observeEvent(eventPublished)
+		}
+		cancel()
+	}
+}
+
+// publish queues the event, dropping it if the queue is full.
+func (p *eventPublisher) publish(e *Event) {
+	select {
+	case p.events <- e:
+	default:
+		p.metrics.observeEvent(eventDropped)
+	}
+}
+
+const (
+	eventPublished = "published"
+	eventFailed    = "failed"
+	eventDropped   = "dropped"
+)
+
+// requestEvent returns the event of the request being enforced or nil if
+// events are disabled. The handlers complete it with what they enforce.
+func requestEvent(ctx context.Context) *Event {
+	e, _ := ctx.Value(keyEvent).(*Event)
+	return e
+}
@@ -0,0 +1,185 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookEvents(t *testing.T) {
+	events := make(chan Event, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var e Event
+		if err := json.NewDecoder(req.Body).Decode(&e); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		events <- e
+	}))
+	defer webhook.Close()
+
+	for _, tc := range []struct {
+		name     string
+		url      string
+		upstream http.Handler
+
+		expEvent Event
+	}{
+		{
+			name:     "query",
+			url:      "http://prometheus.example.com/api/v1/query?query=up&" + proxyLabel + "=default",
+			upstream: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }),
+			expEvent: Event{
+				Method:        http.MethodGet,
+				Path:          "/api/v1/query",
+				Query:         "up",
+				EnforcedQuery: `up{namespace="default"}`,
+			},
+		},
+		{
+			name:     "series",
+			url:      "http://prometheus.example.com/api/v1/series?match[]=up&" + proxyLabel + "=default",
+			upstream: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }),
+			expEvent: Event{
+				Method:            http.MethodGet,
+				Path:              "/api/v1/series",
+				Selectors:         []string{"up"},
+				EnforcedSelectors: []string{`{__name__="up",namespace="default"}`},
+			},
+		},
+		{
+			name:     "rules",
+			url:      "http://prometheus.example.com/api/v1/rules?" + proxyLabel + "=ns1",
+			upstream: validRules(),
+			expEvent: Event{
+				Method: http.MethodGet,
+				Path:   "/api/v1/rules",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(tc.upstream)
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, WithEventSink(&WebhookSink{URL: webhook.URL}))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.url, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			var e Event
+			select {
+			case e = <-events:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for the event")
+			}
+
+			if e.Time.IsZero() {
+				t.Errorf("expected event time to be set")
+			}
+			if e.Label != proxyLabel {
+				t.Errorf("expected label %q, got %q", proxyLabel, e.Label)
+			}
+			if tc.expEvent.Path == "/api/v1/rules" {
+				if e.Dropped == nil || *e.Dropped == 0 {
+					t.Errorf("expected the dropped rules to be counted, got %v", e.Dropped)
+				}
+				e.Dropped = nil
+			}
+			e.Time, e.Label, e.LabelValue = time.Time{}, "", ""
+			if !reflect.DeepEqual(e, tc.expEvent) {
+				t.Fatalf("expected event %+v, got %+v", tc.expEvent, e)
+			}
+		})
+	}
+}
+
+// blockingSink is an EventSink blocking until it's released.
+type blockingSink struct {
+	release chan struct{}
+}
+
+func (s *blockingSink) Publish(ctx context.Context, _ *Event) error {
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+func TestEventsDoNotBlockRequests(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+
+	sink := &blockingSink{release: make(chan struct{})}
+	defer close(sink.release)
+
+	metrics := NewMetrics(nil)
+	r, err := NewRoutes(m.url, proxyLabel, WithEventSink(sink), WithMetrics(metrics))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// One event is being published, the others fill the queue and the last
+	// one is dropped.
+	for i := 0; i < eventQueueSize+2; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&"+proxyLabel+"=default", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, nil)
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	if !strings.Contains(string(body), `prom_label_proxy_events_total{result="dropped"}`) {
+		t.Fatalf("expected dropped events in the metrics, got:\n%s", string(body))
+	}
+}
+
+func TestEventsSharedOnReload(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+
+	sink := &blockingSink{release: make(chan struct{})}
+	defer close(sink.release)
+
+	// The routes built again with the same options (e.g. on reload) share
+	// the publisher rather than starting another one.
+	opt := WithEventSink(sink)
+	r1, err := NewRoutes(m.url, proxyLabel, opt)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r2, err := NewRoutes(m.url, "tenant", opt)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r1.events == nil || r1.events != r2.events {
+		t.Fatalf("expected the routes to share the event publisher")
+	}
+}
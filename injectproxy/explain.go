@@ -0,0 +1,84 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+const explainValueParam = "value"
+
+type explainData struct {
+	Query string `json:"query"`
+}
+
+// ExplainHandler returns a handler previewing the enforcement of a PromQL
+// query for a label value, without forwarding anything upstream. It expects
+// the "query" and "value" form parameters in a POST request and returns the
+// query after injection. The query goes through the same enforcement as the
+// query endpoints.
+//
+// It is meant for debugging and should only be exposed to operators.
+func (r *routes) ExplainHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.NotFound(w, req)
+			return
+		}
+		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, fmt.Sprintf("can't parse form: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		lvalue := req.PostForm.Get(explainValueParam)
+		if lvalue == "" {
+			prometheusAPIError(w, fmt.Sprintf("the %q parameter must be provided", explainValueParam), http.StatusBadRequest)
+			return
+		}
+		query := req.PostForm.Get(queryParam)
+		if query == "" {
+			prometheusAPIError(w, fmt.Sprintf("the %q parameter must be provided", queryParam), http.StatusBadRequest)
+			return
+		}
+
+		// The values of the additional labels are extracted from the request
+		// as for the proxied requests.
+		matchers, err := r.newMatchers(req, []string{lvalue})
+		if err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		v := url.Values{queryParam: {query}}
+		if _, _, err := enforceQueryValues(r.newEnforcer(withEnforcedMatchers(req.Context(), matchers)), v); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		b, err := json.Marshal(explainData{Query: v.Get(queryParam)})
+		if err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(apiResponse{Status: "success", Data: b}); err != nil {
+			log.Printf("error: Failed to encode json: %v", err)
+		}
+	})
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestExplainHandler(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("unexpected request to the upstream: %v", req.URL)
+	}))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name   string
+		opts   []Option
+		method string
+		form   url.Values
+
+		expCode int
+		expBody string
+	}{
+		{
+			name:    "injected query",
+			form:    url.Values{"query": {`sum(rate(http_requests_total{namespace="other"}[5m]))`}, "value": {"default"}},
+			expCode: http.StatusOK,
+			expBody: `{"status":"success","data":{"query":"sum(rate(http_requests_total{namespace=\"default\"}[5m]))"}}` + "\n",
+		},
+		{
+			name:    "query rejected by the limits",
+			opts:    []Option{WithQueryComplexityLimits(1, 0)},
+			form:    url.Values{"query": {`up + down`}, "value": {"default"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid query",
+			form:    url.Values{"query": {`up +`}, "value": {"default"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "missing value",
+			form:    url.Values{"query": {`up`}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "GET isn't allowed",
+			method:  http.MethodGet,
+			expCode: http.StatusNotFound,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			req := httptest.NewRequest(method, "http://localhost/-/explain", strings.NewReader(tc.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			r.ExplainHandler().ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if tc.expBody != "" && string(body) != tc.expBody {
+				t.Fatalf("expected body %q, got %q", tc.expBody, string(body))
+			}
+		})
+	}
+}
@@ -0,0 +1,413 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ExtractLabeler extracts the value of the label to enforce from the request.
+// Implementations may modify the request, e.g. to remove the parameter
+// holding the value before the request is forwarded upstream.
+type ExtractLabeler interface {
+	ExtractLabel(req *http.Request) (string, error)
+}
+
+// MissingLabelValueError is returned by ExtractLabeler implementations when
+// the request carries no label value.
+type MissingLabelValueError struct {
+	Msg string
+}
+
+func (e *MissingLabelValueError) Error() string {
+	return e.Msg
+}
+
+// UnavailableError is returned by ExtractLabeler implementations when the
+// label value can't be extracted because of the proxy configuration. The
+// requests are rejected with 503.
+type UnavailableError struct {
+	Msg string
+}
+
+func (e *UnavailableError) Error() string {
+	return e.Msg
+}
+
+// UnauthorizedError is returned by ExtractLabeler implementations when the
+// request carries no valid credentials. The requests are rejected with 401.
+type UnauthorizedError struct {
+	Msg string
+}
+
+func (e *UnauthorizedError) Error() string {
+	return e.Msg
+}
+
+// HTTPFormEnforcer extracts the label value from a query parameter of the
+// request. The parameter is removed from the request.
+type HTTPFormEnforcer struct {
+	ParameterName string
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (hff HTTPFormEnforcer) ExtractLabel(req *http.Request) (string, error) {
+	q := req.URL.Query()
+	lvalue := q.Get(hff.ParameterName)
+	if lvalue == "" {
+		return "", &MissingLabelValueError{Msg: fmt.Sprintf("Bad request. The %q query parameter must be provided.", hff.ParameterName)}
+	}
+
+	// Remove the proxy label from the query parameters.
+	q.Del(hff.ParameterName)
+	req.URL.RawQuery = q.Encode()
+
+	return lvalue, nil
+}
+
+// binaryHeaderSuffix is the suffix of the gRPC metadata keys holding binary
+// values. These values are base64-encoded when sent as HTTP headers, e.g. by
+// gRPC-Web clients.
+const binaryHeaderSuffix = "-bin"
+
+// HTTPHeaderEnforcer extracts the label value from a header of the request.
+//
+// It can be used in front of gRPC-Web clients which carry the tenancy in
+// custom metadata: the metadata are sent as HTTP headers with the same name
+// (e.g. "grpc-metadata-tenant"). When DecodeBinary is true and the header
+// name ends with "-bin", the value is base64-decoded as per the gRPC
+// conventions for binary metadata (both padded and unpadded values are
+// accepted).
+type HTTPHeaderEnforcer struct {
+	Name         string
+	DecodeBinary bool
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (hhe HTTPHeaderEnforcer) ExtractLabel(req *http.Request) (string, error) {
+	lvalue := req.Header.Get(hhe.Name)
+	if lvalue == "" {
+		return "", &MissingLabelValueError{Msg: fmt.Sprintf("Bad request. The %q header must be provided.", hhe.Name)}
+	}
+
+	if !hhe.DecodeBinary || !strings.HasSuffix(strings.ToLower(hhe.Name), binaryHeaderSuffix) {
+		return lvalue, nil
+	}
+
+	enc := base64.StdEncoding
+	if !strings.HasSuffix(lvalue, "=") {
+		enc = base64.RawStdEncoding
+	}
+	b, err := enc.DecodeString(lvalue)
+	if err != nil {
+		return "", errors.Wrapf(err, "Bad request. Can't decode the %q header", hhe.Name)
+	}
+	if len(b) == 0 {
+		return "", &MissingLabelValueError{Msg: fmt.Sprintf("Bad request. The %q header must be provided.", hhe.Name)}
+	}
+
+	return string(b), nil
+}
+
+// ConflictPolicy defines how a MultiSourceEnforcer resolves the label values
+// yielded by several sources.
+type ConflictPolicy int
+
+const (
+	// RejectConflicts rejects the requests for which the sources yield
+	// different label values.
+	RejectConflicts ConflictPolicy = iota
+	// PreferSourceOrder uses the label value of the first source yielding
+	// one.
+	PreferSourceOrder
+	// IntersectValues uses the single label value allowed by all the sources
+	// yielding values.
+	IntersectValues
+)
+
+// ParseConflictPolicy returns the conflict policy for the given name (one of
+// "reject", "prefer" or "intersect").
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch s {
+	case "reject":
+		return RejectConflicts, nil
+	case "prefer":
+		return PreferSourceOrder, nil
+	case "intersect":
+		return IntersectValues, nil
+	}
+	return 0, errors.Errorf("invalid conflict policy %q, expected one of reject, prefer or intersect", s)
+}
+
+// LabelValuesExtractor is implemented by the ExtractLabelers which can yield
+// several label values for a request, e.g. all the values an identity has
+// access to.
+type LabelValuesExtractor interface {
+	ExtractLabelValues(req *http.Request) ([]string, error)
+}
+
+// MultiSourceEnforcer extracts the label value from several sources (e.g. a
+// header set by an authenticating proxy and a query parameter) and resolves
+// the conflicts according to Policy. The sources without value are ignored
+// but the request is rejected if any source fails otherwise, whatever the
+// policy. All the sources are always evaluated so that they can remove their
+// parameters from the request.
+//
+// The LabelValuesExtractor sources contribute all their values when the
+// request doesn't select one (e.g. a JWT with several groups). With
+// RejectConflicts, the value of the other sources must be one of them and
+// with PreferSourceOrder, the value of a later source must be one of them.
+// With IntersectValues, the request is forbidden if no value is common to all
+// the sources and it must select one if several are.
+type MultiSourceEnforcer struct {
+	Sources []ExtractLabeler
+	Policy  ConflictPolicy
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (mse MultiSourceEnforcer) ExtractLabel(req *http.Request) (string, error) {
+	var (
+		sets    [][]string
+		missing error
+	)
+	for _, s := range mse.Sources {
+		var (
+			values []string
+			err    error
+		)
+		if lve, ok := s.(LabelValuesExtractor); ok {
+			values, err = lve.ExtractLabelValues(req)
+		} else {
+			var v string
+			v, err = s.ExtractLabel(req)
+			values = []string{v}
+		}
+
+		var mlv *MissingLabelValueError
+		switch {
+		case errors.As(err, &mlv):
+			if missing == nil {
+				missing = err
+			}
+		case err != nil:
+			return "", err
+		default:
+			sets = append(sets, values)
+		}
+	}
+
+	if len(sets) == 0 {
+		if missing == nil {
+			missing = &MissingLabelValueError{Msg: "Bad request. The label value must be provided."}
+		}
+		return "", missing
+	}
+
+	switch mse.Policy {
+	case PreferSourceOrder:
+		// The first source with a single value wins but the sources with
+		// several values coming before it restrict the allowed values.
+		for i, set := range sets {
+			if len(set) > 1 {
+				continue
+			}
+			for _, prev := range sets[:i] {
+				if !contains(prev, set[0]) {
+					return "", &ForbiddenLabelValueError{Msg: fmt.Sprintf("Forbidden. The label value %q isn't allowed.", set[0])}
+				}
+			}
+			return set[0], nil
+		}
+
+	case IntersectValues:
+		values := sets[0]
+		for _, set := range sets[1:] {
+			values = intersect(values, set)
+		}
+		switch len(values) {
+		case 0:
+			return "", &ForbiddenLabelValueError{Msg: "Forbidden. The label value sources have no value in common."}
+		case 1:
+			return values[0], nil
+		}
+
+	default:
+		var lvalue string
+		for _, set := range sets {
+			if len(set) > 1 {
+				continue
+			}
+			if lvalue != "" && set[0] != lvalue {
+				return "", errors.Errorf("Bad request. Conflicting label values %q and %q.", lvalue, set[0])
+			}
+			lvalue = set[0]
+		}
+		if lvalue == "" {
+			break
+		}
+		for _, set := range sets {
+			if !contains(set, lvalue) {
+				return "", errors.Errorf("Bad request. Conflicting label values %q and %q.", lvalue, set)
+			}
+		}
+		return lvalue, nil
+	}
+
+	return "", &MissingLabelValueError{Msg: "Bad request. The request must select one of the allowed label values."}
+}
+
+// contains returns whether v is one of the values.
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// intersect returns the values of a which are in b.
+func intersect(a, b []string) []string {
+	in := make(map[string]struct{}, len(b))
+	for _, v := range b {
+		in[v] = struct{}{}
+	}
+	var res []string
+	for _, v := range a {
+		if _, ok := in[v]; ok {
+			res = append(res, v)
+			delete(in, v)
+		}
+	}
+	return res
+}
+
+// ReloadableExtractLabeler is an ExtractLabeler whose configuration can be
+// reloaded at runtime. When a reload fails (e.g. the configuration is only
+// partially valid), all the requests are denied with 503 until a valid
+// configuration is loaded, rather than enforcing the label with a broken
+// configuration. With KeepPrevious, the previous configuration is kept
+// instead.
+type ReloadableExtractLabeler struct {
+	// KeepPrevious keeps the previous ExtractLabeler when a reload fails
+	// instead of denying all the requests.
+	KeepPrevious bool
+
+	mtx sync.RWMutex
+	el  ExtractLabeler
+	err error
+}
+
+// NewReloadableExtractLabeler returns a ReloadableExtractLabeler delegating
+// to the given ExtractLabeler.
+func NewReloadableExtractLabeler(el ExtractLabeler) *ReloadableExtractLabeler {
+	return &ReloadableExtractLabeler{el: el}
+}
+
+// Reload replaces the ExtractLabeler with the one returned by load. If load
+// fails, the requests are denied unless KeepPrevious is set, and the error is
+// returned.
+func (r *ReloadableExtractLabeler) Reload(load func() (ExtractLabeler, error)) error {
+	el, err := load()
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if err != nil {
+		if !r.KeepPrevious || r.el == nil {
+			r.err = err
+		}
+		return err
+	}
+	r.el, r.err = el, nil
+	return nil
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (r *ReloadableExtractLabeler) ExtractLabel(req *http.Request) (string, error) {
+	el, err := r.current()
+	if err != nil {
+		return "", err
+	}
+	return el.ExtractLabel(req)
+}
+
+// ExtractLabelValues implements the LabelValuesExtractor interface.
+func (r *ReloadableExtractLabeler) ExtractLabelValues(req *http.Request) ([]string, error) {
+	el, err := r.current()
+	if err != nil {
+		return nil, err
+	}
+	return extractLabelValues(el, req)
+}
+
+// Snapshot returns an ExtractLabeler delegating to el instead of the current
+// configuration, so that routes built for el keep extracting the value the way
+// they were configured while the reloads swap the configuration. Like the
+// ReloadableExtractLabeler, it denies the requests after a failed reload.
+func (r *ReloadableExtractLabeler) Snapshot(el ExtractLabeler) ExtractLabeler {
+	return &snapshotExtractLabeler{r: r, el: el}
+}
+
+type snapshotExtractLabeler struct {
+	r  *ReloadableExtractLabeler
+	el ExtractLabeler
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (s *snapshotExtractLabeler) ExtractLabel(req *http.Request) (string, error) {
+	if _, err := s.r.current(); err != nil {
+		return "", err
+	}
+	return s.el.ExtractLabel(req)
+}
+
+// ExtractLabelValues implements the LabelValuesExtractor interface.
+func (s *snapshotExtractLabeler) ExtractLabelValues(req *http.Request) ([]string, error) {
+	if _, err := s.r.current(); err != nil {
+		return nil, err
+	}
+	return extractLabelValues(s.el, req)
+}
+
+// extractLabelValues returns the label values extracted by el.
+func extractLabelValues(el ExtractLabeler, req *http.Request) ([]string, error) {
+	if lve, ok := el.(LabelValuesExtractor); ok {
+		return lve.ExtractLabelValues(req)
+	}
+	v, err := el.ExtractLabel(req)
+	if err != nil {
+		return nil, err
+	}
+	return []string{v}, nil
+}
+
+func (r *ReloadableExtractLabeler) current() (ExtractLabeler, error) {
+	r.mtx.RLock()
+	el, err := r.el, r.err
+	r.mtx.RUnlock()
+
+	if err != nil {
+		return nil, &UnavailableError{Msg: fmt.Sprintf("Service unavailable. The label extraction configuration is invalid: %v", err)}
+	}
+	if el == nil {
+		return nil, &UnavailableError{Msg: "Service unavailable. The label extraction isn't configured."}
+	}
+	return el, nil
+}
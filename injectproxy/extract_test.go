@@ -0,0 +1,535 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHTTPHeaderEnforcer(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		el      HTTPHeaderEnforcer
+		headers map[string]string
+
+		expErr   bool
+		expValue string
+	}{
+		{
+			name:   "missing header",
+			el:     HTTPHeaderEnforcer{Name: "grpc-metadata-tenant"},
+			expErr: true,
+		},
+		{
+			name:     "gRPC-Web metadata header",
+			el:       HTTPHeaderEnforcer{Name: "grpc-metadata-tenant"},
+			headers:  map[string]string{"Grpc-Metadata-Tenant": "default"},
+			expValue: "default",
+		},
+		{
+			name:     "binary header without decoding",
+			el:       HTTPHeaderEnforcer{Name: "tenant-bin"},
+			headers:  map[string]string{"tenant-bin": "ZGVmYXVsdA=="},
+			expValue: "ZGVmYXVsdA==",
+		},
+		{
+			name:     "padded binary header",
+			el:       HTTPHeaderEnforcer{Name: "tenant-bin", DecodeBinary: true},
+			headers:  map[string]string{"tenant-bin": "ZGVmYXVsdA=="},
+			expValue: "default",
+		},
+		{
+			name:     "unpadded binary header",
+			el:       HTTPHeaderEnforcer{Name: "Tenant-Bin", DecodeBinary: true},
+			headers:  map[string]string{"tenant-bin": "ZGVmYXVsdA"},
+			expValue: "default",
+		},
+		{
+			name:     "non-binary header with decoding",
+			el:       HTTPHeaderEnforcer{Name: "tenant", DecodeBinary: true},
+			headers:  map[string]string{"tenant": "ZGVmYXVsdA"},
+			expValue: "ZGVmYXVsdA",
+		},
+		{
+			name:    "invalid binary header",
+			el:      HTTPHeaderEnforcer{Name: "tenant-bin", DecodeBinary: true},
+			headers: map[string]string{"tenant-bin": "not base64!"},
+			expErr:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/query", nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+
+			v, err := tc.el.ExtractLabel(req)
+			if tc.expErr {
+				if err == nil {
+					t.Fatalf("expected error, got value %q", v)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if v != tc.expValue {
+				t.Fatalf("expected value %q, got %q", tc.expValue, v)
+			}
+		})
+	}
+}
+
+func TestWithExtractLabeler(t *testing.T) {
+	m := newMockUpstream(checkQueryHandler("", queryParam, `up{namespace="default"}`))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, WithExtractLabeler(HTTPHeaderEnforcer{Name: "grpc-metadata-tenant-bin", DecodeBinary: true}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		header  string
+		expCode int
+	}{
+		{
+			expCode: http.StatusBadRequest,
+		},
+		{
+			header:  "ZGVmYXVsdA",
+			expCode: http.StatusOK,
+		},
+	} {
+		u, err := url.Parse("http://prometheus.example.com/api/v1/query")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		q := u.Query()
+		q.Set(queryParam, "up")
+		// The query parameter is ignored.
+		q.Set(proxyLabel, "other")
+		u.RawQuery = q.Encode()
+
+		req := httptest.NewRequest("GET", u.String(), nil)
+		if tc.header != "" {
+			req.Header.Set("grpc-metadata-tenant-bin", tc.header)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		resp := w.Result()
+		if resp.StatusCode != tc.expCode {
+			body, _ := ioutil.ReadAll(resp.Body)
+			t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+		}
+	}
+}
+
+func TestNoScopeStatusCode(t *testing.T) {
+	m := newMockUpstream(checkQueryHandler("", queryParam, `up{namespace="default"}`))
+	defer m.Close()
+
+	if _, err := NewRoutes(m.url, proxyLabel, WithNoScopeStatusCode(http.StatusNotFound)); err == nil {
+		t.Fatalf("expected error for invalid status code")
+	}
+
+	for _, tc := range []struct {
+		name    string
+		opts    []Option
+		header  string
+		expCode int
+	}{
+		{
+			name:    "default status code",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "unauthorized",
+			opts:    []Option{WithNoScopeStatusCode(http.StatusUnauthorized)},
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "forbidden",
+			opts:    []Option{WithNoScopeStatusCode(http.StatusForbidden)},
+			expCode: http.StatusForbidden,
+		},
+		{
+			name: "invalid value isn't a missing value",
+			opts: []Option{
+				WithNoScopeStatusCode(http.StatusForbidden),
+				WithExtractLabeler(HTTPHeaderEnforcer{Name: "grpc-metadata-tenant-bin", DecodeBinary: true}),
+			},
+			header:  "!!!",
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/query?query=up", nil)
+			if tc.header != "" {
+				req.Header.Set("grpc-metadata-tenant-bin", tc.header)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				body, _ := ioutil.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestAllowedLabelValues(t *testing.T) {
+	m := newMockUpstream(checkQueryHandler("", queryParam, `up{namespace="default"}`))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name    string
+		allowed []string
+		labelv  string
+		header  string
+		expCode int
+	}{
+		{
+			name:    "allowed value",
+			allowed: []string{"other", "default"},
+			labelv:  "default",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "disallowed value",
+			allowed: []string{"other"},
+			labelv:  "default",
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "no allowed value",
+			allowed: []string{},
+			labelv:  "default",
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "missing value",
+			allowed: []string{"default"},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "disallowed value from a trusted header",
+			allowed: []string{"default"},
+			header:  "garbage",
+			expCode: http.StatusForbidden,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			opts := []Option{WithAllowedLabelValues(tc.allowed)}
+			if tc.header != "" {
+				opts = append(opts, WithExtractLabeler(HTTPHeaderEnforcer{Name: "X-Tenant"}))
+			}
+			r, err := NewRoutes(m.url, proxyLabel, opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/query?query=up&"+proxyLabel+"="+tc.labelv, nil)
+			if tc.header != "" {
+				req.Header.Set("X-Tenant", tc.header)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				body, _ := ioutil.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestMultiSourceEnforcer(t *testing.T) {
+	header := HTTPHeaderEnforcer{Name: "X-Tenant"}
+	param := HTTPFormEnforcer{ParameterName: "tenant"}
+	resolving := ResolvingEnforcer{
+		Identity: HTTPHeaderEnforcer{Name: "X-User"},
+		Resolver: &staticResolver{values: map[string][]string{
+			"alice": {"a"},
+			"bob":   {"a", "b"},
+		}},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		sources []ExtractLabeler
+		policy  ConflictPolicy
+		headers map[string]string
+		param   string
+
+		expErr   interface{}
+		expValue string
+	}{
+		{
+			name:    "no value",
+			sources: []ExtractLabeler{header, param},
+			expErr:  &MissingLabelValueError{},
+		},
+		{
+			name:     "single source",
+			sources:  []ExtractLabeler{header, param},
+			param:    "a",
+			expValue: "a",
+		},
+		{
+			name:     "same values",
+			sources:  []ExtractLabeler{header, param},
+			headers:  map[string]string{"X-Tenant": "a"},
+			param:    "a",
+			expValue: "a",
+		},
+		{
+			name:    "conflicting values rejected by default",
+			sources: []ExtractLabeler{header, param},
+			headers: map[string]string{"X-Tenant": "a"},
+			param:   "b",
+			expErr:  true,
+		},
+		{
+			name:     "conflicting values with source order",
+			sources:  []ExtractLabeler{header, param},
+			policy:   PreferSourceOrder,
+			headers:  map[string]string{"X-Tenant": "a"},
+			param:    "b",
+			expValue: "a",
+		},
+		{
+			name:     "conflicting values with reversed source order",
+			sources:  []ExtractLabeler{param, header},
+			policy:   PreferSourceOrder,
+			headers:  map[string]string{"X-Tenant": "a"},
+			param:    "b",
+			expValue: "b",
+		},
+		{
+			name:    "conflicting values intersected",
+			sources: []ExtractLabeler{header, param},
+			policy:  IntersectValues,
+			headers: map[string]string{"X-Tenant": "a"},
+			param:   "b",
+			expErr:  &ForbiddenLabelValueError{},
+		},
+		{
+			name:     "allowed values intersected with a header",
+			sources:  []ExtractLabeler{resolving, header},
+			policy:   IntersectValues,
+			headers:  map[string]string{"X-User": "bob", "X-Tenant": "b"},
+			expValue: "b",
+		},
+		{
+			name:    "allowed values intersected with a forbidden header",
+			sources: []ExtractLabeler{resolving, header},
+			policy:  IntersectValues,
+			headers: map[string]string{"X-User": "alice", "X-Tenant": "b"},
+			expErr:  &ForbiddenLabelValueError{},
+		},
+		{
+			name:    "several allowed values without selection",
+			sources: []ExtractLabeler{resolving, header},
+			policy:  IntersectValues,
+			headers: map[string]string{"X-User": "bob"},
+			expErr:  &MissingLabelValueError{},
+		},
+		{
+			name:     "several allowed values with a header among them",
+			sources:  []ExtractLabeler{resolving, header},
+			headers:  map[string]string{"X-User": "bob", "X-Tenant": "b"},
+			expValue: "b",
+		},
+		{
+			name:    "several allowed values with a conflicting header",
+			sources: []ExtractLabeler{resolving, header},
+			headers: map[string]string{"X-User": "bob", "X-Tenant": "c"},
+			expErr:  true,
+		},
+		{
+			name:    "several allowed values without selection rejected by default",
+			sources: []ExtractLabeler{resolving, header},
+			headers: map[string]string{"X-User": "bob"},
+			expErr:  &MissingLabelValueError{},
+		},
+		{
+			name:     "several allowed values with a header with source order",
+			sources:  []ExtractLabeler{resolving, header},
+			policy:   PreferSourceOrder,
+			headers:  map[string]string{"X-User": "bob", "X-Tenant": "b"},
+			expValue: "b",
+		},
+		{
+			name:    "several allowed values with a conflicting header with source order",
+			sources: []ExtractLabeler{resolving, header},
+			policy:  PreferSourceOrder,
+			headers: map[string]string{"X-User": "bob", "X-Tenant": "c"},
+			expErr:  &ForbiddenLabelValueError{},
+		},
+		{
+			name:    "failing source",
+			sources: []ExtractLabeler{header, resolving},
+			policy:  PreferSourceOrder,
+			headers: map[string]string{"X-User": "eve", "X-Tenant": "a"},
+			expErr:  &ForbiddenLabelValueError{},
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			u := "http://prometheus.example.com/api/v1/query"
+			if tc.param != "" {
+				u += "?tenant=" + tc.param
+			}
+			req := httptest.NewRequest("GET", u, nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+
+			v, err := MultiSourceEnforcer{Sources: tc.sources, Policy: tc.policy}.ExtractLabel(req)
+			if req.URL.Query().Get("tenant") != "" {
+				t.Fatalf("expected the tenant parameter to be removed, got %q", req.URL.RawQuery)
+			}
+			if tc.expErr != nil {
+				if err == nil {
+					t.Fatalf("expected error, got value %q", v)
+				}
+				switch tc.expErr.(type) {
+				case *MissingLabelValueError:
+					if _, ok := err.(*MissingLabelValueError); !ok {
+						t.Fatalf("expected MissingLabelValueError, got %T: %v", err, err)
+					}
+				case *ForbiddenLabelValueError:
+					if _, ok := err.(*ForbiddenLabelValueError); !ok {
+						t.Fatalf("expected ForbiddenLabelValueError, got %T: %v", err, err)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if v != tc.expValue {
+				t.Fatalf("expected value %q, got %q", tc.expValue, v)
+			}
+		})
+	}
+}
+
+func TestReloadableExtractLabeler(t *testing.T) {
+	m := newMockUpstream(checkQueryHandler("", queryParam, `up{namespace="default"}`))
+	defer m.Close()
+
+	valid := func() (ExtractLabeler, error) {
+		return HTTPHeaderEnforcer{Name: "X-Tenant"}, nil
+	}
+	invalid := func() (ExtractLabeler, error) {
+		return nil, errors.New("missing header name")
+	}
+
+	for _, tc := range []struct {
+		name         string
+		keepPrevious bool
+		reloads      []func() (ExtractLabeler, error)
+
+		expCode int
+	}{
+		{
+			name:    "valid reload",
+			reloads: []func() (ExtractLabeler, error){valid},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "invalid reload",
+			reloads: []func() (ExtractLabeler, error){invalid},
+			expCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:    "valid reload after an invalid one",
+			reloads: []func() (ExtractLabeler, error){invalid, valid},
+			expCode: http.StatusOK,
+		},
+		{
+			name:         "invalid reload keeping the previous configuration",
+			keepPrevious: true,
+			reloads:      []func() (ExtractLabeler, error){valid, invalid},
+			expCode:      http.StatusOK,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			el := NewReloadableExtractLabeler(HTTPFormEnforcer{ParameterName: proxyLabel})
+			el.KeepPrevious = tc.keepPrevious
+			r, err := NewRoutes(m.url, proxyLabel, WithExtractLabeler(el))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for _, reload := range tc.reloads {
+				el.Reload(reload)
+			}
+
+			req := httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/query?query=up", nil)
+			req.Header.Set("X-Tenant", "default")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestReloadableExtractLabelerSnapshot(t *testing.T) {
+	m := newMockUpstream(checkQueryHandler("", queryParam, `up{namespace="default"}`))
+	defer m.Close()
+
+	el := NewReloadableExtractLabeler(nil)
+	el.Reload(func() (ExtractLabeler, error) { return HTTPFormEnforcer{ParameterName: proxyLabel}, nil })
+	r, err := NewRoutes(m.url, proxyLabel, WithExtractLabeler(el.Snapshot(HTTPFormEnforcer{ParameterName: proxyLabel})))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	query := func() int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/query?query=up&"+proxyLabel+"=default", nil))
+		return w.Code
+	}
+
+	// The routes keep their configuration when another one is loaded.
+	el.Reload(func() (ExtractLabeler, error) { return HTTPHeaderEnforcer{Name: "X-Tenant"}, nil })
+	if code := query(); code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, code)
+	}
+
+	// The requests are denied when a reload fails.
+	el.Reload(func() (ExtractLabeler, error) { return nil, errors.New("missing header name") })
+	if code := query(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status code %d, got %d", http.StatusServiceUnavailable, code)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// textFormat is the media type of the Prometheus text exposition format.
+const textFormat = "text/plain;version=0.0.4"
+
+// federate ensures that the match[] selectors of /federate have the label
+// injected. When the response is filtered, the text exposition format is
+// requested from the upstream since it's the only one that can be filtered.
+func (r *routes) federate(w http.ResponseWriter, req *http.Request) {
+	if r.filterFederate {
+		req.Header.Set("Accept", textFormat)
+	}
+	r.matcher(w, req)
+}
+
+// filterFederation drops the samples of the /federate response which don't
+// have the enforced label value, in case the upstream ignores the selectors.
+// The comment lines (HELP and TYPE) are kept. The response is filtered line by
+// line without being buffered since it can be large.
+func (r *routes) filterFederation(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	if mt, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err != nil || mt != "text/plain" {
+		return errors.Errorf("unexpected content type for the federation response: %q", resp.Header.Get("Content-Type"))
+	}
+
+	reader, err := bodyReader(resp)
+	if err == errEmptyResponse {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	lvalue := mustLabelValue(resp.Request.Context())
+	matchers := mustEnforcedMatchers(resp.Request.Context())
+	ctx := resp.Request.Context()
+	setDropped := r.announceFilteringTrailers(resp, lvalue)
+	pr, pw := io.Pipe()
+	body := resp.Body
+	go func() {
+		defer body.Close()
+		defer reader.Close()
+		before, after, err := r.filterExposition(pw, reader, matchers)
+		if err == nil {
+			r.recordFiltering(ctx, "federate", lvalue, before, after)
+			setDropped(before - after)
+		}
+		pw.CloseWithError(err)
+	}()
+
+	resp.Body = pr
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	return nil
+}
+
+// filterExposition copies the lines of the text exposition format from src to
+// dst, except the samples which don't match the enforced matchers. It returns
+// the number of samples before and after filtering.
+func (r *routes) filterExposition(dst io.Writer, src io.Reader, matchers []*labels.Matcher) (before, after int, err error) {
+	bw := bufio.NewWriter(dst)
+	br := bufio.NewReader(src)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return 0, 0, err
+		}
+		if line == "" {
+			break
+		}
+
+		keep := true
+		if s := strings.TrimSpace(line); s != "" && !strings.HasPrefix(s, "#") {
+			before++
+			ok, perr := sampleMatches(s, matchers)
+			if perr != nil {
+				r.debugf("dropping invalid federated sample %q: %v", s, perr)
+			}
+			if keep = perr == nil && ok; keep {
+				after++
+			}
+		}
+		if keep {
+			if _, err := bw.WriteString(line); err != nil {
+				return 0, 0, err
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return 0, 0, err
+	}
+	return before, after, nil
+}
+
+// sampleMatches returns whether the labels of a sample line of the text
+// exposition format match all the matchers. A missing label has an empty value.
+func sampleMatches(line string, matchers []*labels.Matcher) (bool, error) {
+	for _, m := range matchers {
+		v, _, err := sampleLabelValue(line, m.Name)
+		if err != nil {
+			return false, err
+		}
+		if !m.Matches(v) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// sampleLabelValue returns the value of the label of a sample line of the
+// text exposition format, e.g. `up{job="prometheus",namespace="default"} 1`.
+func sampleLabelValue(line, name string) (string, bool, error) {
+	i := strings.IndexAny(line, "{ \t")
+	if i < 0 || line[i] != '{' {
+		// The sample has no labels.
+		return "", false, nil
+	}
+
+	s := line[i+1:]
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if strings.HasPrefix(s, "}") {
+			return "", false, nil
+		}
+
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return "", false, errors.New("missing '=' after label name")
+		}
+		lname := strings.TrimSpace(s[:eq])
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		if !strings.HasPrefix(s, `"`) {
+			return "", false, errors.Errorf("expected a quoted value for label %q", lname)
+		}
+
+		var (
+			b   strings.Builder
+			end = -1
+		)
+		for j := 1; j < len(s); j++ {
+			if s[j] == '"' {
+				end = j
+				break
+			}
+			if s[j] == '\\' && j+1 < len(s) {
+				j++
+				switch s[j] {
+				case 'n':
+					b.WriteByte('\n')
+				default:
+					b.WriteByte(s[j])
+				}
+				continue
+			}
+			b.WriteByte(s[j])
+		}
+		if end < 0 {
+			return "", false, errors.Errorf("unterminated value for label %q", lname)
+		}
+		if lname == name {
+			return b.String(), true, nil
+		}
+
+		s = strings.TrimLeft(s[end+1:], " \t")
+		s = strings.TrimPrefix(s, ",")
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const federation = `# HELP up Whether the target is up.
+# TYPE up gauge
+up{instance="a",job="prometheus",namespace="default"} 1 1600000000000
+up{instance="b",job="prometheus",namespace="other"} 1 1600000000000
+up{instance="c",job="prometheus"} 0 1600000000000
+up 1 1600000000000
+# TYPE http_requests_total counter
+http_requests_total{handler="/a,\"b\"",namespace="default"} 10 1600000000000
+http_requests_total{handler="/a",namespace="default-2"} 10 1600000000000
+http_requests_total{namespace="default",handler="/b"} 10
+invalid{namespace="default 1
+`
+
+func TestFederationFiltering(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		opts        []Option
+
+		expCode int
+		expBody string
+	}{
+		{
+			name:        "filtered",
+			contentType: "text/plain; version=0.0.4; charset=utf-8",
+			opts:        []Option{WithFederationFiltering()},
+			expCode:     http.StatusOK,
+			expBody: `# HELP up Whether the target is up.
+# TYPE up gauge
+up{instance="a",job="prometheus",namespace="default"} 1 1600000000000
+# TYPE http_requests_total counter
+http_requests_total{handler="/a,\"b\"",namespace="default"} 10 1600000000000
+http_requests_total{namespace="default",handler="/b"} 10
+`,
+		},
+		{
+			name:        "not filtered",
+			contentType: "text/plain; version=0.0.4; charset=utf-8",
+			expCode:     http.StatusOK,
+			expBody:     federation,
+		},
+		{
+			name:        "unexpected content type",
+			contentType: "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited",
+			opts:        []Option{WithFederationFiltering()},
+			expCode:     http.StatusBadGateway,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				exp := []string{`{__name__="up",namespace="default"}`, `{job="prometheus",namespace="default"}`}
+				if got := req.URL.Query()[matchersParam]; !reflect.DeepEqual(got, exp) {
+					t.Errorf("expected selectors %v, got %v", exp, got)
+				}
+				if len(tc.opts) > 0 && req.Header.Get("Accept") != textFormat {
+					t.Errorf("expected Accept header %q, got %q", textFormat, req.Header.Get("Accept"))
+				}
+				w.Header().Set("Content-Type", tc.contentType)
+				w.Write([]byte(federation))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{proxyLabel: {"default"}, matchersParam: {`up`, `{job="prometheus"}`}}
+			req := httptest.NewRequest("GET", "http://prometheus.example.com/federate?"+q.Encode(), nil)
+			req.Header.Set("Accept", "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if tc.expCode != http.StatusOK {
+				return
+			}
+			if got := resp.Header.Get("Content-Type"); got != tc.contentType {
+				t.Errorf("expected Content-Type %q, got %q", tc.contentType, got)
+			}
+			if string(body) != tc.expBody {
+				t.Fatalf("expected body\n%s\ngot\n%s", tc.expBody, string(body))
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	grafanaQueryPath = "/api/ds/query"
+	grafanaLivePath  = "/api/live/ws"
+)
+
+// grafanaQuery enforces the label on the queries of the Grafana datasource
+// query endpoint. The body looks like:
+//
+//	{"queries": [{"refId": "A", "expr": "up", ...}], "from": "now-1h", "to": "now"}
+//
+// Only the expr fields are modified, the other fields are forwarded as-is. The
+// request is rejected if a query has no PromQL expression (e.g. a server-side
+// expression or another datasource) since it couldn't be enforced.
+func (r *routes) grafanaQuery(w http.ResponseWriter, req *http.Request) {
+	e := r.newEnforcer(req.Context())
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad request: can't read body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: can't decode body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := enforceGrafanaQueries(e, doc); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Body = ioutil.NopCloser(&buf)
+	req.ContentLength = int64(buf.Len())
+
+	r.handler.ServeHTTP(w, req)
+}
+
+func enforceGrafanaQueries(e *Enforcer, doc map[string]interface{}) error {
+	queries, ok := doc["queries"].([]interface{})
+	if !ok || len(queries) == 0 {
+		return errors.New("missing queries")
+	}
+
+	for i, q := range queries {
+		query, ok := q.(map[string]interface{})
+		if !ok {
+			return errors.Errorf("queries[%d]: expected an object, got %T", i, q)
+		}
+		expr, ok := query["expr"].(string)
+		if !ok || expr == "" {
+			return errors.Errorf("queries[%d]: missing PromQL expression", i)
+		}
+		enforced, err := enforceQuery(e, expr)
+		if err != nil {
+			return errors.Wrapf(err, "queries[%d]", i)
+		}
+		query["expr"] = enforced
+	}
+	return nil
+}
+
+// webSocket returns a handler forwarding the WebSocket upgrade requests to h,
+// e.g. for the Grafana Live connections. The label value is validated on the
+// upgrade request but the messages exchanged over the connection aren't
+// enforced. Other requests are rejected.
+func webSocket(h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !isWebSocketUpgrade(req) {
+			http.Error(w, "bad request: expected a WebSocket upgrade request", http.StatusBadRequest)
+			return
+		}
+		h.ServeHTTP(w, req)
+	}
+}
+
+// isWebSocketUpgrade returns whether the request asks to upgrade the
+// connection to the WebSocket protocol.
+func isWebSocketUpgrade(req *http.Request) bool {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range req.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGrafanaQuery(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body string
+
+		expCode int
+		expBody string
+	}{
+		{
+			name:    "queries",
+			body:    `{"queries":[{"refId":"A","expr":"rate(http_requests_total[5m])","intervalMs":15000,"datasource":{"uid":"prom"}},{"refId":"B","expr":"up{namespace=\"other\"}"}],"from":"now-1h","to":"now"}`,
+			expCode: http.StatusOK,
+			expBody: `{"from":"now-1h","queries":[{"datasource":{"uid":"prom"},"expr":"rate(http_requests_total{namespace=\"default\"}[5m])","intervalMs":15000,"refId":"A"},{"expr":"up{namespace=\"default\"}","refId":"B"}],"to":"now"}`,
+		},
+		{
+			name:    "query without expression",
+			body:    `{"queries":[{"refId":"A","expr":"up"},{"refId":"B","type":"math","expression":"$A * 2"}]}`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "no queries",
+			body:    `{"queries":[]}`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid expression",
+			body:    `{"queries":[{"refId":"A","expr":"up{"}]}`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid body",
+			body:    `{"queries":`,
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				body, _ := ioutil.ReadAll(req.Body)
+				if got := strings.TrimSpace(string(body)); got != tc.expBody {
+					t.Errorf("expected body %s, got %s", tc.expBody, got)
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, WithGrafanaQueries())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "http://grafana.example.com/api/ds/query?"+proxyLabel+"=default", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			t.Error("unexpected request to the upstream")
+		}))
+		defer m.Close()
+
+		r, err := NewRoutes(m.url, proxyLabel)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://grafana.example.com/api/ds/query?"+proxyLabel+"=default", strings.NewReader(`{"queries":[]}`)))
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected status code %d, got %d", http.StatusNotFound, w.Code)
+		}
+	})
+}
+
+// echoWebSocket is an upstream accepting the WebSocket upgrades and echoing
+// the lines sent over the connection.
+func echoWebSocket(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get(proxyLabel) != "" {
+			t.Errorf("expected the label parameter to be removed, got %q", req.URL.RawQuery)
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+		for {
+			line, err := rw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			rw.WriteString(line)
+			rw.Flush()
+		}
+	})
+}
+
+func TestGrafanaLive(t *testing.T) {
+	m := newMockUpstream(echoWebSocket(t))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, WithGrafanaLive())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	proxy := httptest.NewServer(r)
+	defer proxy.Close()
+
+	for _, tc := range []struct {
+		name    string
+		query   string
+		headers string
+
+		expCode int
+	}{
+		{
+			name:    "upgrade",
+			query:   "?" + proxyLabel + "=default",
+			headers: "Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n",
+			expCode: http.StatusSwitchingProtocols,
+		},
+		{
+			name:    "upgrade without label value",
+			headers: "Upgrade: websocket\r\nConnection: Upgrade\r\n",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "no upgrade",
+			query:   "?" + proxyLabel + "=default",
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			fmt.Fprintf(conn, "GET %s%s HTTP/1.1\r\nHost: grafana.example.com\r\n%s\r\n", grafanaLivePath, tc.query, tc.headers)
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
+			}
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				return
+			}
+
+			// The upgraded connection is passed through as-is.
+			for _, msg := range []string{"hello\n", "world\n"} {
+				if _, err := conn.Write([]byte(msg)); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				got, err := br.ReadString('\n')
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if got != msg {
+					t.Fatalf("expected %q, got %q", msg, got)
+				}
+			}
+		})
+	}
+}
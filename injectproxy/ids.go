@@ -0,0 +1,98 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	amalert "github.com/prometheus/alertmanager/api/v2/client/alert"
+)
+
+const fingerprintParam = "fingerprint"
+
+// idLabelsResolver resolves IDs to the label sets of the objects they
+// identify. IDs which can't be found are omitted from the returned map.
+type idLabelsResolver func(ctx context.Context, ids []string) (map[string]map[string]string, error)
+
+// enforceIDs returns a handler for endpoints taking a list of IDs in the
+// param query parameter, where the IDs don't carry the enforced label. Each
+// ID is resolved to its labels and only the IDs matching all the enforced
+// labels are forwarded. Requests without any ID in scope are rejected since
+// forwarding them without IDs could select everything.
+func (r *routes) enforceIDs(param string, resolve idLabelsResolver) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		ids := q[param]
+		if len(ids) == 0 {
+			http.Error(w, fmt.Sprintf("bad request: the %q parameter must be provided", param), http.StatusBadRequest)
+			return
+		}
+
+		resolved, err := resolve(req.Context(), ids)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("proxy error: can't resolve %s: %v", param, err), http.StatusBadGateway)
+			return
+		}
+
+		var (
+			enforced = enforcedLabels(req.Context())
+			filtered []string
+		)
+		for _, id := range ids {
+			lset, ok := resolved[id]
+			if !ok || !enforced.matchLabels(lset) {
+				continue
+			}
+			filtered = append(filtered, id)
+		}
+		if len(filtered) == 0 {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		q[param] = filtered
+		req.URL.RawQuery = q.Encode()
+
+		r.handler.ServeHTTP(w, req)
+	}
+}
+
+// resolveAlertFingerprints resolves alert fingerprints to the labels of the
+// alerts from the Alertmanager API.
+func (r *routes) resolveAlertFingerprints(ctx context.Context, fingerprints []string) (map[string]map[string]string, error) {
+	wanted := make(map[string]struct{}, len(fingerprints))
+	for _, fp := range fingerprints {
+		wanted[fp] = struct{}{}
+	}
+
+	alerts, err := r.alertmanagerClient().Alert.GetAlerts(amalert.NewGetAlertsParams().WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := make(map[string]map[string]string, len(fingerprints))
+	for _, a := range alerts.Payload {
+		if a.Fingerprint == nil {
+			continue
+		}
+		if _, ok := wanted[*a.Fingerprint]; !ok {
+			continue
+		}
+		resolved[*a.Fingerprint] = a.Labels
+	}
+
+	return resolved, nil
+}
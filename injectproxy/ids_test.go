@@ -0,0 +1,97 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAlertsByFingerprint(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		fingerprints []string
+		team         string
+
+		expCode         int
+		expFingerprints []string
+	}{
+		{
+			name:    "no fingerprint",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:            "fingerprint in scope",
+			fingerprints:    []string{"0f5bcb00b9e5a2c5"},
+			expCode:         http.StatusOK,
+			expFingerprints: []string{"0f5bcb00b9e5a2c5"},
+		},
+		{
+			name:            "fingerprints in and out of scope",
+			fingerprints:    []string{"0f5bcb00b9e5a2c5", "7c9e5bd3e1c6a3f4", "unknown"},
+			expCode:         http.StatusOK,
+			expFingerprints: []string{"0f5bcb00b9e5a2c5"},
+		},
+		{
+			name:         "fingerprints out of scope",
+			fingerprints: []string{"7c9e5bd3e1c6a3f4", "unknown"},
+			expCode:      http.StatusForbidden,
+		},
+		{
+			name:         "fingerprint matching the label but not the additional label",
+			fingerprints: []string{"0f5bcb00b9e5a2c5"},
+			team:         "x",
+			expCode:      http.StatusForbidden,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.Handle("/api/v2/alerts", checkFiltersHandler())
+			mux.Handle("/api/v2/alert-annotations", checkQueryHandler("", fingerprintParam, tc.expFingerprints...))
+			m := newMockUpstream(mux)
+			defer m.Close()
+
+			opts := []Option{WithAlertsByFingerprintPath("/api/v2/alert-annotations")}
+			if tc.team != "" {
+				opts = append(opts, WithAdditionalLabel("team", HTTPHeaderEnforcer{Name: "X-Team"}))
+			}
+			r, err := NewRoutes(m.url, proxyLabel, opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{}
+			for _, fp := range tc.fingerprints {
+				q.Add(fingerprintParam, fp)
+			}
+			q.Set(proxyLabel, "default")
+
+			req := httptest.NewRequest(http.MethodGet, "http://alertmanager.example.com/api/v2/alert-annotations?"+q.Encode(), nil)
+			if tc.team != "" {
+				req.Header.Set("X-Team", tc.team)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
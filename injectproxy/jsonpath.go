@@ -0,0 +1,259 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// jsonPath is a JSONPath expression supporting the root ($), child (.name or
+// ["name"]) and wildcard (.* or [*]) operators, e.g. `$.groups[*]["match[]"]`.
+type jsonPath struct {
+	expr     string
+	segments []jsonPathSegment
+}
+
+type jsonPathSegment struct {
+	name     string
+	wildcard bool
+}
+
+func parseJSONPath(expr string) (*jsonPath, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, errors.Errorf("invalid JSONPath %q: must start with $", expr)
+	}
+
+	p := &jsonPath{expr: expr}
+	s := expr[1:]
+	for s != "" {
+		switch {
+		case strings.HasPrefix(s, "[*]"):
+			p.segments = append(p.segments, jsonPathSegment{wildcard: true})
+			s = s[3:]
+
+		case strings.HasPrefix(s, `["`), strings.HasPrefix(s, `['`):
+			end := strings.Index(s[2:], s[1:2]+"]")
+			if end < 0 {
+				return nil, errors.Errorf("invalid JSONPath %q: unterminated name", expr)
+			}
+			p.segments = append(p.segments, jsonPathSegment{name: s[2 : 2+end]})
+			s = s[2+end+2:]
+
+		case strings.HasPrefix(s, "."):
+			end := strings.IndexAny(s[1:], ".[")
+			if end < 0 {
+				end = len(s) - 1
+			}
+			name := s[1 : 1+end]
+			switch name {
+			case "":
+				return nil, errors.Errorf("invalid JSONPath %q: empty name", expr)
+			case "*":
+				p.segments = append(p.segments, jsonPathSegment{wildcard: true})
+			default:
+				p.segments = append(p.segments, jsonPathSegment{name: name})
+			}
+			s = s[1+end:]
+
+		default:
+			return nil, errors.Errorf("invalid JSONPath %q: unexpected %q", expr, s)
+		}
+	}
+	return p, nil
+}
+
+func (p *jsonPath) String() string {
+	return p.expr
+}
+
+// apply replaces the values of the document v selected by the path with the
+// result of f. It fails if a selected field is missing or if a value doesn't
+// have the expected type.
+func (p *jsonPath) apply(v interface{}, f func(interface{}) (interface{}, error)) (interface{}, error) {
+	return applySegments(v, p.segments, f)
+}
+
+func applySegments(v interface{}, segments []jsonPathSegment, f func(interface{}) (interface{}, error)) (interface{}, error) {
+	if len(segments) == 0 {
+		return f(v)
+	}
+
+	seg, rest := segments[0], segments[1:]
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if !seg.wildcard {
+			child, ok := v[seg.name]
+			if !ok {
+				return nil, errors.Errorf("missing field %q", seg.name)
+			}
+			nv, err := applySegments(child, rest, f)
+			if err != nil {
+				return nil, err
+			}
+			v[seg.name] = nv
+			return v, nil
+		}
+		for k, child := range v {
+			nv, err := applySegments(child, rest, f)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = nv
+		}
+		return v, nil
+
+	case []interface{}:
+		if !seg.wildcard {
+			return nil, errors.Errorf("expected an object with the %q field, got an array", seg.name)
+		}
+		for i, child := range v {
+			nv, err := applySegments(child, rest, f)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = nv
+		}
+		return v, nil
+	}
+
+	if seg.wildcard {
+		return nil, errors.Errorf("expected an array or an object, got %T", v)
+	}
+	return nil, errors.Errorf("expected an object with the %q field, got %T", seg.name, v)
+}
+
+// jsonSelectors enforces the label on the series selectors of a JSON request
+// body (e.g. a batch of series requests). The path selects the arrays of
+// selectors (or single selectors) in the body. The request is rejected if any
+// of them is missing or empty, or if the path selects nothing since the
+// upstream would then match all the series.
+func (r *routes) jsonSelectors(path *jsonPath) http.HandlerFunc {
+	return r.enforceJSONBody(path, "selector", r.maxMatchSelectors, func(req *http.Request) func(string) (string, error) {
+		matchers := mustEnforcedMatchers(req.Context())
+		e := r.newEnforcer(req.Context())
+		return func(s string) (string, error) {
+			ms, err := parser.ParseMetricSelector(s)
+			if err != nil {
+				return "", errors.Errorf("can't parse selector %q: %v", s, err)
+			}
+			if err := e.checkSelectorNames(ms); err != nil {
+				return "", err
+			}
+			return matchersToString(r.injectMatchers(ms, matchers)...), nil
+		}
+	})
+}
+
+// jsonExpressions enforces the label on the PromQL expressions of a JSON
+// request body, e.g. the rule test or preview endpoints of some backends, so
+// that they are scoped like the live queries. The path selects the expressions
+// (or arrays of expressions) in the body and the request is rejected if any of
+// them is missing or if the path selects nothing.
+func (r *routes) jsonExpressions(path *jsonPath) http.HandlerFunc {
+	return r.enforceJSONBody(path, "expression", 0, func(req *http.Request) func(string) (string, error) {
+		e := r.newEnforcer(req.Context())
+		return func(s string) (string, error) {
+			q, err := enforceQuery(e, s)
+			if err != nil {
+				return "", errors.Wrapf(err, "can't enforce expression %q", s)
+			}
+			return q, nil
+		}
+	})
+}
+
+// enforceJSONBody returns a handler replacing the values of the JSON request
+// body selected by the path with the result of the function returned by
+// newInject for the request. The selected values must be strings or non-empty
+// arrays of strings and at least one value must be selected. When max is
+// positive, the requests with more values are rejected.
+func (r *routes) enforceJSONBody(path *jsonPath, kind string, max int, newInject func(*http.Request) func(string) (string, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		inject := newInject(req)
+
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad request: can't read body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		var doc interface{}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			http.Error(w, fmt.Sprintf("bad request: can't decode body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		var n int
+		doc, err = path.apply(doc, func(v interface{}) (interface{}, error) {
+			switch v := v.(type) {
+			case string:
+				n++
+				return inject(v)
+			case []interface{}:
+				if len(v) == 0 {
+					return nil, errors.Errorf("empty list of %ss", kind)
+				}
+				for i, s := range v {
+					s, ok := s.(string)
+					if !ok {
+						return nil, errors.Errorf("expected a %s, got %T", kind, v[i])
+					}
+					n++
+					enforced, err := inject(s)
+					if err != nil {
+						return nil, err
+					}
+					v[i] = enforced
+				}
+				return v, nil
+			}
+			return nil, errors.Errorf("expected a %s or a list of %ss, got %T", kind, kind, v)
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad request: %s: %v", path, err), http.StatusBadRequest)
+			return
+		}
+		if n == 0 {
+			http.Error(w, fmt.Sprintf("bad request: no %ss found at %s", kind, path), http.StatusBadRequest)
+			return
+		}
+		if max > 0 && n > max {
+			http.Error(w, fmt.Sprintf("bad request: too many %ss: %d, maximum is %d", kind, n, max), http.StatusBadRequest)
+			return
+		}
+
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(doc); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		req.Body = ioutil.NopCloser(&buf)
+		req.ContentLength = int64(buf.Len())
+
+		r.handler.ServeHTTP(w, req)
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	for _, tc := range []struct {
+		expr string
+
+		expErr      bool
+		expSegments []jsonPathSegment
+	}{
+		{
+			expr: "$",
+		},
+		{
+			expr:        `$[*]["match[]"]`,
+			expSegments: []jsonPathSegment{{wildcard: true}, {name: "match[]"}},
+		},
+		{
+			expr:        `$.groups.*['match[]']`,
+			expSegments: []jsonPathSegment{{name: "groups"}, {wildcard: true}, {name: "match[]"}},
+		},
+		{
+			expr:        `$.requests[*].selectors`,
+			expSegments: []jsonPathSegment{{name: "requests"}, {wildcard: true}, {name: "selectors"}},
+		},
+		{
+			expr:   `requests`,
+			expErr: true,
+		},
+		{
+			expr:   `$..selectors`,
+			expErr: true,
+		},
+		{
+			expr:   `$["match[]`,
+			expErr: true,
+		},
+		{
+			expr:   `$[0]`,
+			expErr: true,
+		},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			p, err := parseJSONPath(tc.expr)
+			if tc.expErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", p.segments)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(p.segments, tc.expSegments) {
+				t.Fatalf("expected segments %v, got %v", tc.expSegments, p.segments)
+			}
+		})
+	}
+}
+
+func TestJSONSelectorPaths(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		path string
+		body string
+
+		expCode int
+		expBody string
+	}{
+		{
+			name:    "batch of match[] arrays",
+			path:    `$[*]["match[]"]`,
+			body:    `[{"match[]":["up","{job=\"a\"}"],"start":1600000000},{"match[]":["down"]}]`,
+			expCode: http.StatusOK,
+			expBody: `[{"match[]":["{__name__=\"up\",namespace=\"default\"}","{job=\"a\",namespace=\"default\"}"],"start":1600000000},{"match[]":["{__name__=\"down\",namespace=\"default\"}"]}]`,
+		},
+		{
+			name:    "nested selectors",
+			path:    `$.requests[*].selector`,
+			body:    `{"requests":[{"selector":"{namespace=\"other\"}"}]}`,
+			expCode: http.StatusOK,
+			expBody: `{"requests":[{"selector":"{namespace=\"other\",namespace=\"default\"}"}]}`,
+		},
+		{
+			name:    "missing selectors",
+			path:    `$[*]["match[]"]`,
+			body:    `[{"match[]":["up"]},{"start":1600000000}]`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "empty selectors",
+			path:    `$[*]["match[]"]`,
+			body:    `[{"match[]":[]}]`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "no selectors",
+			path:    `$[*]["match[]"]`,
+			body:    `[]`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid selector",
+			path:    `$[*]["match[]"]`,
+			body:    `[{"match[]":["{job="}"]}]`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "unexpected shape",
+			path:    `$[*]["match[]"]`,
+			body:    `{"match[]":["up"]}`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid body",
+			path:    `$[*]["match[]"]`,
+			body:    `[{`,
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				body, _ := ioutil.ReadAll(req.Body)
+				if got := strings.TrimSpace(string(body)); got != tc.expBody {
+					t.Errorf("expected body %s, got %s", tc.expBody, got)
+				}
+				if req.ContentLength != int64(len(body)) {
+					t.Errorf("expected content length %d, got %d", len(body), req.ContentLength)
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, WithJSONSelectorPaths(map[string]string{"/custom/batch": tc.path}))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/custom/batch?"+proxyLabel+"=default", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+
+	t.Run("invalid_path", func(t *testing.T) {
+		if _, err := NewRoutes(&url.URL{}, proxyLabel, WithJSONSelectorPaths(map[string]string{"/custom/batch": "match[]"})); err == nil {
+			t.Fatal("expected error, got none")
+		}
+	})
+}
+
+func TestJSONExpressionPaths(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		path string
+		body string
+
+		expCode int
+		expBody string
+	}{
+		{
+			name:    "rule expressions",
+			path:    `$.rules[*].expr`,
+			body:    `{"rules":[{"alert":"Down","expr":"up == 0","for":"5m"},{"record":"job:up","expr":"sum by (job) (up{namespace=\"other\"})"}]}`,
+			expCode: http.StatusOK,
+			expBody: `{"rules":[{"alert":"Down","expr":"up{namespace=\"default\"} == 0","for":"5m"},{"expr":"sum by(job) (up{namespace=\"default\"})","record":"job:up"}]}`,
+		},
+		{
+			name:    "missing expression",
+			path:    `$.rules[*].expr`,
+			body:    `{"rules":[{"alert":"Down"}]}`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "no expressions",
+			path:    `$.rules[*].expr`,
+			body:    `{"rules":[]}`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid expression",
+			path:    `$.rules[*].expr`,
+			body:    `{"rules":[{"expr":"up{"}]}`,
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				body, _ := ioutil.ReadAll(req.Body)
+				if got := strings.TrimSpace(string(body)); got != tc.expBody {
+					t.Errorf("expected body %s, got %s", tc.expBody, got)
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, WithJSONExpressionPaths(map[string]string{"/api/v1/rule/test": tc.path}))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/rule/test?"+proxyLabel+"=default", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
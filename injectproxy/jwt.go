@@ -0,0 +1,381 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// JWTEnforcer extracts the label value from a claim of the JWT bearer token of
+// the Authorization header, e.g. set by an OIDC gateway. The signature of the
+// token is verified with the keys of Keys and the token must not be expired.
+// The "iss" claim of the token must be Issuer and its "aud" claim must contain
+// Audience, both being required.
+//
+// Claim is the path of the claim holding the label value(s), the keys of the
+// nested objects being separated by dots (e.g. "tenant" or
+// "realm_access.roles"). A trailing "[]" (e.g. "groups[]") is accepted for
+// readability. The claim may be a string or an array of strings.
+//
+// When the token carries several values, the request may select one of them
+// with the ParameterName query parameter, otherwise all of them are enforced
+// (ExtractLabel alone rejects the request). The requests without token or with
+// an invalid token are rejected with 401.
+type JWTEnforcer struct {
+	Keys          *JWKS
+	Issuer        string
+	Audience      string
+	Claim         string
+	ParameterName string
+
+	// now returns the current time (for tests).
+	now func() time.Time
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (je JWTEnforcer) ExtractLabel(req *http.Request) (string, error) {
+	values, err := je.ExtractLabelValues(req)
+	if err != nil {
+		return "", err
+	}
+	if len(values) > 1 {
+		return "", &MissingLabelValueError{Msg: fmt.Sprintf("Bad request. The %q query parameter must select one of the allowed label values.", je.ParameterName)}
+	}
+	return values[0], nil
+}
+
+// ExtractLabelValues implements the LabelValuesExtractor interface. It returns
+// the selected label value if any or all the label values of the token.
+func (je JWTEnforcer) ExtractLabelValues(req *http.Request) ([]string, error) {
+	auth := req.Header.Get("Authorization")
+	if len(auth) < len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return nil, &UnauthorizedError{Msg: "Unauthorized. A bearer token must be provided."}
+	}
+
+	now := time.Now
+	if je.now != nil {
+		now = je.now
+	}
+	if je.Issuer == "" || je.Audience == "" {
+		return nil, &UnavailableError{Msg: "Service unavailable. The issuer and the audience of the bearer tokens aren't configured."}
+	}
+	claims, err := je.Keys.verify(req.Context(), strings.TrimSpace(auth[len("Bearer "):]), jwt.Expected{
+		Issuer:   je.Issuer,
+		Audience: jwt.Audience{je.Audience},
+		Time:     now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := claimValues(claims, je.Claim)
+	if err != nil {
+		return nil, &ForbiddenLabelValueError{Msg: fmt.Sprintf("Forbidden. %v.", err)}
+	}
+	if len(values) == 0 {
+		return nil, &ForbiddenLabelValueError{Msg: "Forbidden. No label value is allowed."}
+	}
+
+	var selected string
+	if je.ParameterName != "" {
+		q := req.URL.Query()
+		selected = q.Get(je.ParameterName)
+		q.Del(je.ParameterName)
+		req.URL.RawQuery = q.Encode()
+	}
+	if selected == "" {
+		return values, nil
+	}
+
+	for _, v := range values {
+		if v == selected {
+			return []string{v}, nil
+		}
+	}
+	return nil, &ForbiddenLabelValueError{Msg: fmt.Sprintf("Forbidden. The label value %q isn't allowed.", selected)}
+}
+
+func invalidTokenError(format string, args ...interface{}) error {
+	return &UnauthorizedError{Msg: "Unauthorized. Invalid bearer token: " + fmt.Sprintf(format, args...) + "."}
+}
+
+// claimValues returns the string values of the claim at the given path.
+func claimValues(claims map[string]interface{}, path string) ([]string, error) {
+	var v interface{} = claims
+	for _, k := range strings.Split(strings.TrimSuffix(path, "[]"), ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("the %q claim is missing", path)
+		}
+		if v, ok = obj[k]; !ok {
+			return nil, errors.Errorf("the %q claim is missing", path)
+		}
+	}
+
+	switch v := v.(type) {
+	case string:
+		if v == "" {
+			return nil, nil
+		}
+		return []string{v}, nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return nil, errors.Errorf("the %q claim must be a string or an array of strings", path)
+			}
+			if s != "" {
+				values = append(values, s)
+			}
+		}
+		return values, nil
+	}
+	return nil, errors.Errorf("the %q claim must be a string or an array of strings", path)
+}
+
+// JWKS is a set of public keys fetched from a JSON Web Key Set URL, e.g. the
+// jwks_uri of an OpenID provider. The keys are cached and fetched again after
+// RefreshInterval. To follow the key rotations, the keys are fetched again too
+// when a token is signed by an unknown key. The keys are fetched at most once
+// per MinRefreshInterval, failed attempts included. When the keys can't be
+// fetched, the cached keys are used.
+//
+// The keys are fetched in the background, once for all the concurrent
+// requests and independently of their contexts.
+type JWKS struct {
+	URL                string
+	Client             *http.Client
+	RefreshInterval    time.Duration
+	MinRefreshInterval time.Duration
+
+	mtx     sync.Mutex
+	keys    []jose.JSONWebKey
+	err     error
+	fetched time.Time
+	// attempted is the time of the last fetch, successful or not.
+	attempted time.Time
+	// fetching is closed when the fetch in progress completes.
+	fetching chan struct{}
+}
+
+const (
+	defaultJWKSRefreshInterval    = time.Hour
+	defaultJWKSMinRefreshInterval = time.Minute
+	jwksFetchTimeout              = 10 * time.Second
+)
+
+// NewJWKS returns a key set fetched from the given URL with the default
+// refresh intervals.
+func NewJWKS(url string) *JWKS {
+	return &JWKS{
+		URL:                url,
+		Client:             http.DefaultClient,
+		RefreshInterval:    defaultJWKSRefreshInterval,
+		MinRefreshInterval: defaultJWKSMinRefreshInterval,
+	}
+}
+
+// keySet returns the cached keys, fetching them first if they are stale or if
+// force is true, unless the last fetch happened less than MinRefreshInterval
+// ago. It waits for the fetch in progress if any.
+func (j *JWKS) keySet(ctx context.Context, now time.Time, force bool) ([]jose.JSONWebKey, error) {
+	j.mtx.Lock()
+	done := j.fetching
+	if done == nil {
+		due := force || j.fetched.IsZero() || now.Sub(j.fetched) >= j.RefreshInterval
+		if due && (j.attempted.IsZero() || now.Sub(j.attempted) >= j.MinRefreshInterval) {
+			done = make(chan struct{})
+			j.fetching, j.attempted = done, now
+			go j.refresh(done, now)
+		}
+	}
+	j.mtx.Unlock()
+
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}
+
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if j.keys != nil {
+		return j.keys, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if j.err == nil {
+		return nil, errors.New("the JSON Web Key Set hasn't been fetched yet")
+	}
+	return nil, j.err
+}
+
+// refresh fetches the keys and closes done.
+func (j *JWKS) refresh(done chan struct{}, now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+	defer cancel()
+	keys, err := j.fetch(ctx)
+
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if err != nil {
+		if j.keys != nil {
+			log.Printf("warning: Failed to refresh the JSON Web Key Set, using the cached keys: %v", err)
+		}
+		j.err = err
+	} else {
+		j.keys, j.err, j.fetched = keys, nil, now
+	}
+	j.fetching = nil
+	close(done)
+}
+
+// fetch returns the signature keys of the key set. The keys of unsupported
+// types are ignored.
+func (j *JWKS) fetch(ctx context.Context) ([]jose.JSONWebKey, error) {
+	req, err := http.NewRequest(http.MethodGet, j.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := j.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't fetch the JSON Web Key Set")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("can't fetch the JSON Web Key Set: unexpected status code %d", resp.StatusCode)
+	}
+
+	// The keys are decoded one by one since the key set is rejected as a
+	// whole when it contains a key of an unsupported type.
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, errors.Wrap(err, "can't decode the JSON Web Key Set")
+	}
+
+	var keys []jose.JSONWebKey
+	for _, raw := range set.Keys {
+		var k jose.JSONWebKey
+		if err := k.UnmarshalJSON(raw); err != nil {
+			log.Printf("warning: Ignoring a key of the JSON Web Key Set: %v", err)
+			continue
+		}
+		if (k.Use != "" && k.Use != "sig") || !k.IsPublic() || !k.Valid() {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// jwtAlgorithms are the supported signature algorithms.
+var jwtAlgorithms = map[string]struct{}{
+	string(jose.RS256): {},
+	string(jose.RS384): {},
+	string(jose.RS512): {},
+	string(jose.PS256): {},
+	string(jose.PS384): {},
+	string(jose.PS512): {},
+	string(jose.ES256): {},
+	string(jose.ES384): {},
+	string(jose.ES512): {},
+}
+
+// verify returns the claims of the token once its signature and its claims
+// are verified. The token must have an expiration time.
+func (j *JWKS) verify(ctx context.Context, token string, expected jwt.Expected) (map[string]interface{}, error) {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil || len(tok.Headers) != 1 {
+		return nil, invalidTokenError("malformed token")
+	}
+	header := tok.Headers[0]
+	if _, ok := jwtAlgorithms[header.Algorithm]; !ok {
+		return nil, invalidTokenError("unsupported algorithm %q", header.Algorithm)
+	}
+
+	verified := false
+	for _, force := range []bool{false, true} {
+		keys, err := j.keySet(ctx, expected.Time, force)
+		if err != nil {
+			return nil, &UnavailableError{Msg: fmt.Sprintf("Service unavailable. Can't verify the bearer token: %v", err)}
+		}
+		var known bool
+		for _, k := range keys {
+			if header.KeyID != "" && k.KeyID != header.KeyID {
+				continue
+			}
+			if k.Algorithm != "" && k.Algorithm != header.Algorithm {
+				continue
+			}
+			known = true
+			if tok.Claims(k.Key) == nil {
+				verified = true
+				break
+			}
+		}
+		// The key set is only fetched again for unknown keys, the other
+		// tokens are invalid.
+		if verified || known {
+			break
+		}
+	}
+	if !verified {
+		return nil, invalidTokenError("invalid signature")
+	}
+
+	var (
+		std    jwt.Claims
+		claims map[string]interface{}
+	)
+	if err := tok.UnsafeClaimsWithoutVerification(&std, &claims); err != nil {
+		return nil, invalidTokenError("malformed claims")
+	}
+	if std.Expiry == nil {
+		return nil, invalidTokenError("missing expiration time")
+	}
+	switch err := std.ValidateWithLeeway(expected, 0); err {
+	case nil:
+	case jwt.ErrInvalidIssuer:
+		return nil, invalidTokenError("unexpected issuer")
+	case jwt.ErrInvalidAudience:
+		return nil, invalidTokenError("unexpected audience")
+	case jwt.ErrExpired:
+		return nil, invalidTokenError("expired token")
+	case jwt.ErrNotValidYet:
+		return nil, invalidTokenError("token not valid yet")
+	default:
+		return nil, invalidTokenError("invalid claims")
+	}
+	return claims, nil
+}
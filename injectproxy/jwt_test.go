@@ -0,0 +1,518 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	testIssuer   = "https://issuer.example.com"
+	testAudience = "prom-label-proxy"
+)
+
+type testKey struct {
+	kid string
+	key crypto.Signer
+}
+
+func newRSAKey(t *testing.T, kid string) testKey {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return testKey{kid: kid, key: k}
+}
+
+func newECKey(t *testing.T, kid string) testKey {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return testKey{kid: kid, key: k}
+}
+
+func (k testKey) jwk() jose.JSONWebKey {
+	return jose.JSONWebKey{Key: k.key.Public(), KeyID: k.kid, Use: "sig"}
+}
+
+// sign returns a token with the given claims signed by the key. The "iss" and
+// "aud" claims are set to the test issuer and audience unless given, a nil
+// value removing them.
+func (k testKey) sign(t *testing.T, claims map[string]interface{}) string {
+	all := map[string]interface{}{"iss": testIssuer, "aud": testAudience}
+	for c, v := range claims {
+		all[c] = v
+		if v == nil {
+			delete(all, c)
+		}
+	}
+
+	alg := jose.RS256
+	if _, ok := k.key.(*ecdsa.PrivateKey); ok {
+		alg = jose.ES256
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: k.key}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", k.kid))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	token, err := jwt.Signed(signer).Claims(all).CompactSerialize()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return token
+}
+
+// jwksServer serves the public keys of the key set.
+type jwksServer struct {
+	*httptest.Server
+
+	mtx     sync.Mutex
+	keys    []testKey
+	fetches int
+}
+
+func newJWKSServer(keys ...testKey) *jwksServer {
+	s := &jwksServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		s.fetches++
+		if s.keys == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		set := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{}}
+		for _, k := range s.keys {
+			set.Keys = append(set.Keys, k.jwk())
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	return s
+}
+
+func (s *jwksServer) setKeys(keys ...testKey) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.keys = keys
+}
+
+func TestJWTEnforcer(t *testing.T) {
+	rsaKey, ecKey, otherKey := newRSAKey(t, "rsa"), newECKey(t, "ec"), newRSAKey(t, "rsa")
+	jwks := newJWKSServer(rsaKey, ecKey)
+	defer jwks.Close()
+
+	exp := time.Now().Add(time.Hour).Unix()
+	for _, tc := range []struct {
+		name     string
+		claim    string
+		token    string
+		selected string
+
+		expCode  int
+		expQuery string
+	}{
+		{
+			name:    "no token",
+			claim:   "tenant",
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "malformed token",
+			claim:   "tenant",
+			token:   "not.a.token",
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "RSA signature",
+			claim:   "tenant",
+			token:   rsaKey.sign(t, map[string]interface{}{"tenant": "default", "exp": exp}),
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "EC signature",
+			claim:   "tenant",
+			token:   ecKey.sign(t, map[string]interface{}{"tenant": "default", "exp": exp}),
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "unexpected issuer",
+			claim:   "tenant",
+			token:   rsaKey.sign(t, map[string]interface{}{"tenant": "default", "exp": exp, "iss": "https://other.example.com"}),
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "missing issuer",
+			claim:   "tenant",
+			token:   rsaKey.sign(t, map[string]interface{}{"tenant": "default", "exp": exp, "iss": nil}),
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "unexpected audience",
+			claim:   "tenant",
+			token:   rsaKey.sign(t, map[string]interface{}{"tenant": "default", "exp": exp, "aud": "other"}),
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "audience among several",
+			claim:   "tenant",
+			token:   rsaKey.sign(t, map[string]interface{}{"tenant": "default", "exp": exp, "aud": []string{"other", testAudience}}),
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "missing audience",
+			claim:   "tenant",
+			token:   rsaKey.sign(t, map[string]interface{}{"tenant": "default", "exp": exp, "aud": nil}),
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "invalid signature",
+			claim:   "tenant",
+			token:   otherKey.sign(t, map[string]interface{}{"tenant": "default", "exp": exp}),
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "unsigned token",
+			claim:   "tenant",
+			token:   "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString([]byte(`{"tenant":"default","exp":9999999999}`)) + ".",
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "expired token",
+			claim:   "tenant",
+			token:   rsaKey.sign(t, map[string]interface{}{"tenant": "default", "exp": time.Now().Add(-time.Minute).Unix()}),
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "no expiration time",
+			claim:   "tenant",
+			token:   rsaKey.sign(t, map[string]interface{}{"tenant": "default"}),
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "token not valid yet",
+			claim:   "tenant",
+			token:   rsaKey.sign(t, map[string]interface{}{"tenant": "default", "exp": exp, "nbf": time.Now().Add(time.Minute).Unix()}),
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "missing claim",
+			claim:   "tenant",
+			token:   rsaKey.sign(t, map[string]interface{}{"exp": exp}),
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "nested claim",
+			claim:   "org.tenant",
+			token:   rsaKey.sign(t, map[string]interface{}{"org": map[string]string{"tenant": "default"}, "exp": exp}),
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "single value array",
+			claim:   "groups[]",
+			token:   rsaKey.sign(t, map[string]interface{}{"groups": []string{"default"}, "exp": exp}),
+			expCode: http.StatusOK,
+		},
+		{
+			name:     "several values without selection",
+			claim:    "groups[]",
+			token:    rsaKey.sign(t, map[string]interface{}{"groups": []string{"other", "default"}, "exp": exp}),
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace=~"default|other"}`,
+		},
+		{
+			name:     "several values with selection",
+			claim:    "groups[]",
+			token:    rsaKey.sign(t, map[string]interface{}{"groups": []string{"other", "default"}, "exp": exp}),
+			selected: "default",
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "forbidden value selected",
+			claim:    "groups[]",
+			token:    rsaKey.sign(t, map[string]interface{}{"groups": []string{"other"}, "exp": exp}),
+			selected: "default",
+			expCode:  http.StatusForbidden,
+		},
+		{
+			name:    "invalid claim type",
+			claim:   "groups[]",
+			token:   rsaKey.sign(t, map[string]interface{}{"groups": []int{1}, "exp": exp}),
+			expCode: http.StatusForbidden,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			expQuery := tc.expQuery
+			if expQuery == "" {
+				expQuery = `up{namespace="default"}`
+			}
+			m := newMockUpstream(checkQueryHandler("", queryParam, expQuery))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, WithExtractLabeler(JWTEnforcer{
+				Keys:          NewJWKS(jwks.URL),
+				Issuer:        testIssuer,
+				Audience:      testAudience,
+				Claim:         tc.claim,
+				ParameterName: "tenant",
+			}))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			u := "http://prometheus.example.com/api/v1/query?query=up"
+			if tc.selected != "" {
+				u += "&tenant=" + tc.selected
+			}
+			req := httptest.NewRequest(http.MethodGet, u, nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestJWKSRotation(t *testing.T) {
+	oldKey, newKey := newRSAKey(t, "old"), newRSAKey(t, "new")
+	jwks := newJWKSServer()
+	defer jwks.Close()
+
+	now := time.Now()
+	keys := NewJWKS(jwks.URL)
+	je := JWTEnforcer{Keys: keys, Issuer: testIssuer, Audience: testAudience, Claim: "tenant", now: func() time.Time { return now }}
+	extract := func(k testKey) error {
+		req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query", nil)
+		req.Header.Set("Authorization", "Bearer "+k.sign(t, map[string]interface{}{"tenant": "default", "exp": now.Add(time.Hour).Unix()}))
+		_, err := je.ExtractLabel(req)
+		return err
+	}
+
+	// The keys can't be fetched.
+	if err := extract(oldKey); err == nil {
+		t.Fatal("expected error, got none")
+	} else if _, ok := err.(*UnavailableError); !ok {
+		t.Fatalf("expected unavailable error, got %v", err)
+	}
+
+	// The failed fetch isn't retried before the minimum interval.
+	jwks.setKeys(oldKey)
+	if err := extract(oldKey); err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if jwks.fetches != 1 {
+		t.Fatalf("expected the failed fetch not to be retried, got %d fetches", jwks.fetches)
+	}
+	now = now.Add(keys.MinRefreshInterval)
+	if err := extract(oldKey); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := extract(oldKey); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if jwks.fetches != 2 {
+		t.Fatalf("expected the keys to be cached, got %d fetches", jwks.fetches)
+	}
+
+	// The unknown keys trigger a refresh, at most once per minimum interval.
+	jwks.setKeys(oldKey, newKey)
+	if err := extract(newKey); err == nil {
+		t.Fatal("expected error, got none")
+	}
+	now = now.Add(keys.MinRefreshInterval)
+	if err := extract(newKey); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if jwks.fetches != 3 {
+		t.Fatalf("expected 3 fetches, got %d", jwks.fetches)
+	}
+
+	// The cached keys are kept when the refresh fails.
+	jwks.setKeys()
+	now = now.Add(keys.RefreshInterval)
+	if err := extract(oldKey); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestJWTEnforcerWithoutIssuer(t *testing.T) {
+	key := newRSAKey(t, "rsa")
+	jwks := newJWKSServer(key)
+	defer jwks.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query", nil)
+	req.Header.Set("Authorization", "Bearer "+key.sign(t, map[string]interface{}{"tenant": "default", "exp": time.Now().Add(time.Hour).Unix(), "iss": ""}))
+	je := JWTEnforcer{Keys: NewJWKS(jwks.URL), Audience: testAudience, Claim: "tenant"}
+	if _, err := je.ExtractLabel(req); err == nil {
+		t.Fatal("expected error, got none")
+	} else if _, ok := err.(*UnavailableError); !ok {
+		t.Fatalf("expected unavailable error, got %v", err)
+	}
+}
+
+func TestJWKSUnsupportedKeys(t *testing.T) {
+	key := newRSAKey(t, "rsa")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, err := json.Marshal(key.jwk())
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		fmt.Fprintf(w, `{"keys":[{"kty":"unknown","kid":"unknown"},{"kty":"oct","kid":"hmac","k":"c2VjcmV0"},%s]}`, b)
+	}))
+	defer srv.Close()
+
+	keys, err := NewJWKS(srv.URL).fetch(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 1 || keys[0].KeyID != "rsa" {
+		t.Fatalf("expected only the rsa key, got %v", keys)
+	}
+}
+
+func TestJWKSConcurrentFetch(t *testing.T) {
+	key := newRSAKey(t, "rsa")
+	jwks := newJWKSServer(key)
+	defer jwks.Close()
+
+	keys := NewJWKS(jwks.URL)
+	je := JWTEnforcer{Keys: keys, Issuer: testIssuer, Audience: testAudience, Claim: "tenant"}
+	token := key.sign(t, map[string]interface{}{"tenant": "default", "exp": time.Now().Add(time.Hour).Unix()})
+
+	// The fetch doesn't depend on the context of the request triggering it.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query", nil).WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+token)
+	je.ExtractLabel(req)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			_, err := je.ExtractLabel(req)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	jwks.mtx.Lock()
+	defer jwks.mtx.Unlock()
+	if jwks.fetches != 1 {
+		t.Fatalf("expected 1 fetch, got %d", jwks.fetches)
+	}
+}
+
+func TestJWTEnforcerWithHeader(t *testing.T) {
+	key := newRSAKey(t, "rsa")
+	jwks := newJWKSServer(key)
+	defer jwks.Close()
+
+	token := key.sign(t, map[string]interface{}{"groups": []string{"a", "b"}, "exp": time.Now().Add(time.Hour).Unix()})
+	for _, tc := range []struct {
+		name   string
+		policy ConflictPolicy
+		header string
+
+		expErr   bool
+		expValue string
+	}{
+		{
+			name:     "header among the token values",
+			header:   "b",
+			expValue: "b",
+		},
+		{
+			name:   "header not among the token values",
+			header: "c",
+			expErr: true,
+		},
+		{
+			name:   "header not among the token values with source order",
+			policy: PreferSourceOrder,
+			header: "c",
+			expErr: true,
+		},
+		{
+			name:   "no header",
+			expErr: true,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			mse := MultiSourceEnforcer{
+				Sources: []ExtractLabeler{
+					JWTEnforcer{Keys: NewJWKS(jwks.URL), Issuer: testIssuer, Audience: testAudience, Claim: "groups[]"},
+					HTTPHeaderEnforcer{Name: "X-Tenant"},
+				},
+				Policy: tc.policy,
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			if tc.header != "" {
+				req.Header.Set("X-Tenant", tc.header)
+			}
+
+			v, err := mse.ExtractLabel(req)
+			if tc.expErr {
+				if err == nil {
+					t.Fatalf("expected error, got value %q", v)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if v != tc.expValue {
+				t.Fatalf("expected value %q, got %q", tc.expValue, v)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPConn is a bound connection to an LDAP server.
+type LDAPConn interface {
+	// Search returns the values of the attribute of the entries under baseDN
+	// matching the filter.
+	Search(ctx context.Context, baseDN, filter, attribute string) ([]string, error)
+	Close() error
+}
+
+// LDAPResolver resolves an identity to the label values it has access to with
+// an LDAP search, e.g. the names of the groups the user is a member of. The
+// connections are created by Dial and reused up to MaxIdleConns idle
+// connections. A connection which failed is discarded.
+type LDAPResolver struct {
+	Dial func(ctx context.Context) (LDAPConn, error)
+	// BaseDN is the base of the search.
+	BaseDN string
+	// Filter is the search filter in which %s is replaced by the escaped
+	// identity, e.g. "(&(objectClass=groupOfNames)(member=uid=%s,ou=users,dc=example,dc=com))".
+	Filter string
+	// Attribute is the attribute of the matching entries holding the label
+	// values, e.g. "cn".
+	Attribute    string
+	MaxIdleConns int
+
+	mtx  sync.Mutex
+	idle []LDAPConn
+}
+
+// ResolveLabelValues implements the LabelValueResolver interface.
+func (l *LDAPResolver) ResolveLabelValues(ctx context.Context, identity string) ([]string, error) {
+	conn, err := l.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := conn.Search(ctx, l.BaseDN, fmt.Sprintf(l.Filter, ldap.EscapeFilter(identity)), l.Attribute)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	l.release(conn)
+
+	return values, nil
+}
+
+func (l *LDAPResolver) conn(ctx context.Context) (LDAPConn, error) {
+	l.mtx.Lock()
+	if n := len(l.idle); n > 0 {
+		conn := l.idle[n-1]
+		l.idle = l.idle[:n-1]
+		l.mtx.Unlock()
+		return conn, nil
+	}
+	l.mtx.Unlock()
+
+	return l.Dial(ctx)
+}
+
+func (l *LDAPResolver) release(conn LDAPConn) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if len(l.idle) >= l.MaxIdleConns {
+		conn.Close()
+		return
+	}
+	l.idle = append(l.idle, conn)
+}
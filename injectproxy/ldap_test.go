@@ -0,0 +1,97 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// fakeLDAPConn is a test double of an LDAP connection returning the groups
+// of the users.
+type fakeLDAPConn struct {
+	groups  map[string][]string
+	err     error
+	filters []string
+	closed  bool
+}
+
+func (f *fakeLDAPConn) Search(_ context.Context, baseDN, filter, attribute string) ([]string, error) {
+	f.filters = append(f.filters, filter)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.groups[filter], nil
+}
+
+func (f *fakeLDAPConn) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestLDAPResolver(t *testing.T) {
+	var dialed []*fakeLDAPConn
+	l := &LDAPResolver{
+		Dial: func(context.Context) (LDAPConn, error) {
+			c := &fakeLDAPConn{groups: map[string][]string{
+				"(member=uid=alice)":        {"team-a", "team-b"},
+				`(member=uid=\2a\28\29\5c)`: {"team-c"},
+			}}
+			dialed = append(dialed, c)
+			return c, nil
+		},
+		BaseDN:       "ou=groups,dc=example,dc=com",
+		Filter:       "(member=uid=%s)",
+		Attribute:    "cn",
+		MaxIdleConns: 1,
+	}
+
+	values, err := l.ResolveLabelValues(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(values) != 2 || values[0] != "team-a" || values[1] != "team-b" {
+		t.Fatalf("unexpected values %v", values)
+	}
+
+	// The identity is escaped in the filter.
+	values, err = l.ResolveLabelValues(context.Background(), `*()\`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(values) != 1 || values[0] != "team-c" {
+		t.Fatalf("unexpected values %v", values)
+	}
+
+	// The connection is reused.
+	if len(dialed) != 1 {
+		t.Fatalf("expected 1 connection, got %d", len(dialed))
+	}
+
+	// A failing connection is discarded.
+	dialed[0].err = errors.New("connection reset")
+	if _, err := l.ResolveLabelValues(context.Background(), "alice"); err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if !dialed[0].closed {
+		t.Fatal("expected the failing connection to be closed")
+	}
+	if _, err := l.ResolveLabelValues(context.Background(), "alice"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(dialed) != 2 {
+		t.Fatalf("expected 2 connections, got %d", len(dialed))
+	}
+}
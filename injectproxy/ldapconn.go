@@ -0,0 +1,139 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/pkg/errors"
+)
+
+// LDAPDialer dials an LDAP server and authenticates with a simple bind. URL is
+// an ldap:// or ldaps:// URL, the default ports being 389 and 636. When BindDN
+// is empty, the bind is anonymous.
+type LDAPDialer struct {
+	URL          string
+	TLSConfig    *tls.Config
+	BindDN       string
+	BindPassword string
+}
+
+// Dial returns a bound connection to the LDAP server.
+func (d *LDAPDialer) Dial(ctx context.Context) (LDAPConn, error) {
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid LDAP URL")
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return nil, errors.Errorf("invalid LDAP URL %q: the scheme must be ldap or ldaps", d.URL)
+	}
+
+	dialer := &net.Dialer{Timeout: ldap.DefaultTimeout}
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.Deadline = deadline
+	}
+	cfg := &tls.Config{}
+	if d.TLSConfig != nil {
+		cfg = d.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Hostname()
+	}
+	conn, err := ldap.DialURL(d.URL, ldap.DialWithDialer(dialer), ldap.DialWithTLSConfig(cfg))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't connect to the LDAP server")
+	}
+
+	c := &ldapConn{conn: conn}
+	err = c.do(ctx, func() error {
+		if d.BindDN == "" {
+			return conn.UnauthenticatedBind("")
+		}
+		return conn.Bind(d.BindDN, d.BindPassword)
+	})
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "LDAP bind failed")
+	}
+	return c, nil
+}
+
+// ldapConn is a connection to an LDAP server.
+type ldapConn struct {
+	conn *ldap.Conn
+}
+
+// Search implements the LDAPConn interface. The search covers the whole
+// subtree of baseDN. The referrals to other servers aren't followed.
+func (c *ldapConn) Search(ctx context.Context, baseDN, filter, attribute string) ([]string, error) {
+	var res *ldap.SearchResult
+	err := c.do(ctx, func() error {
+		var err error
+		res, err = c.conn.Search(ldap.NewSearchRequest(baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, filter, []string{attribute}, nil))
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "LDAP search failed")
+	}
+
+	var values []string
+	for _, e := range res.Entries {
+		values = append(values, e.GetEqualFoldAttributeValues(attribute)...)
+	}
+	return values, nil
+}
+
+// Close implements the LDAPConn interface.
+func (c *ldapConn) Close() error {
+	c.conn.Close()
+	return nil
+}
+
+// do runs the operation with the timeout of the context. The connection is
+// closed when the context is done before the operation completes.
+func (c *ldapConn) do(ctx context.Context, op func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetTimeout(time.Until(deadline))
+	}
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			c.conn.Close()
+		case <-stop:
+		}
+	}()
+	err := op()
+	close(stop)
+	<-stopped
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// CheckLDAPFilter returns an error if the LDAP search filter is invalid.
+func CheckLDAPFilter(filter string) error {
+	if _, err := ldap.CompileFilter(filter); err != nil {
+		return errors.Wrapf(err, "invalid LDAP filter %q", filter)
+	}
+	return nil
+}
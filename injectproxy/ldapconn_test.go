@@ -0,0 +1,71 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestLDAPDialer(t *testing.T) {
+	d := &LDAPDialer{URL: "http://127.0.0.1:389"}
+	if _, err := d.Dial(context.Background()); err == nil {
+		t.Fatal("expected error for the invalid scheme, got none")
+	}
+
+	// A server which never answers the bind request.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	// The bind is interrupted when the context is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	d = &LDAPDialer{URL: "ldap://" + l.Addr().String(), BindDN: "cn=proxy,dc=example,dc=com", BindPassword: "secret"}
+	if _, err := d.Dial(ctx); errors.Cause(err) != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestCheckLDAPFilter(t *testing.T) {
+	for _, tc := range []struct {
+		filter string
+		expErr bool
+	}{
+		{filter: "(&(objectClass=groupOfNames)(member=uid=x,ou=users,dc=example,dc=com))"},
+		{filter: "cn=a", expErr: true},
+		{filter: "(cn=a", expErr: true},
+	} {
+		t.Run(tc.filter, func(t *testing.T) {
+			if err := CheckLDAPFilter(tc.filter); (err != nil) != tc.expErr {
+				t.Fatalf("expected error %v, got %v", tc.expErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// requestIDHeader is the header carrying the ID of the request, propagated
+// from the client or generated by the proxy.
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength is the maximum length of the request IDs propagated
+// from the clients, longer IDs are replaced.
+const maxRequestIDLength = 128
+
+// maxLoggedErrorLength is the maximum length of the error messages of the
+// rejected requests in the request log.
+const maxLoggedErrorLength = 512
+
+// LogFormat is the format of the structured logs.
+type LogFormat string
+
+const (
+	// LogFormatLogfmt writes the logs as logfmt lines.
+	LogFormatLogfmt LogFormat = "logfmt"
+	// LogFormatJSON writes the logs as JSON objects, one per line.
+	LogFormatJSON LogFormat = "json"
+)
+
+// LogLevel is the severity of a log line.
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < LogLevelDebug || l > LogLevelError {
+		return strconv.Itoa(int(l))
+	}
+	return logLevelNames[l]
+}
+
+// ParseLogLevel returns the log level with the given name, one of "debug",
+// "info", "warn" or "error".
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, n := range logLevelNames {
+		if s == n {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected one of %s", s, strings.Join(logLevelNames, ", "))
+}
+
+// Logger writes structured log lines with a timestamp, a level and a message
+// followed by key/value pairs. The lines below the minimum level are dropped.
+//
+// Logger implements io.Writer so it can be the output of the standard logger
+// (with no flags): the "debug: ", "warning: " and "error: " prefixes of the
+// lines give their level, the other lines are logged at info level.
+type Logger struct {
+	format LogFormat
+	level  LogLevel
+	now    func() time.Time
+
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+// NewLogger returns a logger writing the lines at the given level or above
+// to w.
+func NewLogger(w io.Writer, format LogFormat, level LogLevel) (*Logger, error) {
+	switch format {
+	case LogFormatLogfmt, LogFormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected %q or %q", format, LogFormatLogfmt, LogFormatJSON)
+	}
+	return &Logger{w: w, format: format, level: level, now: time.Now}, nil
+}
+
+// Log writes a line with the given message and key/value pairs if the level
+// is enabled.
+func (l *Logger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	if level < l.level {
+		return
+	}
+
+	keyvals = append([]interface{}{"ts", l.now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg}, keyvals...)
+	if len(keyvals)%2 != 0 {
+		keyvals = append(keyvals, "")
+	}
+
+	var buf bytes.Buffer
+	if l.format == LogFormatJSON {
+		buf.WriteByte('{')
+		for i := 0; i < len(keyvals); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSONValue(&buf, fmt.Sprint(keyvals[i]))
+			buf.WriteByte(':')
+			writeJSONValue(&buf, keyvals[i+1])
+		}
+		buf.WriteByte('}')
+	} else {
+		for i := 0; i < len(keyvals); i += 2 {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(logfmtValue(fmt.Sprint(keyvals[i])))
+			buf.WriteByte('=')
+			buf.WriteString(logfmtValue(fmt.Sprint(keyvals[i+1])))
+		}
+	}
+	buf.WriteByte('\n')
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.w.Write(buf.Bytes())
+}
+
+// Write implements io.Writer for the standard logger.
+func (l *Logger) Write(p []byte) (int, error) {
+	msg, level := strings.TrimSuffix(string(p), "\n"), LogLevelInfo
+	for _, prefix := range []struct {
+		s     string
+		level LogLevel
+	}{
+		{"debug: ", LogLevelDebug},
+		{"warning: ", LogLevelWarn},
+		{"error: ", LogLevelError},
+	} {
+		if strings.HasPrefix(msg, prefix.s) {
+			msg, level = strings.TrimPrefix(msg, prefix.s), prefix.level
+			break
+		}
+	}
+	l.Log(level, msg)
+	return len(p), nil
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+// logfmtValue returns the value quoted when it contains characters which
+// aren't allowed in a bare logfmt value.
+func logfmtValue(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '=' || r == '"' || r == unicode.ReplacementChar || !unicode.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+// requestInfo holds the details of a request collected while it is served,
+// for the request log.
+type requestInfo struct {
+	id           string
+	labelValue   string
+	upstreamCode int
+}
+
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(keyRequestInfo).(*requestInfo)
+	return info
+}
+
+// requestID returns the ID of the request from the X-Request-Id header when
+// it is valid, otherwise a new random ID.
+func requestID(req *http.Request) string {
+	if id := req.Header.Get(requestIDHeader); validRequestID(id) {
+		return id
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if c := id[i]; c <= ' ' || c > '~' || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// logRequest writes the request log line of a served request. The requests
+// rejected by the proxy carry the error message of the response.
+func (r *routes) logRequest(req *http.Request, path string, info *requestInfo, rec *statusRecorder, d time.Duration) {
+	level := LogLevelInfo
+	switch {
+	case rec.code >= http.StatusInternalServerError:
+		level = LogLevelError
+	case rec.code >= http.StatusBadRequest:
+		level = LogLevelWarn
+	}
+
+	lvalue := info.labelValue
+	if r.redactLabelValues && lvalue != "" {
+		sum := sha256.Sum256([]byte(lvalue))
+		lvalue = "sha256:" + hex.EncodeToString(sum[:8])
+	}
+
+	keyvals := []interface{}{
+		"request_id", info.id,
+		"method", req.Method,
+		"path", path,
+		"route", routeFromContext(req.Context()),
+		"label", r.label,
+		"label_value", lvalue,
+		"status", rec.code,
+		"upstream_status", info.upstreamCode,
+		"duration_seconds", d.Seconds(),
+	}
+	if info.upstreamCode == 0 && rec.code >= http.StatusBadRequest {
+		if msg := strings.TrimSpace(string(rec.errBody)); msg != "" {
+			keyvals = append(keyvals, "error", msg)
+		}
+	}
+	r.requestLog.Log(level, "request", keyvals...)
+}
@@ -0,0 +1,238 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tc := range []struct {
+		name   string
+		format LogFormat
+		level  LogLevel
+		log    func(l *Logger)
+
+		exp string
+	}{
+		{
+			name:   "logfmt",
+			format: LogFormatLogfmt,
+			level:  LogLevelInfo,
+			log: func(l *Logger) {
+				l.Log(LogLevelInfo, "request", "path", "/api/v1/query", "status", 400, "error", `bad "query"`, "empty", "")
+			},
+			exp: `ts=2020-01-02T03:04:05Z level=info msg=request path=/api/v1/query status=400 error="bad \"query\"" empty=""` + "\n",
+		},
+		{
+			name:   "json",
+			format: LogFormatJSON,
+			level:  LogLevelInfo,
+			log: func(l *Logger) {
+				l.Log(LogLevelWarn, "request", "path", "/api/v1/query", "status", 400, "duration_seconds", 0.5)
+			},
+			exp: `{"ts":"2020-01-02T03:04:05Z","level":"warn","msg":"request","path":"/api/v1/query","status":400,"duration_seconds":0.5}` + "\n",
+		},
+		{
+			name:   "level below the minimum",
+			format: LogFormatLogfmt,
+			level:  LogLevelWarn,
+			log: func(l *Logger) {
+				l.Log(LogLevelInfo, "request")
+				l.Log(LogLevelError, "failure")
+			},
+			exp: "ts=2020-01-02T03:04:05Z level=error msg=failure\n",
+		},
+		{
+			name:   "standard logger",
+			format: LogFormatLogfmt,
+			level:  LogLevelDebug,
+			log: func(l *Logger) {
+				sl := log.New(l, "", 0)
+				sl.Printf("debug: heavy filtering")
+				sl.Printf("warning: Empty response body")
+				sl.Printf("Listening on :8080")
+			},
+			exp: "ts=2020-01-02T03:04:05Z level=debug msg=\"heavy filtering\"\n" +
+				"ts=2020-01-02T03:04:05Z level=warn msg=\"Empty response body\"\n" +
+				"ts=2020-01-02T03:04:05Z level=info msg=\"Listening on :8080\"\n",
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			var buf bytes.Buffer
+			l, err := NewLogger(&buf, tc.format, tc.level)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			l.now = func() time.Time { return now }
+
+			tc.log(l)
+			if got := buf.String(); got != tc.exp {
+				t.Fatalf("expected:\n%s\ngot:\n%s", tc.exp, got)
+			}
+		})
+	}
+
+	if _, err := NewLogger(&bytes.Buffer{}, "text", LogLevelInfo); err == nil {
+		t.Fatal("expected error for unknown format, got none")
+	}
+}
+
+func TestRequestLog(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		url       string
+		requestID string
+		redact    bool
+
+		expCode           int
+		expLevel          string
+		expLabelValue     string
+		expUpstreamStatus float64
+		expError          string
+		expRequestID      string
+	}{
+		{
+			name:              "forwarded request",
+			url:               "http://prometheus.example.com/api/v1/query?query=up&" + proxyLabel + "=default",
+			expCode:           http.StatusOK,
+			expLevel:          "info",
+			expLabelValue:     "default",
+			expUpstreamStatus: http.StatusOK,
+		},
+		{
+			name:              "propagated request ID",
+			url:               "http://prometheus.example.com/api/v1/query?query=up&" + proxyLabel + "=default",
+			requestID:         "abc-123",
+			expCode:           http.StatusOK,
+			expLevel:          "info",
+			expLabelValue:     "default",
+			expUpstreamStatus: http.StatusOK,
+			expRequestID:      "abc-123",
+		},
+		{
+			name:              "invalid request ID",
+			url:               "http://prometheus.example.com/api/v1/query?query=up&" + proxyLabel + "=default",
+			requestID:         "abc 123",
+			expCode:           http.StatusOK,
+			expLevel:          "info",
+			expLabelValue:     "default",
+			expUpstreamStatus: http.StatusOK,
+		},
+		{
+			name:              "redacted label value",
+			url:               "http://prometheus.example.com/api/v1/query?query=up&" + proxyLabel + "=default",
+			redact:            true,
+			expCode:           http.StatusOK,
+			expLevel:          "info",
+			expLabelValue:     "sha256:37a8eec1ce19687d",
+			expUpstreamStatus: http.StatusOK,
+		},
+		{
+			name:     "missing label value",
+			url:      "http://prometheus.example.com/api/v1/query?query=up",
+			expCode:  http.StatusBadRequest,
+			expLevel: "warn",
+			expError: `Bad request. The "namespace" query parameter must be provided.`,
+		},
+		{
+			name:          "invalid selector",
+			url:           "http://prometheus.example.com/api/v1/series?match[]=" + url.QueryEscape("{job=") + "&" + proxyLabel + "=default",
+			expCode:       http.StatusBadRequest,
+			expLevel:      "warn",
+			expLabelValue: "default",
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			var upstreamID string
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				upstreamID = req.Header.Get(requestIDHeader)
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			var buf bytes.Buffer
+			l, err := NewLogger(&buf, LogFormatJSON, LogLevelInfo)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			r, err := NewRoutes(m.url, proxyLabel, WithRequestLog(l, tc.redact))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			if tc.requestID != "" {
+				req.Header.Set(requestIDHeader, tc.requestID)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
+			}
+
+			var line map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+				t.Fatalf("unexpected error: %v: %s", err, buf.String())
+			}
+
+			id := resp.Header.Get(requestIDHeader)
+			if id == "" || line["request_id"] != id {
+				t.Fatalf("expected the logged request ID %v to be the response one %q", line["request_id"], id)
+			}
+			if tc.expRequestID != "" && id != tc.expRequestID {
+				t.Fatalf("expected request ID %q, got %q", tc.expRequestID, id)
+			}
+			if tc.expUpstreamStatus != 0 && upstreamID != id {
+				t.Fatalf("expected request ID %q sent upstream, got %q", id, upstreamID)
+			}
+
+			for k, exp := range map[string]interface{}{
+				"level":           tc.expLevel,
+				"msg":             "request",
+				"method":          http.MethodGet,
+				"path":            req.URL.Path,
+				"route":           req.URL.Path,
+				"label":           proxyLabel,
+				"label_value":     tc.expLabelValue,
+				"status":          float64(tc.expCode),
+				"upstream_status": tc.expUpstreamStatus,
+			} {
+				if line[k] != exp {
+					t.Fatalf("expected %s=%v, got %v", k, exp, line[k])
+				}
+			}
+			if tc.expError != "" && line["error"] != tc.expError {
+				t.Fatalf("expected error %q, got %v", tc.expError, line["error"])
+			}
+			if tc.expUpstreamStatus != 0 && line["error"] != nil {
+				t.Fatalf("expected no error, got %v", line["error"])
+			}
+			if tc.expCode != http.StatusOK && line["error"] == nil {
+				t.Fatal("expected an error, got none")
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// injectionMarkerHeader is the header marking the query requests already
+// enforced by prom-label-proxy instances. Its value lists the enforced labels
+// and their values, URL-encoded (e.g. "namespace=default&org=acme"), followed
+// by a semicolon and the hex-encoded HMAC-SHA256 of the list and the enforced
+// query.
+const injectionMarkerHeader = "X-Prom-Label-Proxy-Injected"
+
+// maxMarkedBodySize is the maximum size of the POST bodies read to verify the
+// marker, the limit applied by http.Request.ParseForm to the form bodies.
+const maxMarkedBodySize = 10 << 20
+
+var errMarkedBodyTooLarge = errors.Errorf("request body larger than %d bytes", maxMarkedBodySize)
+
+// injectionMarker returns the marker authenticating that the labels have been
+// enforced with the given values in the query.
+func (r *routes) injectionMarker(enforced url.Values, query string) string {
+	ls := enforced.Encode()
+	return ls + ";" + r.injectionMarkerSignature(ls, query)
+}
+
+func (r *routes) injectionMarkerSignature(labels, query string) string {
+	mac := hmac.New(sha256.New, r.injectionMarkerKey)
+	mac.Write([]byte(labels))
+	mac.Write([]byte{0})
+	mac.Write([]byte(query))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// injectionMarkerLabels returns the labels and values listed by the marker of
+// the request if its signature matches the query of the request. Otherwise,
+// it returns nil. The body of the marked POST requests is read before the
+// signature can be verified, so an error is returned when it's larger than
+// maxMarkedBodySize.
+func (r *routes) injectionMarkerLabels(req *http.Request) (url.Values, error) {
+	marker := req.Header.Get(injectionMarkerHeader)
+	i := strings.LastIndex(marker, ";")
+	if i < 0 {
+		return nil, nil
+	}
+	ls, sig := marker[:i], marker[i+1:]
+
+	query := req.URL.Query().Get(queryParam)
+	if req.Method == http.MethodPost && req.Body != nil {
+		if req.ContentLength > maxMarkedBodySize {
+			return nil, errMarkedBodyTooLarge
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxMarkedBodySize+1))
+		req.Body.Close()
+		if len(body) > maxMarkedBodySize {
+			return nil, errMarkedBodyTooLarge
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return nil, nil
+		}
+
+		v, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, nil
+		}
+		if bq := v.Get(queryParam); bq != "" {
+			if query != "" && query != bq {
+				return nil, nil
+			}
+			query = bq
+		}
+	}
+	if query == "" {
+		return nil, nil
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(r.injectionMarkerSignature(ls, query))) {
+		return nil, nil
+	}
+
+	enforced, err := url.ParseQuery(ls)
+	if err != nil {
+		return nil, nil
+	}
+	return enforced, nil
+}
@@ -0,0 +1,368 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInjectionMarker(t *testing.T) {
+	key := []byte("secret")
+
+	// The first instance marks the enforced query.
+	var marker string
+	m1 := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		marker = req.Header.Get(injectionMarkerHeader)
+		w.Write(okResponse)
+	}))
+	defer m1.Close()
+	r1, err := NewRoutes(m1.url, proxyLabel, WithInjectionMarker(key))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w := httptest.NewRecorder()
+	r1.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query_range?query=up&namespace=default", nil))
+	if w.Result().StatusCode != http.StatusOK || marker == "" {
+		t.Fatalf("expected the request to be forwarded with a marker, got status code %d and marker %q", w.Result().StatusCode, marker)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		query  string
+		marker string
+		method string
+
+		expQuery string
+	}{
+		{
+			name:     "valid marker",
+			query:    `up{namespace="default"}`,
+			marker:   marker,
+			expQuery: `up{namespace="default"}`,
+		},
+		{
+			name:     "valid marker in POST body",
+			query:    `up{namespace="default"}`,
+			marker:   marker,
+			method:   http.MethodPost,
+			expQuery: `up{namespace="default"}`,
+		},
+		{
+			name:     "marker for another query",
+			query:    `up{namespace="other"}`,
+			marker:   marker,
+			expQuery: `up{namespace="default"}`,
+		},
+		{
+			name:     "forged marker",
+			query:    `up`,
+			marker:   "forged",
+			expQuery: `up{namespace="default"}`,
+		},
+		{
+			name:     "no marker",
+			query:    `up`,
+			expQuery: `up{namespace="default"}`,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			// The second instance trusts the marked queries.
+			m2 := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				req.ParseForm()
+				if got := req.Form.Get(queryParam); got != tc.expQuery {
+					http.Error(w, fmt.Sprintf("expected query %q, got %q", tc.expQuery, got), http.StatusInternalServerError)
+					return
+				}
+				w.Write(okResponse)
+			}))
+			defer m2.Close()
+			r2, err := NewRoutes(m2.url, proxyLabel, WithInjectionMarker(key))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var req *http.Request
+			if tc.method == http.MethodPost {
+				req = httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query_range?namespace=default", strings.NewReader(url.Values{queryParam: {tc.query}}.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				req = httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query_range?namespace=default&"+url.Values{queryParam: {tc.query}}.Encode(), nil)
+			}
+			if tc.marker != "" {
+				req.Header.Set(injectionMarkerHeader, tc.marker)
+			}
+			w := httptest.NewRecorder()
+			r2.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestChainedInjectionMarker(t *testing.T) {
+	key := []byte("secret")
+
+	var (
+		gotQuery  string
+		gotMarker string
+	)
+	backend := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotQuery = req.URL.Query().Get(queryParam)
+		gotMarker = req.Header.Get(injectionMarkerHeader)
+		w.Write(okResponse)
+	}))
+	defer backend.Close()
+
+	// The inner instance enforces the team label.
+	team, err := NewRoutes(backend.url, "team", WithInjectionMarker(key))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	inner := httptest.NewServer(team)
+	defer inner.Close()
+	innerURL, _ := url.Parse(inner.URL)
+
+	// The outer instance enforces the org label.
+	org, err := NewRoutes(innerURL, "org", WithInjectionMarker(key))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		routes *routes
+		query  string
+		marker string
+		values url.Values
+
+		expQuery  string
+		expLabels url.Values
+	}{
+		{
+			name:      "chained instances",
+			routes:    org,
+			query:     `up`,
+			values:    url.Values{"org": {"acme"}, "team": {"a"}},
+			expQuery:  `up{org="acme",team="a"}`,
+			expLabels: url.Values{"org": {"acme"}, "team": {"a"}},
+		},
+		{
+			name:      "label already enforced by another instance",
+			routes:    team,
+			query:     `up{org="acme",team="a"}`,
+			marker:    org.injectionMarker(url.Values{"org": {"acme"}, "team": {"a"}}, `up{org="acme",team="a"}`),
+			values:    url.Values{"team": {"a"}},
+			expQuery:  `up{org="acme",team="a"}`,
+			expLabels: url.Values{"org": {"acme"}, "team": {"a"}},
+		},
+		{
+			name:      "label enforced with another value by another instance",
+			routes:    team,
+			query:     `up{org="acme",team="a"}`,
+			marker:    org.injectionMarker(url.Values{"org": {"acme"}, "team": {"a"}}, `up{org="acme",team="a"}`),
+			values:    url.Values{"team": {"b"}},
+			expQuery:  `up{org="acme",team="b"}`,
+			expLabels: url.Values{"org": {"acme"}, "team": {"b"}},
+		},
+		{
+			name:      "marker signed with another key",
+			routes:    team,
+			query:     `up`,
+			marker:    (&routes{injectionMarkerKey: []byte("other")}).injectionMarker(url.Values{"org": {"acme"}, "team": {"a"}}, `up`),
+			values:    url.Values{"team": {"a"}},
+			expQuery:  `up{team="a"}`,
+			expLabels: url.Values{"team": {"a"}},
+		},
+		{
+			name:      "marker with tampered labels",
+			routes:    team,
+			query:     `up{org="acme"}`,
+			marker:    "org=other&team=a;" + strings.SplitN(org.injectionMarker(url.Values{"org": {"acme"}}, `up{org="acme"}`), ";", 2)[1],
+			values:    url.Values{"team": {"a"}},
+			expQuery:  `up{org="acme",team="a"}`,
+			expLabels: url.Values{"team": {"a"}},
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			gotQuery, gotMarker = "", ""
+
+			q := url.Values{queryParam: {tc.query}}
+			for k, vs := range tc.values {
+				q[k] = vs
+			}
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+q.Encode(), nil)
+			if tc.marker != "" {
+				req.Header.Set(injectionMarkerHeader, tc.marker)
+			}
+			w := httptest.NewRecorder()
+			tc.routes.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, resp.StatusCode, string(body))
+			}
+			if gotQuery != tc.expQuery {
+				t.Fatalf("expected query %q, got %q", tc.expQuery, gotQuery)
+			}
+			if exp := team.injectionMarker(tc.expLabels, tc.expQuery); gotMarker != exp {
+				t.Fatalf("expected marker %q, got %q", exp, gotMarker)
+			}
+		})
+	}
+}
+
+func TestInjectionMarkerBodyLimit(t *testing.T) {
+	var forwarded bool
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		forwarded = true
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+	r, err := NewRoutes(m.url, proxyLabel, WithInjectionMarker([]byte("secret")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	body := "query=up&padding=" + strings.Repeat("a", maxMarkedBodySize)
+	for _, tc := range []struct {
+		name string
+		body io.Reader
+	}{
+		{
+			name: "known length",
+			body: strings.NewReader(body),
+		},
+		{
+			name: "unknown length",
+			body: ioutil.NopCloser(strings.NewReader(body)),
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			forwarded = false
+			req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query?namespace=default", tc.body)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set(injectionMarkerHeader, "namespace=default;forged")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if resp := w.Result(); resp.StatusCode != http.StatusRequestEntityTooLarge {
+				t.Fatalf("expected status code %d, got %d", http.StatusRequestEntityTooLarge, resp.StatusCode)
+			}
+			if forwarded {
+				t.Fatal("expected the request not to be forwarded")
+			}
+		})
+	}
+}
+
+func TestInjectionMarkerLocalPolicies(t *testing.T) {
+	key := []byte("secret")
+
+	var (
+		gotQuery   string
+		gotTimeout string
+		forwarded  bool
+	)
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		forwarded = true
+		gotQuery = req.URL.Query().Get(queryParam)
+		gotTimeout = req.URL.Query().Get(timeoutParam)
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel,
+		WithInjectionMarker(key),
+		WithMaxQueryTimeout(time.Minute),
+		WithQueryTimeWindow(time.Hour, 0),
+		WithQueryComplexityLimits(1, 0),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	labels := url.Values{proxyLabel: {"default"}}
+
+	for _, tc := range []struct {
+		name   string
+		query  string
+		values url.Values
+
+		expCode    int
+		expTimeout string
+	}{
+		{
+			name:       "timeout clamped",
+			query:      `up{namespace="default"}`,
+			values:     url.Values{timeoutParam: {"1h"}},
+			expCode:    http.StatusOK,
+			expTimeout: "1m",
+		},
+		{
+			name:    "time outside of the window",
+			query:   `up{namespace="default"}`,
+			values:  url.Values{timeParam: {"0"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "too many selectors",
+			query:   `up{namespace="default"} + up{namespace="default"}`,
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			gotQuery, gotTimeout, forwarded = "", "", false
+
+			q := url.Values{queryParam: {tc.query}, proxyLabel: {"default"}}
+			for k, vs := range tc.values {
+				q[k] = vs
+			}
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+q.Encode(), nil)
+			req.Header.Set(injectionMarkerHeader, r.injectionMarker(labels, tc.query))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if tc.expCode != http.StatusOK {
+				if forwarded {
+					t.Fatal("expected the request not to be forwarded")
+				}
+				return
+			}
+			// The marked query isn't enforced again.
+			if gotQuery != tc.query {
+				t.Fatalf("expected query %q, got %q", tc.query, gotQuery)
+			}
+			if gotTimeout != tc.expTimeout {
+				t.Fatalf("expected timeout %q, got %q", tc.expTimeout, gotTimeout)
+			}
+		})
+	}
+}
@@ -0,0 +1,457 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// heavyFilteringRatio is the ratio of kept items under which a filtered
+// response is logged at debug level.
+const heavyFilteringRatio = 0.1
+
+// filteredCountHeader is the response header reporting the number of items
+// dropped by the proxy.
+const filteredCountHeader = "X-Filtered-Count"
+
+// enforcedLabelTrailer is the response trailer reporting the enforced label
+// and value.
+const enforcedLabelTrailer = "X-Enforced-Label"
+
+// Metrics holds the metrics of the proxy. It implements http.Handler to
+// expose them in the Prometheus text format.
+type Metrics struct {
+	mtx sync.Mutex
+
+	// constLabels are the formatted labels added to all the metrics.
+	constLabels string
+
+	requests            *counterVec
+	requestDuration     *histogramVec
+	enforcementFailures *counterVec
+	upstreamResponses   *counterVec
+	modifyErrors        *counterVec
+
+	filteredItemsBefore *counterVec
+	filteredItemsAfter  *counterVec
+	filteredItemsRatio  *histogramVec
+
+	shadowRequests     *counterVec
+	events             *counterVec
+	processingTimeouts *counterVec
+}
+
+// NewMetrics returns a new set of metrics. The given constant labels are
+// added to all the metrics, e.g. to distinguish several proxy instances.
+func NewMetrics(constLabels map[string]string) *Metrics {
+	names := make([]string, 0, len(constLabels))
+	for n := range constLabels {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	values := make([]string, len(names))
+	for i, n := range names {
+		values[i] = constLabels[n]
+	}
+
+	return &Metrics{
+		constLabels: formatLabels(names, values),
+		requests: newCounterVec(
+			"prom_label_proxy_requests_total",
+			"Total number of requests by handler and status code of the response.",
+			"handler", "code",
+		),
+		requestDuration: newHistogramVec(
+			"prom_label_proxy_request_duration_seconds",
+			"Duration of the requests by handler.",
+			[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+			"handler",
+		),
+		enforcementFailures: newCounterVec(
+			"prom_label_proxy_enforcement_failures_total",
+			"Total number of requests rejected because the label value couldn't be enforced, by handler and reason (missing, forbidden, unauthorized, unavailable or invalid).",
+			"handler", "reason",
+		),
+		upstreamResponses: newCounterVec(
+			"prom_label_proxy_upstream_responses_total",
+			"Total number of upstream responses by handler and status code.",
+			"handler", "code",
+		),
+		modifyErrors: newCounterVec(
+			"prom_label_proxy_response_modification_errors_total",
+			"Total number of upstream responses which couldn't be modified (e.g. filtered) by the proxy, by handler.",
+			"handler",
+		),
+		filteredItemsBefore: newCounterVec(
+			"prom_label_proxy_filtered_items_before_total",
+			"Total number of items in the upstream responses before filtering.",
+			"handler",
+		),
+		filteredItemsAfter: newCounterVec(
+			"prom_label_proxy_filtered_items_after_total",
+			"Total number of items in the upstream responses after filtering.",
+			"handler",
+		),
+		filteredItemsRatio: newHistogramVec(
+			"prom_label_proxy_filtered_items_ratio",
+			"Ratio of items kept after filtering the upstream responses.",
+			[]float64{0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 1},
+			"handler",
+		),
+		shadowRequests: newCounterVec(
+			"prom_label_proxy_shadow_requests_total",
+			"Total number of requests mirrored to the shadow upstream by result of the comparison with the primary upstream.",
+			"result",
+		),
+		events: newCounterVec(
+			"prom_label_proxy_events_total",
+			"Total number of events of the enforced requests by result of the publication.",
+			"result",
+		),
+		processingTimeouts: newCounterVec(
+			"prom_label_proxy_processing_timeouts_total",
+			"Total number of requests which exceeded their processing timeout.",
+			"path",
+		),
+	}
+}
+
+// observeRequest records a request served by the proxy. The label value isn't
+// recorded to keep the cardinality bounded.
+func (m *Metrics) observeRequest(handler string, code int, d time.Duration) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.requests.add(1, handler, strconv.Itoa(code))
+	m.requestDuration.observe(d.Seconds(), handler)
+}
+
+// observeEnforcementFailure records a request rejected because the label
+// value couldn't be enforced.
+func (m *Metrics) observeEnforcementFailure(handler, reason string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.enforcementFailures.add(1, handler, reason)
+}
+
+// observeUpstreamResponse records the status code of an upstream response.
+func (m *Metrics) observeUpstreamResponse(handler string, code int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.upstreamResponses.add(1, handler, strconv.Itoa(code))
+}
+
+// observeModifyResponseError records an upstream response which couldn't be
+// modified.
+func (m *Metrics) observeModifyResponseError(handler string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.modifyErrors.add(1, handler)
+}
+
+// observeFiltering records the number of items of a response before and after
+// filtering.
+func (m *Metrics) observeFiltering(handler string, before, after int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.filteredItemsBefore.add(float64(before), handler)
+	m.filteredItemsAfter.add(float64(after), handler)
+	if before > 0 {
+		m.filteredItemsRatio.observe(float64(after)/float64(before), handler)
+	}
+}
+
+// observeShadow records the result of the comparison between the primary and
+// shadow responses.
+func (m *Metrics) observeShadow(result string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.shadowRequests.add(1, result)
+}
+
+// observeEvent records the result of the publication of an event.
+func (m *Metrics) observeEvent(result string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.events.add(1, result)
+}
+
+// observeProcessingTimeout records a request which exceeded its processing
+// timeout.
+func (m *Metrics) observeProcessingTimeout(path string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.processingTimeouts.add(1, path)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	var buf bytes.Buffer
+
+	m.mtx.Lock()
+	m.requests.write(&buf, m.constLabels)
+	m.requestDuration.write(&buf, m.constLabels)
+	m.enforcementFailures.write(&buf, m.constLabels)
+	m.upstreamResponses.write(&buf, m.constLabels)
+	m.modifyErrors.write(&buf, m.constLabels)
+	m.filteredItemsBefore.write(&buf, m.constLabels)
+	m.filteredItemsAfter.write(&buf, m.constLabels)
+	m.filteredItemsRatio.write(&buf, m.constLabels)
+	m.shadowRequests.write(&buf, m.constLabels)
+	m.events.write(&buf, m.constLabels)
+	m.processingTimeouts.write(&buf, m.constLabels)
+	m.mtx.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// route returns the pattern of the route serving the request, used as the
+// handler label of the metrics. The requests which don't match any route get
+// "none".
+func (r *routes) route(req *http.Request) string {
+	_, pattern := r.mux.Handler(req)
+	if pattern == "" {
+		return "none"
+	}
+	if p := strings.TrimSuffix(pattern, "/"); p != "" {
+		return p
+	}
+	return pattern
+}
+
+func routeFromContext(ctx context.Context) string {
+	route, ok := ctx.Value(keyRoute).(string)
+	if !ok {
+		return "none"
+	}
+	return route
+}
+
+// statusRecorder records the status code of the response and, when
+// captureErrors is true, the beginning of the error responses.
+type statusRecorder struct {
+	http.ResponseWriter
+	code        int
+	wroteHeader bool
+
+	captureErrors bool
+	errBody       []byte
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if !s.wroteHeader {
+		s.code, s.wroteHeader = code, true
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	if s.captureErrors && s.code >= http.StatusBadRequest && len(s.errBody) < maxLoggedErrorLength {
+		n := maxLoggedErrorLength - len(s.errBody)
+		if n > len(b) {
+			n = len(b)
+		}
+		s.errBody = append(s.errBody, b[:n]...)
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher for the streamed responses.
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker for the WebSocket upgrades.
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer doesn't support hijacking")
+	}
+	return h.Hijack()
+}
+
+// Unwrap returns the underlying response writer for http.ResponseController.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// recordFiltering updates the filtering metrics and logs responses for which
+// filtering dropped most of the items, which usually denotes a wrong label
+// mapping for the tenant.
+func (r *routes) recordFiltering(ctx context.Context, handler, lvalue string, before, after int) {
+	if isShadowRequest(ctx) {
+		return
+	}
+
+	r.metrics.observeFiltering(handler, before, after)
+
+	if before > 0 && float64(after)/float64(before) < heavyFilteringRatio {
+		r.debugf("heavy filtering of %s response for %s=%q: %d items out of %d kept", handler, r.label, lvalue, after, before)
+	}
+}
+
+// setFilteredCount reports the number of items dropped from the response in
+// the X-Filtered-Count header when enabled.
+func (r *routes) setFilteredCount(resp *http.Response, dropped int) {
+	if !r.filteredCountHeader {
+		return
+	}
+	resp.Header.Set(filteredCountHeader, strconv.Itoa(dropped))
+}
+
+// announceFilteringTrailers declares the X-Enforced-Label and X-Filtered-Count
+// trailers of the streamed response when enabled and returns the function
+// setting the number of items dropped once the response is filtered. Trailers
+// are only sent to HTTP/2 clients.
+func (r *routes) announceFilteringTrailers(resp *http.Response, lvalue string) func(dropped int) {
+	if !r.filteringTrailers || resp.Request.ProtoMajor != 2 {
+		return func(int) {}
+	}
+
+	if resp.Trailer == nil {
+		resp.Trailer = http.Header{}
+	}
+	resp.Trailer.Set(enforcedLabelTrailer, r.label+"="+strconv.Quote(lvalue))
+	resp.Trailer[filteredCountHeader] = nil
+	return func(dropped int) {
+		resp.Trailer.Set(filteredCountHeader, strconv.Itoa(dropped))
+	}
+}
+
+type counterVec struct {
+	name, help string
+	labels     []string
+	values     map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) add(v float64, lvs ...string) {
+	c.values[formatLabels(c.labels, lvs)] += v
+}
+
+func (c *counterVec) write(buf *bytes.Buffer, constLabels string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(buf, "%s{%s} %s\n", c.name, joinLabels(constLabels, k), formatFloat(c.values[k]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name, help string
+	buckets    []float64
+	labels     []string
+	values     map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, buckets: buckets, labels: labels, values: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(v float64, lvs ...string) {
+	k := formatLabels(h.labels, lvs)
+	hist, ok := h.values[k]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = hist
+	}
+
+	for i, b := range h.buckets {
+		if v <= b {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) write(buf *bytes.Buffer, constLabels string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		hist := h.values[k]
+		k = joinLabels(constLabels, k)
+		for i, b := range h.buckets {
+			fmt.Fprintf(buf, "%s_bucket{%s,le=%q} %d\n", h.name, k, formatFloat(b), hist.counts[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, k, hist.count)
+		fmt.Fprintf(buf, "%s_sum{%s} %s\n", h.name, k, formatFloat(hist.sum))
+		fmt.Fprintf(buf, "%s_count{%s} %d\n", h.name, k, hist.count)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", n, values[i])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	if b == "" {
+		return a
+	}
+	return a + "," + b
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
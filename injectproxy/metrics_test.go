@@ -0,0 +1,105 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics(map[string]string{"proxy_instance": "a", "cluster": "b"})
+	m.observeFiltering("rules", 10, 5)
+	m.observeFiltering("rules", 4, 0)
+	m.observeFiltering("alerts", 0, 0)
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	defer resp.Body.Close()
+
+	for _, exp := range []string{
+		`prom_label_proxy_filtered_items_before_total{cluster="b",proxy_instance="a",handler="alerts"} 0`,
+		`prom_label_proxy_filtered_items_before_total{cluster="b",proxy_instance="a",handler="rules"} 14`,
+		`prom_label_proxy_filtered_items_after_total{cluster="b",proxy_instance="a",handler="rules"} 5`,
+		`prom_label_proxy_filtered_items_ratio_bucket{cluster="b",proxy_instance="a",handler="rules",le="0.01"} 1`,
+		`prom_label_proxy_filtered_items_ratio_bucket{cluster="b",proxy_instance="a",handler="rules",le="0.5"} 2`,
+		`prom_label_proxy_filtered_items_ratio_bucket{cluster="b",proxy_instance="a",handler="rules",le="+Inf"} 2`,
+		`prom_label_proxy_filtered_items_ratio_sum{cluster="b",proxy_instance="a",handler="rules"} 0.5`,
+		`prom_label_proxy_filtered_items_ratio_count{cluster="b",proxy_instance="a",handler="rules"} 2`,
+	} {
+		if !strings.Contains(string(body), exp+"\n") {
+			t.Errorf("expected %q in metrics output, got:\n%s", exp, string(body))
+		}
+	}
+
+	if strings.Contains(string(body), `prom_label_proxy_filtered_items_ratio_count{cluster="b",proxy_instance="a",handler="alerts"}`) {
+		t.Errorf("expected no ratio observed for empty responses, got:\n%s", string(body))
+	}
+}
+
+func TestRequestMetrics(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api/v1/rules" {
+			// Invalid response which can't be filtered.
+			w.Write([]byte("{"))
+			return
+		}
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	metrics := NewMetrics(nil)
+	r, err := NewRoutes(m.url, proxyLabel, WithMetrics(metrics))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, u := range []string{
+		"http://prometheus.example.com/api/v1/query?query=up&" + proxyLabel + "=default",
+		"http://prometheus.example.com/api/v1/query?query=up&" + proxyLabel + "=other",
+		"http://prometheus.example.com/api/v1/query?query=up",
+		"http://prometheus.example.com/api/v1/rules?" + proxyLabel + "=default",
+		"http://prometheus.example.com/unknown",
+	} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, u, nil))
+	}
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+
+	for _, exp := range []string{
+		`prom_label_proxy_requests_total{handler="/api/v1/query",code="200"} 2`,
+		`prom_label_proxy_requests_total{handler="/api/v1/query",code="400"} 1`,
+		`prom_label_proxy_requests_total{handler="/api/v1/rules",code="502"} 1`,
+		`prom_label_proxy_requests_total{handler="none",code="404"} 1`,
+		`prom_label_proxy_request_duration_seconds_count{handler="/api/v1/query"} 3`,
+		`prom_label_proxy_enforcement_failures_total{handler="/api/v1/query",reason="missing"} 1`,
+		`prom_label_proxy_upstream_responses_total{handler="/api/v1/query",code="200"} 2`,
+		`prom_label_proxy_response_modification_errors_total{handler="/api/v1/rules"} 1`,
+	} {
+		if !strings.Contains(body, exp+"\n") {
+			t.Errorf("expected %q in metrics output, got:\n%s", exp, body)
+		}
+	}
+	if strings.Contains(body, `"default"`) || strings.Contains(body, `"other"`) {
+		t.Errorf("expected no label value in metrics output, got:\n%s", body)
+	}
+}
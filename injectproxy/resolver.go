@@ -0,0 +1,161 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// LabelValueResolver resolves an identity (e.g. a username) to the label
+// values it has access to.
+type LabelValueResolver interface {
+	ResolveLabelValues(ctx context.Context, identity string) ([]string, error)
+}
+
+// ForbiddenLabelValueError is returned by ExtractLabeler implementations when
+// the request isn't allowed to access any or the requested label value.
+type ForbiddenLabelValueError struct {
+	Msg string
+}
+
+func (e *ForbiddenLabelValueError) Error() string {
+	return e.Msg
+}
+
+// ResolvingEnforcer extracts the label value from the label values an
+// identity has access to. The identity is extracted from the request by
+// Identity (e.g. an HTTPHeaderEnforcer reading the username set by an
+// authenticating proxy) and resolved to the allowed label values by Resolver.
+//
+// When the identity has access to several values, the request may select one
+// of them with the ParameterName query parameter, otherwise all the values are
+// enforced. The request is rejected if the identity has no access to any value
+// or if the selected value isn't allowed, and with 503 if the resolution
+// fails.
+type ResolvingEnforcer struct {
+	Identity      ExtractLabeler
+	Resolver      LabelValueResolver
+	ParameterName string
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (re ResolvingEnforcer) ExtractLabel(req *http.Request) (string, error) {
+	values, err := re.ExtractLabelValues(req)
+	if err != nil {
+		return "", err
+	}
+	if len(values) > 1 {
+		return "", &MissingLabelValueError{Msg: fmt.Sprintf("Bad request. The %q query parameter must select one of the allowed label values.", re.ParameterName)}
+	}
+	return values[0], nil
+}
+
+// ExtractLabelValues implements the LabelValuesExtractor interface. It returns
+// the selected label value if any or all the label values the identity has
+// access to.
+func (re ResolvingEnforcer) ExtractLabelValues(req *http.Request) ([]string, error) {
+	identity, err := re.Identity.ExtractLabel(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected string
+	if re.ParameterName != "" {
+		q := req.URL.Query()
+		selected = q.Get(re.ParameterName)
+		q.Del(re.ParameterName)
+		req.URL.RawQuery = q.Encode()
+	}
+
+	values, err := re.Resolver.ResolveLabelValues(req.Context(), identity)
+	if err != nil {
+		// The details of the failure (e.g. of the LDAP server) are only
+		// logged.
+		log.Printf("warning: Failed to resolve the label values: %v", err)
+		return nil, &UnavailableError{Msg: "Service unavailable. Can't resolve the label values."}
+	}
+	if len(values) == 0 {
+		return nil, &ForbiddenLabelValueError{Msg: "Forbidden. No label value is allowed."}
+	}
+
+	if selected == "" {
+		return values, nil
+	}
+
+	for _, v := range values {
+		if v == selected {
+			return []string{v}, nil
+		}
+	}
+	return nil, &ForbiddenLabelValueError{Msg: fmt.Sprintf("Forbidden. The label value %q isn't allowed.", selected)}
+}
+
+// CachingResolver caches the label values resolved by another resolver for a
+// fixed duration. Failed resolutions aren't cached.
+type CachingResolver struct {
+	resolver LabelValueResolver
+	ttl      time.Duration
+	now      func() time.Time
+
+	mtx     sync.Mutex
+	entries map[string]cachedLabelValues
+}
+
+type cachedLabelValues struct {
+	values  []string
+	expires time.Time
+}
+
+// NewCachingResolver returns a resolver caching the label values resolved by
+// r for ttl.
+func NewCachingResolver(r LabelValueResolver, ttl time.Duration) *CachingResolver {
+	return &CachingResolver{
+		resolver: r,
+		ttl:      ttl,
+		now:      time.Now,
+		entries:  map[string]cachedLabelValues{},
+	}
+}
+
+// ResolveLabelValues implements the LabelValueResolver interface.
+func (c *CachingResolver) ResolveLabelValues(ctx context.Context, identity string) ([]string, error) {
+	c.mtx.Lock()
+	e, ok := c.entries[identity]
+	c.mtx.Unlock()
+	if ok && c.now().Before(e.expires) {
+		return e.values, nil
+	}
+
+	values, err := c.resolver.ResolveLabelValues(ctx, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	now := c.now()
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[identity] = cachedLabelValues{values: values, expires: now.Add(c.ttl)}
+
+	return values, nil
+}
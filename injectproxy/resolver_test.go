@@ -0,0 +1,207 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+type staticResolver struct {
+	values map[string][]string
+	err    error
+	calls  int
+}
+
+func (s *staticResolver) ResolveLabelValues(_ context.Context, identity string) ([]string, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.values[identity], nil
+}
+
+func TestResolvingEnforcer(t *testing.T) {
+	resolver := &staticResolver{values: map[string][]string{
+		"alice": {"default"},
+		"bob":   {"default", "other"},
+	}}
+
+	for _, tc := range []struct {
+		name     string
+		path     string
+		user     string
+		selected string
+		err      error
+		opts     []Option
+
+		expCode  int
+		expQuery string
+	}{
+		{
+			name:    "no identity",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "single value",
+			user:    "alice",
+			expCode: http.StatusOK,
+		},
+		{
+			name:     "single value selected",
+			user:     "alice",
+			selected: "default",
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "forbidden value selected",
+			user:     "alice",
+			selected: "other",
+			expCode:  http.StatusForbidden,
+		},
+		{
+			name:     "several values without selection",
+			user:     "bob",
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace=~"default|other"}`,
+		},
+		{
+			name:     "several values with an allowed one",
+			user:     "bob",
+			opts:     []Option{WithAllowedLabelValues([]string{"default"})},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="default"}`,
+		},
+		{
+			name:     "several values with a negative matcher",
+			user:     "bob",
+			opts:     []Option{WithEnforcedMatchType(proxyLabel, labels.MatchNotEqual)},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace!~"default|other"}`,
+		},
+		{
+			name:    "several values without selection on the Alertmanager APIs",
+			path:    "/api/v2/silences",
+			user:    "bob",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:     "several values with selection",
+			user:     "bob",
+			selected: "default",
+			expCode:  http.StatusOK,
+		},
+		{
+			name:    "no value",
+			user:    "eve",
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "resolution failure",
+			user:    "alice",
+			err:     errors.New("connection refused"),
+			expCode: http.StatusServiceUnavailable,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			expQuery := tc.expQuery
+			if expQuery == "" {
+				expQuery = `up{namespace="default"}`
+			}
+			m := newMockUpstream(checkQueryHandler("", queryParam, expQuery))
+			defer m.Close()
+
+			resolver.err = tc.err
+			r, err := NewRoutes(m.url, proxyLabel, append([]Option{WithExtractLabeler(ResolvingEnforcer{
+				Identity:      HTTPHeaderEnforcer{Name: "X-Forwarded-User"},
+				Resolver:      resolver,
+				ParameterName: "tenant",
+			})}, tc.opts...)...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			path := tc.path
+			if path == "" {
+				path = "/api/v1/query"
+			}
+			u := "http://prometheus.example.com" + path + "?query=up"
+			if tc.selected != "" {
+				u += "&tenant=" + tc.selected
+			}
+			req := httptest.NewRequest(http.MethodGet, u, nil)
+			if tc.user != "" {
+				req.Header.Set("X-Forwarded-User", tc.user)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestCachingResolver(t *testing.T) {
+	resolver := &staticResolver{values: map[string][]string{"alice": {"default"}}}
+	now := time.Unix(0, 0)
+	c := NewCachingResolver(resolver, time.Minute)
+	c.now = func() time.Time { return now }
+
+	for i, step := range []struct {
+		advance  time.Duration
+		err      error
+		expErr   bool
+		expCalls int
+	}{
+		{expCalls: 1},
+		{advance: 30 * time.Second, expCalls: 1},
+		{advance: 30 * time.Second, expCalls: 2},
+		// Failures aren't cached and don't serve the expired entry.
+		{advance: 2 * time.Minute, err: errors.New("timeout"), expErr: true, expCalls: 3},
+		{expCalls: 4},
+		{expCalls: 4},
+	} {
+		now = now.Add(step.advance)
+		resolver.err = step.err
+
+		values, err := c.ResolveLabelValues(context.Background(), "alice")
+		if step.expErr {
+			if err == nil {
+				t.Fatalf("step %d: expected error, got none", i)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("step %d: unexpected error: %v", i, err)
+			}
+			if len(values) != 1 || values[0] != "default" {
+				t.Fatalf("step %d: unexpected values %v", i, values)
+			}
+		}
+		if resolver.calls != step.expCalls {
+			t.Fatalf("step %d: expected %d calls, got %d", i, step.expCalls, resolver.calls)
+		}
+	}
+}
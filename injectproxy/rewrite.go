@@ -0,0 +1,52 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// pathRewrite rewrites the request paths matching from to the to template.
+type pathRewrite struct {
+	from *regexp.Regexp
+	to   string
+}
+
+// rewritePath applies the first matching rewrite to the request path. It must
+// be called before routing the request: the rewritten path is the canonical
+// one on which the enforcement is decided and which is forwarded upstream.
+func (r *routes) rewritePath(req *http.Request) {
+	for _, rw := range r.pathRewrites {
+		m := rw.from.FindStringSubmatchIndex(req.URL.Path)
+		if m == nil {
+			continue
+		}
+
+		p := string(rw.from.ExpandString(nil, rw.to, req.URL.Path, m))
+		// Clean the path so that the router doesn't redirect the client to
+		// the rewritten path.
+		cleaned := path.Clean("/" + p)
+		if strings.HasSuffix(p, "/") && cleaned != "/" {
+			cleaned += "/"
+		}
+
+		r.debugf("rewriting path %q to %q", req.URL.Path, cleaned)
+		req.URL.Path = cleaned
+		req.URL.RawPath = ""
+		return
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPathRewrite(t *testing.T) {
+	rewrites := []Option{
+		// Deprecated path of an enforced endpoint.
+		WithPathRewrite("/old/query", "/api/v1/query"),
+		// Prefix swap.
+		WithPathRewrite("/prometheus/(.*)", "/$1"),
+		// Attempts to bypass the enforcement.
+		WithPathRewrite("/api/v1/series", "/api/v1/unknown"),
+		WithPathRewrite("/bypass/(.*)", "/api/v1/../../$1"),
+	}
+
+	for _, tc := range []struct {
+		name    string
+		path    string
+		query   url.Values
+		expCode int
+		expPath string
+	}{
+		{
+			name:    "rewritten to an enforced path",
+			path:    "/old/query",
+			query:   url.Values{queryParam: []string{"up"}, proxyLabel: []string{"default"}},
+			expCode: http.StatusOK,
+			expPath: "/api/v1/query",
+		},
+		{
+			name:    "rewritten to an enforced path without label value",
+			path:    "/old/query",
+			query:   url.Values{queryParam: []string{"up"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "prefix swapped to an enforced path",
+			path:    "/prometheus/api/v1/query",
+			query:   url.Values{queryParam: []string{"up"}, proxyLabel: []string{"default"}},
+			expCode: http.StatusOK,
+			expPath: "/api/v1/query",
+		},
+		{
+			name:    "prefix swapped to an enforced path without label value",
+			path:    "/prometheus/api/v1/query",
+			query:   url.Values{queryParam: []string{"up"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "enforced path rewritten to an unknown path",
+			path:    "/api/v1/series",
+			query:   url.Values{matchersParam: []string{"up"}},
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "rewritten to a non-canonical path",
+			path:    "/bypass/api/v1/query",
+			query:   url.Values{queryParam: []string{"up"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "not rewritten",
+			path:    "/api/v1/query",
+			query:   url.Values{queryParam: []string{"up"}, proxyLabel: []string{"default"}},
+			expCode: http.StatusOK,
+			expPath: "/api/v1/query",
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			var gotPath string
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				gotPath = req.URL.Path
+				checkQueryHandler("", queryParam, `up{namespace="default"}`).ServeHTTP(w, req)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, rewrites...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"?"+tc.query.Encode(), nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if gotPath != tc.expPath {
+				t.Fatalf("expected upstream path %q, got %q", tc.expPath, gotPath)
+			}
+		})
+	}
+
+	t.Run("invalid_rewrite", func(t *testing.T) {
+		_, err := NewRoutes(&url.URL{}, proxyLabel, WithPathRewrite("(", "/"))
+		if err == nil {
+			t.Fatal("expected error, got none")
+		}
+	})
+}
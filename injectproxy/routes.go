@@ -15,36 +15,174 @@ package injectproxy
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/efficientgo/tools/core/pkg/merrors"
 	"github.com/pkg/errors"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql/parser"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
-	queryParam    = "query"
-	matchersParam = "match[]"
+	queryParam       = "query"
+	matchersParam    = "match[]"
+	matchTargetParam = "match_target"
 )
 
 type routes struct {
-	upstream *url.URL
-	handler  http.Handler
-	label    string
+	upstream  *url.URL
+	handler   http.Handler
+	transport http.RoundTripper
+	label     string
+	el        ExtractLabeler
+
+	rulesWithActiveAlerts bool
+	scopedRecordingRules  bool
+	scopedAlertingRules   bool
+	maxQuerySelectors     int
+	maxMatchSelectors     int
+	maxQueryDepth         int
+	maxEstimatedSeries    int
+	matcherPosition       MatcherPosition
+	collapseMatchers      bool
+	skipIfLabelPresent    bool
+	stripIntrospection    bool
+	strictAlerts          bool
+	labelRef              *regexp.Regexp
+	responseBufferLimit   int
+	streamingThreshold    int
+	injectionMarkerKey    []byte
+	filteredCountHeader   bool
+	filteringTrailers     bool
+	filteringWarnings     bool
+	genericWarnings       bool
+	redactWarnings        *regexp.Regexp
+	passthroughOptions    bool
+	recompressResponses   bool
+	emptyBodyAsEmptyData  bool
+	maxQueryTimeout       time.Duration
+	maxQueryTimePast      time.Duration
+	maxQueryTimeFuture    time.Duration
+	processingTimeouts    map[string]time.Duration
+	scopedAlertReferences bool
+	alertsErrorOnReplace  bool
+	silenceErrorOnReplace bool
+	matchErrorOnConflict  bool
+	pathRewrites          []pathRewrite
+	forbidBroadNames      bool
+	minNamePrefix         int
+	matchOnLabels         bool
+	groupByLabels         bool
+	filterFederate        bool
+	queryCache            *queryCache
+	transform             LabelValueTransform
+	allowedValues         map[string]struct{}
+	additionalLabels      []labelEnforcement
+	matchType             labels.MatchType
+	maxSilenceDuration    time.Duration
+	events                *eventPublisher
+
+	noScopeStatusCode int
+	maxHeaders        int
+
+	metrics           *Metrics
+	requestLog        *Logger
+	redactLabelValues bool
+	tracer            trace.Tracer
+	tracing           bool
+	spanLabelValues   bool
+	debug             bool
 
 	mux       *http.ServeMux
 	modifiers map[string]func(*http.Response) error
 }
 
 type options struct {
-	enableLabelAPIs bool
-	pasthroughPaths []string
+	extractLabeler        ExtractLabeler
+	additionalLabels      []labelEnforcement
+	matchTypes            map[string]labels.MatchType
+	enableLabelAPIs       bool
+	pasthroughPaths       []string
+	proxyUnknownPaths     bool
+	strictQueryResults    bool
+	partialQueryResults   bool
+	rulesWithActiveAlerts bool
+	scopedRecordingRules  bool
+	scopedAlertingRules   bool
+	maxQuerySelectors     int
+	maxMatchSelectors     int
+	maxQueryDepth         int
+	maxEstimatedSeries    int
+	matcherPosition       MatcherPosition
+	collapseMatchers      bool
+	skipIfLabelPresent    bool
+	noScopeStatusCode     int
+	upstreamProxy         func(*http.Request) (*url.URL, error)
+	upstreamTLS           *UpstreamTLSConfig
+	alertsByFingerprint   string
+	stripIntrospection    bool
+	auditLog              io.Writer
+	maxHeaders            int
+	searchPath            string
+	rulesAlertsPath       string
+	noForwardedHeaders    bool
+	strictAlerts          bool
+	responseBufferLimit   int
+	streamingThreshold    int
+	injectionMarkerKey    []byte
+	filteredCountHeader   bool
+	filteringTrailers     bool
+	filteringWarnings     bool
+	genericWarnings       bool
+	redactWarnings        *regexp.Regexp
+	passthroughOptions    bool
+	recompressResponses   bool
+	emptyBodyAsEmptyData  bool
+	maxQueryTimeout       time.Duration
+	maxQueryTimePast      time.Duration
+	maxQueryTimeFuture    time.Duration
+	shadowUpstream        *url.URL
+	scopedAlertReferences bool
+	alertsErrorOnReplace  bool
+	silenceErrorOnReplace bool
+	matchErrorOnConflict  bool
+	pathRewrites          [][2]string
+	selectorPaths         map[string]string
+	processingTimeouts    map[string]time.Duration
+	jsonSelectorPaths     map[string]string
+	jsonExpressionPaths   map[string]string
+	grafanaQueries        bool
+	grafanaLive           bool
+	labelValueTransform   LabelValueTransform
+	allowedValues         []string
+	maxSilenceDuration    time.Duration
+	forbidBroadNames      bool
+	minNamePrefix         int
+	matchOnLabels         bool
+	groupByLabels         bool
+	filterFederate        bool
+	queryCache            *queryCache
+	stripAuthorization    bool
+	bearerTokenFile       string
+	events                *eventPublisher
+	metrics               *Metrics
+	requestLog            *Logger
+	redactLabelValues     bool
+	tracerProvider        trace.TracerProvider
+	spanLabelValues       bool
+	debug                 bool
 }
 
 type Option interface {
@@ -57,6 +195,37 @@ func (f optionFunc) apply(o *options) {
 	f(o)
 }
 
+// WithExtractLabeler configures how routes extract the label value from the requests. By default, the value is read
+// from the query parameter named after the label.
+func WithExtractLabeler(el ExtractLabeler) Option {
+	return optionFunc(func(o *options) {
+		o.extractLabeler = el
+	})
+}
+
+// WithAdditionalLabel configures routes to enforce another label along with the label, e.g. for multi-dimensional
+// tenancy. The value of the label is extracted from the request by el, by default from the query parameter named after
+// the label. The value isn't transformed nor restricted by the allowed values which only apply to the label.
+func WithAdditionalLabel(label string, el ExtractLabeler) Option {
+	return optionFunc(func(o *options) {
+		o.additionalLabels = append(o.additionalLabels, labelEnforcement{name: label, el: el})
+	})
+}
+
+// WithEnforcedMatchType configures routes to enforce the given label (the label or an additional label) with a matcher
+// of the given type instead of an equality matcher. The supported types are labels.MatchEqual, labels.MatchNotEqual and
+// labels.MatchNotRegexp (the value being a regular expression), e.g. to give access to all the series except the ones
+// of an internal namespace with namespace!="internal". The responses then keep the items which don't match the value.
+// The Alertmanager APIs, which set the label on the alerts and silences, aren't supported with negative matchers.
+func WithEnforcedMatchType(label string, t labels.MatchType) Option {
+	return optionFunc(func(o *options) {
+		if o.matchTypes == nil {
+			o.matchTypes = map[string]labels.MatchType{}
+		}
+		o.matchTypes[label] = t
+	})
+}
+
 // WithEnabledLabelsAPI enables proxying to labels API. If false, "501 Not implemented" will be return for those.
 func WithEnabledLabelsAPI() Option {
 	return optionFunc(func(o *options) {
@@ -64,6 +233,638 @@ func WithEnabledLabelsAPI() Option {
 	})
 }
 
+// WithFederationFiltering configures routes to drop from the /federate responses the samples which don't have the
+// enforced label value, in case the upstream ignores the injected selectors.
+func WithFederationFiltering() Option {
+	return optionFunc(func(o *options) {
+		o.filterFederate = true
+	})
+}
+
+// WithStrictQueryResults configures routes to verify that every series returned by the query endpoints carries the
+// enforced label with the expected value. If any series doesn't (e.g. because it was produced by a function that drops
+// labels), the response is replaced by an error instead of being passed to the client.
+func WithStrictQueryResults() Option {
+	return optionFunc(func(o *options) {
+		o.strictQueryResults = true
+	})
+}
+
+// WithPartialQueryResults configures routes to filter the partial results of the query endpoints, i.e. the successful
+// responses carrying warnings such as the Thanos partial responses: the series which don't carry the enforced label
+// value are removed and a warning is appended instead of failing the request (see WithStrictQueryResults). The
+// warnings of the upstream are preserved so that the client knows that the result is incomplete.
+func WithPartialQueryResults() Option {
+	return optionFunc(func(o *options) {
+		o.partialQueryResults = true
+	})
+}
+
+// WithRulesWithActiveAlerts configures routes to also return the alerting rules which don't have the enforced label
+// but have at least one active alert matching it. Only the matching alerts are returned for such rules.
+func WithRulesWithActiveAlerts() Option {
+	return optionFunc(func(o *options) {
+		o.rulesWithActiveAlerts = true
+	})
+}
+
+// WithScopedRecordingRuleQueries configures routes to inject the enforced label matcher into the query expressions of
+// the recording rules returned by /api/v1/rules. The rules whose query can't be enforced are dropped.
+func WithScopedRecordingRuleQueries() Option {
+	return optionFunc(func(o *options) {
+		o.scopedRecordingRules = true
+	})
+}
+
+// WithScopedAlertingRuleQueries configures routes to inject the enforced label matcher into the query expressions of
+// the alerting rules returned by /api/v1/rules. The rules whose query can't be enforced are dropped.
+func WithScopedAlertingRuleQueries() Option {
+	return optionFunc(func(o *options) {
+		o.scopedAlertingRules = true
+	})
+}
+
+// WithQueryComplexityLimits configures routes to reject the PromQL queries having more than maxSelectors selectors or
+// a nesting depth greater than maxDepth. A zero value means no limit.
+func WithQueryComplexityLimits(maxSelectors, maxDepth int) Option {
+	return optionFunc(func(o *options) {
+		o.maxQuerySelectors = maxSelectors
+		o.maxQueryDepth = maxDepth
+	})
+}
+
+// WithMaxMatchSelectors configures routes to reject the requests having more than max match[] selectors (or selectors of
+// the custom selector endpoints), e.g. on /api/v1/series. A zero value means no limit.
+func WithMaxMatchSelectors(max int) Option {
+	return optionFunc(func(o *options) {
+		o.maxMatchSelectors = max
+	})
+}
+
+// WithMaxEstimatedSeries configures routes to estimate the number of series selected by the range queries before
+// forwarding them and to reject the queries selecting more than max series. The estimate is a cheap instant query
+// counting the series of every (enforced) selector of the query at the end of the range. It protects the upstream
+// from the queries which are properly scoped but too large. A zero value disables the estimate.
+func WithMaxEstimatedSeries(max int) Option {
+	return optionFunc(func(o *options) {
+		o.maxEstimatedSeries = max
+	})
+}
+
+// MatcherPosition is the position of the enforced matchers in the serialized selectors sent upstream.
+type MatcherPosition int
+
+const (
+	// MatcherPositionDefault keeps the order of the PromQL printer (sorted matchers) for the queries and appends the
+	// enforced matchers to the match[] selectors.
+	MatcherPositionDefault MatcherPosition = iota
+	// MatcherPositionFirst puts the enforced matchers before the other matchers.
+	MatcherPositionFirst
+	// MatcherPositionLast puts the enforced matchers after the other matchers.
+	MatcherPositionLast
+)
+
+// WithEnforcedMatcherPosition configures the position of the enforced matchers in the serialized selectors sent
+// upstream, e.g. for the tools parsing the query logs of the upstream which expect the enforced matcher at a fixed
+// position. The metric name of a PromQL selector is always serialized before its matchers.
+func WithEnforcedMatcherPosition(p MatcherPosition) Option {
+	return optionFunc(func(o *options) {
+		o.matcherPosition = p
+	})
+}
+
+// WithForbiddenBroadNameMatchers configures routes to reject the selectors whose matcher on the metric name is too
+// broad, e.g. {__name__=~".+"} or {__name__!=""}. Negative matchers on the metric name are always rejected. Regular
+// expressions are accepted only when they match a finite set of names (e.g. "foo|bar") or, if minPrefix isn't zero,
+// when they start with a literal prefix of at least minPrefix characters (e.g. "node_.*" for a minimum of 5).
+func WithForbiddenBroadNameMatchers(minPrefix int) Option {
+	return optionFunc(func(o *options) {
+		o.forbidBroadNames = true
+		o.minNamePrefix = minPrefix
+	})
+}
+
+// WithEnforcedVectorMatching configures routes to add the label to the on() clauses and to remove it from the
+// ignoring() clauses of the binary operations between vectors of the queries. The series of both sides are then only
+// matched on the label value and the results of the on() clauses keep the label.
+func WithEnforcedVectorMatching() Option {
+	return optionFunc(func(o *options) {
+		o.matchOnLabels = true
+	})
+}
+
+// WithEnforcedGrouping configures routes to add the label to the by() clauses and to remove it from the without()
+// clauses of the aggregations of the queries, so that their results keep the label, e.g. when they are federated.
+// This changes the grouping of the results when the query spans several label values.
+func WithEnforcedGrouping() Option {
+	return optionFunc(func(o *options) {
+		o.groupByLabels = true
+	})
+}
+
+// WithCollapsedMatchers configures routes to not inject an enforced matcher into the match[] selectors which already
+// have an identical matcher (same label, type and value), e.g. `{namespace="x"}` is sent as is instead of
+// `{namespace="x",namespace="x"}`. The selectors having a different matcher on the label are still enforced.
+func WithCollapsedMatchers() Option {
+	return optionFunc(func(o *options) {
+		o.collapseMatchers = true
+	})
+}
+
+// WithSkipIfLabelPresent configures routes to not inject the label matcher into the selectors which already have a
+// matcher on the label, whatever its type and value. This trusts the existing matcher and should only be used when the
+// requests were already enforced upstream, e.g. by another proxy in a chained topology.
+func WithSkipIfLabelPresent() Option {
+	return optionFunc(func(o *options) {
+		o.skipIfLabelPresent = true
+	})
+}
+
+// WithNoScopeStatusCode configures the HTTP status code returned when the
+// request carries no label value. It must be one of 400 (default), 401 or 403.
+func WithNoScopeStatusCode(code int) Option {
+	return optionFunc(func(o *options) {
+		o.noScopeStatusCode = code
+	})
+}
+
+// WithUpstreamProxy configures the function returning the proxy used for the
+// connections to the upstream, overriding the HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY environment variables. A function returning a nil URL disables the
+// proxy.
+func WithUpstreamProxy(proxy func(*http.Request) (*url.URL, error)) Option {
+	return optionFunc(func(o *options) {
+		o.upstreamProxy = proxy
+	})
+}
+
+// WithUpstreamTLS configures the TLS connections to the upstream, e.g. to
+// present a client certificate (mutual TLS) or to verify the upstream
+// certificate with a private CA.
+func WithUpstreamTLS(c UpstreamTLSConfig) Option {
+	return optionFunc(func(o *options) {
+		o.upstreamTLS = &c
+	})
+}
+
+// WithAlertsByFingerprintPath configures routes to enforce the label on the
+// given path which takes a list of alert fingerprints in the "fingerprint"
+// query parameter (e.g. a custom endpoint returning the alerts' annotations).
+// The fingerprints are resolved to the alerts' labels with the Alertmanager
+// API and only the fingerprints of alerts matching the label are forwarded.
+func WithAlertsByFingerprintPath(path string) Option {
+	return optionFunc(func(o *options) {
+		o.alertsByFingerprint = path
+	})
+}
+
+// WithStripQueryIntrospection configures routes to remove the query
+// introspection parameters (stats, explain and analyze) from the query requests
+// and the corresponding fields from the responses. Query statistics reveal the
+// backend timings and cardinalities while Thanos query plans may reveal the
+// store topology and the external labels of other tenants.
+func WithStripQueryIntrospection() Option {
+	return optionFunc(func(o *options) {
+		o.stripIntrospection = true
+	})
+}
+
+// WithStripQueryExplanation is an alias of WithStripQueryIntrospection.
+//
+// Deprecated: use WithStripQueryIntrospection.
+func WithStripQueryExplanation() Option {
+	return WithStripQueryIntrospection()
+}
+
+// WithAuditLog configures routes to write an audit record to w for every
+// query, range query and series request forwarded upstream. The record
+// contains the exact URL query string and body sent upstream, the label value
+// and where it was extracted from.
+func WithAuditLog(w io.Writer) Option {
+	return optionFunc(func(o *options) {
+		o.auditLog = w
+	})
+}
+
+// WithRequestLog configures routes to write a line to l for every request
+// with its method, path, route, enforced label value, status code, upstream
+// status code, duration and, for the requests rejected by the proxy, the
+// error. The ID of the request is propagated from the X-Request-Id header or
+// generated, and set on both the upstream request and the response. When
+// redactLabelValues is true, the label values are replaced by a hash.
+func WithRequestLog(l *Logger, redactLabelValues bool) Option {
+	return optionFunc(func(o *options) {
+		o.requestLog = l
+		o.redactLabelValues = redactLabelValues
+	})
+}
+
+// WithMaxHeaders configures routes to reject the requests with more than n
+// header values. It guards the label extraction against requests sending
+// many tiny headers.
+func WithMaxHeaders(n int) Option {
+	return optionFunc(func(o *options) {
+		o.maxHeaders = n
+	})
+}
+
+// WithSearchPath configures routes to enforce the label on the given search
+// endpoint returning metric names (e.g. for autocompletion). The response must
+// be a Prometheus API response whose data is a list of metric names. Only the
+// names having at least one series matching the label are returned, which is
+// verified with a series lookup scoped to the label value.
+func WithSearchPath(path string) Option {
+	return optionFunc(func(o *options) {
+		o.searchPath = path
+	})
+}
+
+// WithRulesAndAlertsPath configures routes to enforce the label on the given endpoint combining the rule groups of
+// /api/v1/rules and the alerts of /api/v1/alerts in the same response (e.g. for dashboards). The response must be a
+// Prometheus API response whose data has both the groups and alerts fields, which are filtered like the responses
+// of /api/v1/rules and /api/v1/alerts.
+func WithRulesAndAlertsPath(path string) Option {
+	return optionFunc(func(o *options) {
+		o.rulesAlertsPath = path
+	})
+}
+
+// WithDisabledForwardedHeaders configures routes to not send the
+// X-Forwarded-For, X-Forwarded-Host and X-Forwarded-Proto headers upstream,
+// e.g. when the upstream shouldn't see the client IP addresses.
+func WithDisabledForwardedHeaders() Option {
+	return optionFunc(func(o *options) {
+		o.noForwardedHeaders = true
+	})
+}
+
+// WithStrictAlerts configures routes to also drop the alerts whose
+// annotations or generator URL reference a value of the label different from
+// the alert's value (e.g. `namespace="other"` in the expression), which may
+// disclose data of another tenant.
+func WithStrictAlerts() Option {
+	return optionFunc(func(o *options) {
+		o.strictAlerts = true
+	})
+}
+
+// WithResponseBufferLimit configures the size in bytes above which the
+// responses modified by the proxy are buffered in a temporary file instead of
+// memory. It defaults to 32MiB.
+func WithResponseBufferLimit(limit int) Option {
+	return optionFunc(func(o *options) {
+		o.responseBufferLimit = limit
+	})
+}
+
+// WithStreamingThreshold configures the size in bytes above which the rules
+// and alerts responses are filtered while being streamed to the client instead
+// of being decoded and encoded as a whole, bounding the memory usage for large
+// responses. The responses of unknown size are always streamed. It's disabled
+// by default and when the X-Filtered-Count header or the filtering warnings are
+// enabled.
+func WithStreamingThreshold(threshold int) Option {
+	return optionFunc(func(o *options) {
+		o.streamingThreshold = threshold
+	})
+}
+
+// WithInjectionMarker configures routes to mark the query requests forwarded
+// upstream with a header listing the labels enforced in the query, signed with
+// the given key, and to forward the query requests carrying a valid marker for
+// the label and value without re-enforcing them. The local policies (timeout,
+// time window, replica labels, complexity limits, series estimate and cache)
+// still apply to the marked queries. This is meant for instances sharing the
+// same key and placed before and after a Thanos query-frontend (the
+// sub-queries split by the frontend keep the marker of the original query) or
+// chained to enforce different labels (e.g. an organization then a team): the
+// labels of the previous instances are kept in the marker.
+func WithInjectionMarker(key []byte) Option {
+	return optionFunc(func(o *options) {
+		o.injectionMarkerKey = key
+	})
+}
+
+// WithFilteredCountHeader configures routes to report the number of rules or
+// alerts dropped by the proxy in the X-Filtered-Count response header.
+func WithFilteredCountHeader() Option {
+	return optionFunc(func(o *options) {
+		o.filteredCountHeader = true
+	})
+}
+
+// WithFilteringTrailers configures routes to report the enforced label and the number of items dropped by the proxy
+// in the X-Enforced-Label and X-Filtered-Count trailers of the streamed responses (see WithStreamingThreshold and
+// WithFederationFiltering), since the number of items dropped is only known once the response has been sent. The
+// trailers are only sent to HTTP/2 clients.
+func WithFilteringTrailers() Option {
+	return optionFunc(func(o *options) {
+		o.filteringTrailers = true
+	})
+}
+
+// WithOptionsPassthrough configures routes to forward the OPTIONS requests
+// (e.g. CORS preflight requests) of the enforced endpoints to the upstream
+// without label enforcement so that the upstream CORS handling answers them.
+// The query string and body of these requests are dropped.
+func WithOptionsPassthrough() Option {
+	return optionFunc(func(o *options) {
+		o.passthroughOptions = true
+	})
+}
+
+// WithFilteringWarnings configures routes to add a warning to the rules and
+// alerts responses when none of the upstream items match the label value,
+// which usually denotes a wrong label mapping for the tenant.
+func WithFilteringWarnings() Option {
+	return optionFunc(func(o *options) {
+		o.filteringWarnings = true
+	})
+}
+
+// WithGenericWarnings configures routes to replace the warnings of the upstream responses filtered by the proxy
+// (including the query responses) with a single generic warning, since the warnings of partial responses (e.g. of
+// Thanos) usually name the stores which failed and disclose the backend topology to the tenants.
+func WithGenericWarnings() Option {
+	return optionFunc(func(o *options) {
+		o.genericWarnings = true
+	})
+}
+
+// WithRedactedWarnings configures routes to redact the parts of the warnings of the upstream responses filtered by
+// the proxy (including the query responses) which match the given expression, e.g. the addresses of the Thanos
+// stores. WithGenericWarnings takes precedence.
+func WithRedactedWarnings(re *regexp.Regexp) Option {
+	return optionFunc(func(o *options) {
+		o.redactWarnings = re
+	})
+}
+
+// WithRecompressedResponses configures routes to gzip the responses modified by
+// the proxy (e.g. filtered rules) when the upstream response was compressed and
+// the client accepts gzip. Otherwise they are sent uncompressed.
+func WithRecompressedResponses() Option {
+	return optionFunc(func(o *options) {
+		o.recompressResponses = true
+	})
+}
+
+// WithEmptyResponsesAsEmptyResults configures routes to return an empty result
+// instead of a 502 error when the upstream returns a 200 response without body
+// for the endpoints filtered by the proxy.
+func WithEmptyResponsesAsEmptyResults() Option {
+	return optionFunc(func(o *options) {
+		o.emptyBodyAsEmptyData = true
+	})
+}
+
+// WithMaxQueryTimeout configures routes to cap the timeout parameter of the
+// query requests to the given duration. Requests without timeout get it.
+func WithMaxQueryTimeout(d time.Duration) Option {
+	return optionFunc(func(o *options) {
+		o.maxQueryTimeout = d
+	})
+}
+
+// WithQueryTimeWindow configures routes to reject the instant queries whose time parameter is more than maxPast
+// before or maxFuture after the current time (e.g. to avoid expensive scans beyond the retention). A zero duration
+// means no limit.
+func WithQueryTimeWindow(maxPast, maxFuture time.Duration) Option {
+	return optionFunc(func(o *options) {
+		o.maxQueryTimePast = maxPast
+		o.maxQueryTimeFuture = maxFuture
+	})
+}
+
+// WithQueryCache configures routes to cache the responses of the query and
+// range query endpoints for the given duration, e.g. for dashboards polling the
+// same queries. The responses are cached by enforced label value, query and
+// time parameters rounded to the TTL, up to size entries. The Cache-Control
+// header of the requests and responses is honored. The routes built with the
+// same option share the cache, e.g. when they are built again on reload.
+func WithQueryCache(ttl time.Duration, size int) Option {
+	if ttl <= 0 {
+		return optionFunc(func(o *options) {})
+	}
+	if size <= 0 {
+		size = defaultQueryCacheSize
+	}
+	c := newQueryCache(ttl, size)
+	return optionFunc(func(o *options) {
+		o.queryCache = c
+	})
+}
+
+// WithEventSink configures routes to publish an event for each enforced
+// request to the given sink, e.g. for security monitoring. The events are
+// published asynchronously and dropped if the sink can't keep up. The routes
+// built with the same option share the publisher, e.g. when they are built
+// again on reload.
+func WithEventSink(sink EventSink) Option {
+	p := newEventPublisher(sink)
+	return optionFunc(func(o *options) {
+		o.events = p
+	})
+}
+
+// WithShadowUpstream configures routes to mirror the enforced read requests to
+// a shadow upstream, e.g. to validate a backend migration. The responses of the
+// shadow upstream are filtered like the primary ones and compared to them, the
+// divergences being logged and counted in the metrics. The client only gets
+// the primary response.
+func WithShadowUpstream(u *url.URL) Option {
+	return optionFunc(func(o *options) {
+		o.shadowUpstream = u
+	})
+}
+
+// WithScopedAlertReferences configures routes to remove from the status of the
+// Alertmanager alerts the IDs of the silences (silencedBy) and inhibiting alerts
+// (inhibitedBy) which don't match the enforced label value.
+func WithScopedAlertReferences() Option {
+	return optionFunc(func(o *options) {
+		o.scopedAlertReferences = true
+	})
+}
+
+// WithSilencesErrorOnReplace configures routes to reject the silences created
+// or updated through Alertmanager (POST /api/v2/silences) having a matcher on
+// the enforced label other than an equality matcher with the enforced value,
+// instead of replacing the matcher.
+func WithSilencesErrorOnReplace() Option {
+	return optionFunc(func(o *options) {
+		o.silenceErrorOnReplace = true
+	})
+}
+
+// WithSelectorsErrorOnConflict configures routes to reject the requests having a match[] selector (e.g. for the
+// /api/v1/series and /api/v1/labels endpoints) with a matcher on the label which doesn't match the enforced value,
+// instead of returning an empty result for the selector.
+func WithSelectorsErrorOnConflict() Option {
+	return optionFunc(func(o *options) {
+		o.matchErrorOnConflict = true
+	})
+}
+
+// WithAlertsErrorOnReplace configures routes to reject the alerts pushed to
+// Alertmanager (POST /api/v2/alerts) carrying the enforced label with another
+// value instead of replacing the value.
+func WithAlertsErrorOnReplace() Option {
+	return optionFunc(func(o *options) {
+		o.alertsErrorOnReplace = true
+	})
+}
+
+// WithPathRewrite configures routes to rewrite the request paths matching the
+// from regular expression (anchored at both ends) to the to template which can
+// reference the capture groups (e.g. $1). Only the first matching rewrite is
+// applied. The paths are rewritten before being routed, so that the
+// enforcement is always decided on the path forwarded upstream.
+func WithPathRewrite(from, to string) Option {
+	return optionFunc(func(o *options) {
+		o.pathRewrites = append(o.pathRewrites, [2]string{from, to})
+	})
+}
+
+// WithProcessingTimeouts configures routes to bound the total processing time of the requests to the given paths,
+// from the reception of the request to the end of the response modification (e.g. the filtering of a large rules
+// response), e.g. "/api/v1/rules": 10s. The requests exceeding it get a 504 error.
+func WithProcessingTimeouts(timeouts map[string]time.Duration) Option {
+	return optionFunc(func(o *options) {
+		o.processingTimeouts = timeouts
+	})
+}
+
+// WithSelectorPaths configures routes to enforce the label on additional endpoints taking series selectors. The map
+// associates each path with the name of its parameter holding the selectors (e.g. "/custom/selectors": "sel[]"). The
+// label is injected into each selector like for the /api/v1/series endpoint.
+func WithSelectorPaths(paths map[string]string) Option {
+	return optionFunc(func(o *options) {
+		o.selectorPaths = paths
+	})
+}
+
+// WithJSONSelectorPaths configures routes to enforce the label on additional POST endpoints taking series selectors in
+// a JSON body, e.g. batches of series requests. The map associates each path with the JSONPath expression selecting
+// the arrays of selectors in the body (e.g. "/custom/batch": `$[*]["match[]"]` for a body like
+// `[{"match[]": ["up"]}, {"match[]": ["down"]}]`). The label is injected into every selector and the requests for
+// which the expression selects nothing are rejected.
+func WithJSONSelectorPaths(paths map[string]string) Option {
+	return optionFunc(func(o *options) {
+		o.jsonSelectorPaths = paths
+	})
+}
+
+// WithJSONExpressionPaths configures routes to enforce the label on additional POST endpoints taking PromQL
+// expressions in a JSON body, e.g. the rule test or preview endpoints whose path varies by backend. The map associates
+// each path with the JSONPath expression selecting the expressions in the body (e.g. "/api/v1/rule/test":
+// `$.rules[*].expr`). The label is injected into every expression like for the query endpoints.
+func WithJSONExpressionPaths(paths map[string]string) Option {
+	return optionFunc(func(o *options) {
+		o.jsonExpressionPaths = paths
+	})
+}
+
+// WithGrafanaQueries configures routes to enforce the label on the Grafana
+// datasource query endpoint (/api/ds/query) when Grafana is behind the proxy.
+// The label is injected into the PromQL expression of every query of the body.
+func WithGrafanaQueries() Option {
+	return optionFunc(func(o *options) {
+		o.grafanaQueries = true
+	})
+}
+
+// WithGrafanaLive configures routes to forward the WebSocket connections of
+// Grafana Live (/api/live/ws) when Grafana is behind the proxy. The label
+// value is extracted and validated on the upgrade request, the upgrades without
+// valid value are rejected. The messages aren't enforced, the connection is
+// passed through as-is (and never to the shadow upstream).
+func WithGrafanaLive() Option {
+	return optionFunc(func(o *options) {
+		o.grafanaLive = true
+	})
+}
+
+// WithAllowedLabelValues configures routes to reject with 403 the requests whose label value, once extracted, isn't
+// one of the given values. This is an additional safeguard against misconfigured extraction sources (e.g. an
+// authenticating proxy) producing unexpected values.
+func WithAllowedLabelValues(values []string) Option {
+	return optionFunc(func(o *options) {
+		o.allowedValues = values
+	})
+}
+
+// WithLabelValueTransform configures routes to transform the label value once extracted from the request, before
+// it's checked against the allowed values and enforced. The requests whose value can't be transformed or is empty
+// once transformed are rejected.
+func WithLabelValueTransform(t LabelValueTransform) Option {
+	return optionFunc(func(o *options) {
+		o.labelValueTransform = t
+	})
+}
+
+// WithMaxSilenceDuration configures routes to reject the Alertmanager silences
+// lasting longer than the given duration, from their start (or now if they
+// start in the past) to their end.
+func WithMaxSilenceDuration(d time.Duration) Option {
+	return optionFunc(func(o *options) {
+		o.maxSilenceDuration = d
+	})
+}
+
+// WithStrippedAuthorization configures routes to remove the Authorization
+// header from the requests sent upstream, e.g. when the header carries the
+// credentials of the tenants which the upstream shouldn't see. By default, the
+// header is forwarded as-is.
+func WithStrippedAuthorization() Option {
+	return optionFunc(func(o *options) {
+		o.stripAuthorization = true
+	})
+}
+
+// WithUpstreamBearerTokenFile configures routes to replace the Authorization
+// header of the requests sent upstream with the bearer token read from the
+// given file, so that the proxy authenticates to the upstream with its own
+// identity. The file is read again when it changes.
+func WithUpstreamBearerTokenFile(file string) Option {
+	return optionFunc(func(o *options) {
+		o.bearerTokenFile = file
+	})
+}
+
+// WithMetrics configures routes to record their metrics into the given Metrics.
+func WithMetrics(m *Metrics) Option {
+	return optionFunc(func(o *options) {
+		o.metrics = m
+	})
+}
+
+// WithTracerProvider configures routes to trace the requests with the tracers
+// of tp: one span for the label value extraction, one for the label injection
+// and one for the upstream round-trip. The trace context of the incoming
+// requests is propagated to the upstream.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return optionFunc(func(o *options) {
+		o.tracerProvider = tp
+	})
+}
+
+// WithLabelValuesInSpans configures routes to record the enforced label values
+// as an attribute of the label value extraction span. They aren't recorded by
+// default since they may be sensitive.
+func WithLabelValuesInSpans() Option {
+	return optionFunc(func(o *options) {
+		o.spanLabelValues = true
+	})
+}
+
+// WithDebugLogging enables the debug logs.
+func WithDebugLogging() Option {
+	return optionFunc(func(o *options) {
+		o.debug = true
+	})
+}
+
 // WithPassthroughPaths configures routes to register given paths as passthrough handlers for all HTTP methods.
 // that, if requested, will be forwarded without enforcing label. Use with care.
 // NOTE: Passthrough "all" paths like "/" or "" and regex are not allowed.
@@ -73,6 +874,16 @@ func WithPassthroughPaths(paths []string) Option {
 	})
 }
 
+// WithUnknownPathsProxied configures routes to forward the requests to the paths without route to the upstream as-is,
+// without enforcing the label. By default, these requests are denied with 404 so that the endpoints of the upstream
+// which aren't explicitly handled aren't exposed. The endpoints of the proxy which are disabled (e.g. the labels APIs)
+// are still denied. Use with care.
+func WithUnknownPathsProxied() Option {
+	return optionFunc(func(o *options) {
+		o.proxyUnknownPaths = true
+	})
+}
+
 // strictMux is a mux that wraps standard HTTP handler with safer handler that allows safe user provided handler registrations.
 type strictMux struct {
 	seen map[string]struct{}
@@ -122,34 +933,291 @@ func NewRoutes(upstream *url.URL, label string, opts ...Option) (*routes, error)
 		o.apply(&opt)
 	}
 
+	if opt.extractLabeler == nil {
+		opt.extractLabeler = HTTPFormEnforcer{ParameterName: label}
+	}
+
+	seen := map[string]struct{}{label: {}}
+	for i, le := range opt.additionalLabels {
+		if le.name == "" {
+			return nil, errors.New("the additional label name cannot be empty")
+		}
+		if _, ok := seen[le.name]; ok {
+			return nil, errors.Errorf("label %q is enforced more than once", le.name)
+		}
+		seen[le.name] = struct{}{}
+		if le.el == nil {
+			opt.additionalLabels[i].el = HTTPFormEnforcer{ParameterName: le.name}
+		}
+		opt.additionalLabels[i].matchType = opt.matchTypes[le.name]
+	}
+	negativeMatchers := false
+	for name, t := range opt.matchTypes {
+		if _, ok := seen[name]; !ok {
+			return nil, errors.Errorf("match type configured for the label %q which isn't enforced", name)
+		}
+		switch t {
+		case labels.MatchEqual:
+		case labels.MatchNotEqual, labels.MatchNotRegexp:
+			negativeMatchers = true
+		default:
+			return nil, errors.Errorf("invalid match type %q for the label %q", t, name)
+		}
+	}
+
+	switch opt.noScopeStatusCode {
+	case 0:
+		opt.noScopeStatusCode = http.StatusBadRequest
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden:
+	default:
+		return nil, errors.Errorf("invalid status code for requests without label value: %d", opt.noScopeStatusCode)
+	}
+
+	if opt.responseBufferLimit <= 0 {
+		opt.responseBufferLimit = defaultResponseBufferLimit
+	}
+
+	if opt.metrics == nil {
+		opt.metrics = NewMetrics(nil)
+	}
+
+	rewrites := make([]pathRewrite, 0, len(opt.pathRewrites))
+	for _, rw := range opt.pathRewrites {
+		from, err := regexp.Compile("^(?:" + rw[0] + ")$")
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid path rewrite %q", rw[0])
+		}
+		rewrites = append(rewrites, pathRewrite{from: from, to: rw[1]})
+	}
+
 	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		setForwardedHeaders(req, !opt.noForwardedHeaders)
+	}
+	if opt.upstreamProxy != nil || opt.upstreamTLS != nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		if opt.upstreamProxy != nil {
+			t.Proxy = opt.upstreamProxy
+		}
+		if opt.upstreamTLS != nil {
+			cfg, err := opt.upstreamTLS.tlsConfig()
+			if err != nil {
+				return nil, err
+			}
+			t.TLSClientConfig = cfg
+		}
+		proxy.Transport = t
+	}
+	if opt.stripAuthorization || opt.bearerTokenFile != "" {
+		next := proxy.Transport
+		if next == nil {
+			next = http.DefaultTransport
+		}
+		t := &authorizationTransport{next: next}
+		if opt.bearerTokenFile != "" {
+			t.token = &tokenFile{path: opt.bearerTokenFile}
+		}
+		proxy.Transport = t
+	}
+	baseTransport := proxy.Transport
+	if opt.auditLog != nil {
+		next := proxy.Transport
+		if next == nil {
+			next = http.DefaultTransport
+		}
+		proxy.Transport = &auditTransport{
+			next:   next,
+			label:  label,
+			source: extractionSource(opt.extractLabeler),
+			w:      opt.auditLog,
+		}
+	}
+
+	tracer := trace.NewNoopTracerProvider().Tracer(tracerName)
+	if opt.tracerProvider != nil {
+		tracer = opt.tracerProvider.Tracer(tracerName)
+		next := proxy.Transport
+		if next == nil {
+			next = http.DefaultTransport
+		}
+		proxy.Transport = &tracingTransport{next: next, tracer: tracer}
+	}
 
-	r := &routes{upstream: upstream, handler: proxy, label: label}
+	transport := proxy.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	r := &routes{
+		upstream:              upstream,
+		handler:               proxy,
+		transport:             transport,
+		label:                 label,
+		el:                    opt.extractLabeler,
+		additionalLabels:      opt.additionalLabels,
+		matchType:             opt.matchTypes[label],
+		rulesWithActiveAlerts: opt.rulesWithActiveAlerts,
+		scopedRecordingRules:  opt.scopedRecordingRules,
+		scopedAlertingRules:   opt.scopedAlertingRules,
+		maxQuerySelectors:     opt.maxQuerySelectors,
+		maxMatchSelectors:     opt.maxMatchSelectors,
+		maxQueryDepth:         opt.maxQueryDepth,
+		maxEstimatedSeries:    opt.maxEstimatedSeries,
+		matcherPosition:       opt.matcherPosition,
+		collapseMatchers:      opt.collapseMatchers,
+		forbidBroadNames:      opt.forbidBroadNames,
+		minNamePrefix:         opt.minNamePrefix,
+		matchOnLabels:         opt.matchOnLabels,
+		groupByLabels:         opt.groupByLabels,
+		filterFederate:        opt.filterFederate,
+		skipIfLabelPresent:    opt.skipIfLabelPresent,
+		stripIntrospection:    opt.stripIntrospection,
+		strictAlerts:          opt.strictAlerts,
+		labelRef:              labelReference(label),
+		responseBufferLimit:   opt.responseBufferLimit,
+		streamingThreshold:    opt.streamingThreshold,
+		injectionMarkerKey:    opt.injectionMarkerKey,
+		filteredCountHeader:   opt.filteredCountHeader,
+		filteringTrailers:     opt.filteringTrailers,
+		filteringWarnings:     opt.filteringWarnings,
+		genericWarnings:       opt.genericWarnings,
+		redactWarnings:        opt.redactWarnings,
+		passthroughOptions:    opt.passthroughOptions,
+		recompressResponses:   opt.recompressResponses,
+		emptyBodyAsEmptyData:  opt.emptyBodyAsEmptyData,
+		maxQueryTimeout:       opt.maxQueryTimeout,
+		maxQueryTimePast:      opt.maxQueryTimePast,
+		maxQueryTimeFuture:    opt.maxQueryTimeFuture,
+		scopedAlertReferences: opt.scopedAlertReferences,
+		alertsErrorOnReplace:  opt.alertsErrorOnReplace,
+		silenceErrorOnReplace: opt.silenceErrorOnReplace,
+		matchErrorOnConflict:  opt.matchErrorOnConflict,
+		pathRewrites:          rewrites,
+		transform:             opt.labelValueTransform,
+		maxSilenceDuration:    opt.maxSilenceDuration,
+		noScopeStatusCode:     opt.noScopeStatusCode,
+		maxHeaders:            opt.maxHeaders,
+		metrics:               opt.metrics,
+		processingTimeouts:    opt.processingTimeouts,
+		requestLog:            opt.requestLog,
+		redactLabelValues:     opt.redactLabelValues,
+		tracer:                tracer,
+		tracing:               opt.tracerProvider != nil,
+		spanLabelValues:       opt.spanLabelValues,
+		debug:                 opt.debug,
+	}
+	if opt.events != nil {
+		r.events = opt.events.start(opt.metrics)
+	}
+	r.queryCache = opt.queryCache
+	if opt.allowedValues != nil {
+		r.allowedValues = make(map[string]struct{}, len(opt.allowedValues))
+		for _, v := range opt.allowedValues {
+			r.allowedValues[v] = struct{}{}
+		}
+	}
 	mux := newStrictMux()
 
 	errs := merrors.New(
-		mux.Handle("/federate", r.enforceLabel(enforceMethods(r.matcher, "GET"))),
+		mux.Handle("/federate", r.enforceLabel(enforceMethods(r.federate, "GET"))),
 		mux.Handle("/api/v1/query", r.enforceLabel(enforceMethods(r.query, "GET", "POST"))),
 		mux.Handle("/api/v1/query_range", r.enforceLabel(enforceMethods(r.query, "GET", "POST"))),
-		mux.Handle("/api/v1/alerts", r.enforceLabel(enforceMethods(r.passthrough, "GET"))),
-		mux.Handle("/api/v1/rules", r.enforceLabel(enforceMethods(r.passthrough, "GET"))),
-		mux.Handle("/api/v1/series", r.enforceLabel(enforceMethods(r.matcher, "GET"))),
+		mux.Handle("/api/v1/query_exemplars", r.enforceLabel(enforceMethods(r.query, "GET", "POST"))),
+		mux.Handle("/api/v1/alerts", r.enforceLabel(enforceMethods(r.prometheusAlerts, "GET"))),
+		mux.Handle("/api/v1/rules", r.enforceLabel(enforceMethods(r.rules, "GET"))),
+		mux.Handle("/api/v1/series", r.enforceLabel(enforceMethods(r.matcher, "GET", "POST"))),
+		mux.Handle("/api/v1/targets/metadata", r.enforceLabel(enforceMethods(r.matchTarget, "GET"))),
 	)
 
 	if opt.enableLabelAPIs {
 		errs.Add(
-			mux.Handle("/api/v1/labels", r.enforceLabel(enforceMethods(r.matcher, "GET"))),
+			mux.Handle("/api/v1/labels", r.enforceLabel(enforceMethods(r.matcher, "GET", "POST"))),
 			// Full path is /api/v1/label/<label_name>/values but http mux does not support patterns.
 			// This is fine though as we don't care about name for matcher injector.
 			mux.Handle("/api/v1/label/", r.enforceLabel(enforceMethods(r.matcher, "GET"))),
 		)
 	}
 
+	// The Alertmanager APIs set the label on the alerts and silences, they
+	// can't be enforced with negative matchers nor with several label values.
+	alertmanager := func(h http.HandlerFunc) http.Handler {
+		return r.enforceLabel(r.singleLabelValue(h))
+	}
+	if negativeMatchers {
+		alertmanager = func(http.HandlerFunc) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				http.Error(w, "The Alertmanager APIs aren't supported with negative label matchers.", http.StatusNotImplemented)
+			})
+		}
+	}
 	errs.Add(
-		mux.Handle("/api/v2/silences", r.enforceLabel(enforceMethods(r.silences, "GET", "POST"))),
-		mux.Handle("/api/v2/silence/", r.enforceLabel(enforceMethods(r.deleteSilence, "DELETE"))),
+		mux.Handle("/api/v2/silences", alertmanager(enforceMethods(r.silences, "GET", "POST"))),
+		mux.Handle("/api/v2/silence/", alertmanager(enforceMethods(r.deleteSilence, "DELETE"))),
+		mux.Handle("/api/v2/alerts", alertmanager(enforceMethods(r.alerts, "GET", "POST"))),
 	)
 
+	for path, param := range opt.selectorPaths {
+		errs.Add(
+			mux.Handle(path, r.enforceLabel(enforceMethods(r.selectors(param), "GET"))),
+		)
+	}
+
+	for path, expr := range opt.jsonSelectorPaths {
+		jp, err := parseJSONPath(expr)
+		if err != nil {
+			errs.Add(err)
+			continue
+		}
+		errs.Add(
+			mux.Handle(path, r.enforceLabel(enforceMethods(r.jsonSelectors(jp), "POST"))),
+		)
+	}
+
+	for path, expr := range opt.jsonExpressionPaths {
+		jp, err := parseJSONPath(expr)
+		if err != nil {
+			errs.Add(err)
+			continue
+		}
+		errs.Add(
+			mux.Handle(path, r.enforceLabel(enforceMethods(r.jsonExpressions(jp), "POST"))),
+		)
+	}
+
+	if opt.grafanaQueries {
+		errs.Add(
+			mux.Handle(grafanaQueryPath, r.enforceLabel(enforceMethods(r.grafanaQuery, "POST"))),
+		)
+	}
+
+	if opt.grafanaLive {
+		// The shadow handler records the responses, it can't pass the
+		// upgraded connections through.
+		errs.Add(
+			mux.Handle(grafanaLivePath, r.enforceLabel(enforceMethods(webSocket(proxy), "GET"))),
+		)
+	}
+
+	if opt.searchPath != "" {
+		errs.Add(
+			mux.Handle(opt.searchPath, r.enforceLabel(enforceMethods(r.passthrough, "GET"))),
+		)
+	}
+
+	if opt.rulesAlertsPath != "" {
+		errs.Add(
+			mux.Handle(opt.rulesAlertsPath, r.enforceLabel(enforceMethods(r.rules, "GET"))),
+		)
+	}
+
+	if opt.alertsByFingerprint != "" {
+		errs.Add(
+			mux.Handle(opt.alertsByFingerprint, alertmanager(enforceMethods(r.enforceIDs(fingerprintParam, r.resolveAlertFingerprints), "GET"))),
+		)
+	}
+
 	if err := errs.Err(); err != nil {
 		return nil, err
 	}
@@ -168,57 +1236,411 @@ func NewRoutes(upstream *url.URL, label string, opts ...Option) (*routes, error)
 		}
 	}
 
-	// Register optional passthrough paths.
-	for _, path := range opt.pasthroughPaths {
-		if err := mux.Handle(path, http.HandlerFunc(r.passthrough)); err != nil {
-			return nil, err
-		}
+	// Register optional passthrough paths.
+	for _, path := range opt.pasthroughPaths {
+		if err := mux.Handle(path, http.HandlerFunc(r.passthrough)); err != nil {
+			return nil, err
+		}
+	}
+
+	if opt.proxyUnknownPaths {
+		// The disabled endpoints would otherwise be proxied without
+		// enforcing the label.
+		var disabled []string
+		if !opt.enableLabelAPIs {
+			disabled = append(disabled, "/api/v1/labels", "/api/v1/label/")
+		}
+		if !opt.grafanaQueries {
+			disabled = append(disabled, grafanaQueryPath)
+		}
+		if !opt.grafanaLive {
+			disabled = append(disabled, grafanaLivePath)
+		}
+		for _, path := range disabled {
+			if err := mux.Handle(path, http.NotFoundHandler()); err != nil {
+				return nil, err
+			}
+		}
+		mux.m.Handle("/", http.HandlerFunc(r.passthrough))
+	}
+
+	r.mux = mux.m
+	r.modifiers = map[string]func(*http.Response) error{
+		"/api/v1/rules":  r.streamingResponse(r.modifyAPIResponse(r.filterRules, `{"groups":[]}`), r.rulesList()),
+		"/api/v1/alerts": r.streamingResponse(r.modifyAPIResponse(r.filterAlerts, `{"alerts":[]}`), r.alertsList()),
+
+		"/api/v1/targets/metadata": r.modifyAPIResponse(r.filterTargetsMetadata, `[]`),
+		"/api/v1/query_exemplars":  r.modifyAPIResponse(r.filterExemplars, `[]`),
+
+		"/api/v2/alerts":   r.filterAlertmanagerAlerts,
+		"/api/v2/silences": r.filterSilences,
+	}
+	if opt.filterFederate {
+		r.modifiers["/federate"] = r.filterFederation
+	}
+	if opt.enableLabelAPIs {
+		r.modifiers["/api/v1/label/"+label+"/values"] = r.modifyAPIResponse(r.filterLabelValues(label), `[]`)
+		for _, le := range opt.additionalLabels {
+			r.modifiers["/api/v1/label/"+le.name+"/values"] = r.modifyAPIResponse(r.filterLabelValues(le.name), `[]`)
+		}
+	}
+	if opt.searchPath != "" {
+		r.modifiers[opt.searchPath] = r.modifyAPIResponse(r.filterSearchResults, `[]`)
+	}
+	if opt.rulesAlertsPath != "" {
+		r.modifiers[opt.rulesAlertsPath] = r.modifyAPIResponse(r.filterRulesAndAlerts, `{"groups":[],"alerts":[]}`)
+	}
+
+	var queryFilters []apiFilter
+	if opt.partialQueryResults {
+		queryFilters = append(queryFilters, r.filterPartialResults)
+	}
+	if opt.strictQueryResults {
+		queryFilters = append(queryFilters, r.checkQueryResults)
+	}
+	if opt.stripIntrospection {
+		queryFilters = append(queryFilters, stripIntrospection)
+	}
+	if len(queryFilters) > 0 || r.sanitizingWarnings() {
+		r.modifiers["/api/v1/query"] = r.modifyAPIResponse(chainAPIFilters(queryFilters...), `{"resultType":"vector","result":[]}`)
+		r.modifiers["/api/v1/query_range"] = r.modifyAPIResponse(chainAPIFilters(queryFilters...), `{"resultType":"matrix","result":[]}`)
+	}
+	proxy.ModifyResponse = r.ModifyResponse
+	proxy.ErrorHandler = r.proxyErrorHandler
+
+	if opt.shadowUpstream != nil {
+		shadow := httputil.NewSingleHostReverseProxy(opt.shadowUpstream)
+		shadowDirector := shadow.Director
+		shadow.Director = func(req *http.Request) {
+			shadowDirector(req)
+			setForwardedHeaders(req, !opt.noForwardedHeaders)
+		}
+		shadow.Transport = baseTransport
+		shadow.ModifyResponse = r.ModifyResponse
+		shadow.ErrorHandler = shadowErrorHandler
+		r.handler = &shadowHandler{
+			primary: proxy,
+			shadow:  shadow,
+			metrics: r.metrics,
+			limit:   r.responseBufferLimit,
+		}
+	}
+
+	return r, nil
+}
+
+// setForwardedHeaders sets the X-Forwarded-Host and X-Forwarded-Proto headers
+// of the request sent upstream unless they were set by a proxy in front of
+// prom-label-proxy. The X-Forwarded-For header is appended to by the reverse
+// proxy. When disabled, all these headers are removed.
+func setForwardedHeaders(req *http.Request, enabled bool) {
+	if !enabled {
+		// A nil value prevents the reverse proxy from adding the header.
+		req.Header["X-Forwarded-For"] = nil
+		req.Header.Del("X-Forwarded-Host")
+		req.Header.Del("X-Forwarded-Proto")
+		return
+	}
+
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		proto := "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+}
+
+func (r *routes) enforceLabel(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodOptions && r.passthroughOptions {
+			// CORS preflight requests carry neither the label value nor data,
+			// they are answered by the upstream without the query string.
+			req.URL.RawQuery = ""
+			req.Body = http.NoBody
+			req.ContentLength = 0
+			r.handler.ServeHTTP(w, req)
+			return
+		}
+
+		span := r.startExtractSpan(req.Context())
+		lvalues, err := r.extractLabelValues(req)
+		var matchers []*labels.Matcher
+		if err == nil {
+			r.recordLabelValues(span, lvalues...)
+			matchers, err = r.newMatchers(req, lvalues)
+		}
+		endSpan(span, 0, err)
+		if err != nil {
+			code, reason := http.StatusBadRequest, "invalid"
+			var (
+				mlv *MissingLabelValueError
+				flv *ForbiddenLabelValueError
+				ue  *UnavailableError
+				uae *UnauthorizedError
+			)
+			switch {
+			case errors.As(err, &mlv):
+				code, reason = r.noScopeStatusCode, "missing"
+			case errors.As(err, &flv):
+				code, reason = http.StatusForbidden, "forbidden"
+			case errors.As(err, &ue):
+				code, reason = http.StatusServiceUnavailable, "unavailable"
+			case errors.As(err, &uae):
+				code, reason = http.StatusUnauthorized, "unauthorized"
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			r.metrics.observeEnforcementFailure(routeFromContext(req.Context()), reason)
+			http.Error(w, err.Error(), code)
+			return
+		}
+		req = req.WithContext(withEnforcedMatchers(withLabelValues(req.Context(), lvalues), matchers))
+		lvalue := mustLabelValue(req.Context())
+		if info := requestInfoFromContext(req.Context()); info != nil {
+			info.labelValue = lvalue
+		}
+		req, span = r.startInjectSpan(req)
+		defer span.End()
+
+		if r.events == nil {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		e := &Event{
+			Time:       time.Now().UTC(),
+			Label:      r.label,
+			LabelValue: lvalue,
+			Method:     req.Method,
+			Path:       req.URL.Path,
+		}
+		req = req.WithContext(context.WithValue(req.Context(), keyEvent, e))
+		h.ServeHTTP(w, req)
+		r.events.publish(e)
+	})
+}
+
+// singleLabelValue rejects the requests enforcing several label values.
+func (r *routes) singleLabelValue(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if len(mustLabelValues(req.Context())) > 1 {
+			http.Error(w, "Bad request. The request must select one of the allowed label values.", r.noScopeStatusCode)
+			return
+		}
+		h(w, req)
+	}
+}
+
+// extractLabelValues returns the label values of the request, transformed and
+// checked against the allowed values. The values of a LabelValuesExtractor
+// (e.g. the groups of a user) are all enforced, the values which aren't
+// allowed being ignored.
+func (r *routes) extractLabelValues(req *http.Request) ([]string, error) {
+	var values []string
+	if lve, ok := r.el.(LabelValuesExtractor); ok {
+		vs, err := lve.ExtractLabelValues(req)
+		if err != nil {
+			return nil, err
+		}
+		values = vs
+	} else {
+		v, err := r.el.ExtractLabel(req)
+		if err != nil {
+			return nil, err
+		}
+		values = []string{v}
+	}
+
+	allowed := make([]string, 0, len(values))
+	for _, v := range values {
+		if r.transform != nil {
+			var err error
+			if v, err = r.transformLabelValue(v); err != nil {
+				return nil, err
+			}
+		}
+		if r.allowedValues != nil {
+			if _, ok := r.allowedValues[v]; !ok {
+				if len(values) == 1 {
+					return nil, &ForbiddenLabelValueError{Msg: fmt.Sprintf("Forbidden. The label value %q isn't allowed.", v)}
+				}
+				continue
+			}
+		}
+		if !contains(allowed, v) {
+			allowed = append(allowed, v)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, &ForbiddenLabelValueError{Msg: "Forbidden. No label value is allowed."}
+	}
+	sort.Strings(allowed)
+	return allowed, nil
+}
+
+// newMatchers returns the matchers enforced for the request: the matcher of
+// the label with the given values followed by the matchers of the additional
+// labels with the values extracted from the request. All the labels must have
+// a value.
+func (r *routes) newMatchers(req *http.Request, lvalues []string) ([]*labels.Matcher, error) {
+	m, err := newEnforcedMatcher(r.matchType, r.label, lvalues...)
+	if err != nil {
+		return nil, err
+	}
+	ms := []*labels.Matcher{m}
+	for _, le := range r.additionalLabels {
+		v, err := le.el.ExtractLabel(req)
+		if err != nil {
+			return nil, err
+		}
+		m, err := newEnforcedMatcher(le.matchType, le.name, v)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+// newEnforcedMatcher returns the matcher enforcing the label values. The value
+// of a regular expression matcher must be valid. Several values are enforced
+// with a regular expression matcher selecting any of them (or none of them
+// for the negative matchers).
+func newEnforcedMatcher(t labels.MatchType, name string, values ...string) (*labels.Matcher, error) {
+	value := values[0]
+	if len(values) > 1 {
+		alts := make([]string, 0, len(values))
+		for _, v := range values {
+			if t == labels.MatchNotRegexp {
+				alts = append(alts, "(?:"+v+")")
+				continue
+			}
+			alts = append(alts, regexp.QuoteMeta(v))
+		}
+		value = strings.Join(alts, "|")
+		switch t {
+		case labels.MatchEqual:
+			t = labels.MatchRegexp
+		case labels.MatchNotEqual:
+			t = labels.MatchNotRegexp
+		}
+	}
+
+	m, err := labels.NewMatcher(t, name, value)
+	if err != nil {
+		return nil, errors.Errorf("Bad request. Invalid value %q for the label %q: %v", value, name, err)
 	}
+	return m, nil
+}
 
-	r.mux = mux.m
-	r.modifiers = map[string]func(*http.Response) error{
-		"/api/v1/rules":  modifyAPIResponse(r.filterRules),
-		"/api/v1/alerts": modifyAPIResponse(r.filterAlerts),
+// transformLabelValue returns the transformed label value. An empty value
+// would match the series without the label, it is rejected.
+func (r *routes) transformLabelValue(lvalue string) (string, error) {
+	v, err := r.transform(lvalue)
+	if err != nil {
+		return "", errors.Wrapf(err, "Bad request. Invalid label value %q", lvalue)
 	}
-	proxy.ModifyResponse = r.ModifyResponse
-	return r, nil
+	if v == "" {
+		return "", errors.Errorf("Bad request. The label value %q is empty once transformed.", lvalue)
+	}
+	return v, nil
 }
 
-func (r *routes) enforceLabel(h http.HandlerFunc) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		lvalue := req.URL.Query().Get(r.label)
-		if lvalue == "" {
-			http.Error(w, fmt.Sprintf("Bad request. The %q query parameter must be provided.", r.label), http.StatusBadRequest)
+func (r *routes) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	path := req.URL.Path
+	r.rewritePath(req)
+	route := r.route(req)
+	req = req.WithContext(context.WithValue(req.Context(), keyRoute, route))
+	rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK, captureErrors: r.requestLog != nil}
+	w = rec
+	defer func() {
+		r.metrics.observeRequest(route, rec.code, time.Since(start))
+	}()
+	if r.tracing {
+		var span trace.Span
+		req, span = r.startRequestSpan(req, route)
+		defer func() {
+			endSpan(span, rec.code, nil)
+		}()
+	}
+	if r.requestLog != nil {
+		info := &requestInfo{id: requestID(req)}
+		req.Header.Set(requestIDHeader, info.id)
+		w.Header().Set(requestIDHeader, info.id)
+		req = req.WithContext(context.WithValue(req.Context(), keyRequestInfo, info))
+		defer func() {
+			r.logRequest(req, path, info, rec, time.Since(start))
+		}()
+	}
+
+	if r.maxHeaders > 0 {
+		var n int
+		for _, v := range req.Header {
+			n += len(v)
+		}
+		if n > r.maxHeaders {
+			http.Error(w, fmt.Sprintf("too many headers: %d, maximum is %d", n, r.maxHeaders), http.StatusRequestHeaderFieldsTooLarge)
 			return
 		}
-		req = req.WithContext(withLabelValue(req.Context(), lvalue))
-
-		// Remove the proxy label from the query parameters.
-		q := req.URL.Query()
-		q.Del(r.label)
-		req.URL.RawQuery = q.Encode()
-
-		h.ServeHTTP(w, req)
-	})
-}
+	}
 
-func (r *routes) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if d, ok := r.processingTimeouts[req.URL.Path]; ok {
+		ctx, cancel := context.WithTimeout(req.Context(), d)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
 	r.mux.ServeHTTP(w, req)
 }
 
 func (r *routes) ModifyResponse(resp *http.Response) error {
+	if isShadowRequest(resp.Request.Context()) {
+		return r.modifyResponse(resp)
+	}
+
+	route := routeFromContext(resp.Request.Context())
+	r.metrics.observeUpstreamResponse(route, resp.StatusCode)
+	if info := requestInfoFromContext(resp.Request.Context()); info != nil {
+		info.upstreamCode = resp.StatusCode
+	}
+	err := r.modifyResponse(resp)
+	if err != nil {
+		r.metrics.observeModifyResponseError(route)
+	}
+	return err
+}
+
+func (r *routes) modifyResponse(resp *http.Response) error {
 	m, found := r.modifiers[resp.Request.URL.Path]
 	if !found {
 		// Return the server's response unmodified.
 		return nil
 	}
+	if resp.Request.Method == http.MethodHead || resp.Request.Method == http.MethodOptions {
+		// There is no body to modify but the length of the unmodified body
+		// shouldn't be disclosed.
+		resp.Header.Del("Content-Length")
+		return nil
+	}
+	if _, ok := r.processingTimeouts[resp.Request.URL.Path]; ok {
+		return modifyBeforeDeadline(resp, m)
+	}
 	return m(resp)
 }
 
+// enforceMethods returns a handler serving only the requests with the given
+// methods. HEAD requests are served where GET requests are.
 func enforceMethods(h http.HandlerFunc, methods ...string) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
+		method := req.Method
+		if method == http.MethodHead {
+			method = http.MethodGet
+		}
 		for _, m := range methods {
-			if m == req.Method {
+			if m == method {
 				h(w, req)
 				return
 			}
@@ -229,53 +1651,223 @@ func enforceMethods(h http.HandlerFunc, methods ...string) http.HandlerFunc {
 
 type ctxKey int
 
-const keyLabel ctxKey = iota
+const (
+	keyLabel ctxKey = iota
+	keyShadow
+	keyEvent
+	keyMatchers
+	keyRoute
+	keyRequestInfo
+	keyInjectSpan
+)
 
-func mustLabelValue(ctx context.Context) string {
-	label, ok := ctx.Value(keyLabel).(string)
+// mustLabelValues returns the label values enforced for the request, several
+// values being enforced at once when the LabelValuesExtractor returns several
+// values.
+func mustLabelValues(ctx context.Context) []string {
+	values, ok := ctx.Value(keyLabel).([]string)
 	if !ok {
 		panic(fmt.Sprintf("can't find the %q value in the context", keyLabel))
 	}
-	if label == "" {
+	if len(values) == 0 {
 		panic(fmt.Sprintf("empty %q value in the context", keyLabel))
 	}
-	return label
+	return values
+}
+
+// mustLabelValue returns the label value enforced for the request, the values
+// being joined with "|" when there are several.
+func mustLabelValue(ctx context.Context) string {
+	return strings.Join(mustLabelValues(ctx), "|")
+}
+
+func withLabelValues(ctx context.Context, values []string) context.Context {
+	return context.WithValue(ctx, keyLabel, values)
+}
+
+// labelEnforcement is an additional label enforced by the routes along with
+// the label.
+type labelEnforcement struct {
+	name      string
+	el        ExtractLabeler
+	matchType labels.MatchType
+}
+
+// mustEnforcedMatchers returns the matchers of the labels enforced for the
+// request: the matcher of the label followed by the matchers of the additional
+// labels, if any.
+func mustEnforcedMatchers(ctx context.Context) []*labels.Matcher {
+	ms, ok := ctx.Value(keyMatchers).([]*labels.Matcher)
+	if !ok || len(ms) == 0 {
+		panic(fmt.Sprintf("can't find the %q value in the context", keyMatchers))
+	}
+	return ms
+}
+
+// enforcedLabelsString returns the matchers enforced for the request in a
+// human-readable form, e.g. namespace="default".
+func enforcedLabelsString(ctx context.Context) string {
+	ms := mustEnforcedMatchers(ctx)
+	s := make([]string, 0, len(ms))
+	for _, m := range ms {
+		s = append(s, m.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func withEnforcedMatchers(ctx context.Context, ms []*labels.Matcher) context.Context {
+	return context.WithValue(ctx, keyMatchers, ms)
+}
+
+// matchesEnforcedLabels returns whether the label set matches all the labels
+// enforced for the request. A missing label has an empty value, it doesn't
+// match an equality matcher but matches a negative matcher.
+func matchesEnforcedLabels(ctx context.Context, ls labels.Labels) bool {
+	for _, m := range mustEnforcedMatchers(ctx) {
+		if !m.Matches(ls.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
 }
 
-func withLabelValue(ctx context.Context, label string) context.Context {
-	return context.WithValue(ctx, keyLabel, label)
+// prometheusAPIError writes an error response following the Prometheus API format.
+func prometheusAPIError(w http.ResponseWriter, errorMessage string, code int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+
+	res := apiResponse{
+		Status:    "error",
+		ErrorType: "bad_data",
+		Error:     errorMessage,
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Printf("error: Failed to encode json: %v", err)
+	}
 }
 
 func (r *routes) passthrough(w http.ResponseWriter, req *http.Request) {
 	r.handler.ServeHTTP(w, req)
 }
 
+// prometheusAlerts forwards the requests to the Prometheus alerts endpoint
+// whose response is always filtered. The endpoint doesn't take selectors but
+// for forward compatibility, the label is injected into the match[] selectors
+// if present so that the upstream can do the filtering too.
+func (r *routes) prometheusAlerts(w http.ResponseWriter, req *http.Request) {
+	if _, ok := req.URL.Query()[matchersParam]; ok {
+		r.selectors(matchersParam)(w, req)
+		return
+	}
+	r.handler.ServeHTTP(w, req)
+}
+
+// newEnforcer returns an Enforcer for the given label value and the additional labels of the context configured with
+// the routes options.
+func (r *routes) newEnforcer(ctx context.Context) *Enforcer {
+	e := NewEnforcer(mustEnforcedMatchers(ctx)...)
+	e.skipIfLabelPresent = r.skipIfLabelPresent
+	e.maxSelectors = r.maxQuerySelectors
+	e.maxDepth = r.maxQueryDepth
+	e.forbidBroadNames = r.forbidBroadNames
+	e.minNamePrefix = r.minNamePrefix
+	e.matchOnLabels = r.matchOnLabels
+	e.groupByLabels = r.groupByLabels
+	e.matcherPosition = r.matcherPosition
+	return e
+}
+
 func (r *routes) query(w http.ResponseWriter, req *http.Request) {
-	e := NewEnforcer([]*labels.Matcher{{
-		Name:  r.label,
-		Type:  labels.MatchEqual,
-		Value: mustLabelValue(req.Context()),
-	}}...)
+	matchers := mustEnforcedMatchers(req.Context())
+	var (
+		enforcedLabels url.Values
+		marked         bool
+	)
+	if r.injectionMarkerKey != nil {
+		var err error
+		if enforcedLabels, err = r.injectionMarkerLabels(req); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		// When the query has already been enforced by another instance, the
+		// labels aren't injected again but the local policies still apply.
+		if marked = markedAsEnforced(enforcedLabels, matchers); !marked {
+			req.Header.Del(injectionMarkerHeader)
+		}
+	}
+
+	e := r.newEnforcer(req.Context())
+	e.checkOnly = marked
 
 	// The `query` can come in the URL query string and/or the POST body.
 	// For this reason, we need to try to enforcing in both places.
 	// Note: a POST request may include some values in the URL query string
 	// and others in the body. If both locations include a `query`, then
-	// enforce in both places.
-	q, found1, err := enforceQueryValues(e, req.URL.Query())
+	// enforce in both places. Because it would be ambiguous which one is
+	// evaluated upstream, the request is rejected if the values differ.
+	urlValues := req.URL.Query()
+	if r.stripIntrospection {
+		stripIntrospectionParams(urlValues)
+	}
+	if r.maxQueryTimeout > 0 {
+		if err := clampQueryTimeout(urlValues, r.maxQueryTimeout); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := checkQueryTime(urlValues, time.Now(), r.maxQueryTimePast, r.maxQueryTimeFuture); err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkReplicaLabels(urlValues, r.label); err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	urlQuery := urlValues.Get(queryParam)
+	q, found1, err := enforceQueryValues(e, urlValues)
 	if err != nil {
+		if _, ok := err.(illegalQueryError); ok {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		}
 		return
 	}
 	req.URL.RawQuery = q
 
-	var found2 bool
+	var (
+		found2    bool
+		bodyQuery string
+	)
 	// Enforce the query in the POST body if needed.
 	if req.Method == http.MethodPost {
 		if err := req.ParseForm(); err != nil {
 			return
 		}
+		if bodyQuery = req.PostForm.Get(queryParam); urlQuery != "" && bodyQuery != "" && urlQuery != bodyQuery {
+			prometheusAPIError(w, fmt.Sprintf("conflicting values for the %q parameter in the URL and the request body", queryParam), http.StatusBadRequest)
+			return
+		}
+		if r.stripIntrospection {
+			stripIntrospectionParams(req.PostForm)
+		}
+		if r.maxQueryTimeout > 0 {
+			if err := clampQueryTimeout(req.PostForm, r.maxQueryTimeout); err != nil {
+				prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := checkQueryTime(req.PostForm, time.Now(), r.maxQueryTimePast, r.maxQueryTimeFuture); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkReplicaLabels(req.PostForm, r.label); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		q, found2, err = enforceQueryValues(e, req.PostForm)
 		if err != nil {
+			if _, ok := err.(illegalQueryError); ok {
+				prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			}
 			return
 		}
 		// We are replacing request body, close previous one (ParseForm ensures it is read fully and not nil).
@@ -289,9 +1881,82 @@ func (r *routes) query(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	enforced := urlValues.Get(queryParam)
+	if found2 {
+		enforced = req.PostForm.Get(queryParam)
+	}
+	if ev := requestEvent(req.Context()); ev != nil {
+		ev.Query = urlQuery
+		if found2 {
+			ev.Query = bodyQuery
+		}
+		ev.EnforcedQuery = enforced
+	}
+
+	if r.maxEstimatedSeries > 0 && req.URL.Path == "/api/v1/query_range" {
+		end := urlValues.Get("end")
+		if found2 {
+			end = req.PostForm.Get("end")
+		}
+		n, err := r.estimateSeries(req.Context(), enforced, end)
+		if err != nil {
+			prometheusAPIError(w, fmt.Sprintf("can't estimate the number of series of the query: %v", err), http.StatusBadGateway)
+			return
+		}
+		if n > r.maxEstimatedSeries {
+			prometheusAPIError(w, fmt.Sprintf("the query selects too many series: about %d, maximum is %d", n, r.maxEstimatedSeries), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if r.injectionMarkerKey != nil && !marked {
+		// The labels enforced by the previous instances are still enforced
+		// since the query has only been restricted further.
+		if enforcedLabels == nil {
+			enforcedLabels = url.Values{}
+		}
+		for _, m := range matchers {
+			enforcedLabels.Set(m.Name, markerValue(m))
+		}
+		req.Header.Set(injectionMarkerHeader, r.injectionMarker(enforcedLabels, enforced))
+	}
+
+	if r.queryCache != nil && req.Method != http.MethodHead {
+		labels := enforcedLabels
+		if labels == nil {
+			labels = url.Values{}
+			for _, m := range matchers {
+				labels.Set(m.Name, markerValue(m))
+			}
+		}
+		r.serveCachedQuery(w, req, r.queryCache.key(req, labels, urlValues, req.PostForm))
+		return
+	}
+
 	r.handler.ServeHTTP(w, req)
 }
 
+// markedAsEnforced returns whether the labels of the injection marker include
+// all the enforced matchers, that is the query has already been enforced.
+func markedAsEnforced(marked url.Values, matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if vs, ok := marked[m.Name]; !ok || len(vs) != 1 || vs[0] != markerValue(m) {
+			return false
+		}
+	}
+	return true
+}
+
+// markerValue returns the value of the matcher recorded by the injection
+// marker. The type of the negative matchers is recorded too so that they
+// aren't mistaken for equality matchers.
+func markerValue(m *labels.Matcher) string {
+	if m.Type == labels.MatchEqual {
+		return m.Value
+	}
+	return m.Type.String() + m.Value
+}
+
 func enforceQueryValues(e *Enforcer, v url.Values) (values string, noQuery bool, err error) {
 	// If no values were given or no query is present,
 	// e.g. because the query came in the POST body
@@ -299,49 +1964,355 @@ func enforceQueryValues(e *Enforcer, v url.Values) (values string, noQuery bool,
 	if v.Get(queryParam) == "" {
 		return v.Encode(), false, nil
 	}
-	expr, err := parser.ParseExpr(v.Get(queryParam))
+	q, err := enforceQuery(e, v.Get(queryParam))
 	if err != nil {
 		return "", true, err
 	}
 
+	v.Set(queryParam, q)
+	return v.Encode(), true, nil
+}
+
+// enforceQuery returns the given PromQL expression with the label enforced.
+func enforceQuery(e *Enforcer, q string) (string, error) {
+	expr, err := parser.ParseExpr(q)
+	if err != nil {
+		return "", err
+	}
+
+	if err := e.checkComplexity(expr); err != nil {
+		return "", err
+	}
+
+	if err := e.checkNameMatchers(expr); err != nil {
+		return "", err
+	}
+
+	if e.checkOnly {
+		return q, nil
+	}
+
 	if err := e.EnforceNode(expr); err != nil {
-		return "", true, err
+		return "", err
 	}
 
-	v.Set(queryParam, expr.String())
-	return v.Encode(), true, nil
+	if e.matcherPosition != MatcherPositionDefault {
+		return reorderMatchers(expr.String(), e.ordered, e.matcherPosition == MatcherPositionFirst), nil
+	}
+	return expr.String(), nil
+}
+
+type queryData struct {
+	ResultType string          `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+type querySeries struct {
+	Metric labels.Labels `json:"metric"`
+}
+
+// checkQueryResults returns an error if any of the series returned by a query doesn't carry the enforced label value.
+// Scalar and string results have no labels, they are returned as-is.
+func (r *routes) checkQueryResults(lvalue string, req *http.Request, resp *apiResponse) (interface{}, error) {
+	var data queryData
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return nil, errors.Wrap(err, "can't decode query data")
+	}
+
+	switch data.ResultType {
+	case "vector", "matrix":
+	default:
+		return resp.Data, nil
+	}
+
+	var series []querySeries
+	if err := json.Unmarshal(data.Result, &series); err != nil {
+		return nil, errors.Wrap(err, "can't decode query result")
+	}
+	for _, s := range series {
+		if !matchesEnforcedLabels(req.Context(), s.Metric) {
+			return nil, errors.Errorf("query result contains series %s without the %s label", s.Metric.String(), enforcedLabelsString(req.Context()))
+		}
+	}
+
+	return resp.Data, nil
+}
+
+// filterPartialResults removes the series which don't carry the enforced label value from the partial query results,
+// i.e. the results with warnings. The complete results are returned as-is.
+func (r *routes) filterPartialResults(lvalue string, req *http.Request, resp *apiResponse) (interface{}, error) {
+	if len(resp.Warnings) == 0 {
+		return resp.Data, nil
+	}
+
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return nil, errors.Wrap(err, "can't decode query data")
+	}
+	switch string(data["resultType"]) {
+	case `"vector"`, `"matrix"`:
+	default:
+		return resp.Data, nil
+	}
+
+	var series []json.RawMessage
+	if err := json.Unmarshal(data["result"], &series); err != nil {
+		return nil, errors.Wrap(err, "can't decode query result")
+	}
+	filtered := []json.RawMessage{}
+	for _, s := range series {
+		var qs querySeries
+		if err := json.Unmarshal(s, &qs); err != nil {
+			return nil, errors.Wrap(err, "can't decode query result")
+		}
+		if matchesEnforcedLabels(req.Context(), qs.Metric) {
+			filtered = append(filtered, s)
+		}
+	}
+	resp.setDropped(len(series), len(filtered))
+	if n := len(series) - len(filtered); n > 0 {
+		resp.addWarning("partial response: %d series without the %s label removed", n, enforcedLabelsString(req.Context()))
+	}
+
+	result, err := json.Marshal(filtered)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't encode query result")
+	}
+	data["result"] = result
+	return data, nil
+}
+
+// queryIntrospectionParams are the parameters asking the upstream to return
+// the query statistics (Prometheus) or the query plan and its analysis
+// (Thanos) along with the result.
+var queryIntrospectionParams = []string{"stats", "explain", "analyze"}
+
+// replicaLabelsParam is the Thanos parameter overriding the labels which are
+// considered as replica labels when deduplicating the series.
+const replicaLabelsParam = "replicaLabels[]"
+
+// checkReplicaLabels returns an error if the enforced label is passed as a
+// replica label. Thanos would remove it from the series and deduplicate the
+// series regardless of its value.
+func checkReplicaLabels(v url.Values, label string) error {
+	for _, l := range v[replicaLabelsParam] {
+		if l == label {
+			return errors.Errorf("the %q label can't be used as a replica label", label)
+		}
+	}
+	return nil
+}
+
+func stripIntrospectionParams(v url.Values) {
+	for _, p := range queryIntrospectionParams {
+		v.Del(p)
+	}
+}
+
+// stripIntrospection removes the query statistics, plan and analysis
+// fields from the query results.
+func stripIntrospection(_ string, _ *http.Request, resp *apiResponse) (interface{}, error) {
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return nil, errors.Wrap(err, "can't decode query data")
+	}
+
+	delete(data, "stats")
+	delete(data, "explanation")
+	delete(data, "analysis")
+
+	return data, nil
 }
 
 // matcher ensures all the provided match[] if any has label injected. If none was provided, single matcher is injected.
 // This works for non-query Prometheus APIs like: /api/v1/series, /api/v1/label/<name>/values, /api/v1/labels and /federate support multiple matchers.
 // See e.g https://prometheus.io/docs/prometheus/latest/querying/api/#querying-metadata
 func (r *routes) matcher(w http.ResponseWriter, req *http.Request) {
-	matcher := &labels.Matcher{
-		Name:  r.label,
-		Type:  labels.MatchEqual,
-		Value: mustLabelValue(req.Context()),
+	r.selectors(matchersParam)(w, req)
+}
+
+// filterLabelValues returns a filter keeping only the enforced value in the
+// values of the given enforced label. The injected selector should already
+// restrict the values but the upstream may ignore it or the selector may be
+// skipped with skipIfLabelPresent.
+func (r *routes) filterLabelValues(label string) func(string, *http.Request, *apiResponse) (interface{}, error) {
+	return func(lvalue string, req *http.Request, resp *apiResponse) (interface{}, error) {
+		var values []string
+		if err := json.Unmarshal(resp.Data, &values); err != nil {
+			return nil, errors.Wrap(err, "can't decode label values")
+		}
+
+		var matcher *labels.Matcher
+		for _, m := range mustEnforcedMatchers(req.Context()) {
+			if m.Name == label {
+				matcher = m
+			}
+		}
+
+		filtered := []string{}
+		for _, v := range values {
+			if matcher != nil && matcher.Matches(v) {
+				filtered = append(filtered, v)
+			}
+		}
+		r.recordFiltering(req.Context(), "label_values", lvalue, len(values), len(filtered))
+		resp.setDropped(len(values), len(filtered))
+
+		return filtered, nil
 	}
+}
 
-	q := req.URL.Query()
-	matchers := q[matchersParam]
-	if len(matchers) == 0 {
-		q.Set(matchersParam, matchersToString(matcher))
-	} else {
-		// Inject label to existing matchers.
-		for i, m := range matchers {
-			ms, err := parser.ParseMetricSelector(m)
-			if err != nil {
+// selectors returns a handler ensuring all the selectors of the param parameter have the label injected. If none was
+// provided, a single selector with the matcher is injected. The matcher is AND-ed into each selector rather than added
+// as a separate selector because the upstream returns the union of the selectors' results. For POST requests, the
+// selectors of the form-encoded body are enforced too.
+func (r *routes) selectors(param string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		matchers := mustEnforcedMatchers(req.Context())
+
+		q := req.URL.Query()
+		var form url.Values
+		if req.Method == http.MethodPost {
+			if err := req.ParseForm(); err != nil {
+				http.Error(w, fmt.Sprintf("bad request: can't parse form: %v", err), http.StatusBadRequest)
+				return
+			}
+			form = req.PostForm
+		}
+		if n := len(q[param]) + len(form[param]); r.maxMatchSelectors > 0 && n > r.maxMatchSelectors {
+			prometheusAPIError(w, fmt.Sprintf("too many %s selectors: %d, maximum is %d", param, n, r.maxMatchSelectors), http.StatusBadRequest)
+			return
+		}
+		selectors := append(append([]string(nil), q[param]...), form[param]...)
+		for _, v := range []url.Values{q, form} {
+			if err := r.enforceSelectors(req.Context(), v, param, matchers); err != nil {
+				http.Error(w, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
 				return
 			}
-			matchers[i] = matchersToString(append(ms, matcher)...)
 		}
-		q[matchersParam] = matchers
+		if len(selectors) == 0 {
+			q.Set(param, matchersToString(matchers...))
+		}
+		if e := requestEvent(req.Context()); e != nil {
+			e.Selectors = selectors
+			e.EnforcedSelectors = append(append([]string(nil), q[param]...), form[param]...)
+		}
+
+		req.URL.RawQuery = q.Encode()
+		if form != nil {
+			body := form.Encode()
+			_ = req.Body.Close()
+			req.Body = ioutil.NopCloser(strings.NewReader(body))
+			req.ContentLength = int64(len(body))
+		}
+		r.handler.ServeHTTP(w, req)
+	}
+}
+
+// enforceSelectors injects the matchers into each of the selectors of the param parameter of v, since the
+// upstream returns the union of the series matching the selectors.
+func (r *routes) enforceSelectors(ctx context.Context, v url.Values, param string, matchers []*labels.Matcher) error {
+	for i, m := range v[param] {
+		ms, err := parser.ParseMetricSelector(m)
+		if err != nil {
+			return errors.Errorf("can't parse %s %q: %v", param, m, err)
+		}
+		if err := r.newEnforcer(ctx).checkSelectorNames(ms); err != nil {
+			return err
+		}
+		if r.matchErrorOnConflict {
+			for _, matcher := range matchers {
+				for _, lm := range ms {
+					if lm.Name == matcher.Name && conflicts(lm, matcher) {
+						return errors.Errorf("%s %q conflicts with the enforced %s", param, m, matcher.String())
+					}
+				}
+			}
+		}
+		v[param][i] = matchersToString(r.injectMatchers(ms, matchers)...)
+	}
+	return nil
+}
+
+// matchTarget ensures the match_target selector of /api/v1/targets/metadata has the label injected. If none was
+// provided, a selector with the single matcher is injected.
+func (r *routes) matchTarget(w http.ResponseWriter, req *http.Request) {
+	matchers := mustEnforcedMatchers(req.Context())
+
+	q := req.URL.Query()
+	if target := q.Get(matchTargetParam); target == "" {
+		q.Set(matchTargetParam, matchersToString(matchers...))
+	} else {
+		ms, err := parser.ParseMetricSelector(target)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad request: can't parse %s %q: %v", matchTargetParam, target, err), http.StatusBadRequest)
+			return
+		}
+		q.Set(matchTargetParam, matchersToString(r.injectMatchers(ms, matchers)...))
 	}
 
 	req.URL.RawQuery = q.Encode()
 	r.handler.ServeHTTP(w, req)
 }
 
+// injectMatchers appends the given matchers to the selector's matchers, or prepends them when the enforced matchers
+// are configured to come first. When the routes are configured to skip the selectors which already have a matcher on a
+// label, the matcher of this label isn't injected.
+func (r *routes) injectMatchers(ms []*labels.Matcher, matchers []*labels.Matcher) []*labels.Matcher {
+	var injected []*labels.Matcher
+	for _, matcher := range matchers {
+		if r.skipIfLabelPresent && hasMatcher(ms, matcher.Name) {
+			continue
+		}
+		if r.collapseMatchers && hasIdenticalMatcher(ms, matcher) {
+			continue
+		}
+		injected = append(injected, matcher)
+	}
+	if r.matcherPosition == MatcherPositionFirst {
+		return append(injected, ms...)
+	}
+	return append(ms, injected...)
+}
+
+// conflicts returns whether the matcher of a selector can't select any series
+// matching the enforced matcher on the same label. For a negative enforced
+// matcher, only the equality matchers on an excluded value are detected.
+func conflicts(m, enforced *labels.Matcher) bool {
+	if enforced.Type == labels.MatchEqual {
+		return !m.Matches(enforced.Value)
+	}
+	return m.Type == labels.MatchEqual && !enforced.Matches(m.Value)
+}
+
+// hasMatcher returns whether one of the matchers is on the given label.
+func hasMatcher(ms []*labels.Matcher, name string) bool {
+	for _, m := range ms {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasIdenticalMatcher returns whether one of the matchers is identical to the
+// given matcher.
+func hasIdenticalMatcher(ms []*labels.Matcher, matcher *labels.Matcher) bool {
+	for _, m := range ms {
+		if m.Name == matcher.Name && m.Type == matcher.Type && m.Value == matcher.Value {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *routes) debugf(format string, args ...interface{}) {
+	if !r.debug {
+		return
+	}
+	log.Printf("debug: "+format, args...)
+}
+
 func matchersToString(ms ...*labels.Matcher) string {
 	var el []string
 	for _, m := range ms {
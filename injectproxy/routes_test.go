@@ -14,16 +14,20 @@
 package injectproxy
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"sort"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
 )
 
 var okResponse = []byte(`ok`)
@@ -257,9 +261,25 @@ func TestMatch(t *testing.T) {
 			expMatch: []string{`{job="prometheus",namespace="default"}`, `{__name__=~"job:.*",namespace="default"}`},
 			expBody:  okResponse,
 		},
+		{
+			// Many "match" parameters with the label. The matcher is AND-ed
+			// into each selector so that none of them can select other values.
+			labelv:   "default",
+			matches:  []string{`{namespace="other"}`, `{namespace=~".+"}`, `up`},
+			expCode:  http.StatusOK,
+			expMatch: []string{`{namespace="other",namespace="default"}`, `{namespace=~".+",namespace="default"}`, `{__name__="up",namespace="default"}`},
+			expBody:  okResponse,
+		},
+		{
+			// Invalid "match" parameter.
+			labelv:  "default",
+			matches: []string{`{job="prometheus"}`, `{job=`},
+			expCode: http.StatusBadRequest,
+		},
 	} {
 		for _, u := range []string{
 			"http://prometheus.example.com/federate",
+			"http://prometheus.example.com/api/v1/series",
 			"http://prometheus.example.com/api/v1/labels",
 			"http://prometheus.example.com/api/v1/label/some_label/values",
 		} {
@@ -381,15 +401,26 @@ func TestQuery(t *testing.T) {
 			expResponse:      okResponse,
 		},
 		{
-			name:             `Query without a vector selector in POST body or query different`,
-			labelv:           "default",
-			promQuery:        "up",
-			promQueryBody:    "foo",
-			method:           http.MethodPost,
-			expCode:          http.StatusOK,
-			expPromQuery:     `up{namespace="default"}`,
-			expPromQueryBody: `foo{namespace="default"}`,
-			expResponse:      okResponse,
+			name:          `Query without a vector selector in POST body or query different returns bad_data`,
+			labelv:        "default",
+			promQuery:     "up",
+			promQueryBody: "foo",
+			method:        http.MethodPost,
+			expCode:       http.StatusBadRequest,
+		},
+		{
+			name:         `Query with absent()`,
+			labelv:       "default",
+			promQuery:    `absent(up{job="x"})`,
+			expCode:      http.StatusOK,
+			expPromQuery: `absent(up{job="x",namespace="default"})`,
+			expResponse:  okResponse,
+		},
+		{
+			name:      `Query producing the enforced label returns bad_data`,
+			labelv:    "default",
+			promQuery: `count_values("namespace", up)`,
+			expCode:   http.StatusBadRequest,
 		},
 		{
 			name:         `Query with a vector selector`,
@@ -514,3 +545,1924 @@ func TestQuery(t *testing.T) {
 		}
 	}
 }
+
+var emptyMetadataResponse = []byte(`{"status":"success","data":[]}`)
+
+func TestMatchTarget(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		labelv string
+		target string
+
+		expCode   int
+		expTarget string
+	}{
+		{
+			name:    `No "namespace" parameter returns an error`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:      `No "match_target" parameter`,
+			labelv:    "default",
+			expCode:   http.StatusOK,
+			expTarget: `{namespace="default"}`,
+		},
+		{
+			name:      `Single "match_target" parameter`,
+			labelv:    "default",
+			target:    `{job="prometheus"}`,
+			expCode:   http.StatusOK,
+			expTarget: `{job="prometheus",namespace="default"}`,
+		},
+		{
+			name:      `"match_target" parameter with the label`,
+			labelv:    "default",
+			target:    `{job="prometheus",namespace="other"}`,
+			expCode:   http.StatusOK,
+			expTarget: `{job="prometheus",namespace="other",namespace="default"}`,
+		},
+		{
+			name:    `Invalid "match_target" parameter`,
+			labelv:  "default",
+			target:  `{job=`,
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(
+				checkParameterAbsent(
+					proxyLabel,
+					http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+						if got := req.URL.Query().Get(matchTargetParam); got != tc.expTarget {
+							http.Error(w, fmt.Sprintf("expected %s %q, got %q", matchTargetParam, tc.expTarget, got), http.StatusInternalServerError)
+							return
+						}
+						w.Write(emptyMetadataResponse)
+					}),
+				),
+			)
+			defer m.Close()
+			r, err := NewRoutes(m.url, proxyLabel)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			u, err := url.Parse("http://prometheus.example.com/api/v1/targets/metadata")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			q := u.Query()
+			if tc.target != "" {
+				q.Set(matchTargetParam, tc.target)
+			}
+			q.Set(proxyLabel, tc.labelv)
+			u.RawQuery = q.Encode()
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", u.String(), nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.expCode {
+				t.Logf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
+				t.Logf("%s", string(body))
+				t.FailNow()
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+			if strings.TrimSpace(string(body)) != string(emptyMetadataResponse) {
+				t.Fatalf("expected body %q, got %q", string(emptyMetadataResponse), string(body))
+			}
+		})
+	}
+}
+
+func TestStrictQueryResults(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		strict   bool
+		upstream string
+
+		expCode int
+	}{
+		{
+			name:     "all series carry the label",
+			strict:   true,
+			upstream: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","namespace":"default"},"value":[1,"1"]}]}}`,
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "series without the label",
+			strict:   true,
+			upstream: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"namespace":"default"},"value":[1,"1"]},{"metric":{},"value":[1,"2"]}]}}`,
+			expCode:  http.StatusBadGateway,
+		},
+		{
+			name:     "series with another label value",
+			strict:   true,
+			upstream: `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"namespace":"other"},"values":[[1,"1"]]}]}}`,
+			expCode:  http.StatusBadGateway,
+		},
+		{
+			name:     "scalar result",
+			strict:   true,
+			upstream: `{"status":"success","data":{"resultType":"scalar","result":[1,"1"]}}`,
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "series without the label and strict mode disabled",
+			upstream: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1,"2"]}]}}`,
+			expCode:  http.StatusOK,
+		},
+	} {
+		for _, endpoint := range []string{"query", "query_range"} {
+			t.Run(endpoint+"/"+strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+				m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					w.Write([]byte(tc.upstream))
+				}))
+				defer m.Close()
+
+				var opts []Option
+				if tc.strict {
+					opts = append(opts, WithStrictQueryResults())
+				}
+				r, err := NewRoutes(m.url, proxyLabel, opts...)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				u, err := url.Parse("http://prometheus.example.com/api/v1/" + endpoint)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				q := u.Query()
+				q.Set(queryParam, "absent(up)")
+				q.Set(proxyLabel, "default")
+				u.RawQuery = q.Encode()
+
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, u.String(), nil))
+
+				resp := w.Result()
+				if resp.StatusCode != tc.expCode {
+					body, _ := ioutil.ReadAll(resp.Body)
+					t.Logf("%s", string(body))
+					t.Fatalf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
+				}
+			})
+		}
+	}
+}
+
+func TestPartialQueryResults(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		upstream string
+
+		expCode     int
+		expResult   string
+		expWarnings []string
+	}{
+		{
+			name:        "thanos partial response",
+			opts:        []Option{WithPartialQueryResults()},
+			upstream:    `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","namespace":"default"},"value":[1,"1"]},{"metric":{"__name__":"up"},"value":[1,"2"]}]},"warnings":["No StoreAPIs matched for this query"]}`,
+			expCode:     http.StatusOK,
+			expResult:   `[{"metric":{"__name__":"up","namespace":"default"},"value":[1,"1"]}]`,
+			expWarnings: []string{"No StoreAPIs matched for this query", `partial response: 1 series without the namespace="default" label removed`},
+		},
+		{
+			name:        "thanos partial response with strict results",
+			opts:        []Option{WithPartialQueryResults(), WithStrictQueryResults()},
+			upstream:    `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"namespace":"other"},"values":[[1,"1"]]},{"metric":{"namespace":"default"},"values":[[1,"2"]]}]},"warnings":["receive: context deadline exceeded"]}`,
+			expCode:     http.StatusOK,
+			expResult:   `[{"metric":{"namespace":"default"},"values":[[1,"2"]]}]`,
+			expWarnings: []string{"receive: context deadline exceeded", `partial response: 1 series without the namespace="default" label removed`},
+		},
+		{
+			name:        "thanos partial response without series to remove",
+			opts:        []Option{WithPartialQueryResults()},
+			upstream:    `{"status":"success","data":{"resultType":"vector","result":[]},"warnings":["No StoreAPIs matched for this query"]}`,
+			expCode:     http.StatusOK,
+			expResult:   `[]`,
+			expWarnings: []string{"No StoreAPIs matched for this query"},
+		},
+		{
+			name:      "complete response",
+			opts:      []Option{WithPartialQueryResults()},
+			upstream:  `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1,"2"]}]}}`,
+			expCode:   http.StatusOK,
+			expResult: `[{"metric":{},"value":[1,"2"]}]`,
+		},
+		{
+			name:     "partial response with strict results only",
+			opts:     []Option{WithStrictQueryResults()},
+			upstream: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1,"2"]}]},"warnings":["No StoreAPIs matched for this query"]}`,
+			expCode:  http.StatusBadGateway,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte(tc.upstream))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&partial_response=true&"+proxyLabel+"=default", nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if tc.expCode != http.StatusOK {
+				return
+			}
+
+			var apir apiResponse
+			if err := json.Unmarshal(body, &apir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var data queryData
+			if err := json.Unmarshal(apir.Data, &data); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(data.Result) != tc.expResult {
+				t.Errorf("expected result %s, got %s", tc.expResult, string(data.Result))
+			}
+			if !reflect.DeepEqual(apir.Warnings, tc.expWarnings) {
+				t.Errorf("expected warnings %q, got %q", tc.expWarnings, apir.Warnings)
+			}
+		})
+	}
+}
+
+func TestQueryComplexityLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		promQuery    string
+		maxSelectors int
+		maxDepth     int
+
+		expCode      int
+		expPromQuery string
+	}{
+		{
+			name:         "no limits",
+			promQuery:    `sum(rate(up[5m])) / sum(rate(down[5m]))`,
+			expCode:      http.StatusOK,
+			expPromQuery: `sum(rate(up{namespace="default"}[5m])) / sum(rate(down{namespace="default"}[5m]))`,
+		},
+		{
+			name:         "within limits",
+			promQuery:    `sum(rate(up[5m]))`,
+			maxSelectors: 1,
+			maxDepth:     4,
+			expCode:      http.StatusOK,
+			expPromQuery: `sum(rate(up{namespace="default"}[5m]))`,
+		},
+		{
+			name:         "too many selectors",
+			promQuery:    `up + down`,
+			maxSelectors: 1,
+			expCode:      http.StatusBadRequest,
+		},
+		{
+			name:      "too deep",
+			promQuery: `sum(rate(up[5m]))`,
+			maxDepth:  3,
+			expCode:   http.StatusBadRequest,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(checkQueryHandler("", queryParam, tc.expPromQuery))
+			defer m.Close()
+			r, err := NewRoutes(m.url, proxyLabel, WithQueryComplexityLimits(tc.maxSelectors, tc.maxDepth))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			u, err := url.Parse("http://prometheus.example.com/api/v1/query")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			q := u.Query()
+			q.Set(queryParam, tc.promQuery)
+			q.Set(proxyLabel, "default")
+			u.RawQuery = q.Encode()
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, u.String(), nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Logf("%s", string(body))
+				t.Fatalf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
+			}
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+			if !strings.Contains(string(body), `"errorType":"bad_data"`) {
+				t.Fatalf("expected bad_data error, got %q", string(body))
+			}
+		})
+	}
+}
+
+func TestForbiddenBroadNameMatchers(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		path     string
+		param    string
+		selector string
+
+		expCode  int
+		expParam string
+	}{
+		{
+			name:     "query with metric names",
+			path:     "/api/v1/query",
+			param:    queryParam,
+			selector: `{__name__=~"up|down"}`,
+			expCode:  http.StatusOK,
+			expParam: `{__name__=~"up|down",namespace="default"}`,
+		},
+		{
+			name:     "query with broad regexp",
+			path:     "/api/v1/query",
+			param:    queryParam,
+			selector: `count({__name__=~".+"})`,
+			expCode:  http.StatusBadRequest,
+		},
+		{
+			name:     "series with metric names",
+			path:     "/api/v1/series",
+			param:    matchersParam,
+			selector: `{__name__=~"up|down"}`,
+			expCode:  http.StatusOK,
+			expParam: `{__name__=~"up|down",namespace="default"}`,
+		},
+		{
+			name:     "series with negative matcher",
+			path:     "/api/v1/series",
+			param:    matchersParam,
+			selector: `{__name__!=""}`,
+			expCode:  http.StatusBadRequest,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(checkQueryHandler("", tc.param, tc.expParam))
+			defer m.Close()
+			r, err := NewRoutes(m.url, proxyLabel, WithForbiddenBroadNameMatchers(0))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			u, err := url.Parse("http://prometheus.example.com" + tc.path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			q := u.Query()
+			q.Set(tc.param, tc.selector)
+			q.Set(proxyLabel, "default")
+			u.RawQuery = q.Encode()
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, u.String(), nil))
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				body, _ := ioutil.ReadAll(resp.Body)
+				t.Logf("%s", string(body))
+				t.Fatalf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestQueryConflictingValues(t *testing.T) {
+	m := newMockUpstream(checkQueryHandler("", queryParam, ""))
+	defer m.Close()
+	r, err := NewRoutes(m.url, proxyLabel)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	b := strings.NewReader(url.Values{queryParam: {`up{namespace="other"}`}}.Encode())
+	req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query?query=up&namespace=default", b)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusBadRequest, resp.StatusCode, string(body))
+	}
+	if !strings.Contains(string(body), `"errorType":"bad_data"`) {
+		t.Fatalf("expected bad_data error, got %q", string(body))
+	}
+}
+
+func TestSkipIfLabelPresent(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		url      string
+		param    string
+		value    string
+		expValue string
+	}{
+		{
+			name:     "query without the label",
+			url:      "http://prometheus.example.com/api/v1/query",
+			param:    queryParam,
+			value:    `up{job="prometheus"}`,
+			expValue: `up{job="prometheus",namespace="default"}`,
+		},
+		{
+			name:     "query with the label",
+			url:      "http://prometheus.example.com/api/v1/query",
+			param:    queryParam,
+			value:    `up{job="prometheus",namespace=~"other|default"} / up`,
+			expValue: `up{job="prometheus",namespace=~"other|default"} / up{namespace="default"}`,
+		},
+		{
+			name:     "match[] without the label",
+			url:      "http://prometheus.example.com/api/v1/series",
+			param:    matchersParam,
+			value:    `{job="prometheus"}`,
+			expValue: `{job="prometheus",namespace="default"}`,
+		},
+		{
+			name:     "match[] with the label",
+			url:      "http://prometheus.example.com/api/v1/series",
+			param:    matchersParam,
+			value:    `{job="prometheus",namespace!="kube-system"}`,
+			expValue: `{job="prometheus",namespace!="kube-system"}`,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(
+				checkParameterAbsent(
+					proxyLabel,
+					checkQueryHandler("", tc.param, tc.expValue),
+				),
+			)
+			defer m.Close()
+			r, err := NewRoutes(m.url, proxyLabel, WithSkipIfLabelPresent())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			u, err := url.Parse(tc.url)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			q := u.Query()
+			q.Set(tc.param, tc.value)
+			q.Set(proxyLabel, "default")
+			u.RawQuery = q.Encode()
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", u.String(), nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestCollapsedMatchers(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		url      string
+		param    string
+		value    string
+		expValue string
+	}{
+		{
+			name:     "match[] without the label",
+			url:      "http://prometheus.example.com/api/v1/series",
+			param:    matchersParam,
+			value:    `{job="prometheus"}`,
+			expValue: `{job="prometheus",namespace="default"}`,
+		},
+		{
+			name:     "match[] with the identical matcher",
+			url:      "http://prometheus.example.com/api/v1/series",
+			param:    matchersParam,
+			value:    `{job="prometheus",namespace="default"}`,
+			expValue: `{job="prometheus",namespace="default"}`,
+		},
+		{
+			name:     "match[] with another value",
+			url:      "http://prometheus.example.com/api/v1/series",
+			param:    matchersParam,
+			value:    `{job="prometheus",namespace="other"}`,
+			expValue: `{job="prometheus",namespace="other",namespace="default"}`,
+		},
+		{
+			name:     "match[] with another matcher type",
+			url:      "http://prometheus.example.com/api/v1/series",
+			param:    matchersParam,
+			value:    `{namespace=~"default"}`,
+			expValue: `{namespace=~"default",namespace="default"}`,
+		},
+		{
+			name:     "query with the identical matcher",
+			url:      "http://prometheus.example.com/api/v1/query",
+			param:    queryParam,
+			value:    `up{job="prometheus",namespace="default"}`,
+			expValue: `up{job="prometheus",namespace="default"}`,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(
+				checkParameterAbsent(
+					proxyLabel,
+					checkQueryHandler("", tc.param, tc.expValue),
+				),
+			)
+			defer m.Close()
+			r, err := NewRoutes(m.url, proxyLabel, WithCollapsedMatchers())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			u, err := url.Parse(tc.url)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			q := u.Query()
+			q.Set(tc.param, tc.value)
+			q.Set(proxyLabel, "default")
+			u.RawQuery = q.Encode()
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", u.String(), nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	// The forward proxy receives the requests to the upstream.
+	var proxied string
+	fwd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proxied = req.URL.Path
+		w.Write(okResponse)
+	}))
+	defer fwd.Close()
+
+	proxyURL, err := url.Parse(fwd.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	upstream, err := url.Parse("http://upstream.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var called bool
+	r, err := NewRoutes(upstream, proxyLabel, WithUpstreamProxy(func(req *http.Request) (*url.URL, error) {
+		called = true
+		return http.ProxyURL(proxyURL)(req)
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=default", nil))
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, resp.StatusCode, string(body))
+	}
+	if !called {
+		t.Fatalf("expected the proxy function to be called")
+	}
+	if proxied != "/api/v1/query" {
+		t.Fatalf("expected the request to go through the proxy, got %q", proxied)
+	}
+}
+
+func TestStripQueryIntrospection(t *testing.T) {
+	const explainedResponse = `{"status":"success","data":{"resultType":"vector","result":[],"stats":{"timings":{"evalTotalTime":0.01}},"explanation":{"name":"[*remoteExec]"},"analysis":{"name":"[*remoteExec]"}}}`
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+
+		expResponse string
+	}{
+		{
+			name:        "pass-through by default",
+			expResponse: explainedResponse,
+		},
+		{
+			name:        "stripped",
+			opts:        []Option{WithStripQueryIntrospection()},
+			expResponse: `{"status":"success","data":{"result":[],"resultType":"vector"}}` + "\n",
+		},
+		{
+			name:        "stripped with deprecated option",
+			opts:        []Option{WithStripQueryExplanation()},
+			expResponse: `{"status":"success","data":{"result":[],"resultType":"vector"}}` + "\n",
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				q := req.URL.Query()
+				introspection := q.Get("stats") != "" || q.Get("explain") != "" || q.Get("analyze") != ""
+				if len(tc.opts) > 0 && introspection {
+					http.Error(w, "unexpected introspection parameter", http.StatusInternalServerError)
+					return
+				}
+				w.Write([]byte(explainedResponse))
+			}))
+			defer m.Close()
+			r, err := NewRoutes(m.url, proxyLabel, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&stats=all&explain=true&analyze=true&namespace=default", nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, resp.StatusCode, string(body))
+			}
+			if string(body) != tc.expResponse {
+				t.Fatalf("expected response body %q, got %q", tc.expResponse, string(body))
+			}
+		})
+	}
+}
+
+func TestMaxHeaders(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+	r, err := NewRoutes(m.url, proxyLabel, WithMaxHeaders(3))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		headers int
+		expCode int
+	}{
+		{headers: 3, expCode: http.StatusOK},
+		{headers: 4, expCode: http.StatusRequestHeaderFieldsTooLarge},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=default", nil)
+		for i := 0; i < tc.headers; i++ {
+			req.Header.Add("X-Foo", fmt.Sprint(i))
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if resp := w.Result(); resp.StatusCode != tc.expCode {
+			t.Errorf("expected status code %d for %d headers, got %d", tc.expCode, tc.headers, resp.StatusCode)
+		}
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		opts    []Option
+		headers map[string]string
+
+		expHeaders map[string]string
+	}{
+		{
+			name: "headers set",
+			expHeaders: map[string]string{
+				"X-Forwarded-For":   "192.0.2.1",
+				"X-Forwarded-Host":  "prometheus.example.com",
+				"X-Forwarded-Proto": "http",
+			},
+		},
+		{
+			name: "headers from a front proxy",
+			headers: map[string]string{
+				"X-Forwarded-For":   "198.51.100.1",
+				"X-Forwarded-Host":  "front.example.com",
+				"X-Forwarded-Proto": "https",
+			},
+			expHeaders: map[string]string{
+				"X-Forwarded-For":   "198.51.100.1, 192.0.2.1",
+				"X-Forwarded-Host":  "front.example.com",
+				"X-Forwarded-Proto": "https",
+			},
+		},
+		{
+			name: "disabled",
+			opts: []Option{WithDisabledForwardedHeaders()},
+			headers: map[string]string{
+				"X-Forwarded-For":   "198.51.100.1",
+				"X-Forwarded-Host":  "front.example.com",
+				"X-Forwarded-Proto": "https",
+			},
+			expHeaders: map[string]string{
+				"X-Forwarded-For":   "",
+				"X-Forwarded-Host":  "",
+				"X-Forwarded-Proto": "",
+			},
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				for k, v := range tc.expHeaders {
+					if got := req.Header.Get(k); got != v {
+						http.Error(w, fmt.Sprintf("expected header %s %q, got %q", k, v, got), http.StatusInternalServerError)
+						return
+					}
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+			r, err := NewRoutes(m.url, proxyLabel, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=default", nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestLabelAlias(t *testing.T) {
+	const aliasedLabel = "__tenant__"
+
+	for _, tc := range []struct {
+		name     string
+		url      string
+		param    string
+		value    string
+		expValue string
+	}{
+		{
+			name:     "query",
+			url:      "http://prometheus.example.com/api/v1/query",
+			param:    queryParam,
+			value:    `up{tenant="other"}`,
+			expValue: `up{__tenant__="acme",tenant="other"}`,
+		},
+		{
+			name:     "series",
+			url:      "http://prometheus.example.com/api/v1/series",
+			param:    matchersParam,
+			value:    `{job="prometheus"}`,
+			expValue: `{job="prometheus",__tenant__="acme"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(
+				checkParameterAbsent(
+					"tenant",
+					checkQueryHandler("", tc.param, tc.expValue),
+				),
+			)
+			defer m.Close()
+			r, err := NewRoutes(m.url, aliasedLabel, WithExtractLabeler(HTTPFormEnforcer{ParameterName: "tenant"}))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			u, err := url.Parse(tc.url)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			q := u.Query()
+			q.Set(tc.param, tc.value)
+			q.Set("tenant", "acme")
+			u.RawQuery = q.Encode()
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, u.String(), nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestSelectorPaths(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		selectors []string
+		expected  []string
+	}{
+		{
+			name:     "no selector",
+			expected: []string{`{namespace="default"}`},
+		},
+		{
+			name:      "single selector",
+			selectors: []string{`up`},
+			expected:  []string{`{__name__="up",namespace="default"}`},
+		},
+		{
+			name:      "multiple selectors",
+			selectors: []string{`up`, `{job="prometheus"}`},
+			expected: []string{
+				`{__name__="up",namespace="default"}`,
+				`{job="prometheus",namespace="default"}`,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkQueryHandler("", "sel[]", tc.expected...))
+			defer m.Close()
+			r, err := NewRoutes(m.url, proxyLabel, WithSelectorPaths(map[string]string{"/custom/selectors": "sel[]"}))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{proxyLabel: []string{"default"}, "sel[]": tc.selectors}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/custom/selectors?"+q.Encode(), nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, resp.StatusCode, string(body))
+			}
+		})
+	}
+
+	t.Run("conflicting path", func(t *testing.T) {
+		_, err := NewRoutes(&url.URL{}, proxyLabel, WithSelectorPaths(map[string]string{"/api/v1/series": "match[]"}))
+		if err == nil {
+			t.Fatal("expected error, got none")
+		}
+	})
+}
+
+func TestHeadRequests(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		url      string
+		upstream http.Handler
+
+		expCode    int
+		expMatcher string
+	}{
+		{
+			name: "series",
+			url:  "http://prometheus.example.com/api/v1/series?match[]=up&" + proxyLabel + "=default",
+			upstream: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Length", "1024")
+			}),
+			expCode:    http.StatusOK,
+			expMatcher: `{__name__="up",namespace="default"}`,
+		},
+		{
+			name: "rules",
+			url:  "http://prometheus.example.com/api/v1/rules?" + proxyLabel + "=default",
+			upstream: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Length", "1024")
+			}),
+			expCode: http.StatusOK,
+		},
+		{
+			name: "missing label",
+			url:  "http://prometheus.example.com/api/v1/series?match[]=up",
+			upstream: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				t.Error("unexpected request to the upstream")
+			}),
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Method != http.MethodHead {
+					t.Errorf("expected HEAD request, got %s", req.Method)
+				}
+				if got := req.URL.Query().Get(matchersParam); got != tc.expMatcher {
+					t.Errorf("expected matcher %q, got %q", tc.expMatcher, got)
+				}
+				tc.upstream.ServeHTTP(w, req)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodHead, tc.url, nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if tc.expCode != http.StatusOK {
+				return
+			}
+			if len(body) != 0 {
+				t.Fatalf("expected no body, got %q", string(body))
+			}
+			if tc.expMatcher == "" && resp.Header.Get("Content-Length") != "" {
+				t.Fatalf("expected no Content-Length for a filtered endpoint, got %s", resp.Header.Get("Content-Length"))
+			}
+		})
+	}
+}
+
+func TestOptionsPassthrough(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodOptions {
+			t.Errorf("expected OPTIONS request, got %s", req.Method)
+		}
+		if req.URL.RawQuery != "" {
+			t.Errorf("expected no query string, got %q", req.URL.RawQuery)
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+
+		expCode int
+	}{
+		{
+			name:    "enforced",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "passthrough",
+			opts:    []Option{WithOptionsPassthrough()},
+			expCode: http.StatusNoContent,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// The preflight request doesn't carry the label value.
+			req := httptest.NewRequest(http.MethodOptions, "http://prometheus.example.com/api/v1/query?query=up", nil)
+			req.Header.Set("Origin", "http://grafana.example.com")
+			req.Header.Set("Access-Control-Request-Method", "POST")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestMaxMatchSelectors(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name  string
+		path  string
+		count int
+		opts  []Option
+
+		expCode int
+	}{
+		{
+			name:    "below the limit",
+			path:    "/api/v1/series",
+			count:   2,
+			opts:    []Option{WithMaxMatchSelectors(2)},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "above the limit",
+			path:    "/api/v1/series",
+			count:   3,
+			opts:    []Option{WithMaxMatchSelectors(2)},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "above the limit on federate",
+			path:    "/federate",
+			count:   3,
+			opts:    []Option{WithMaxMatchSelectors(2)},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "above the limit on labels",
+			path:    "/api/v1/labels",
+			count:   3,
+			opts:    []Option{WithMaxMatchSelectors(2), WithEnabledLabelsAPI()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "no limit",
+			path:    "/api/v1/series",
+			count:   100,
+			expCode: http.StatusOK,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{proxyLabel: []string{"default"}}
+			for i := 0; i < tc.count; i++ {
+				q.Add(matchersParam, fmt.Sprintf("up{instance=\"%d\"}", i))
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com"+tc.path+"?"+q.Encode(), nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if tc.expCode == http.StatusBadRequest && !strings.Contains(string(body), `"errorType":"bad_data"`) {
+				t.Fatalf("expected a bad_data error, got %s", string(body))
+			}
+		})
+	}
+}
+
+func TestQueryDedup(t *testing.T) {
+	// The upstream deduplicates the series which only differ by the replica
+	// label, like Thanos with dedup=true.
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		if req.Form.Get("dedup") != "true" {
+			t.Errorf("expected the dedup parameter to be passed through, got %q", req.Form.Get("dedup"))
+		}
+		var ns []string
+		for _, v := range []string{"default", "other"} {
+			if strings.Contains(req.Form.Get(queryParam), fmt.Sprintf(`namespace="%s"`, v)) {
+				ns = append(ns, v)
+			}
+		}
+		var series []string
+		for _, v := range ns {
+			series = append(series, fmt.Sprintf(`{"metric":{"__name__":"up","namespace":%q},"value":[1,"1"]}`, v))
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[%s]}}`, strings.Join(series, ","))
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		lvalue string
+		params string
+		body   string
+
+		expCode int
+		expNs   []string
+	}{
+		{
+			name:    "default",
+			lvalue:  "default",
+			params:  "query=up&dedup=true&replicaLabels[]=replica",
+			expCode: http.StatusOK,
+			expNs:   []string{"default"},
+		},
+		{
+			name:    "other",
+			lvalue:  "other",
+			params:  "query=up&dedup=true",
+			expCode: http.StatusOK,
+			expNs:   []string{"other"},
+		},
+		{
+			// The query can't select the series of another value.
+			name:    "regex matcher",
+			lvalue:  "default",
+			params:  `query=up{namespace=~"default|other"}&dedup=true`,
+			expCode: http.StatusOK,
+			expNs:   []string{"default"},
+		},
+		{
+			name:    "enforced label as replica label",
+			lvalue:  "default",
+			params:  "query=up&dedup=true&replicaLabels[]=replica&replicaLabels[]=" + proxyLabel,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "enforced label as replica label in the body",
+			lvalue:  "default",
+			body:    "query=up&dedup=true&replicaLabels[]=" + proxyLabel,
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			u := "http://prometheus.example.com/api/v1/query?" + proxyLabel + "=" + tc.lvalue
+			if tc.params != "" {
+				v, err := url.ParseQuery(tc.params)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				u += "&" + v.Encode()
+			}
+			method := http.MethodGet
+			if tc.body != "" {
+				method = http.MethodPost
+			}
+			req := httptest.NewRequest(method, u, strings.NewReader(tc.body))
+			if tc.body != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if tc.expCode != http.StatusOK {
+				return
+			}
+
+			var res struct {
+				Data struct {
+					Result []struct {
+						Metric map[string]string `json:"metric"`
+					} `json:"result"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(body, &res); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var ns []string
+			for _, s := range res.Data.Result {
+				ns = append(ns, s.Metric[proxyLabel])
+			}
+			if !reflect.DeepEqual(ns, tc.expNs) {
+				t.Fatalf("expected series of namespaces %v, got %v", tc.expNs, ns)
+			}
+		})
+	}
+}
+
+func TestMatchParams(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		method string
+		query  url.Values
+		body   url.Values
+		opts   []Option
+
+		expCode  int
+		expQuery url.Values
+		expBody  url.Values
+	}{
+		{
+			name:     "get",
+			method:   http.MethodGet,
+			query:    url.Values{"start": {"1"}, "end": {"2"}, "limit": {"10"}},
+			expCode:  http.StatusOK,
+			expQuery: url.Values{"start": {"1"}, "end": {"2"}, "limit": {"10"}, matchersParam: {`{namespace="default"}`}},
+			expBody:  url.Values{},
+		},
+		{
+			name:     "post",
+			method:   http.MethodPost,
+			body:     url.Values{"start": {"1"}, "end": {"2"}, "limit": {"10"}, matchersParam: {`up`, `{job="prometheus"}`}},
+			expCode:  http.StatusOK,
+			expQuery: url.Values{},
+			expBody:  url.Values{"start": {"1"}, "end": {"2"}, "limit": {"10"}, matchersParam: {`{__name__="up",namespace="default"}`, `{job="prometheus",namespace="default"}`}},
+		},
+		{
+			name:     "post without selectors",
+			method:   http.MethodPost,
+			body:     url.Values{"limit": {"10"}},
+			expCode:  http.StatusOK,
+			expQuery: url.Values{matchersParam: {`{namespace="default"}`}},
+			expBody:  url.Values{"limit": {"10"}},
+		},
+		{
+			name:     "post with selectors in the URL and the body",
+			method:   http.MethodPost,
+			query:    url.Values{matchersParam: {`up`}},
+			body:     url.Values{matchersParam: {`{namespace="other"}`}},
+			expCode:  http.StatusOK,
+			expQuery: url.Values{matchersParam: {`{__name__="up",namespace="default"}`}},
+			expBody:  url.Values{matchersParam: {`{namespace="other",namespace="default"}`}},
+		},
+		{
+			name:    "post with invalid selector",
+			method:  http.MethodPost,
+			body:    url.Values{matchersParam: {`{job=`}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "empty selector",
+			method:  http.MethodGet,
+			query:   url.Values{matchersParam: {``}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:     "selector matching all the metric names",
+			method:   http.MethodGet,
+			query:    url.Values{matchersParam: {`{__name__=~".+"}`, `up`}},
+			expCode:  http.StatusOK,
+			expQuery: url.Values{matchersParam: {`{__name__=~".+",namespace="default"}`, `{__name__="up",namespace="default"}`}},
+			expBody:  url.Values{},
+		},
+		{
+			name:     "selector with the enforced matcher",
+			method:   http.MethodGet,
+			query:    url.Values{matchersParam: {`up{namespace="default"}`}},
+			expCode:  http.StatusOK,
+			expQuery: url.Values{matchersParam: {`{namespace="default",__name__="up",namespace="default"}`}},
+			expBody:  url.Values{},
+		},
+		{
+			name:     "selector with a compatible matcher",
+			method:   http.MethodGet,
+			query:    url.Values{matchersParam: {`up{namespace=~"default|other"}`}},
+			opts:     []Option{WithSelectorsErrorOnConflict()},
+			expCode:  http.StatusOK,
+			expQuery: url.Values{matchersParam: {`{namespace=~"default|other",__name__="up",namespace="default"}`}},
+			expBody:  url.Values{},
+		},
+		{
+			name:    "selector with a conflicting matcher",
+			method:  http.MethodGet,
+			query:   url.Values{matchersParam: {`up`, `up{namespace="other"}`}},
+			opts:    []Option{WithSelectorsErrorOnConflict()},
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		for _, path := range []string{"/api/v1/labels", "/api/v1/series"} {
+			t.Run(strings.ReplaceAll(tc.name, " ", "_")+path, func(t *testing.T) {
+				m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					body, err := ioutil.ReadAll(req.Body)
+					if err != nil {
+						t.Errorf("unexpected error: %v", err)
+						return
+					}
+					form, err := url.ParseQuery(string(body))
+					if err != nil {
+						t.Errorf("unexpected error: %v", err)
+						return
+					}
+					if got := req.URL.Query(); !reflect.DeepEqual(got, tc.expQuery) {
+						t.Errorf("expected query %v, got %v", tc.expQuery, got)
+					}
+					if !reflect.DeepEqual(form, tc.expBody) {
+						t.Errorf("expected body %v, got %v", tc.expBody, form)
+					}
+					w.Write(okResponse)
+				}))
+				defer m.Close()
+
+				r, err := NewRoutes(m.url, proxyLabel, append([]Option{WithEnabledLabelsAPI()}, tc.opts...)...)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				q := url.Values{proxyLabel: {"default"}}
+				for k, vs := range tc.query {
+					q[k] = vs
+				}
+				req := httptest.NewRequest(tc.method, "http://prometheus.example.com"+path+"?"+q.Encode(), strings.NewReader(tc.body.Encode()))
+				if tc.method == http.MethodPost {
+					req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				}
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+				if w.Code != tc.expCode {
+					t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+				}
+			})
+		}
+	}
+}
+
+func TestLabelValues(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		path     string
+		upstream string
+
+		expMatch []string
+		expData  []string
+	}{
+		{
+			name:     "enforced label",
+			path:     "/api/v1/label/namespace/values",
+			upstream: `["default","other","third"]`,
+			expMatch: []string{`{namespace="default"}`},
+			expData:  []string{"default"},
+		},
+		{
+			name:     "enforced label without the value",
+			path:     "/api/v1/label/namespace/values",
+			upstream: `["other"]`,
+			expMatch: []string{`{namespace="default"}`},
+			expData:  []string{},
+		},
+		{
+			name:     "other label",
+			path:     "/api/v1/label/job/values",
+			upstream: `["prometheus","node"]`,
+			expMatch: []string{`{namespace="default"}`},
+			expData:  []string{"prometheus", "node"},
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if got := req.URL.Query()[matchersParam]; !reflect.DeepEqual(got, tc.expMatch) {
+					t.Errorf("expected %s %v, got %v", matchersParam, tc.expMatch, got)
+				}
+				fmt.Fprintf(w, `{"status":"success","data":%s}`, tc.upstream)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, WithEnabledLabelsAPI())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com"+tc.path+"?"+proxyLabel+"=default", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			var res struct {
+				Data []string `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(res.Data, tc.expData) {
+				t.Fatalf("expected values %v, got %v", tc.expData, res.Data)
+			}
+		})
+	}
+}
+
+func TestQueryExemplars(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if got, exp := req.Form.Get(queryParam), `http_requests_total{namespace="default"}`; got != exp {
+			t.Errorf("expected query %q, got %q", exp, got)
+		}
+		w.Write([]byte(`{"status":"success","data":[
+  {"seriesLabels":{"__name__":"http_requests_total","namespace":"default"},"exemplars":[{"labels":{"trace_id":"1"},"value":"1","timestamp":1600000000}]},
+  {"seriesLabels":{"__name__":"http_requests_total","namespace":"other"},"exemplars":[{"labels":{"trace_id":"2"},"value":"1","timestamp":1600000000}]},
+  {"seriesLabels":{"__name__":"http_requests_total"},"exemplars":[{"labels":{"trace_id":"3"},"value":"1","timestamp":1600000000}]}
+]}`))
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		t.Run(method, func(t *testing.T) {
+			q := url.Values{queryParam: {"http_requests_total"}, "start": {"1600000000"}, "end": {"1600000100"}}
+			var req *http.Request
+			if method == http.MethodGet {
+				req = httptest.NewRequest(method, "http://prometheus.example.com/api/v1/query_exemplars?"+proxyLabel+"=default&"+q.Encode(), nil)
+			} else {
+				req = httptest.NewRequest(method, "http://prometheus.example.com/api/v1/query_exemplars?"+proxyLabel+"=default", strings.NewReader(q.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			var apir apiResponse
+			if err := json.NewDecoder(w.Body).Decode(&apir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var data []exemplarData
+			if err := json.Unmarshal(apir.Data, &data); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(data) != 1 || data[0].SeriesLabels.Get(proxyLabel) != "default" {
+				t.Fatalf("expected the exemplars of the default namespace only, got %s", string(apir.Data))
+			}
+			if exp := `[{"labels":{"trace_id":"1"},"value":"1","timestamp":1600000000}]`; string(data[0].Exemplars) != exp {
+				t.Fatalf("expected exemplars %s, got %s", exp, string(data[0].Exemplars))
+			}
+		})
+	}
+}
+
+func TestAdditionalLabels(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		path     string
+		header   string
+		upstream string
+
+		expCode  int
+		expQuery string
+		expMatch []string
+		expData  string
+	}{
+		{
+			name:     "query",
+			path:     "/api/v1/query?query=up&" + proxyLabel + "=default",
+			header:   "eu",
+			upstream: `{"resultType":"vector","result":[]}`,
+			expCode:  http.StatusOK,
+			expQuery: `up{cluster="eu",namespace="default"}`,
+		},
+		{
+			name:    "query without the additional label value",
+			path:    "/api/v1/query?query=up&" + proxyLabel + "=default",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:     "series",
+			path:     "/api/v1/series?match[]=up&match[]={job=\"prometheus\"}&" + proxyLabel + "=default",
+			header:   "eu",
+			upstream: `[]`,
+			expCode:  http.StatusOK,
+			expMatch: []string{`{__name__="up",namespace="default",cluster="eu"}`, `{job="prometheus",namespace="default",cluster="eu"}`},
+		},
+		{
+			name:     "labels",
+			path:     "/api/v1/labels?" + proxyLabel + "=default",
+			header:   "eu",
+			upstream: `[]`,
+			expCode:  http.StatusOK,
+			expMatch: []string{`{namespace="default",cluster="eu"}`},
+		},
+		{
+			name:     "label values of the additional label",
+			path:     "/api/v1/label/cluster/values?" + proxyLabel + "=default",
+			header:   "eu",
+			upstream: `["eu","us"]`,
+			expCode:  http.StatusOK,
+			expMatch: []string{`{namespace="default",cluster="eu"}`},
+			expData:  `["eu"]`,
+		},
+		{
+			name:   "alerts",
+			path:   "/api/v1/alerts?" + proxyLabel + "=default",
+			header: "eu",
+			upstream: `{"alerts":[
+  {"labels":{"alertname":"a","namespace":"default","cluster":"eu"},"annotations":{},"state":"firing","activeAt":"2020-01-01T00:00:00Z","value":"1"},
+  {"labels":{"alertname":"b","namespace":"default","cluster":"us"},"annotations":{},"state":"firing","activeAt":"2020-01-01T00:00:00Z","value":"1"},
+  {"labels":{"alertname":"c","namespace":"default"},"annotations":{},"state":"firing","activeAt":"2020-01-01T00:00:00Z","value":"1"},
+  {"labels":{"alertname":"d","namespace":"other","cluster":"eu"},"annotations":{},"state":"firing","activeAt":"2020-01-01T00:00:00Z","value":"1"}
+]}`,
+			expCode: http.StatusOK,
+			expData: `{"alerts":[{"labels":{"alertname":"a","cluster":"eu","namespace":"default"},"annotations":{},"state":"firing","activeAt":"2020-01-01T00:00:00Z","value":"1"}]}`,
+		},
+		{
+			name:   "rules",
+			path:   "/api/v1/rules?" + proxyLabel + "=default",
+			header: "eu",
+			upstream: `{"groups":[{"name":"group","file":"rules.yml","interval":30,"rules":[
+  {"name":"a","query":"up","labels":{"namespace":"default","cluster":"eu"},"health":"ok","type":"recording"},
+  {"name":"b","query":"up","labels":{"namespace":"default","cluster":"us"},"health":"ok","type":"recording"},
+  {"name":"c","query":"up","labels":{"namespace":"default"},"health":"ok","type":"recording"}
+]}]}`,
+			expCode: http.StatusOK,
+			expData: `{"groups":[{"name":"group","file":"rules.yml","rules":[{"name":"a","query":"up","labels":{"cluster":"eu","namespace":"default"},"health":"ok","type":"recording"}],"interval":30}]}`,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if got := req.URL.Query().Get(queryParam); got != tc.expQuery {
+					t.Errorf("expected query %q, got %q", tc.expQuery, got)
+				}
+				if got := req.URL.Query()[matchersParam]; !reflect.DeepEqual(got, tc.expMatch) {
+					t.Errorf("expected %s %v, got %v", matchersParam, tc.expMatch, got)
+				}
+				fmt.Fprintf(w, `{"status":"success","data":%s}`, tc.upstream)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, WithEnabledLabelsAPI(), WithAdditionalLabel("cluster", HTTPHeaderEnforcer{Name: "X-Cluster"}))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest("GET", "http://prometheus.example.com"+tc.path, nil)
+			if tc.header != "" {
+				req.Header.Set("X-Cluster", tc.header)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+			if tc.expData == "" {
+				return
+			}
+
+			var res struct {
+				Data json.RawMessage `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(res.Data) != tc.expData {
+				t.Fatalf("expected data %s, got %s", tc.expData, string(res.Data))
+			}
+		})
+	}
+
+	t.Run("duplicate label", func(t *testing.T) {
+		if _, err := NewRoutes(&url.URL{Scheme: "http", Host: "prometheus.example.com"}, proxyLabel, WithAdditionalLabel(proxyLabel, nil)); err == nil {
+			t.Fatal("expected an error, got none")
+		}
+	})
+}
+
+func TestAdditionalLabelsAlertmanager(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		upstream string
+
+		expCode    int
+		expFilters []string
+		expBody    string
+		expData    string
+	}{
+		{
+			name:   "list silences",
+			method: http.MethodGet,
+			path:   "/api/v2/silences?filter=cluster%3D%22us%22",
+			upstream: `[
+  {"id":"1","matchers":[{"name":"namespace","value":"default","isRegex":false},{"name":"cluster","value":"eu","isRegex":false}]},
+  {"id":"2","matchers":[{"name":"namespace","value":"default","isRegex":false},{"name":"cluster","value":"us","isRegex":false}]},
+  {"id":"3","matchers":[{"name":"namespace","value":"default","isRegex":false}]}
+]`,
+			expCode:    http.StatusOK,
+			expFilters: []string{`namespace="default"`, `cluster="eu"`},
+			expData:    `[{"id":"1","matchers":[{"name":"namespace","value":"default","isRegex":false},{"name":"cluster","value":"eu","isRegex":false}]}]`,
+		},
+		{
+			name:     "post silence",
+			method:   http.MethodPost,
+			path:     "/api/v2/silences",
+			body:     `{"matchers":[{"name":"alertname","value":"a","isRegex":false},{"name":"cluster","value":"us","isRegex":false}]}`,
+			upstream: `{"silenceID":"1"}`,
+			expCode:  http.StatusOK,
+			expBody:  `{"matchers":[{"name":"namespace","value":"default","isRegex":false,"isEqual":true},{"name":"cluster","value":"eu","isRegex":false,"isEqual":true},{"name":"alertname","value":"a","isRegex":false}]}`,
+		},
+		{
+			name:    "delete silence of another cluster",
+			method:  http.MethodDelete,
+			path:    "/api/v2/silence/2",
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "delete silence",
+			method:  http.MethodDelete,
+			path:    "/api/v2/silence/1",
+			expCode: http.StatusOK,
+		},
+		{
+			name:   "list alerts",
+			method: http.MethodGet,
+			path:   "/api/v2/alerts",
+			upstream: `[
+  {"labels":{"alertname":"a","namespace":"default","cluster":"eu"},"annotations":{},"fingerprint":"1","receivers":[],"startsAt":"2020-01-01T00:00:00.000Z","endsAt":"2020-01-01T00:00:00.000Z","updatedAt":"2020-01-01T00:00:00.000Z","status":{"state":"active","silencedBy":[],"inhibitedBy":[]}},
+  {"labels":{"alertname":"b","namespace":"default","cluster":"us"},"annotations":{},"fingerprint":"2","receivers":[],"startsAt":"2020-01-01T00:00:00.000Z","endsAt":"2020-01-01T00:00:00.000Z","updatedAt":"2020-01-01T00:00:00.000Z","status":{"state":"active","silencedBy":[],"inhibitedBy":[]}}
+]`,
+			expCode:    http.StatusOK,
+			expFilters: []string{`namespace="default"`, `cluster="eu"`},
+			expData:    `[{"annotations":{},"endsAt":"2020-01-01T00:00:00.000Z","fingerprint":"1","receivers":[],"startsAt":"2020-01-01T00:00:00.000Z","status":{"inhibitedBy":[],"silencedBy":[],"state":"active"},"updatedAt":"2020-01-01T00:00:00.000Z","labels":{"alertname":"a","cluster":"eu","namespace":"default"}}]`,
+		},
+		{
+			name:     "post alerts",
+			method:   http.MethodPost,
+			path:     "/api/v2/alerts",
+			body:     `[{"labels":{"alertname":"a","cluster":"us"}}]`,
+			upstream: `{}`,
+			expCode:  http.StatusOK,
+			expBody:  `[{"endsAt":"0001-01-01T00:00:00.000Z","startsAt":"0001-01-01T00:00:00.000Z","labels":{"alertname":"a","cluster":"eu","namespace":"default"}}]`,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				switch {
+				case req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/api/v2/silence/"):
+					cluster := "eu"
+					if strings.HasSuffix(req.URL.Path, "/2") {
+						cluster = "us"
+					}
+					fmt.Fprintf(w, `{"id":"1","matchers":[{"name":"namespace","value":"default","isRegex":false},{"name":"cluster","value":%q,"isRegex":false}]}`, cluster)
+					return
+				case req.Method == http.MethodDelete:
+					return
+				}
+
+				if got := req.URL.Query()["filter"]; !reflect.DeepEqual(got, tc.expFilters) {
+					t.Errorf("expected filters %v, got %v", tc.expFilters, got)
+				}
+				if tc.expBody != "" {
+					body, _ := ioutil.ReadAll(req.Body)
+					if got := strings.TrimSpace(string(body)); got != tc.expBody {
+						t.Errorf("expected body %s, got %s", tc.expBody, got)
+					}
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(tc.upstream))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, WithAdditionalLabel("cluster", HTTPHeaderEnforcer{Name: "X-Cluster"}))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			sep := "?"
+			if strings.Contains(tc.path, "?") {
+				sep = "&"
+			}
+			req := httptest.NewRequest(tc.method, "http://alertmanager.example.com"+tc.path+sep+proxyLabel+"=default", strings.NewReader(tc.body))
+			req.Header.Set("X-Cluster", "eu")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+			if tc.expData == "" {
+				return
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tc.expData {
+				t.Fatalf("expected data %s, got %s", tc.expData, got)
+			}
+		})
+	}
+}
+
+func TestNegativeMatchers(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		path      string
+		matchType labels.MatchType
+		upstream  string
+
+		expCode  int
+		expQuery string
+		expMatch []string
+		expData  string
+	}{
+		{
+			name:      "query",
+			path:      "/api/v1/query?query=up&" + proxyLabel + "=internal",
+			matchType: labels.MatchNotEqual,
+			upstream:  `{"resultType":"vector","result":[]}`,
+			expCode:   http.StatusOK,
+			expQuery:  `up{namespace!="internal"}`,
+		},
+		{
+			name:      "query with a regular expression",
+			path:      "/api/v1/query?query=up&" + proxyLabel + "=internal|kube-.*",
+			matchType: labels.MatchNotRegexp,
+			upstream:  `{"resultType":"vector","result":[]}`,
+			expCode:   http.StatusOK,
+			expQuery:  `up{namespace!~"internal|kube-.*"}`,
+		},
+		{
+			name:      "invalid regular expression",
+			path:      "/api/v1/query?query=up&" + proxyLabel + "=(",
+			matchType: labels.MatchNotRegexp,
+			expCode:   http.StatusBadRequest,
+		},
+		{
+			name:      "series",
+			path:      "/api/v1/series?match[]=up&" + proxyLabel + "=internal",
+			matchType: labels.MatchNotEqual,
+			upstream:  `[]`,
+			expCode:   http.StatusOK,
+			expMatch:  []string{`{__name__="up",namespace!="internal"}`},
+		},
+		{
+			name:      "label values",
+			path:      "/api/v1/label/namespace/values?" + proxyLabel + "=internal|kube-.*",
+			matchType: labels.MatchNotRegexp,
+			upstream:  `["default","internal","kube-system"]`,
+			expCode:   http.StatusOK,
+			expMatch:  []string{`{namespace!~"internal|kube-.*"}`},
+			expData:   `["default"]`,
+		},
+		{
+			name:      "alerts",
+			path:      "/api/v1/alerts?" + proxyLabel + "=internal",
+			matchType: labels.MatchNotEqual,
+			upstream: `{"alerts":[
+  {"labels":{"alertname":"a","namespace":"default"},"annotations":{},"state":"firing","activeAt":"2020-01-01T00:00:00Z","value":"1"},
+  {"labels":{"alertname":"b","namespace":"internal"},"annotations":{},"state":"firing","activeAt":"2020-01-01T00:00:00Z","value":"1"},
+  {"labels":{"alertname":"c"},"annotations":{},"state":"firing","activeAt":"2020-01-01T00:00:00Z","value":"1"}
+]}`,
+			expCode: http.StatusOK,
+			expData: `{"alerts":[{"labels":{"alertname":"a","namespace":"default"},"annotations":{},"state":"firing","activeAt":"2020-01-01T00:00:00Z","value":"1"},{"labels":{"alertname":"c"},"annotations":{},"state":"firing","activeAt":"2020-01-01T00:00:00Z","value":"1"}]}`,
+		},
+		{
+			name:      "rules",
+			path:      "/api/v1/rules?" + proxyLabel + "=internal",
+			matchType: labels.MatchNotEqual,
+			upstream: `{"groups":[{"name":"group","file":"rules.yml","interval":30,"rules":[
+  {"name":"a","query":"up","labels":{"namespace":"default"},"health":"ok","type":"recording"},
+  {"name":"b","query":"up","labels":{"namespace":"internal"},"health":"ok","type":"recording"},
+  {"name":"c","query":"up","health":"ok","type":"recording"}
+]}]}`,
+			expCode: http.StatusOK,
+			expData: `{"groups":[{"name":"group","file":"rules.yml","rules":[{"name":"a","query":"up","labels":{"namespace":"default"},"health":"ok","type":"recording"},{"name":"c","query":"up","health":"ok","type":"recording"}],"interval":30}]}`,
+		},
+		{
+			name:      "alertmanager",
+			path:      "/api/v2/silences?" + proxyLabel + "=internal",
+			matchType: labels.MatchNotEqual,
+			expCode:   http.StatusNotImplemented,
+		},
+		{
+			name:      "equality matcher",
+			path:      "/api/v1/query?query=up&" + proxyLabel + "=default",
+			matchType: labels.MatchEqual,
+			upstream:  `{"resultType":"vector","result":[]}`,
+			expCode:   http.StatusOK,
+			expQuery:  `up{namespace="default"}`,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if got := req.URL.Query().Get(queryParam); got != tc.expQuery {
+					t.Errorf("expected query %q, got %q", tc.expQuery, got)
+				}
+				if got := req.URL.Query()[matchersParam]; !reflect.DeepEqual(got, tc.expMatch) {
+					t.Errorf("expected %s %v, got %v", matchersParam, tc.expMatch, got)
+				}
+				fmt.Fprintf(w, `{"status":"success","data":%s}`, tc.upstream)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, WithEnabledLabelsAPI(), WithEnforcedMatchType(proxyLabel, tc.matchType))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com"+tc.path, nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+			if tc.expData == "" {
+				return
+			}
+
+			var res struct {
+				Data json.RawMessage `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(res.Data) != tc.expData {
+				t.Fatalf("expected data %s, got %s", tc.expData, string(res.Data))
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		name  string
+		label string
+		t     labels.MatchType
+	}{
+		{name: "regexp matcher", label: proxyLabel, t: labels.MatchRegexp},
+		{name: "label not enforced", label: "cluster", t: labels.MatchNotEqual},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			if _, err := NewRoutes(&url.URL{Scheme: "http", Host: "prometheus.example.com"}, proxyLabel, WithEnforcedMatchType(tc.label, tc.t)); err == nil {
+				t.Fatal("expected an error, got none")
+			}
+		})
+	}
+}
+
+func TestUnknownPaths(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		path string
+		opts []Option
+
+		expCode int
+	}{
+		{
+			name:    "denied by default",
+			path:    "/api/v1/status/config",
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "proxied",
+			path:    "/api/v1/status/config",
+			opts:    []Option{WithUnknownPathsProxied()},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "root path proxied",
+			path:    "/",
+			opts:    []Option{WithUnknownPathsProxied()},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "disabled endpoint not proxied",
+			path:    "/api/v1/label/job/values",
+			opts:    []Option{WithUnknownPathsProxied()},
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "enforced endpoint",
+			path:    "/api/v1/query?query=up",
+			opts:    []Option{WithUnknownPathsProxied()},
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com"+tc.path, nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+			if tc.expCode == http.StatusOK && w.Body.String() != string(okResponse) {
+				t.Fatalf("expected body %q, got %q", string(okResponse), w.Body.String())
+			}
+		})
+	}
+}
@@ -14,16 +14,26 @@
 package injectproxy
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/pkg/errors"
 	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
 )
 
 type apiResponse struct {
@@ -32,23 +42,45 @@ type apiResponse struct {
 	ErrorType string          `json:"errorType,omitempty"`
 	Error     string          `json:"error,omitempty"`
 	Warnings  []string        `json:"warnings,omitempty"`
+
+	// dropped is the number of items removed from the data by the proxy, nil
+	// if unknown.
+	dropped *int
 }
 
-func getAPIResponse(resp *http.Response) (*apiResponse, error) {
-	defer resp.Body.Close()
-	reader := resp.Body
+// addWarning appends a warning to the response, e.g. to explain the result of
+// the filtering to the client.
+func (a *apiResponse) addWarning(format string, args ...interface{}) {
+	a.Warnings = append(a.Warnings, fmt.Sprintf(format, args...))
+}
 
-	if resp.Header.Get("Content-Encoding") == "gzip" && !resp.Uncompressed {
-		var err error
-		reader, err = gzip.NewReader(resp.Body)
-		if err != nil {
-			return nil, errors.Wrap(err, "gzip decoding")
-		}
-		defer reader.Close()
+// setDropped records the number of items removed from the data by the proxy.
+func (a *apiResponse) setDropped(before, after int) {
+	n := before - after
+	a.dropped = &n
+}
+
+// modifiedAPIResponse is an apiResponse whose data has been modified by the
+// proxy.
+type modifiedAPIResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Warnings  []string    `json:"warnings,omitempty"`
+}
+
+// errEmptyResponse is returned when the upstream responds with an empty body,
+// e.g. a flaky backend returning a 200 status code without data.
+var errEmptyResponse = errors.New("empty response body from the upstream")
 
-		// TODO: recompress the modified response?
-		resp.Header.Del("Content-Encoding")
+func getAPIResponse(resp *http.Response) (*apiResponse, error) {
+	defer resp.Body.Close()
+	reader, err := bodyReader(resp)
+	if err != nil {
+		return nil, err
 	}
+	defer reader.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
@@ -56,6 +88,9 @@ func getAPIResponse(resp *http.Response) (*apiResponse, error) {
 
 	var apir apiResponse
 	if err := json.NewDecoder(reader).Decode(&apir); err != nil {
+		if err == io.EOF {
+			return nil, errEmptyResponse
+		}
 		return nil, errors.Wrap(err, "JSON decoding")
 	}
 
@@ -66,8 +101,216 @@ func getAPIResponse(resp *http.Response) (*apiResponse, error) {
 	return &apir, nil
 }
 
+// bodyReader returns a reader of the response's body which is decompressed if
+// needed (gzip, deflate and br encodings). The response is then marked as
+// uncompressed like the responses decompressed by the http package.
+func bodyReader(resp *http.Response) (io.ReadCloser, error) {
+	encoding := resp.Header.Get("Content-Encoding")
+	if encoding == "" || encoding == "identity" || resp.Uncompressed {
+		return ioutil.NopCloser(resp.Body), nil
+	}
+
+	body := bufio.NewReader(resp.Body)
+	if _, err := body.Peek(1); err == io.EOF {
+		return nil, errEmptyResponse
+	}
+
+	var reader io.ReadCloser
+	switch encoding {
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, errors.Wrap(err, "gzip decoding")
+		}
+		reader = gz
+	case "deflate":
+		zr, err := deflateReader(body)
+		if err != nil {
+			return nil, errors.Wrap(err, "deflate decoding")
+		}
+		reader = zr
+	case "br":
+		reader = ioutil.NopCloser(brotli.NewReader(body))
+	default:
+		return nil, errors.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+
+	resp.Header.Del("Content-Encoding")
+	resp.Uncompressed = true
+	return reader, nil
+}
+
+// deflateReader returns a reader decompressing the deflate-encoded data. The
+// deflate encoding should be the zlib format but some servers send the raw
+// deflate format so both are accepted.
+func deflateReader(r *bufio.Reader) (io.ReadCloser, error) {
+	if hdr, err := r.Peek(2); err == nil && hdr[0]&0x0f == 8 && (uint16(hdr[0])<<8|uint16(hdr[1]))%31 == 0 {
+		return zlib.NewReader(r)
+	}
+	return flate.NewReader(r), nil
+}
+
+const (
+	excludeAlertsParam  = "exclude_alerts"
+	healthParam         = "health"
+	ruleTypeParam       = "type"
+	ruleNameParam       = "rule_name[]"
+	ruleGroupParam      = "rule_group[]"
+	ruleFileParam       = "file[]"
+	groupLimitParam     = "group_limit"
+	groupNextTokenParam = "group_next_token"
+)
+
+// ruleHealths are the allowed values of the health filter.
+var ruleHealths = map[string]struct{}{
+	"ok":      {},
+	"err":     {},
+	"unknown": {},
+}
+
+// parseHealthFilter returns the set of rule healths requested by the client
+// or nil if the client doesn't filter on the health.
+func parseHealthFilter(q url.Values) (map[string]struct{}, error) {
+	if len(q[healthParam]) == 0 {
+		return nil, nil
+	}
+
+	healths := make(map[string]struct{}, len(q[healthParam]))
+	for _, h := range q[healthParam] {
+		if _, ok := ruleHealths[h]; !ok {
+			return nil, errors.Errorf("invalid %s parameter %q, must be one of ok, err or unknown", healthParam, h)
+		}
+		healths[h] = struct{}{}
+	}
+	return healths, nil
+}
+
+// ruleParams are the parameters of a rules request restricting the rules
+// returned by Prometheus. A nil set means no restriction.
+type ruleParams struct {
+	excludeAlerts bool
+	healths       map[string]struct{}
+	ruleType      string
+	names         map[string]struct{}
+	groups        map[string]struct{}
+	files         map[string]struct{}
+}
+
+// parseRuleParams validates the parameters of a rules request. The
+// pagination parameters (group_limit and group_next_token) are only validated
+// since the pagination is done by Prometheus.
+func parseRuleParams(q url.Values) (*ruleParams, error) {
+	var (
+		p   ruleParams
+		err error
+	)
+	if v := q.Get(excludeAlertsParam); v != "" {
+		if p.excludeAlerts, err = strconv.ParseBool(v); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s parameter", excludeAlertsParam)
+		}
+	}
+
+	if p.healths, err = parseHealthFilter(q); err != nil {
+		return nil, err
+	}
+
+	switch p.ruleType = q.Get(ruleTypeParam); p.ruleType {
+	case "", "alert", "record":
+	default:
+		return nil, errors.Errorf("invalid %s parameter %q, must be either alert or record", ruleTypeParam, p.ruleType)
+	}
+
+	p.names = stringSet(q[ruleNameParam])
+	p.groups = stringSet(q[ruleGroupParam])
+	p.files = stringSet(q[ruleFileParam])
+
+	if v := q.Get(groupLimitParam); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return nil, errors.Errorf("invalid %s parameter %q, must be a positive integer", groupLimitParam, v)
+		}
+	} else if q.Get(groupNextTokenParam) != "" {
+		return nil, errors.Errorf("the %s parameter requires the %s parameter", groupNextTokenParam, groupLimitParam)
+	}
+
+	return &p, nil
+}
+
+// keepGroup returns whether the rule group is selected by the parameters.
+func (p *ruleParams) keepGroup(rg *ruleGroup) bool {
+	if p.groups != nil {
+		if _, ok := p.groups[rg.Name]; !ok {
+			return false
+		}
+	}
+	if p.files != nil {
+		if _, ok := p.files[rg.File]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// keepRule returns whether the rule is selected by the parameters.
+func (p *ruleParams) keepRule(rule *rule) bool {
+	if p.healths != nil {
+		if _, ok := p.healths[rule.Health()]; !ok {
+			return false
+		}
+	}
+	if p.names != nil {
+		if _, ok := p.names[rule.Name()]; !ok {
+			return false
+		}
+	}
+	switch p.ruleType {
+	case "alert":
+		return rule.alertingRule != nil
+	case "record":
+		return rule.recordingRule != nil
+	}
+	return true
+}
+
+// stringSet returns the set of the given values or nil if there are none.
+func stringSet(values []string) map[string]struct{} {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+	return set
+}
+
+// rules validates the rules request before forwarding it upstream.
+func (r *routes) rules(w http.ResponseWriter, req *http.Request) {
+	if _, err := parseRuleParams(req.URL.Query()); err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.handler.ServeHTTP(w, req)
+}
+
 type rulesData struct {
 	RuleGroups []*ruleGroup `json:"groups"`
+	// GroupNextToken is the pagination token of the next page of rule groups
+	// returned by Prometheus when the request sets group_limit.
+	GroupNextToken string `json:"groupNextToken,omitempty"`
+}
+
+// UnmarshalJSON decodes the rules data of Prometheus as well as the bare array
+// of rule groups returned by some compatible backends.
+func (d *rulesData) UnmarshalJSON(b []byte) error {
+	if b = bytes.TrimSpace(b); len(b) > 0 && b[0] == '[' {
+		*d = rulesData{}
+		return json.Unmarshal(b, &d.RuleGroups)
+	}
+
+	type plain rulesData
+	return json.Unmarshal(b, (*plain)(d))
 }
 
 type ruleGroup struct {
@@ -89,6 +332,20 @@ func (r *rule) Labels() labels.Labels {
 	return r.recordingRule.Labels
 }
 
+func (r *rule) Name() string {
+	if r.alertingRule != nil {
+		return r.alertingRule.Name
+	}
+	return r.recordingRule.Name
+}
+
+func (r *rule) Health() string {
+	if r.alertingRule != nil {
+		return r.alertingRule.Health
+	}
+	return r.recordingRule.Health
+}
+
 // MarshalJSON implements the json.Marshaler interface for rule.
 func (r *rule) MarshalJSON() ([]byte, error) {
 	if r.alertingRule != nil {
@@ -126,6 +383,9 @@ func (r *rule) UnmarshalJSON(b []byte) error {
 }
 
 type alertingRule struct {
+	// State is the strongest state of the rule's alerts, missing in the
+	// responses of old Prometheus versions.
+	State       string        `json:"state,omitempty"`
 	Name        string        `json:"name"`
 	Query       string        `json:"query"`
 	Duration    float64       `json:"duration"`
@@ -160,10 +420,46 @@ type alert struct {
 	Value       string        `json:"value"`
 }
 
+type metricMetadata struct {
+	Target labels.Labels `json:"target"`
+	Metric string        `json:"metric,omitempty"`
+	Type   string        `json:"type"`
+	Help   string        `json:"help"`
+	Unit   string        `json:"unit"`
+}
+
+// apiFilter modifies the data of an API response for the enforced label
+// value.
+type apiFilter func(string, *http.Request, *apiResponse) (interface{}, error)
+
+// chainAPIFilters returns an apiFilter applying the given filters in order,
+// each filter being passed the data returned by the previous one.
+func chainAPIFilters(filters ...apiFilter) apiFilter {
+	return func(lvalue string, req *http.Request, resp *apiResponse) (interface{}, error) {
+		var v interface{} = resp.Data
+		for i, f := range filters {
+			if i > 0 {
+				b, err := json.Marshal(v)
+				if err != nil {
+					return nil, errors.Wrap(err, "can't replace data")
+				}
+				resp.Data = json.RawMessage(b)
+			}
+
+			var err error
+			if v, err = f(lvalue, req, resp); err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	}
+}
+
 // modifyAPIResponse unwraps the Prometheus API response, passes the enforced
 // label value and the response to the given function and finally replaces the
-// result in the response.
-func modifyAPIResponse(f func(string, *apiResponse) (interface{}, error)) func(*http.Response) error {
+// result in the response. The empty data is used in place of an empty upstream
+// response if configured.
+func (r *routes) modifyAPIResponse(f apiFilter, emptyData string) func(*http.Response) error {
 	return func(resp *http.Response) error {
 		if resp.StatusCode != http.StatusOK {
 			// Pass non-200 responses as-is.
@@ -171,59 +467,171 @@ func modifyAPIResponse(f func(string, *apiResponse) (interface{}, error)) func(*
 		}
 
 		apir, err := getAPIResponse(resp)
-		if err != nil {
+		if err == errEmptyResponse {
+			if !r.emptyBodyAsEmptyData {
+				return r.badUpstreamResponse(resp, &apiResponse{Status: "error", ErrorType: "bad_response", Error: err.Error()})
+			}
+			log.Printf("warning: Empty response body from the upstream for %s, returning an empty result", resp.Request.URL.Path)
+			apir = &apiResponse{Status: "success", Data: json.RawMessage(emptyData)}
+		} else if err != nil {
 			return errors.Wrap(err, "can't decode API response")
 		}
+		apir.Warnings = r.sanitizeWarnings(apir.Warnings)
 
-		v, err := f(mustLabelValue(resp.Request.Context()), apir)
+		v, err := f(mustLabelValue(resp.Request.Context()), resp.Request, apir)
 		if err != nil {
 			return err
 		}
-
-		b, err := json.Marshal(v)
-		if err != nil {
-			return errors.Wrap(err, "can't replace data")
-		}
-		apir.Data = json.RawMessage(b)
-
-		var buf bytes.Buffer
-		if err = json.NewEncoder(&buf).Encode(apir); err != nil {
-			return errors.Wrap(err, "can't encode API response")
+		if apir.dropped != nil {
+			if e := requestEvent(resp.Request.Context()); e != nil {
+				e.Dropped = apir.dropped
+			}
+			r.setFilteredCount(resp, *apir.dropped)
 		}
-		resp.Body = ioutil.NopCloser(&buf)
-		resp.Header["Content-Length"] = []string{fmt.Sprint(buf.Len())}
 
-		return nil
+		// The data is encoded along with the envelope to avoid buffering it
+		// twice. The format of the response doesn't change so the upstream
+		// Content-Type header is kept as-is.
+		return r.replaceBody(resp, &modifiedAPIResponse{
+			Status:    apir.Status,
+			Data:      v,
+			ErrorType: apir.ErrorType,
+			Error:     apir.Error,
+			Warnings:  apir.Warnings,
+		})
 	}
 }
 
-func (r *routes) filterRules(lvalue string, resp *apiResponse) (interface{}, error) {
+// filterRules keeps the rules whose labels match the enforced label value.
+//
+// When rulesWithActiveAlerts is enabled, alerting rules without a matching
+// label are kept too if at least one of their active alerts matches, with
+// only the matching alerts retained. Because the request may ask Prometheus
+// to omit the alerts (exclude_alerts=true), this alert-based retention is
+// disabled for such requests: the decision is then only based on the rule
+// labels and rules without the enforced label are always dropped.
+//
+// The client may also restrict the response to the rules with the given
+// health(s) with the "health" parameter and with the "type", "rule_name[]",
+// "rule_group[]" and "file[]" parameters of Prometheus. These filters are
+// always applied in addition to the enforced label, even if the upstream
+// doesn't support them. The pagination token of the upstream is preserved.
+func (r *routes) filterRules(lvalue string, req *http.Request, resp *apiResponse) (interface{}, error) {
 	var rgs rulesData
 	if err := json.Unmarshal(resp.Data, &rgs); err != nil {
 		return nil, errors.Wrap(err, "can't decode rules data")
 	}
 
+	keep, err := r.newRuleFilter(lvalue, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var before, after int
 	filtered := []*ruleGroup{}
 	for _, rg := range rgs.RuleGroups {
+		before += len(rg.Rules)
+		rules := keep(rg)
+		if len(rules) > 0 {
+			rg.Rules = rules
+			filtered = append(filtered, rg)
+		}
+		after += len(rules)
+	}
+	r.recordFiltering(req.Context(), "rules", lvalue, before, after)
+	resp.setDropped(before, after)
+	if r.filteringWarnings && len(rgs.RuleGroups) > 0 && len(filtered) == 0 {
+		resp.addWarning("none of the %d rule groups match %s", len(rgs.RuleGroups), enforcedLabelsString(req.Context()))
+	}
+
+	// The token identifies the next group of the upstream, it stays valid
+	// whatever the groups removed from this page.
+	return &rulesData{RuleGroups: filtered, GroupNextToken: rgs.GroupNextToken}, nil
+}
+
+// newRuleFilter returns a function returning the rules of a group to keep for
+// the enforced label value and the parameters of the request.
+func (r *routes) newRuleFilter(lvalue string, req *http.Request) (func(*ruleGroup) []rule, error) {
+	params, err := parseRuleParams(req.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	withActiveAlerts := r.rulesWithActiveAlerts && !params.excludeAlerts
+
+	e := r.newEnforcer(req.Context())
+	keep := func(rules []rule, rule rule) []rule {
+		if err := r.scopeRuleQuery(e, rule); err != nil {
+			log.Printf("warning: Dropping rule %q: can't enforce the label on its query: %v", rule.Name(), err)
+			return rules
+		}
+		return append(rules, rule)
+	}
+
+	return func(rg *ruleGroup) []rule {
+		if !params.keepGroup(rg) {
+			return nil
+		}
+
 		var rules []rule
 		for _, rule := range rg.Rules {
-			for _, lbl := range rule.Labels() {
-				if lbl.Name == r.label && lbl.Value == lvalue {
-					rules = append(rules, rule)
-					break
+			if !params.keepRule(&rule) {
+				continue
+			}
+
+			if matchesEnforcedLabels(req.Context(), rule.Labels()) {
+				rules = keep(rules, rule)
+				continue
+			}
+
+			if !withActiveAlerts || rule.alertingRule == nil {
+				continue
+			}
+
+			var alerts []*alert
+			for _, alert := range rule.alertingRule.Alerts {
+				if matchesEnforcedLabels(req.Context(), alert.Labels) {
+					alerts = append(alerts, alert)
 				}
 			}
+			if len(alerts) == 0 {
+				continue
+			}
+			rule.alertingRule.Alerts = alerts
+			if rule.alertingRule.State != "" {
+				rule.alertingRule.State = alertsState(alerts)
+			}
+			rules = keep(rules, rule)
 		}
-		if len(rules) > 0 {
-			rg.Rules = rules
-			filtered = append(filtered, rg)
-		}
+		return rules
+	}, nil
+}
+
+// scopeRuleQuery injects the enforced label matcher into the query of the
+// rule when enabled for the rule's type, so that the displayed expression
+// doesn't reference the series of other label values.
+func (r *routes) scopeRuleQuery(e *Enforcer, rule rule) error {
+	var q *string
+	switch {
+	case rule.alertingRule != nil && r.scopedAlertingRules:
+		q = &rule.alertingRule.Query
+	case rule.recordingRule != nil && r.scopedRecordingRules:
+		q = &rule.recordingRule.Query
+	default:
+		return nil
 	}
 
-	return &rulesData{RuleGroups: filtered}, nil
+	expr, err := parser.ParseExpr(*q)
+	if err != nil {
+		return err
+	}
+	if err := e.EnforceNode(expr); err != nil {
+		return err
+	}
+	*q = expr.String()
+	return nil
 }
 
-func (r *routes) filterAlerts(lvalue string, resp *apiResponse) (interface{}, error) {
+func (r *routes) filterAlerts(lvalue string, req *http.Request, resp *apiResponse) (interface{}, error) {
 	var data alertsData
 	if err := json.Unmarshal(resp.Data, &data); err != nil {
 		return nil, errors.Wrap(err, "can't decode alerts data")
@@ -231,13 +639,123 @@ func (r *routes) filterAlerts(lvalue string, resp *apiResponse) (interface{}, er
 
 	filtered := []*alert{}
 	for _, alert := range data.Alerts {
-		for _, lbl := range alert.Labels {
-			if lbl.Name == r.label && lbl.Value == lvalue {
-				filtered = append(filtered, alert)
-				break
-			}
+		if r.keepAlert(req.Context(), alert) {
+			filtered = append(filtered, alert)
 		}
 	}
+	r.recordFiltering(req.Context(), "alerts", lvalue, len(data.Alerts), len(filtered))
+	resp.setDropped(len(data.Alerts), len(filtered))
+	if r.filteringWarnings && len(data.Alerts) > 0 && len(filtered) == 0 {
+		resp.addWarning("none of the %d alerts match %s", len(data.Alerts), enforcedLabelsString(req.Context()))
+	}
 
 	return &alertsData{Alerts: filtered}, nil
 }
+
+// filterRulesAndAlerts filters the response of an endpoint combining the rule
+// groups of /api/v1/rules and the alerts of /api/v1/alerts in the same data
+// object, e.g. for dashboards. The other fields of the data are kept as-is.
+func (r *routes) filterRulesAndAlerts(lvalue string, req *http.Request, resp *apiResponse) (interface{}, error) {
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return nil, errors.Wrap(err, "can't decode rules and alerts data")
+	}
+	for _, k := range []string{"groups", "alerts"} {
+		if _, ok := data[k]; !ok {
+			return nil, errors.Errorf("can't decode rules and alerts data: missing %s field", k)
+		}
+	}
+
+	rules, err := r.filterRules(lvalue, req, resp)
+	if err != nil {
+		return nil, err
+	}
+	dropped := *resp.dropped
+	alerts, err := r.filterAlerts(lvalue, req, resp)
+	if err != nil {
+		return nil, err
+	}
+	dropped += *resp.dropped
+	resp.dropped = &dropped
+
+	filtered := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		filtered[k] = v
+	}
+	filtered["groups"] = rules.(*rulesData).RuleGroups
+	filtered["alerts"] = alerts.(*alertsData).Alerts
+	return filtered, nil
+}
+
+// alertStates are the states of the alerts by increasing strength.
+var alertStates = map[string]int{
+	"inactive": 0,
+	"pending":  1,
+	"firing":   2,
+}
+
+// alertsState returns the state of an alerting rule with the given alerts,
+// that is the strongest state of the alerts (firing, then pending, then
+// inactive).
+func alertsState(alerts []*alert) string {
+	state := "inactive"
+	for _, a := range alerts {
+		if alertStates[a.State] > alertStates[state] {
+			state = a.State
+		}
+	}
+	return state
+}
+
+// keepAlert returns whether the alert matches the enforced label values and the
+// additional labels of the context.
+func (r *routes) keepAlert(ctx context.Context, a *alert) bool {
+	if !matchesEnforcedLabels(ctx, a.Labels) {
+		return false
+	}
+	return !r.strictAlerts || !r.referencesOtherValue(mustLabelValues(ctx), a.Annotations.Map(), "")
+}
+
+func (r *routes) filterTargetsMetadata(lvalue string, req *http.Request, resp *apiResponse) (interface{}, error) {
+	var data []*metricMetadata
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return nil, errors.Wrap(err, "can't decode targets metadata")
+	}
+
+	filtered := []*metricMetadata{}
+	for _, md := range data {
+		if matchesEnforcedLabels(req.Context(), md.Target) {
+			filtered = append(filtered, md)
+		}
+	}
+	r.recordFiltering(req.Context(), "targets_metadata", lvalue, len(data), len(filtered))
+	resp.setDropped(len(data), len(filtered))
+
+	return filtered, nil
+}
+
+type exemplarData struct {
+	SeriesLabels labels.Labels   `json:"seriesLabels"`
+	Exemplars    json.RawMessage `json:"exemplars"`
+}
+
+// filterExemplars drops the exemplars of the series which don't have the
+// enforced label value, in case the upstream doesn't apply the selectors of
+// the enforced query to the exemplars.
+func (r *routes) filterExemplars(lvalue string, req *http.Request, resp *apiResponse) (interface{}, error) {
+	var data []*exemplarData
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return nil, errors.Wrap(err, "can't decode exemplars")
+	}
+
+	filtered := []*exemplarData{}
+	for _, ed := range data {
+		if matchesEnforcedLabels(req.Context(), ed.SeriesLabels) {
+			filtered = append(filtered, ed)
+		}
+	}
+	r.recordFiltering(req.Context(), "exemplars", lvalue, len(data), len(filtered))
+	resp.setDropped(len(data), len(filtered))
+
+	return filtered, nil
+}
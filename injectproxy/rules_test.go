@@ -14,7 +14,9 @@
 package injectproxy
 
 import (
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -22,7 +24,11 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/andybalholm/brotli"
 )
 
 type gzipResponseWriter struct {
@@ -895,3 +901,1612 @@ func normalizeAPIResponse(t *testing.T, b []byte) string {
 
 	return string(out)
 }
+
+func validTargetsMetadata() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+  "status": "success",
+  "data": [
+    {
+      "target": {
+        "instance": "127.0.0.1:9090",
+        "job": "prometheus",
+        "namespace": "ns1"
+      },
+      "type": "gauge",
+      "help": "Number of goroutines that currently exist.",
+      "unit": ""
+    },
+    {
+      "target": {
+        "instance": "127.0.0.1:9091",
+        "job": "prometheus",
+        "namespace": "ns2"
+      },
+      "type": "gauge",
+      "help": "Number of goroutines that currently exist.",
+      "unit": ""
+    }
+  ]
+}`))
+	})
+}
+
+func TestTargetsMetadata(t *testing.T) {
+	for _, tc := range []struct {
+		labelv   string
+		upstream http.Handler
+
+		expCode int
+		expBody []byte
+	}{
+		{
+			// No "namespace" parameter returns an error.
+			expCode: http.StatusBadRequest,
+			expBody: []byte("Bad request. The \"namespace\" query parameter must be provided.\n"),
+		},
+		{
+			// "namespace" parameter matching no target.
+			labelv:   "not_present",
+			upstream: validTargetsMetadata(),
+
+			expCode: http.StatusOK,
+			expBody: []byte(`{
+  "status": "success",
+  "data": []
+}`),
+		},
+		{
+			labelv:   "ns2",
+			upstream: validTargetsMetadata(),
+
+			expCode: http.StatusOK,
+			expBody: []byte(`{
+  "status": "success",
+  "data": [
+    {
+      "target": {
+        "instance": "127.0.0.1:9091",
+        "job": "prometheus",
+        "namespace": "ns2"
+      },
+      "type": "gauge",
+      "help": "Number of goroutines that currently exist.",
+      "unit": ""
+    }
+  ]
+}`),
+		},
+	} {
+		t.Run(fmt.Sprintf("%s=%s", proxyLabel, tc.labelv), func(t *testing.T) {
+			m := newMockUpstream(tc.upstream)
+			defer m.Close()
+			r, err := NewRoutes(m.url, proxyLabel)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			u, err := url.Parse("http://prometheus.example.com/api/v1/targets/metadata")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			q := u.Query()
+			q.Set(proxyLabel, tc.labelv)
+			u.RawQuery = q.Encode()
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", u.String(), nil)
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
+			}
+
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				if string(body) != string(tc.expBody) {
+					t.Fatalf("expected: %q, got: %q", string(tc.expBody), string(body))
+				}
+				return
+			}
+
+			got := normalizeAPIResponse(t, body)
+			expected := normalizeAPIResponse(t, tc.expBody)
+			if got != expected {
+				t.Logf("expected:")
+				t.Logf(expected)
+				t.Logf("got:")
+				t.Logf(got)
+				t.FailNow()
+			}
+		})
+	}
+}
+
+// rulesWithoutLabel returns an alerting rule which doesn't have the namespace
+// label but has active alerts for different namespaces. The alerts are
+// omitted when the request sets exclude_alerts=true like Prometheus does.
+func rulesWithoutLabel() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		alerts := `[
+              {
+                "labels": {
+                  "alertname": "Alert1",
+                  "namespace": "ns1"
+                },
+                "annotations": {},
+                "state": "firing",
+                "activeAt": "2019-12-18T13:14:44.543981127+01:00",
+                "value": "0e+00"
+              },
+              {
+                "labels": {
+                  "alertname": "Alert1",
+                  "namespace": "ns2"
+                },
+                "annotations": {},
+                "state": "firing",
+                "activeAt": "2019-12-18T13:14:44.543981127+01:00",
+                "value": "0e+00"
+              }
+            ]`
+		if req.URL.Query().Get("exclude_alerts") == "true" {
+			alerts = "null"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+  "status": "success",
+  "data": {
+    "groups": [
+      {
+        "name": "group1",
+        "file": "testdata/rules1.yml",
+        "rules": [
+          {
+            "name": "Alert1",
+            "query": "metric1 == 0",
+            "duration": 0,
+            "labels": {},
+            "annotations": {},
+            "alerts": ` + alerts + `,
+            "health": "ok",
+            "type": "alerting"
+          }
+        ],
+        "interval": 10
+      }
+    ]
+  }
+}`))
+	})
+}
+
+func TestRulesWithActiveAlerts(t *testing.T) {
+	for _, tc := range []struct {
+		name                  string
+		rulesWithActiveAlerts bool
+		excludeAlerts         string
+
+		expCode int
+		expBody []byte
+	}{
+		{
+			name: "rule without label is dropped by default",
+
+			expCode: http.StatusOK,
+			expBody: []byte(`{
+  "status": "success",
+  "data": {
+    "groups": []
+  }
+}`),
+		},
+		{
+			name:                  "rule without label is kept with the matching alerts only",
+			rulesWithActiveAlerts: true,
+
+			expCode: http.StatusOK,
+			expBody: []byte(`{
+  "status": "success",
+  "data": {
+    "groups": [
+      {
+        "name": "group1",
+        "file": "testdata/rules1.yml",
+        "rules": [
+          {
+            "name": "Alert1",
+            "query": "metric1 == 0",
+            "duration": 0,
+            "labels": {},
+            "annotations": {},
+            "alerts": [
+              {
+                "labels": {
+                  "alertname": "Alert1",
+                  "namespace": "ns1"
+                },
+                "annotations": {},
+                "state": "firing",
+                "activeAt": "2019-12-18T13:14:44.543981127+01:00",
+                "value": "0e+00"
+              }
+            ],
+            "health": "ok",
+            "type": "alerting"
+          }
+        ],
+        "interval": 10
+      }
+    ]
+  }
+}`),
+		},
+		{
+			name:                  "rule without label is dropped when alerts are excluded",
+			rulesWithActiveAlerts: true,
+			excludeAlerts:         "true",
+
+			expCode: http.StatusOK,
+			expBody: []byte(`{
+  "status": "success",
+  "data": {
+    "groups": []
+  }
+}`),
+		},
+		{
+			name:                  "rule without label is kept when alerts aren't excluded",
+			rulesWithActiveAlerts: true,
+			excludeAlerts:         "false",
+
+			expCode: http.StatusOK,
+			expBody: []byte(`{
+  "status": "success",
+  "data": {
+    "groups": [
+      {
+        "name": "group1",
+        "file": "testdata/rules1.yml",
+        "rules": [
+          {
+            "name": "Alert1",
+            "query": "metric1 == 0",
+            "duration": 0,
+            "labels": {},
+            "annotations": {},
+            "alerts": [
+              {
+                "labels": {
+                  "alertname": "Alert1",
+                  "namespace": "ns1"
+                },
+                "annotations": {},
+                "state": "firing",
+                "activeAt": "2019-12-18T13:14:44.543981127+01:00",
+                "value": "0e+00"
+              }
+            ],
+            "health": "ok",
+            "type": "alerting"
+          }
+        ],
+        "interval": 10
+      }
+    ]
+  }
+}`),
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(rulesWithoutLabel())
+			defer m.Close()
+
+			var opts []Option
+			if tc.rulesWithActiveAlerts {
+				opts = append(opts, WithRulesWithActiveAlerts())
+			}
+			r, err := NewRoutes(m.url, proxyLabel, opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			u, err := url.Parse("http://prometheus.example.com/api/v1/rules")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			q := u.Query()
+			q.Set(proxyLabel, "ns1")
+			if tc.excludeAlerts != "" {
+				q.Set("exclude_alerts", tc.excludeAlerts)
+			}
+			u.RawQuery = q.Encode()
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", u.String(), nil))
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
+			}
+
+			body, _ := ioutil.ReadAll(resp.Body)
+			got := normalizeAPIResponse(t, body)
+			expected := normalizeAPIResponse(t, tc.expBody)
+			if got != expected {
+				t.Logf("expected:")
+				t.Logf(expected)
+				t.Logf("got:")
+				t.Logf(got)
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestRulesWithActiveAlertsState(t *testing.T) {
+	// The rule is firing because of ns2 while ns1 only has pending alerts.
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{
+  "status": "success",
+  "data": {
+    "groups": [
+      {
+        "name": "group1",
+        "file": "testdata/rules1.yml",
+        "rules": [
+          {
+            "state": "firing",
+            "name": "Alert1",
+            "query": "metric1 == 0",
+            "duration": 0,
+            "labels": {},
+            "annotations": {},
+            "alerts": [
+              {"labels": {"alertname": "Alert1", "namespace": "ns1"}, "annotations": {}, "state": "pending", "activeAt": "2019-12-18T13:14:44.543981127+01:00", "value": "0e+00"},
+              {"labels": {"alertname": "Alert1", "namespace": "ns2"}, "annotations": {}, "state": "firing", "activeAt": "2019-12-18T13:14:44.543981127+01:00", "value": "0e+00"},
+              {"labels": {"alertname": "Alert1", "namespace": "ns3"}, "annotations": {}, "state": "pending", "activeAt": "2019-12-18T13:14:44.543981127+01:00", "value": "0e+00"},
+              {"labels": {"alertname": "Alert1", "namespace": "ns3"}, "annotations": {}, "state": "firing", "activeAt": "2019-12-18T13:14:44.543981127+01:00", "value": "0e+00"}
+            ],
+            "health": "ok",
+            "type": "alerting"
+          }
+        ],
+        "interval": 10
+      }
+    ]
+  }
+}`))
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, WithRulesWithActiveAlerts())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		labelv string
+
+		expAlerts int
+		expState  string
+	}{
+		{
+			labelv:    "ns1",
+			expAlerts: 1,
+			expState:  "pending",
+		},
+		{
+			labelv:    "ns2",
+			expAlerts: 1,
+			expState:  "firing",
+		},
+		{
+			labelv:    "ns3",
+			expAlerts: 2,
+			expState:  "firing",
+		},
+	} {
+		t.Run(tc.labelv, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/rules?"+proxyLabel+"="+tc.labelv, nil))
+
+			resp := w.Result()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+
+			var apir apiResponse
+			if err := json.NewDecoder(resp.Body).Decode(&apir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var data rulesData
+			if err := json.Unmarshal(apir.Data, &data); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(data.RuleGroups) != 1 || len(data.RuleGroups[0].Rules) != 1 {
+				t.Fatalf("expected 1 rule, got %+v", data)
+			}
+
+			ar := data.RuleGroups[0].Rules[0].alertingRule
+			if len(ar.Alerts) != tc.expAlerts {
+				t.Errorf("expected %d alerts, got %d", tc.expAlerts, len(ar.Alerts))
+			}
+			if ar.State != tc.expState {
+				t.Errorf("expected state %q, got %q", tc.expState, ar.State)
+			}
+		})
+	}
+}
+
+func TestScopedRuleQueries(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{
+  "status": "success",
+  "data": {
+    "groups": [
+      {
+        "name": "group1",
+        "file": "testdata/rules1.yml",
+        "rules": [
+          {
+            "name": "record1",
+            "query": "sum(rate(http_requests_total[5m]))",
+            "labels": {"namespace": "ns1"},
+            "health": "ok",
+            "type": "recording"
+          },
+          {
+            "name": "record2",
+            "query": "label_replace(up, \"namespace\", \"ns2\", \"\", \"\")",
+            "labels": {"namespace": "ns1"},
+            "health": "ok",
+            "type": "recording"
+          },
+          {
+            "name": "alert1",
+            "query": "up{namespace=\"ns2\"} == 0",
+            "duration": 0,
+            "labels": {"namespace": "ns1"},
+            "annotations": {},
+            "alerts": [],
+            "health": "ok",
+            "type": "alerting"
+          }
+        ],
+        "interval": 10
+      }
+    ]
+  }
+}`))
+	}))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+
+		expQueries map[string]string
+	}{
+		{
+			name: "disabled",
+			expQueries: map[string]string{
+				"record1": "sum(rate(http_requests_total[5m]))",
+				"record2": `label_replace(up, "namespace", "ns2", "", "")`,
+				"alert1":  `up{namespace="ns2"} == 0`,
+			},
+		},
+		{
+			name: "recording rules",
+			opts: []Option{WithScopedRecordingRuleQueries()},
+			expQueries: map[string]string{
+				"record1": `sum(rate(http_requests_total{namespace="ns1"}[5m]))`,
+				"alert1":  `up{namespace="ns2"} == 0`,
+			},
+		},
+		{
+			name: "alerting rules",
+			opts: []Option{WithScopedAlertingRuleQueries()},
+			expQueries: map[string]string{
+				"record1": "sum(rate(http_requests_total[5m]))",
+				"record2": `label_replace(up, "namespace", "ns2", "", "")`,
+				"alert1":  `up{namespace="ns1"} == 0`,
+			},
+		},
+		{
+			name: "all rules",
+			opts: []Option{WithScopedRecordingRuleQueries(), WithScopedAlertingRuleQueries()},
+			expQueries: map[string]string{
+				"record1": `sum(rate(http_requests_total{namespace="ns1"}[5m]))`,
+				"alert1":  `up{namespace="ns1"} == 0`,
+			},
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/rules?"+proxyLabel+"=ns1", nil))
+
+			resp := w.Result()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+
+			var apir apiResponse
+			if err := json.NewDecoder(resp.Body).Decode(&apir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var data rulesData
+			if err := json.Unmarshal(apir.Data, &data); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			queries := map[string]string{}
+			for _, rg := range data.RuleGroups {
+				for _, rule := range rg.Rules {
+					if rule.alertingRule != nil {
+						queries[rule.Name()] = rule.alertingRule.Query
+						continue
+					}
+					queries[rule.Name()] = rule.recordingRule.Query
+				}
+			}
+			if !reflect.DeepEqual(queries, tc.expQueries) {
+				t.Fatalf("expected queries %v, got %v", tc.expQueries, queries)
+			}
+		})
+	}
+}
+
+func rulesWithHealth() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+  "status": "success",
+  "data": {
+    "groups": [
+      {
+        "name": "group1",
+        "file": "testdata/rules1.yml",
+        "rules": [
+          {
+            "name": "metric1",
+            "query": "0",
+            "labels": {"namespace": "ns1"},
+            "health": "ok",
+            "type": "recording"
+          },
+          {
+            "name": "metric2",
+            "query": "1 +",
+            "labels": {"namespace": "ns1"},
+            "health": "err",
+            "lastError": "parse error",
+            "type": "recording"
+          },
+          {
+            "name": "metric3",
+            "query": "1 +",
+            "labels": {"namespace": "ns2"},
+            "health": "err",
+            "lastError": "parse error",
+            "type": "recording"
+          }
+        ],
+        "interval": 10
+      }
+    ]
+  }
+}`))
+	})
+}
+
+func TestRulesHealthFilter(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		healths []string
+
+		expCode int
+		expBody []byte
+	}{
+		{
+			name:    "no health filter",
+			expCode: http.StatusOK,
+			expBody: []byte(`{
+  "status": "success",
+  "data": {
+    "groups": [
+      {
+        "name": "group1",
+        "file": "testdata/rules1.yml",
+        "rules": [
+          {
+            "name": "metric1",
+            "query": "0",
+            "labels": {"namespace": "ns1"},
+            "health": "ok",
+            "type": "recording"
+          },
+          {
+            "name": "metric2",
+            "query": "1 +",
+            "labels": {"namespace": "ns1"},
+            "health": "err",
+            "lastError": "parse error",
+            "type": "recording"
+          }
+        ],
+        "interval": 10
+      }
+    ]
+  }
+}`),
+		},
+		{
+			name:    "unhealthy rules only",
+			healths: []string{"err", "unknown"},
+			expCode: http.StatusOK,
+			expBody: []byte(`{
+  "status": "success",
+  "data": {
+    "groups": [
+      {
+        "name": "group1",
+        "file": "testdata/rules1.yml",
+        "rules": [
+          {
+            "name": "metric2",
+            "query": "1 +",
+            "labels": {"namespace": "ns1"},
+            "health": "err",
+            "lastError": "parse error",
+            "type": "recording"
+          }
+        ],
+        "interval": 10
+      }
+    ]
+  }
+}`),
+		},
+		{
+			name:    "no matching rule",
+			healths: []string{"unknown"},
+			expCode: http.StatusOK,
+			expBody: []byte(`{
+  "status": "success",
+  "data": {
+    "groups": []
+  }
+}`),
+		},
+		{
+			name:    "invalid health",
+			healths: []string{"err", "broken"},
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(rulesWithHealth())
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{healthParam: tc.healths}
+			q.Set(proxyLabel, "ns1")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/rules?"+q.Encode(), nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+
+			got := normalizeAPIResponse(t, body)
+			expected := normalizeAPIResponse(t, tc.expBody)
+			if got != expected {
+				t.Logf("expected:")
+				t.Logf(expected)
+				t.Logf("got:")
+				t.Logf(got)
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestRulesFilterParams(t *testing.T) {
+	// The upstream ignores the filter parameters like old Prometheus versions.
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{
+  "status": "success",
+  "data": {
+    "groups": [
+      {
+        "name": "group1",
+        "file": "rules1.yml",
+        "rules": [
+          {"name": "metric1", "query": "0", "labels": {"namespace": "ns1"}, "health": "ok", "type": "recording"},
+          {"name": "Alert1", "query": "metric1 == 0", "duration": 0, "labels": {"namespace": "ns1"}, "annotations": {}, "alerts": [], "health": "ok", "type": "alerting"},
+          {"name": "Alert2", "query": "metric1 == 0", "duration": 0, "labels": {"namespace": "ns2"}, "annotations": {}, "alerts": [], "health": "ok", "type": "alerting"}
+        ],
+        "interval": 10
+      },
+      {
+        "name": "group2",
+        "file": "rules2.yml",
+        "rules": [
+          {"name": "metric2", "query": "1", "labels": {"namespace": "ns1"}, "health": "ok", "type": "recording"}
+        ],
+        "interval": 10
+      },
+      {
+        "name": "group3",
+        "file": "rules2.yml",
+        "rules": [
+          {"name": "metric3", "query": "1", "labels": {"namespace": "ns2"}, "health": "ok", "type": "recording"}
+        ],
+        "interval": 10
+      }
+    ],
+    "groupNextToken": "abc123"
+  }
+}`))
+	})
+
+	for _, tc := range []struct {
+		name   string
+		params url.Values
+
+		expCode  int
+		expRules []string
+	}{
+		{
+			name:     "no filter",
+			expCode:  http.StatusOK,
+			expRules: []string{"group1/metric1", "group1/Alert1", "group2/metric2"},
+		},
+		{
+			name:     "alerting rules",
+			params:   url.Values{ruleTypeParam: {"alert"}},
+			expCode:  http.StatusOK,
+			expRules: []string{"group1/Alert1"},
+		},
+		{
+			name:     "recording rules",
+			params:   url.Values{ruleTypeParam: {"record"}},
+			expCode:  http.StatusOK,
+			expRules: []string{"group1/metric1", "group2/metric2"},
+		},
+		{
+			name:    "invalid type",
+			params:  url.Values{ruleTypeParam: {"alerting"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:     "rule names",
+			params:   url.Values{ruleNameParam: {"metric2", "Alert1", "Alert2"}},
+			expCode:  http.StatusOK,
+			expRules: []string{"group1/Alert1", "group2/metric2"},
+		},
+		{
+			name:     "rule groups",
+			params:   url.Values{ruleGroupParam: {"group1", "group3"}},
+			expCode:  http.StatusOK,
+			expRules: []string{"group1/metric1", "group1/Alert1"},
+		},
+		{
+			name:     "files",
+			params:   url.Values{ruleFileParam: {"rules2.yml"}},
+			expCode:  http.StatusOK,
+			expRules: []string{"group2/metric2"},
+		},
+		{
+			name:     "combined filters",
+			params:   url.Values{ruleFileParam: {"rules1.yml"}, ruleTypeParam: {"record"}},
+			expCode:  http.StatusOK,
+			expRules: []string{"group1/metric1"},
+		},
+		{
+			name:     "pagination",
+			params:   url.Values{groupLimitParam: {"3"}, groupNextTokenParam: {"xyz"}},
+			expCode:  http.StatusOK,
+			expRules: []string{"group1/metric1", "group1/Alert1", "group2/metric2"},
+		},
+		{
+			name:    "invalid group limit",
+			params:  url.Values{groupLimitParam: {"0"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "next token without group limit",
+			params:  url.Values{groupNextTokenParam: {"xyz"}},
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		for _, streaming := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/streaming=%v", strings.ReplaceAll(tc.name, " ", "_"), streaming), func(t *testing.T) {
+				m := newMockUpstream(upstream)
+				defer m.Close()
+
+				var opts []Option
+				if streaming {
+					opts = append(opts, WithStreamingThreshold(1))
+				}
+				r, err := NewRoutes(m.url, proxyLabel, opts...)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				q := url.Values{}
+				for k, v := range tc.params {
+					q[k] = v
+				}
+				q.Set(proxyLabel, "ns1")
+
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/rules?"+q.Encode(), nil))
+
+				resp := w.Result()
+				body, _ := ioutil.ReadAll(resp.Body)
+				if resp.StatusCode != tc.expCode {
+					t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+				}
+				if resp.StatusCode != http.StatusOK {
+					return
+				}
+
+				var apir apiResponse
+				if err := json.Unmarshal(body, &apir); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				var data rulesData
+				if err := json.Unmarshal(apir.Data, &data); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				var rules []string
+				for _, rg := range data.RuleGroups {
+					for _, rule := range rg.Rules {
+						rules = append(rules, rg.Name+"/"+rule.Name())
+					}
+				}
+				if !reflect.DeepEqual(rules, tc.expRules) {
+					t.Errorf("expected rules %v, got %v", tc.expRules, rules)
+				}
+				if data.GroupNextToken != "abc123" {
+					t.Errorf("expected the group next token to be preserved, got %q", data.GroupNextToken)
+				}
+			})
+		}
+	}
+}
+
+func TestFilteredCountHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		upstream http.Handler
+		path     string
+		value    string
+		opts     []Option
+
+		expCount string
+	}{
+		{
+			name:     "alerts",
+			upstream: validAlerts(),
+			path:     "/api/v1/alerts",
+			value:    "ns1",
+			opts:     []Option{WithFilteredCountHeader()},
+			expCount: "1",
+		},
+		{
+			name:     "alerts for another value",
+			upstream: validAlerts(),
+			path:     "/api/v1/alerts",
+			value:    "ns2",
+			opts:     []Option{WithFilteredCountHeader()},
+			expCount: "3",
+		},
+		{
+			name:     "rules",
+			upstream: rulesWithHealth(),
+			path:     "/api/v1/rules",
+			value:    "ns1",
+			opts:     []Option{WithFilteredCountHeader()},
+			expCount: "1",
+		},
+		{
+			name:     "targets metadata",
+			upstream: validTargetsMetadata(),
+			path:     "/api/v1/targets/metadata",
+			value:    "ns2",
+			opts:     []Option{WithFilteredCountHeader()},
+			expCount: "1",
+		},
+		{
+			name:     "disabled",
+			upstream: validAlerts(),
+			path:     "/api/v1/alerts",
+			value:    "ns1",
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(tc.upstream)
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com"+tc.path+"?"+proxyLabel+"="+tc.value, nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, resp.StatusCode, string(body))
+			}
+			if got := resp.Header.Get(filteredCountHeader); got != tc.expCount {
+				t.Fatalf("expected %s header %q, got %q", filteredCountHeader, tc.expCount, got)
+			}
+		})
+	}
+}
+
+// contentTypeWriter overrides the Content-Type header set by the wrapped
+// handler.
+type contentTypeWriter struct {
+	http.ResponseWriter
+	contentType string
+}
+
+func (w *contentTypeWriter) WriteHeader(code int) {
+	w.Header().Set("Content-Type", w.contentType)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *contentTypeWriter) Write(b []byte) (int, error) {
+	w.Header().Set("Content-Type", w.contentType)
+	return w.ResponseWriter.Write(b)
+}
+
+func TestFilteredResponseContentType(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		upstream    http.Handler
+		path        string
+		contentType string
+	}{
+		{
+			name:        "alerts",
+			upstream:    validAlerts(),
+			path:        "/api/v1/alerts",
+			contentType: "application/json",
+		},
+		{
+			name:        "rules with vendor type",
+			upstream:    rulesWithHealth(),
+			path:        "/api/v1/rules",
+			contentType: "application/vnd.prometheus.api+json; charset=utf-8",
+		},
+		{
+			name:        "alerts without type",
+			upstream:    validAlerts(),
+			path:        "/api/v1/alerts",
+			contentType: "",
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				tc.upstream.ServeHTTP(&contentTypeWriter{ResponseWriter: w, contentType: tc.contentType}, req)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com"+tc.path+"?"+proxyLabel+"=ns1", nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, resp.StatusCode, string(body))
+			}
+			if got := resp.Header.Get("Content-Type"); got != tc.contentType {
+				t.Fatalf("expected Content-Type %q, got %q", tc.contentType, got)
+			}
+		})
+	}
+}
+
+func TestRecompressedResponses(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		upstream       http.Handler
+		acceptEncoding string
+		opts           []Option
+
+		expGzip bool
+	}{
+		{
+			name:           "recompressed",
+			upstream:       gzipHandler(validRules()),
+			acceptEncoding: "gzip, deflate",
+			opts:           []Option{WithRecompressedResponses()},
+			expGzip:        true,
+		},
+		{
+			name:           "disabled",
+			upstream:       gzipHandler(validRules()),
+			acceptEncoding: "gzip",
+		},
+		{
+			name:           "gzip refused by the client",
+			upstream:       gzipHandler(validRules()),
+			acceptEncoding: "gzip;q=0, identity",
+			opts:           []Option{WithRecompressedResponses()},
+		},
+		{
+			name:           "uncompressed upstream response",
+			upstream:       validRules(),
+			acceptEncoding: "gzip",
+			opts:           []Option{WithRecompressedResponses()},
+		},
+		{
+			name:     "client not asking for gzip",
+			upstream: gzipHandler(validRules()),
+			opts:     []Option{WithRecompressedResponses()},
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(tc.upstream)
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/rules?"+proxyLabel+"=ns1", nil)
+			if tc.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, resp.StatusCode, string(body))
+			}
+			if got := resp.Header.Get("Content-Length"); got != fmt.Sprint(len(body)) {
+				t.Fatalf("expected Content-Length %d, got %s", len(body), got)
+			}
+
+			encoding := resp.Header.Get("Content-Encoding")
+			if !tc.expGzip {
+				if encoding != "" {
+					t.Fatalf("expected no Content-Encoding, got %q", encoding)
+				}
+			} else {
+				if encoding != "gzip" {
+					t.Fatalf("expected gzip Content-Encoding, got %q", encoding)
+				}
+				gz, err := gzip.NewReader(strings.NewReader(string(body)))
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if body, err = ioutil.ReadAll(gz); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			var apir apiResponse
+			if err := json.Unmarshal(body, &apir); err != nil {
+				t.Fatalf("unexpected error: %v: %s", err, string(body))
+			}
+			if apir.Status != "success" {
+				t.Fatalf("expected success status, got %q", apir.Status)
+			}
+		})
+	}
+}
+
+func TestEmptyUpstreamResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		path string
+		opts []Option
+
+		expCode int
+		expBody string
+	}{
+		{
+			name:    "rules",
+			path:    "/api/v1/rules",
+			expCode: http.StatusBadGateway,
+			expBody: `{"status":"error","errorType":"bad_response","error":"empty response body from the upstream"}`,
+		},
+		{
+			name:    "rules with empty result",
+			path:    "/api/v1/rules",
+			opts:    []Option{WithEmptyResponsesAsEmptyResults()},
+			expCode: http.StatusOK,
+			expBody: `{"status":"success","data":{"groups":[]}}`,
+		},
+		{
+			name:    "alerts with empty result",
+			path:    "/api/v1/alerts",
+			opts:    []Option{WithEmptyResponsesAsEmptyResults()},
+			expCode: http.StatusOK,
+			expBody: `{"status":"success","data":{"alerts":[]}}`,
+		},
+		{
+			name:    "targets metadata with empty result",
+			path:    "/api/v1/targets/metadata",
+			opts:    []Option{WithEmptyResponsesAsEmptyResults()},
+			expCode: http.StatusOK,
+			expBody: `{"status":"success","data":[]}`,
+		},
+		{
+			name:    "alertmanager alerts",
+			path:    "/api/v2/alerts",
+			expCode: http.StatusBadGateway,
+			expBody: `"empty response body from the upstream"`,
+		},
+		{
+			name:    "alertmanager alerts with empty result",
+			path:    "/api/v2/alerts",
+			opts:    []Option{WithEmptyResponsesAsEmptyResults()},
+			expCode: http.StatusOK,
+			expBody: `[]`,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com"+tc.path+"?"+proxyLabel+"=ns1", nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if got := strings.TrimSpace(string(body)); got != tc.expBody {
+				t.Fatalf("expected body %s, got %s", tc.expBody, got)
+			}
+		})
+	}
+}
+
+func TestContentEncodings(t *testing.T) {
+	rec := httptest.NewRecorder()
+	validRules().ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/rules", nil))
+	rules := rec.Body.Bytes()
+
+	for _, tc := range []struct {
+		encoding string
+		compress func(io.Writer) io.WriteCloser
+
+		expCode int
+	}{
+		{
+			encoding: "gzip",
+			compress: func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+			expCode:  http.StatusOK,
+		},
+		{
+			encoding: "deflate",
+			compress: func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+			expCode:  http.StatusOK,
+		},
+		{
+			// Raw deflate data without the zlib wrapper.
+			encoding: "deflate",
+			compress: func(w io.Writer) io.WriteCloser {
+				fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+				return fw
+			},
+			expCode: http.StatusOK,
+		},
+		{
+			encoding: "br",
+			compress: func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+			expCode:  http.StatusOK,
+		},
+		{
+			encoding: "compress",
+			compress: func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+			expCode:  http.StatusBadGateway,
+		},
+	} {
+		t.Run(tc.encoding, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Encoding", tc.encoding)
+				cw := tc.compress(w)
+				cw.Write(rules)
+				cw.Close()
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/rules?"+proxyLabel+"=ns1", nil)
+			req.Header.Set("Accept-Encoding", tc.encoding)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if tc.expCode != http.StatusOK {
+				return
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != "" {
+				t.Fatalf("expected no Content-Encoding, got %q", got)
+			}
+
+			var apir apiResponse
+			if err := json.Unmarshal(body, &apir); err != nil {
+				t.Fatalf("unexpected error: %v: %s", err, string(body))
+			}
+			if !strings.Contains(string(apir.Data), `"namespace":"ns1"`) {
+				t.Fatalf("expected the rules of ns1, got %s", string(apir.Data))
+			}
+		})
+	}
+}
+
+func TestFilteringWarnings(t *testing.T) {
+	upstreamWarnings := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"status":"success","data":{"groups":[{"name":"group1","file":"rules.yml","rules":[{"name":"metric1","query":"0","labels":{"namespace":"ns1"},"health":"ok","type":"recording"}],"interval":10}]},"warnings":["upstream warning"]}`))
+	})
+
+	for _, tc := range []struct {
+		name     string
+		upstream http.Handler
+		path     string
+		labelv   string
+		opts     []Option
+
+		expWarnings []string
+	}{
+		{
+			name:        "no matching rule groups",
+			upstream:    validRules(),
+			path:        "/api/v1/rules",
+			labelv:      "not_present",
+			opts:        []Option{WithFilteringWarnings()},
+			expWarnings: []string{`none of the 3 rule groups match namespace="not_present"`},
+		},
+		{
+			name:     "matching rule groups",
+			upstream: validRules(),
+			path:     "/api/v1/rules",
+			labelv:   "ns1",
+			opts:     []Option{WithFilteringWarnings()},
+		},
+		{
+			name:     "disabled",
+			upstream: validRules(),
+			path:     "/api/v1/rules",
+			labelv:   "not_present",
+		},
+		{
+			name:        "no matching alerts",
+			upstream:    validAlerts(),
+			path:        "/api/v1/alerts",
+			labelv:      "not_present",
+			opts:        []Option{WithFilteringWarnings()},
+			expWarnings: []string{`none of the 4 alerts match namespace="not_present"`},
+		},
+		{
+			name:        "upstream warnings",
+			upstream:    upstreamWarnings,
+			path:        "/api/v1/rules",
+			labelv:      "not_present",
+			opts:        []Option{WithFilteringWarnings()},
+			expWarnings: []string{"upstream warning", `none of the 1 rule groups match namespace="not_present"`},
+		},
+		{
+			name:        "upstream warnings without filtering warnings",
+			upstream:    upstreamWarnings,
+			path:        "/api/v1/rules",
+			labelv:      "ns1",
+			expWarnings: []string{"upstream warning"},
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(tc.upstream)
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com"+tc.path+"?"+proxyLabel+"="+tc.labelv, nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, resp.StatusCode, string(body))
+			}
+
+			var apir apiResponse
+			if err := json.Unmarshal(body, &apir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(apir.Warnings, tc.expWarnings) {
+				t.Fatalf("expected warnings %q, got %q", tc.expWarnings, apir.Warnings)
+			}
+		})
+	}
+}
+
+func TestAlertsSelectors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		matches []string
+
+		expCode  int
+		expMatch []string
+	}{
+		{
+			name:    "no selector",
+			expCode: http.StatusOK,
+		},
+		{
+			name:     "selector",
+			matches:  []string{`{alertname="Alert2"}`},
+			expCode:  http.StatusOK,
+			expMatch: []string{`{alertname="Alert2",namespace="ns1"}`},
+		},
+		{
+			name:     "selectors with other label value",
+			matches:  []string{`{namespace="ns2"}`, `{alertname=~"Alert.*"}`},
+			expCode:  http.StatusOK,
+			expMatch: []string{`{namespace="ns2",namespace="ns1"}`, `{alertname=~"Alert.*",namespace="ns1"}`},
+		},
+		{
+			name:    "invalid selector",
+			matches: []string{`{alertname=}`},
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if got := req.URL.Query()[matchersParam]; !reflect.DeepEqual(got, tc.expMatch) {
+					http.Error(w, fmt.Sprintf("expected %s %v, got %v", matchersParam, tc.expMatch, got), http.StatusTeapot)
+					return
+				}
+				// The hypothetical selectors are ignored by the upstream.
+				validAlerts().ServeHTTP(w, req)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{}
+			q.Set(proxyLabel, "ns1")
+			for _, match := range tc.matches {
+				q.Add(matchersParam, match)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/alerts?"+q.Encode(), nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+
+			var apir struct {
+				Data alertsData `json:"data"`
+			}
+			if err := json.Unmarshal(body, &apir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(apir.Data.Alerts) != 3 {
+				t.Fatalf("expected 3 alerts, got %d: %s", len(apir.Data.Alerts), string(body))
+			}
+			for _, a := range apir.Data.Alerts {
+				if v := a.Labels.Get(proxyLabel); v != "ns1" {
+					t.Fatalf("expected alerts with %s=%q, got %q", proxyLabel, "ns1", v)
+				}
+			}
+		})
+	}
+}
+
+// bareArrayRules returns the rules of h with the data being the bare array of
+// rule groups, like some Prometheus-compatible backends.
+func bareArrayRules(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		var resp struct {
+			Status string `json:"status"`
+			Data   struct {
+				Groups json.RawMessage `json:"groups"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": resp.Status, "data": resp.Data.Groups})
+	})
+}
+
+func TestBareArrayRules(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		labelv string
+	}{
+		{
+			name:   "matching rules",
+			labelv: "ns1",
+		},
+		{
+			name:   "no matching rules",
+			labelv: "not_present",
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			get := func(h http.Handler) *http.Response {
+				m := newMockUpstream(h)
+				defer m.Close()
+
+				r, err := NewRoutes(m.url, proxyLabel)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/rules?"+proxyLabel+"="+tc.labelv, nil))
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+				}
+				return w.Result()
+			}
+
+			// The response is normalized to the standard shape.
+			if got, exp := decodeResponse(t, get(bareArrayRules(validRules()))), decodeResponse(t, get(validRules())); !reflect.DeepEqual(got, exp) {
+				t.Fatalf("expected response\n%v\ngot\n%v", exp, got)
+			}
+		})
+	}
+}
+
+func TestRulesAndAlerts(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		upstream string
+
+		expCode int
+		expData string
+	}{
+		{
+			name: "combined response",
+			upstream: `{"status":"success","data":{
+  "groups":[
+    {"name":"group1","file":"rules.yml","interval":30,"rules":[
+      {"name":"metric1","query":"0","labels":{"namespace":"ns1"},"health":"ok","type":"recording"},
+      {"name":"metric1","query":"0","labels":{"namespace":"ns2"},"health":"ok","type":"recording"}
+    ]},
+    {"name":"group2","file":"rules.yml","interval":30,"rules":[
+      {"name":"metric2","query":"0","labels":{"namespace":"ns2"},"health":"ok","type":"recording"}
+    ]}
+  ],
+  "alerts":[
+    {"labels":{"alertname":"Alert1","namespace":"ns1"},"annotations":{},"state":"firing","value":"1"},
+    {"labels":{"alertname":"Alert1","namespace":"ns2"},"annotations":{},"state":"firing","value":"1"}
+  ],
+  "groupNextToken":"abc"
+}}`,
+			expCode: http.StatusOK,
+			expData: `{
+  "groups":[
+    {"name":"group1","file":"rules.yml","interval":30,"rules":[
+      {"name":"metric1","query":"0","labels":{"namespace":"ns1"},"health":"ok","type":"recording"}
+    ]}
+  ],
+  "alerts":[
+    {"labels":{"alertname":"Alert1","namespace":"ns1"},"annotations":{},"state":"firing","value":"1"}
+  ],
+  "groupNextToken":"abc"
+}`,
+		},
+		{
+			name:     "no matching rules and alerts",
+			upstream: `{"status":"success","data":{"groups":[],"alerts":[{"labels":{"alertname":"Alert1","namespace":"ns2"},"annotations":{},"state":"firing","value":"1"}]}}`,
+			expCode:  http.StatusOK,
+			expData:  `{"groups":[],"alerts":[]}`,
+		},
+		{
+			name:     "missing alerts",
+			upstream: `{"status":"success","data":{"groups":[]}}`,
+			expCode:  http.StatusBadGateway,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(tc.upstream))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, WithRulesAndAlertsPath("/api/dashboard/alerting"))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com/api/dashboard/alerting?"+proxyLabel+"=ns1", nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+			if tc.expCode != http.StatusOK {
+				return
+			}
+
+			var apir apiResponse
+			if err := json.NewDecoder(w.Body).Decode(&apir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got, exp interface{}
+			if err := json.Unmarshal(apir.Data, &got); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := json.Unmarshal([]byte(tc.expData), &exp); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, exp) {
+				t.Fatalf("expected data\n%s\ngot\n%s", tc.expData, string(apir.Data))
+			}
+		})
+	}
+}
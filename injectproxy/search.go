@@ -0,0 +1,98 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// filterSearchResults keeps the metric names of a search response which
+// belong to at least one series matching the enforced label value. The
+// response data must be a list of metric names. The names are checked with a
+// series lookup scoped to the label value so that autocompletion doesn't leak
+// the metric names of other tenants.
+func (r *routes) filterSearchResults(lvalue string, req *http.Request, resp *apiResponse) (interface{}, error) {
+	var names []string
+	if err := json.Unmarshal(resp.Data, &names); err != nil {
+		return nil, errors.Wrap(err, "can't decode search results")
+	}
+
+	filtered := []string{}
+	if len(names) > 0 {
+		scoped, err := r.scopedMetricNames(req.Context(), lvalue, names)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't look up the series")
+		}
+		for _, name := range names {
+			if _, ok := scoped[name]; ok {
+				filtered = append(filtered, name)
+			}
+		}
+	}
+	r.recordFiltering(req.Context(), "search", lvalue, len(names), len(filtered))
+	resp.setDropped(len(names), len(filtered))
+
+	return filtered, nil
+}
+
+// scopedMetricNames returns the subset of the given metric names having at
+// least one series matching the enforced label value.
+func (r *routes) scopedMetricNames(ctx context.Context, lvalue string, names []string) (map[string]struct{}, error) {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = regexp.QuoteMeta(n)
+	}
+	selector := matchersToString(append(
+		[]*labels.Matcher{{Name: labels.MetricName, Type: labels.MatchRegexp, Value: strings.Join(quoted, "|")}},
+		mustEnforcedMatchers(ctx)...,
+	)...)
+
+	u := *r.upstream
+	u.Path = path.Join(u.Path, "/api/v1/series")
+	u.RawQuery = url.Values{matchersParam: {selector}}.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&http.Client{Transport: r.transport}).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	apir, err := getAPIResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var series []labels.Labels
+	if err := json.Unmarshal(apir.Data, &series); err != nil {
+		return nil, errors.Wrap(err, "can't decode series")
+	}
+
+	scoped := make(map[string]struct{}, len(series))
+	for _, s := range series {
+		scoped[s.Get(labels.MetricName)] = struct{}{}
+	}
+	return scoped, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	const expSeriesMatch = `{__name__=~"up|http_requests_total|node_cpu_seconds_total",namespace="default"}`
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get(proxyLabel) != "" {
+			http.Error(w, "unexpected label parameter", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"status":"success","data":["up","http_requests_total","node_cpu_seconds_total"]}`))
+	})
+	mux.HandleFunc("/api/v1/series", func(w http.ResponseWriter, req *http.Request) {
+		if got := req.URL.Query().Get(matchersParam); got != expSeriesMatch {
+			http.Error(w, fmt.Sprintf("expected %s %q, got %q", matchersParam, expSeriesMatch, got), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"status":"success","data":[
+			{"__name__":"up","job":"prometheus","namespace":"default"},
+			{"__name__":"up","job":"node","namespace":"default"},
+			{"__name__":"http_requests_total","job":"prometheus","namespace":"default"}
+		]}`))
+	})
+	m := newMockUpstream(mux)
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, WithSearchPath("/search"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/search?q=t&namespace=default", nil))
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, resp.StatusCode, string(body))
+	}
+
+	exp := `{"status":"success","data":["up","http_requests_total"]}` + "\n"
+	if string(body) != exp {
+		t.Fatalf("expected response body %q, got %q", exp, string(body))
+	}
+}
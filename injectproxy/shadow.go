@@ -0,0 +1,237 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// shadowTimeout is the maximum duration of a request mirrored to the shadow
+// upstream.
+const shadowTimeout = time.Minute
+
+const (
+	shadowMatch    = "match"
+	shadowMismatch = "mismatch"
+	shadowError    = "error"
+	shadowSkipped  = "skipped"
+)
+
+// shadowHandler forwards the requests to the primary upstream and mirrors the
+// enforced read requests to a shadow upstream. The responses of both
+// upstreams are compared once filtered by the proxy and the divergences are
+// logged and counted. Only the primary response is returned to the client:
+// the shadow request runs in the background and its failures are never
+// reported to the client.
+type shadowHandler struct {
+	primary http.Handler
+	shadow  http.Handler
+	metrics *Metrics
+	// limit is the maximum size of the primary responses which are compared.
+	limit int
+
+	// done is called when the comparison of a mirrored request is finished
+	// (for tests).
+	done func(result string)
+}
+
+func (s *shadowHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	lvalues, ok := req.Context().Value(keyLabel).([]string)
+	if !ok || !isReadRequest(req) {
+		s.primary.ServeHTTP(w, req)
+		return
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	ctx := withEnforcedMatchers(withLabelValues(context.Background(), lvalues), mustEnforcedMatchers(req.Context()))
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, keyShadow, true), shadowTimeout)
+	sreq := req.Clone(ctx)
+	sreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	srec := &shadowRecorder{header: http.Header{}, code: http.StatusOK}
+	shadowDone := make(chan struct{})
+	go func() {
+		defer close(shadowDone)
+		defer func() {
+			if err := recover(); err != nil {
+				srec.err = err
+			}
+		}()
+		s.shadow.ServeHTTP(srec, sreq)
+	}()
+
+	prec := &primaryRecorder{ResponseWriter: w, code: http.StatusOK, limit: s.limit}
+	s.primary.ServeHTTP(prec, req)
+	if prec.header == nil {
+		prec.header = w.Header().Clone()
+	}
+
+	go func() {
+		defer cancel()
+		<-shadowDone
+
+		result := s.compare(prec, srec)
+		switch result {
+		case shadowMismatch:
+			log.Printf("warning: Shadow upstream response differs for %s %s (status code %d for the primary, %d for the shadow)", req.Method, req.URL.Path, prec.code, srec.code)
+		case shadowError:
+			log.Printf("warning: Shadow upstream request failed for %s %s: %v", req.Method, req.URL.Path, srec.err)
+		}
+		s.metrics.observeShadow(result)
+		if s.done != nil {
+			s.done(result)
+		}
+	}()
+}
+
+// compare returns the result of the comparison between the primary and
+// shadow responses.
+func (s *shadowHandler) compare(primary *primaryRecorder, shadow *shadowRecorder) string {
+	if shadow.err != nil {
+		return shadowError
+	}
+	if primary.truncated {
+		return shadowSkipped
+	}
+	if primary.code != shadow.code {
+		return shadowMismatch
+	}
+
+	p, err := decodedBody(primary.header, primary.buf.Bytes())
+	if err != nil {
+		return shadowSkipped
+	}
+	sh, err := decodedBody(shadow.header, shadow.buf.Bytes())
+	if err != nil {
+		shadow.err = err
+		return shadowError
+	}
+	if bytes.Equal(p, sh) {
+		return shadowMatch
+	}
+
+	// Compare the JSON documents regardless of their formatting.
+	var pv, sv interface{}
+	if json.Unmarshal(p, &pv) != nil || json.Unmarshal(sh, &sv) != nil || !reflect.DeepEqual(pv, sv) {
+		return shadowMismatch
+	}
+	return shadowMatch
+}
+
+// decodedBody returns the response body without content encoding.
+func decodedBody(header http.Header, body []byte) ([]byte, error) {
+	reader, err := bodyReader(&http.Response{Header: header.Clone(), Body: ioutil.NopCloser(bytes.NewReader(body))})
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// isReadRequest returns true if the request doesn't modify the upstream state.
+func isReadRequest(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet:
+		return true
+	case http.MethodPost:
+		return req.URL.Path == "/api/v1/query" || req.URL.Path == "/api/v1/query_range" || req.URL.Path == "/api/v1/query_exemplars"
+	}
+	return false
+}
+
+// primaryRecorder writes the response to the client and keeps a copy of the
+// header and of up to limit bytes of the body.
+type primaryRecorder struct {
+	http.ResponseWriter
+	header    http.Header
+	code      int
+	limit     int
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (p *primaryRecorder) WriteHeader(code int) {
+	if p.header == nil {
+		p.header = p.ResponseWriter.Header().Clone()
+		p.code = code
+	}
+	p.ResponseWriter.WriteHeader(code)
+}
+
+func (p *primaryRecorder) Write(b []byte) (int, error) {
+	if p.header == nil {
+		p.WriteHeader(http.StatusOK)
+	}
+	if !p.truncated {
+		if p.buf.Len()+len(b) > p.limit {
+			p.truncated = true
+			p.buf.Reset()
+		} else {
+			p.buf.Write(b)
+		}
+	}
+	return p.ResponseWriter.Write(b)
+}
+
+// shadowRecorder records the response of the shadow upstream.
+type shadowRecorder struct {
+	header http.Header
+	code   int
+	buf    bytes.Buffer
+	err    interface{}
+}
+
+func (s *shadowRecorder) Header() http.Header {
+	return s.header
+}
+
+func (s *shadowRecorder) WriteHeader(code int) {
+	s.code = code
+}
+
+func (s *shadowRecorder) Write(b []byte) (int, error) {
+	return s.buf.Write(b)
+}
+
+// shadowErrorHandler records the error of a request to the shadow upstream.
+func shadowErrorHandler(w http.ResponseWriter, _ *http.Request, err error) {
+	if rec, ok := w.(*shadowRecorder); ok {
+		rec.err = err
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// isShadowRequest returns true if the context belongs to a request mirrored to
+// the shadow upstream.
+func isShadowRequest(ctx context.Context) bool {
+	shadow, _ := ctx.Value(keyShadow).(bool)
+	return shadow
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShadowUpstream(t *testing.T) {
+	otherAlerts := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"alerts":[{"labels":{"alertname":"Alert4","namespace":"ns1"},"annotations":{},"state":"firing","value":"1e+00"}]}}`))
+	})
+	failing := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+
+	for _, tc := range []struct {
+		name   string
+		shadow http.Handler
+		method string
+		path   string
+
+		expResult string
+	}{
+		{
+			name:      "same filtered response",
+			shadow:    validAlerts(),
+			method:    http.MethodGet,
+			path:      "/api/v1/alerts",
+			expResult: shadowMatch,
+		},
+		{
+			// The shadow response differs from the primary one but the
+			// differences are filtered out by the proxy.
+			name: "same filtered response with other values",
+			shadow: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"status":"success","data":{"alerts":[
+{"labels":{"alertname":"Alert1","namespace":"ns1"},"annotations":{},"state":"firing","activeAt":"2019-12-18T13:14:44.543981127+01:00","value":"0e+00"},
+{"labels":{"alertname":"Alert2","namespace":"ns1","operation":"update"},"annotations":{},"state":"firing","activeAt":"2019-12-18T13:14:44.543981127+01:00","value":"0e+00"},
+{"labels":{"alertname":"Alert2","namespace":"ns1","operation":"delete"},"annotations":{},"state":"firing","activeAt":"2019-12-18T13:14:44.543981127+01:00","value":"0e+00"},
+{"labels":{"alertname":"Alert5","namespace":"ns3"},"annotations":{},"state":"firing","value":"0e+00"}
+]}}`))
+			}),
+			method:    http.MethodGet,
+			path:      "/api/v1/alerts",
+			expResult: shadowMatch,
+		},
+		{
+			name:      "different filtered response",
+			shadow:    otherAlerts,
+			method:    http.MethodGet,
+			path:      "/api/v1/alerts",
+			expResult: shadowMismatch,
+		},
+		{
+			name:      "failing shadow",
+			shadow:    failing,
+			method:    http.MethodGet,
+			path:      "/api/v1/alerts",
+			expResult: shadowError,
+		},
+		{
+			name:   "unenforced request",
+			shadow: otherAlerts,
+			method: http.MethodGet,
+			path:   "/graph",
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			var shadowCalled bool
+			s := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				shadowCalled = true
+				tc.shadow.ServeHTTP(w, req)
+			}))
+			defer s.Close()
+			m := newMockUpstream(validAlerts())
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, WithShadowUpstream(s.url), WithPassthroughPaths([]string{"/graph"}))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			results := make(chan string, 1)
+			r.handler.(*shadowHandler).done = func(result string) { results <- result }
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tc.method, "http://prometheus.example.com"+tc.path+"?"+url.Values{proxyLabel: []string{"ns1"}}.Encode(), nil))
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, resp.StatusCode, string(body))
+			}
+
+			if tc.expResult == "" {
+				select {
+				case result := <-results:
+					t.Fatalf("expected no shadow request, got result %q", result)
+				case <-time.After(100 * time.Millisecond):
+				}
+				if shadowCalled {
+					t.Fatal("expected no shadow request")
+				}
+				return
+			}
+
+			select {
+			case result := <-results:
+				if result != tc.expResult {
+					t.Fatalf("expected result %q, got %q", tc.expResult, result)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for the shadow request")
+			}
+		})
+	}
+}
@@ -18,23 +18,28 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"net/url"
 	"path"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	runtimeclient "github.com/go-openapi/runtime/client"
 	"github.com/go-openapi/strfmt"
+	"github.com/pkg/errors"
 	"github.com/prometheus/alertmanager/api/v2/client"
-	"github.com/prometheus/alertmanager/api/v2/client/silence"
 	"github.com/prometheus/alertmanager/api/v2/models"
 	"github.com/prometheus/alertmanager/pkg/labels"
 )
 
 func (r *routes) silences(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
-	case "GET":
+	case "GET", "HEAD":
 		r.listSilences(w, req)
 	case "POST":
 		r.postSilence(w, req)
@@ -45,13 +50,9 @@ func (r *routes) silences(w http.ResponseWriter, req *http.Request) {
 
 func (r *routes) listSilences(w http.ResponseWriter, req *http.Request) {
 	var (
-		q               = req.URL.Query()
-		proxyLabelMatch = labels.Matcher{
-			Type:  labels.MatchEqual,
-			Name:  r.label,
-			Value: mustLabelValue(req.Context()),
-		}
-		modified = []string{proxyLabelMatch.String()}
+		q        = req.URL.Query()
+		enforced = enforcedLabels(req.Context())
+		modified = enforced.filters()
 	)
 	for _, filter := range q["filter"] {
 		m, err := labels.ParseMatcher(filter)
@@ -59,7 +60,7 @@ func (r *routes) listSilences(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, fmt.Sprintf("bad request: can't parse filter %q: %v", filter, err), http.StatusBadRequest)
 			return
 		}
-		if m.Name == r.label {
+		if _, ok := enforced.value(m.Name); ok {
 			continue
 		}
 		modified = append(modified, filter)
@@ -72,50 +73,97 @@ func (r *routes) listSilences(w http.ResponseWriter, req *http.Request) {
 	r.handler.ServeHTTP(w, req)
 }
 
+// postSilence injects the enforced label matchers into the silence before
+// forwarding it. The matchers on the labels are replaced by the enforced ones
+// unless silenceErrorOnReplace is set, in which case the silences with a
+// conflicting matcher are rejected. The silence is rewritten from its raw
+// fields so that the fields unknown to the vendored models (e.g. isEqual) are
+// preserved.
 func (r *routes) postSilence(w http.ResponseWriter, req *http.Request) {
 	var (
-		sil    models.PostableSilence
-		lvalue = mustLabelValue(req.Context())
+		sil      models.PostableSilence
+		fields   map[string]json.RawMessage
+		enforced = enforcedLabels(req.Context())
 	)
-	if err := json.NewDecoder(req.Body).Decode(&sil); err != nil {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad request: can't read: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := json.Unmarshal(body, &sil); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: can't decode: %v", err), http.StatusBadRequest)
+		return
+	}
+	var matchers []json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
 		http.Error(w, fmt.Sprintf("bad request: can't decode: %v", err), http.StatusBadRequest)
 		return
 	}
+	if err := json.Unmarshal(fields["matchers"], &matchers); fields["matchers"] != nil && err != nil {
+		http.Error(w, fmt.Sprintf("bad request: can't decode matchers: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if r.maxSilenceDuration > 0 {
+		if err := checkSilenceDuration(&sil, r.maxSilenceDuration, time.Now()); err != nil {
+			http.Error(w, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
 
 	if sil.ID != "" {
 		// This is an update for an existing silence.
-		existing, err := r.getSilenceByID(req.Context(), sil.ID)
+		existing, err := r.getSilenceMatchers(req.Context(), sil.ID)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("proxy error: can't get silence: %v", err), http.StatusBadGateway)
 			return
 		}
 
-		if !hasMatcherForLabel(existing.Matchers, r.label, lvalue) {
+		if !enforced.matchSilence(existing) {
 			http.Error(w, "forbidden", http.StatusForbidden)
 			return
 		}
 	}
 
-	var falsy bool
-	modified := models.Matchers{
-		&models.Matcher{Name: &(r.label), Value: &lvalue, IsRegex: &falsy},
+	truthy := true
+	var modified []json.RawMessage
+	for _, l := range enforced {
+		m, err := json.Marshal(silenceMatcher{Name: l.name, Value: l.value, IsEqual: &truthy})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("can't encode: %v", err), http.StatusInternalServerError)
+			return
+		}
+		modified = append(modified, m)
 	}
-	for _, m := range sil.Matchers {
-		if m.Name != nil && *m.Name == r.label {
+	for _, rm := range matchers {
+		var m silenceMatcher
+		if err := json.Unmarshal(rm, &m); err != nil {
+			http.Error(w, fmt.Sprintf("bad request: can't decode matcher: %v", err), http.StatusBadRequest)
+			return
+		}
+		lvalue, ok := enforced.value(m.Name)
+		if !ok {
+			modified = append(modified, rm)
 			continue
 		}
-		modified = append(modified, m)
+		if r.silenceErrorOnReplace && (m.IsRegex || (m.IsEqual != nil && !*m.IsEqual) || m.Value != lvalue) {
+			http.Error(w, fmt.Sprintf("bad request: the matcher on the %q label conflicts with the enforced value", m.Name), http.StatusBadRequest)
+			return
+		}
 	}
-	// At least one matcher in addition to the enforced label is required,
+	// At least one matcher in addition to the enforced labels is required,
 	// otherwise all alerts would be silenced
-	if len(modified) < 2 {
+	if len(modified) <= len(enforced) {
 		http.Error(w, "need at least one matcher, got none", http.StatusBadRequest)
 		return
 	}
-	sil.Matchers = modified
+	if fields["matchers"], err = json.Marshal(modified); err != nil {
+		http.Error(w, fmt.Sprintf("can't encode: %v", err), http.StatusInternalServerError)
+		return
+	}
 
 	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(&sil); err != nil {
+	if err := json.NewEncoder(&buf).Encode(fields); err != nil {
 		http.Error(w, fmt.Sprintf("can't encode: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -136,14 +184,14 @@ func (r *routes) deleteSilence(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Get the silence by ID and verify that it has the expected label.
-	sil, err := r.getSilenceByID(req.Context(), silID)
+	// Get the silence by ID and verify that it has the expected labels.
+	matchers, err := r.getSilenceMatchers(req.Context(), silID)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("proxy error: %v", err), http.StatusBadGateway)
 		return
 	}
 
-	if !hasMatcherForLabel(sil.Matchers, r.label, mustLabelValue(req.Context())) {
+	if !enforcedLabels(req.Context()).matchSilence(matchers) {
 		http.Error(w, "forbidden", http.StatusForbidden)
 		return
 	}
@@ -152,25 +200,239 @@ func (r *routes) deleteSilence(w http.ResponseWriter, req *http.Request) {
 	r.handler.ServeHTTP(w, req)
 }
 
-func (r *routes) getSilenceByID(ctx context.Context, id string) (*models.GettableSilence, error) {
-	amc := client.New(
-		runtimeclient.New(r.upstream.Host, path.Join(r.upstream.Path, "/api/v2"), []string{r.upstream.Scheme}),
-		strfmt.Default,
-	)
-	params := silence.NewGetSilenceParams().WithContext(ctx)
-	params.SetSilenceID(strfmt.UUID(id))
-	sil, err := amc.Silence.GetSilence(params)
+// getSilenceMatchers returns the matchers of the silence with the given ID.
+// The silence is decoded without the vendored models which lack the isEqual
+// field, otherwise negative matchers would be mistaken for equality ones.
+func (r *routes) getSilenceMatchers(ctx context.Context, id string) ([]silenceMatcher, error) {
+	u := *r.upstream
+	u.Path = path.Join(u.Path, "/api/v2/silence", url.PathEscape(id))
+	u.RawPath = ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
-	return sil.Payload, nil
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := (&http.Client{Transport: r.transport}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	var sil struct {
+		Matchers []silenceMatcher `json:"matchers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&sil); err != nil {
+		return nil, errors.Wrap(err, "can't decode silence")
+	}
+	return sil.Matchers, nil
+}
+
+// listSilenceMatchers returns the matchers of the silences selected by the
+// filters, keyed by silence ID. Like getSilenceMatchers, the silences are
+// decoded without the vendored models.
+func (r *routes) listSilenceMatchers(ctx context.Context, filters []string) (map[string][]silenceMatcher, error) {
+	u := *r.upstream
+	u.Path = path.Join(u.Path, "/api/v2/silences")
+	u.RawPath = ""
+	u.RawQuery = url.Values{"filter": filters}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := (&http.Client{Transport: r.transport}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	var silences []struct {
+		ID       string           `json:"id"`
+		Matchers []silenceMatcher `json:"matchers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&silences); err != nil {
+		return nil, errors.Wrap(err, "can't decode silences")
+	}
+	matchers := make(map[string][]silenceMatcher, len(silences))
+	for _, sil := range silences {
+		if sil.ID == "" {
+			continue
+		}
+		matchers[sil.ID] = sil.Matchers
+	}
+	return matchers, nil
 }
 
-func hasMatcherForLabel(matchers models.Matchers, name, value string) bool {
+func (r *routes) alertmanagerClient() *client.Alertmanager {
+	rt := runtimeclient.New(r.upstream.Host, path.Join(r.upstream.Path, "/api/v2"), []string{r.upstream.Scheme})
+	rt.Transport = r.transport
+	return client.New(rt, strfmt.Default)
+}
+
+// checkSilenceDuration returns an error if the silence lasts longer than max.
+// Silences starting in the past are considered to start now, like
+// Alertmanager does.
+func checkSilenceDuration(sil *models.PostableSilence, max time.Duration, now time.Time) error {
+	if sil.EndsAt == nil {
+		return fmt.Errorf("missing end of the silence")
+	}
+	start := now
+	if sil.StartsAt != nil && time.Time(*sil.StartsAt).After(now) {
+		start = time.Time(*sil.StartsAt)
+	}
+	if d := time.Time(*sil.EndsAt).Sub(start); d > max {
+		return fmt.Errorf("silence duration %s exceeds the maximum of %s", d.Round(time.Second), max)
+	}
+	return nil
+}
+
+// silenceMatcher is a matcher of an Alertmanager silence. The isEqual field
+// of the recent Alertmanager versions is missing from the vendored models.
+type silenceMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual *bool  `json:"isEqual,omitempty"`
+}
+
+// silenceMatchesLabel returns whether one of the matchers pins the label to
+// the value: either an equality matcher or a regular expression matching only
+// the value. Negative matchers and broader regular expressions don't pin the
+// label.
+func silenceMatchesLabel(matchers []silenceMatcher, name, value string) bool {
 	for _, m := range matchers {
-		if *m.Name == name && !*m.IsRegex && *m.Value == value {
+		if m.Name != name || (m.IsEqual != nil && !*m.IsEqual) {
+			continue
+		}
+		if !m.IsRegex && m.Value == value {
+			return true
+		}
+		if m.IsRegex && m.Value == regexp.QuoteMeta(value) {
 			return true
 		}
 	}
 	return false
 }
+
+// filterSilences removes the silences which don't pin the enforced labels to
+// their values from the Alertmanager response. The backend should already have
+// applied the injected filter but it also returns the silences with a broader
+// matcher on the label (e.g. a regular expression matching several values).
+// The silences are forwarded as-is otherwise.
+func (r *routes) filterSilences(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK || resp.Request.Method != http.MethodGet {
+		// Pass non-200 responses and the responses to the created silences as-is.
+		return nil
+	}
+
+	defer resp.Body.Close()
+	var silences []json.RawMessage
+	reader, err := bodyReader(resp)
+	if err == nil {
+		defer reader.Close()
+		if err = json.NewDecoder(reader).Decode(&silences); err == io.EOF {
+			err = errEmptyResponse
+		}
+	}
+	switch {
+	case err == errEmptyResponse:
+		if !r.emptyBodyAsEmptyData {
+			// The Alertmanager API returns the errors as JSON strings.
+			return r.badUpstreamResponse(resp, err.Error())
+		}
+		log.Printf("warning: Empty response body from the upstream for %s, returning an empty result", resp.Request.URL.Path)
+	case err != nil:
+		return errors.Wrap(err, "can't decode silences")
+	}
+
+	var (
+		lvalue   = mustLabelValue(resp.Request.Context())
+		enforced = enforcedLabels(resp.Request.Context())
+		filtered = []json.RawMessage{}
+	)
+	for _, raw := range silences {
+		var sil struct {
+			Matchers []silenceMatcher `json:"matchers"`
+		}
+		if err := json.Unmarshal(raw, &sil); err != nil {
+			return errors.Wrap(err, "can't decode silence")
+		}
+		if enforced.matchSilence(sil.Matchers) {
+			filtered = append(filtered, raw)
+		}
+	}
+	r.recordFiltering(resp.Request.Context(), "silences", lvalue, len(silences), len(filtered))
+	r.setFilteredCount(resp, len(silences)-len(filtered))
+
+	return r.replaceBody(resp, filtered)
+}
+
+// enforcedLabel is a label pinned to a value by the Alertmanager APIs.
+type enforcedLabel struct {
+	name, value string
+}
+
+// enforcedLabelSet holds the labels enforced for a request.
+type enforcedLabelSet []enforcedLabel
+
+// enforcedLabels returns the labels enforced for the request: the label
+// followed by the additional labels. The Alertmanager APIs are only served
+// with equality matchers.
+func enforcedLabels(ctx context.Context) enforcedLabelSet {
+	var ls enforcedLabelSet
+	for _, m := range mustEnforcedMatchers(ctx) {
+		ls = append(ls, enforcedLabel{name: m.Name, value: m.Value})
+	}
+	return ls
+}
+
+// value returns the enforced value of the label and whether the label is
+// enforced.
+func (ls enforcedLabelSet) value(name string) (string, bool) {
+	for _, l := range ls {
+		if l.name == name {
+			return l.value, true
+		}
+	}
+	return "", false
+}
+
+// filters returns the Alertmanager filters matching the enforced labels.
+func (ls enforcedLabelSet) filters() []string {
+	filters := make([]string, 0, len(ls))
+	for _, l := range ls {
+		m := labels.Matcher{Type: labels.MatchEqual, Name: l.name, Value: l.value}
+		filters = append(filters, m.String())
+	}
+	return filters
+}
+
+// matchSilence returns whether the silence matchers pin all the enforced
+// labels to their values.
+func (ls enforcedLabelSet) matchSilence(matchers []silenceMatcher) bool {
+	for _, l := range ls {
+		if !silenceMatchesLabel(matchers, l.name, l.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchLabels returns whether the label set has all the enforced labels with
+// their values.
+func (ls enforcedLabelSet) matchLabels(lset map[string]string) bool {
+	for _, l := range ls {
+		if lset[l.name] != l.value {
+			return false
+		}
+	}
+	return true
+}
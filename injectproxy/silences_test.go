@@ -23,10 +23,17 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/prometheus/alertmanager/api/v2/models"
 )
 
+const (
+	silences        = `[` + defaultSilence + `,{"id":"2","matchers":[{"name":"namespace","value":"default|other","isRegex":true}]}]`
+	defaultSilence  = `{"id":"1","matchers":[{"name":"namespace","value":"default","isRegex":false},{"name":"job","value":"prometheus","isRegex":false}]}`
+	defaultSilences = `[` + defaultSilence + `]`
+)
+
 func TestListSilences(t *testing.T) {
 	for _, tc := range []struct {
 		labelv  string
@@ -45,7 +52,7 @@ func TestListSilences(t *testing.T) {
 			labelv:     "default",
 			expCode:    http.StatusOK,
 			expFilters: []string{`namespace="default"`},
-			expBody:    okResponse,
+			expBody:    []byte(defaultSilences),
 		},
 		{
 			// Many "filter" parameters.
@@ -53,7 +60,7 @@ func TestListSilences(t *testing.T) {
 			filters:    []string{`job="prometheus"`, `instance=~".+"`},
 			expCode:    http.StatusOK,
 			expFilters: []string{`job="prometheus"`, `instance=~".+"`, `namespace="default"`},
-			expBody:    okResponse,
+			expBody:    []byte(defaultSilences),
 		},
 		{
 			// Many "filter" parameters with a "namespace" label that needs to be enforced.
@@ -61,7 +68,7 @@ func TestListSilences(t *testing.T) {
 			filters:    []string{`namespace=~"foo|default"`, `job="prometheus"`},
 			expCode:    http.StatusOK,
 			expFilters: []string{`namespace="default"`, `job="prometheus"`},
-			expBody:    okResponse,
+			expBody:    []byte(defaultSilences),
 		},
 		{
 			// Invalid "filter" parameter.
@@ -71,7 +78,15 @@ func TestListSilences(t *testing.T) {
 		},
 	} {
 		t.Run(strings.Join(tc.filters, "&"), func(t *testing.T) {
-			m := newMockUpstream(checkQueryHandler("", "filter", tc.expFilters...))
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				rec := httptest.NewRecorder()
+				checkQueryHandler("", "filter", tc.expFilters...).ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					http.Error(w, rec.Body.String(), rec.Code)
+					return
+				}
+				w.Write([]byte(silences))
+			}))
 			defer m.Close()
 			r, err := NewRoutes(m.url, proxyLabel)
 			if err != nil {
@@ -106,7 +121,7 @@ func TestListSilences(t *testing.T) {
 				return
 			}
 
-			if string(body) != string(tc.expBody) {
+			if strings.TrimSpace(string(body)) != string(tc.expBody) {
 				t.Fatalf("expected body %q, got %q", string(tc.expBody), string(body))
 			}
 		})
@@ -150,6 +165,16 @@ func getSilenceWithoutLabel() http.Handler {
 }
 
 func getSilenceWithLabel(labelv string) http.Handler {
+	return getSilenceWithMatchers(fmt.Sprintf(`
+    {
+      "isRegex": false,
+      "name": "%s",
+      "value": "%s"
+    }`, proxyLabel, labelv))
+}
+
+// getSilenceWithMatchers returns the silence with the given encoded matchers.
+func getSilenceWithMatchers(matchers string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		if req.Method != "GET" {
 			http.Error(w, "invalid method: "+req.Method, http.StatusInternalServerError)
@@ -170,16 +195,11 @@ func getSilenceWithLabel(labelv string) http.Handler {
   "comment": "comment",
   "createdBy": "author",
   "endsAt": "2020-02-13T13:00:02.084Z",
-  "matchers": [
-    {
-      "isRegex": false,
-      "name": "%s",
-      "value": "%s"
-    }
+  "matchers": [%s
   ],
   "startsAt": "2020-02-13T12:02:01.000Z"
 }
-				`, silID, proxyLabel, labelv)
+				`, silID, matchers)
 	})
 }
 
@@ -267,6 +287,20 @@ func TestDeleteSilence(t *testing.T) {
 			upstream: getSilenceWithLabel("not default"),
 			expCode:  http.StatusForbidden,
 		},
+		{
+			// The silence of another tenant excludes the label value.
+			ID:       silID,
+			labelv:   "default",
+			upstream: getSilenceWithMatchers(`{"isRegex":false,"isEqual":false,"name":"namespace","value":"default"}`),
+			expCode:  http.StatusForbidden,
+		},
+		{
+			// The silence of another tenant matches several label values.
+			ID:       silID,
+			labelv:   "default",
+			upstream: getSilenceWithMatchers(`{"isRegex":true,"isEqual":true,"name":"namespace","value":"default|other"}`),
+			expCode:  http.StatusForbidden,
+		},
 		{
 			// The silence has the expected value for the label.
 			ID:     silID,
@@ -449,6 +483,28 @@ func TestUpdateSilence(t *testing.T) {
 
 			expCode: http.StatusForbidden,
 		},
+		{
+			// Update of the silence of another tenant excluding the label value is denied.
+			data: `{
+    "id":"` + silID + `",
+    "comment":"foo",
+    "createdBy":"bar",
+    "endsAt":"2020-02-13T13:00:02.084Z",
+    "matchers": [
+        {"isRegex":false,"Name":"foo","Value":"bar"}
+    ],
+    "startsAt":"2020-02-13T12:02:01Z"
+}`,
+			labelv: "default",
+			upstream: &chainedHandlers{
+				handlers: []http.Handler{
+					getSilenceWithMatchers(`{"isRegex":false,"isEqual":false,"name":"namespace","value":"default"}`),
+					createSilenceWithLabel("default"),
+				},
+			},
+
+			expCode: http.StatusForbidden,
+		},
 		{
 			// Update of a non-existing silence fails.
 			data: `{
@@ -531,3 +587,317 @@ func TestUpdateSilence(t *testing.T) {
 		})
 	}
 }
+
+func TestMaxSilenceDuration(t *testing.T) {
+	now := time.Now().UTC()
+	for _, tc := range []struct {
+		name     string
+		startsAt time.Time
+		endsAt   time.Time
+
+		expCode int
+	}{
+		{
+			name:     "within the maximum",
+			startsAt: now,
+			endsAt:   now.Add(30 * time.Minute),
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "started in the past within the maximum",
+			startsAt: now.Add(-24 * time.Hour),
+			endsAt:   now.Add(30 * time.Minute),
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "exceeding the maximum",
+			startsAt: now,
+			endsAt:   now.Add(2 * time.Hour),
+			expCode:  http.StatusBadRequest,
+		},
+		{
+			name:     "starting in the future and exceeding the maximum",
+			startsAt: now.Add(24 * time.Hour),
+			endsAt:   now.Add(26 * time.Hour),
+			expCode:  http.StatusBadRequest,
+		},
+		{
+			name:     "far in the future",
+			startsAt: now,
+			endsAt:   now.AddDate(100, 0, 0),
+			expCode:  http.StatusBadRequest,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(createSilenceWithLabel("default"))
+			defer m.Close()
+			r, err := NewRoutes(m.url, proxyLabel, WithMaxSilenceDuration(time.Hour))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			data := fmt.Sprintf(`{
+    "comment":"foo",
+    "createdBy":"bar",
+    "endsAt":%q,
+    "matchers": [
+        {"isRegex":false,"Name":"foo","Value":"bar"}
+    ],
+    "startsAt":%q
+}`, tc.endsAt.Format(time.RFC3339), tc.startsAt.Format(time.RFC3339))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "http://alertmanager.example.com/api/v2/silences/?"+proxyLabel+"=default", bytes.NewBufferString(data))
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestSilenceMatchesLabel(t *testing.T) {
+	truthy, falsy := true, false
+	for _, tc := range []struct {
+		name     string
+		matchers []silenceMatcher
+
+		exp bool
+	}{
+		{
+			name:     "equal matcher",
+			matchers: []silenceMatcher{{Name: "namespace", Value: "default"}},
+			exp:      true,
+		},
+		{
+			name:     "explicit equal matcher",
+			matchers: []silenceMatcher{{Name: "namespace", Value: "default", IsEqual: &truthy}},
+			exp:      true,
+		},
+		{
+			name:     "not-equal matcher",
+			matchers: []silenceMatcher{{Name: "namespace", Value: "default", IsEqual: &falsy}},
+		},
+		{
+			name:     "equal matcher with another value",
+			matchers: []silenceMatcher{{Name: "namespace", Value: "other"}},
+		},
+		{
+			name:     "regex matcher matching only the value",
+			matchers: []silenceMatcher{{Name: "namespace", Value: "default", IsRegex: true, IsEqual: &truthy}},
+			exp:      true,
+		},
+		{
+			name:     "broader regex matcher",
+			matchers: []silenceMatcher{{Name: "namespace", Value: "default|other", IsRegex: true}},
+		},
+		{
+			name:     "wildcard regex matcher",
+			matchers: []silenceMatcher{{Name: "namespace", Value: ".+", IsRegex: true}},
+		},
+		{
+			name:     "negative regex matcher",
+			matchers: []silenceMatcher{{Name: "namespace", Value: "default", IsRegex: true, IsEqual: &falsy}},
+		},
+		{
+			name:     "matcher on another label",
+			matchers: []silenceMatcher{{Name: "job", Value: "default"}},
+		},
+		{
+			name: "broader regex matcher and equal matcher",
+			matchers: []silenceMatcher{
+				{Name: "namespace", Value: ".+", IsRegex: true},
+				{Name: "namespace", Value: "default"},
+			},
+			exp: true,
+		},
+		{
+			name: "no matchers",
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			if got := silenceMatchesLabel(tc.matchers, proxyLabel, "default"); got != tc.exp {
+				t.Fatalf("expected %v, got %v", tc.exp, got)
+			}
+		})
+	}
+
+	t.Run("regex_metacharacters", func(t *testing.T) {
+		// A regular expression matching exactly "a.b" is escaped.
+		ms := []silenceMatcher{{Name: "namespace", Value: `a\.b`, IsRegex: true}}
+		if !silenceMatchesLabel(ms, proxyLabel, "a.b") {
+			t.Fatal("expected the escaped regular expression to match")
+		}
+		ms = []silenceMatcher{{Name: "namespace", Value: "a.b", IsRegex: true}}
+		if silenceMatchesLabel(ms, proxyLabel, "a.b") {
+			t.Fatal("expected the unescaped regular expression not to match")
+		}
+	})
+}
+
+func TestFilterSilences(t *testing.T) {
+	upstream := `[
+  {"id":"1","status":{"state":"active"},"matchers":[{"name":"namespace","value":"default","isRegex":false,"isEqual":true},{"name":"job","value":"prometheus","isRegex":false,"isEqual":true}]},
+  {"id":"2","status":{"state":"active"},"matchers":[{"name":"namespace","value":"default|other","isRegex":true,"isEqual":true}]},
+  {"id":"3","status":{"state":"active"},"matchers":[{"name":"namespace","value":"default","isRegex":false,"isEqual":false}]},
+  {"id":"4","status":{"state":"expired"},"matchers":[{"name":"namespace","value":"default","isRegex":true,"isEqual":true}]}
+]`
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(upstream))
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, WithFilteredCountHeader())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "http://alertmanager.example.com/api/v2/silences?"+proxyLabel+"=default", nil))
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, resp.StatusCode, string(body))
+	}
+	if got := resp.Header.Get(filteredCountHeader); got != "2" {
+		t.Errorf("expected 2 filtered silences, got %q", got)
+	}
+
+	var sils []map[string]interface{}
+	if err := json.Unmarshal(body, &sils); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var ids []string
+	for _, sil := range sils {
+		ids = append(ids, sil["id"].(string))
+	}
+	if strings.Join(ids, ",") != "1,4" {
+		t.Fatalf("expected silences 1 and 4, got %v", ids)
+	}
+
+	// The fields unknown to the proxy are preserved.
+	ms := sils[0]["matchers"].([]interface{})
+	if isEqual, ok := ms[0].(map[string]interface{})["isEqual"]; !ok || isEqual != true {
+		t.Fatalf("expected the isEqual field to be preserved, got %v", ms[0])
+	}
+}
+
+func TestPostSilenceRewrite(t *testing.T) {
+	const data = `{
+    "comment":"foo",
+    "createdBy":"bar",
+    "endsAt":"2020-02-13T13:00:02.084Z",
+    "matchers": [
+        {"isRegex":false,"isEqual":false,"name":"job","value":"prometheus"},
+        %s
+    ],
+    "startsAt":"2020-02-13T12:02:01Z"
+}`
+	for _, tc := range []struct {
+		name           string
+		matcher        string
+		errorOnReplace bool
+
+		expCode int
+	}{
+		{
+			name:    "no matcher on the label",
+			matcher: `{"isRegex":false,"name":"instance","value":"a"}`,
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "conflicting matcher replaced",
+			matcher: `{"isRegex":true,"name":"namespace","value":".+"}`,
+			expCode: http.StatusOK,
+		},
+		{
+			name:           "enforced matcher",
+			matcher:        `{"isRegex":false,"isEqual":true,"name":"namespace","value":"default"}`,
+			errorOnReplace: true,
+			expCode:        http.StatusOK,
+		},
+		{
+			name:           "conflicting value",
+			matcher:        `{"isRegex":false,"name":"namespace","value":"other"}`,
+			errorOnReplace: true,
+			expCode:        http.StatusBadRequest,
+		},
+		{
+			name:           "conflicting regular expression",
+			matcher:        `{"isRegex":true,"name":"namespace","value":"default"}`,
+			errorOnReplace: true,
+			expCode:        http.StatusBadRequest,
+		},
+		{
+			name:           "conflicting negative matcher",
+			matcher:        `{"isRegex":false,"isEqual":false,"name":"namespace","value":"default"}`,
+			errorOnReplace: true,
+			expCode:        http.StatusBadRequest,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				body, err := ioutil.ReadAll(req.Body)
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+				if req.ContentLength != int64(len(body)) {
+					t.Errorf("expected content length %d, got %d", len(body), req.ContentLength)
+				}
+
+				var sil struct {
+					Comment   string           `json:"comment"`
+					CreatedBy string           `json:"createdBy"`
+					StartsAt  string           `json:"startsAt"`
+					EndsAt    string           `json:"endsAt"`
+					Matchers  []silenceMatcher `json:"matchers"`
+				}
+				if err := json.Unmarshal(body, &sil); err != nil {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+				if sil.Comment != "foo" || sil.CreatedBy != "bar" || sil.StartsAt != "2020-02-13T12:02:01Z" || sil.EndsAt != "2020-02-13T13:00:02.084Z" {
+					t.Errorf("expected the silence fields to be preserved, got %s", string(body))
+				}
+
+				var ns []silenceMatcher
+				for _, m := range sil.Matchers {
+					switch m.Name {
+					case proxyLabel:
+						ns = append(ns, m)
+					case "job":
+						if m.IsEqual == nil || *m.IsEqual {
+							t.Errorf("expected the isEqual field to be preserved, got %s", string(body))
+						}
+					}
+				}
+				if len(ns) != 1 || ns[0].Value != "default" || ns[0].IsRegex || ns[0].IsEqual == nil || !*ns[0].IsEqual {
+					t.Errorf("expected a single enforced matcher, got %v", ns)
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			var opts []Option
+			if tc.errorOnReplace {
+				opts = append(opts, WithSilencesErrorOnReplace())
+			}
+			r, err := NewRoutes(m.url, proxyLabel, opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "http://alertmanager.example.com/api/v2/silences?"+proxyLabel+"=default", strings.NewReader(fmt.Sprintf(data, tc.matcher)))
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
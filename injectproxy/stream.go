@@ -0,0 +1,362 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// itemFilter decodes the next item of a streamed list and returns the value
+// to write in place of it (nil to drop it) along with the number of items
+// before and after filtering.
+type itemFilter func(dec *json.Decoder) (v interface{}, before, after int, err error)
+
+// streamedList describes the list of items of the data of an API response
+// which can be filtered in a streaming fashion.
+type streamedList struct {
+	// handler is the name of the handler for the metrics.
+	handler string
+	// key is the field of the data object holding the list.
+	key string
+	// newFilter returns the item filter for the enforced label value.
+	newFilter func(lvalue string, req *http.Request) (itemFilter, error)
+}
+
+func (r *routes) rulesList() *streamedList {
+	return &streamedList{
+		handler: "rules",
+		key:     "groups",
+		newFilter: func(lvalue string, req *http.Request) (itemFilter, error) {
+			keep, err := r.newRuleFilter(lvalue, req)
+			if err != nil {
+				return nil, err
+			}
+			return func(dec *json.Decoder) (interface{}, int, int, error) {
+				var rg ruleGroup
+				if err := dec.Decode(&rg); err != nil {
+					return nil, 0, 0, errors.Wrap(err, "can't decode rule group")
+				}
+				before := len(rg.Rules)
+				if rg.Rules = keep(&rg); len(rg.Rules) == 0 {
+					return nil, before, 0, nil
+				}
+				return &rg, before, len(rg.Rules), nil
+			}, nil
+		},
+	}
+}
+
+func (r *routes) alertsList() *streamedList {
+	return &streamedList{
+		handler: "alerts",
+		key:     "alerts",
+		newFilter: func(lvalue string, req *http.Request) (itemFilter, error) {
+			return func(dec *json.Decoder) (interface{}, int, int, error) {
+				var a alert
+				if err := dec.Decode(&a); err != nil {
+					return nil, 0, 0, errors.Wrap(err, "can't decode alert")
+				}
+				if !r.keepAlert(req.Context(), &a) {
+					return nil, 1, 0, nil
+				}
+				return &a, 1, 1, nil
+			}, nil
+		},
+	}
+}
+
+// streamingResponse returns a response modifier filtering the list of the
+// API responses larger than the streaming threshold (or of unknown size) item
+// by item, without holding the whole decoded data and encoded response in
+// memory. The smaller responses are passed to the m modifier.
+//
+// Since the response is sent while being filtered, the X-Filtered-Count
+// header isn't supported (only the trailer), the events don't report the
+// number of dropped items and errors occurring after the beginning of the data
+// can only abort the response. The streaming is disabled when the header, the
+// filtering warnings or the sanitization of the warnings are enabled.
+func (r *routes) streamingResponse(m func(*http.Response) error, l *streamedList) func(*http.Response) error {
+	if r.streamingThreshold <= 0 || r.filteredCountHeader || r.filteringWarnings || r.sanitizingWarnings() {
+		return m
+	}
+
+	return func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK || (resp.ContentLength >= 0 && resp.ContentLength <= int64(r.streamingThreshold)) {
+			return m(resp)
+		}
+
+		lvalue := mustLabelValue(resp.Request.Context())
+		filter, err := l.newFilter(lvalue, resp.Request)
+		if err != nil {
+			return err
+		}
+
+		reader, err := bodyReader(resp)
+		if err == errEmptyResponse {
+			return m(resp)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Read the envelope up to the data synchronously so that invalid
+		// responses are still reported as errors.
+		dec := json.NewDecoder(reader)
+		tok, err := dec.Token()
+		if err == io.EOF {
+			resp.Body = ioutil.NopCloser(strings.NewReader(""))
+			return m(resp)
+		}
+		if err != nil || tok != json.Delim('{') {
+			return errors.Errorf("can't decode API response: expected an object, got %v (%v)", tok, err)
+		}
+		head, err := readFieldsUntil(dec, "data")
+		if err != nil {
+			return errors.Wrap(err, "can't decode API response")
+		}
+
+		compress := r.recompressResponses && resp.Uncompressed && acceptsGzip(resp.Request)
+		ctx := resp.Request.Context()
+		setDropped := r.announceFilteringTrailers(resp, lvalue)
+		pr, pw := io.Pipe()
+		body := resp.Body
+		go func() {
+			defer body.Close()
+			defer reader.Close()
+			before, after, err := streamAPIResponse(pw, dec, head, l.key, filter, compress)
+			if err == nil {
+				r.recordFiltering(ctx, l.handler, lvalue, before, after)
+				setDropped(before - after)
+			}
+			pw.CloseWithError(err)
+		}()
+
+		resp.Body = pr
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		if compress {
+			resp.Header.Set("Content-Encoding", "gzip")
+			resp.Uncompressed = false
+		}
+		return nil
+	}
+}
+
+// readFieldsUntil reads the fields of the current object up to the given key
+// and returns them encoded. It fails if the key isn't found or if the status
+// field isn't "success".
+func readFieldsUntil(dec *json.Decoder, key string) ([]byte, error) {
+	var b strings.Builder
+	for dec.More() {
+		k, err := nextKey(dec)
+		if err != nil {
+			return nil, err
+		}
+		if k == key {
+			return []byte(b.String()), nil
+		}
+
+		v, err := readField(dec, k)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(v)
+		b.WriteByte(',')
+	}
+	return nil, errors.Errorf("missing %s field", key)
+}
+
+// readField returns the encoded key and value of the next field.
+func readField(dec *json.Decoder, key string) ([]byte, error) {
+	var raw json.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	if key == "status" && string(raw) != `"success"` {
+		return nil, fmt.Errorf("unexpected response status: %s", string(raw))
+	}
+
+	k, err := json.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(k, ':'), raw...), nil
+}
+
+func nextKey(dec *json.Decoder) (string, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return "", err
+	}
+	k, ok := tok.(string)
+	if !ok {
+		return "", errors.Errorf("expected a key, got %v", tok)
+	}
+	return k, nil
+}
+
+func expectDelim(dec *json.Decoder, d json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != d {
+		return errors.Errorf("expected %v, got %v", d, tok)
+	}
+	return nil
+}
+
+// streamList writes the filtered items of the list to w and returns the number
+// of items before and after filtering. The decoder is positioned after the
+// opening bracket of the list.
+func streamList(w *bufio.Writer, dec *json.Decoder, filter itemFilter) (before, after int, err error) {
+	w.WriteByte('[')
+	var n int
+	for dec.More() {
+		v, b, a, err := filter(dec)
+		if err != nil {
+			return 0, 0, err
+		}
+		before += b
+		after += a
+		if v == nil {
+			continue
+		}
+		item, err := json.Marshal(v)
+		if err != nil {
+			return 0, 0, errors.Wrap(err, "can't encode response")
+		}
+		if n > 0 {
+			w.WriteByte(',')
+		}
+		w.Write(item)
+		n++
+	}
+	if err := expectDelim(dec, ']'); err != nil {
+		return 0, 0, err
+	}
+	w.WriteByte(']')
+	return before, after, nil
+}
+
+// streamAPIResponse writes the API response with the filtered data to w and
+// returns the number of items before and after filtering. The decoder is
+// positioned at the value of the data field whose list is filtered.
+func streamAPIResponse(w io.Writer, dec *json.Decoder, head []byte, key string, filter itemFilter, compress bool) (before, after int, err error) {
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	bw := bufio.NewWriter(w)
+
+	bw.WriteByte('{')
+	bw.Write(head)
+	bw.WriteString(`"data":`)
+
+	// The data object, or the bare list returned by some backends which is
+	// normalized to an object.
+	tok, err := dec.Token()
+	if err != nil {
+		return 0, 0, err
+	}
+	encodedKey, _ := json.Marshal(key)
+	switch tok {
+	case json.Delim('['):
+		bw.WriteByte('{')
+		bw.Write(encodedKey)
+		bw.WriteByte(':')
+		if before, after, err = streamList(bw, dec, filter); err != nil {
+			return 0, 0, err
+		}
+		bw.WriteByte('}')
+
+	case json.Delim('{'):
+		bw.WriteByte('{')
+		first := true
+		for dec.More() {
+			k, err := nextKey(dec)
+			if err != nil {
+				return 0, 0, err
+			}
+			if !first {
+				bw.WriteByte(',')
+			}
+			first = false
+
+			if k != key {
+				v, err := readField(dec, k)
+				if err != nil {
+					return 0, 0, err
+				}
+				bw.Write(v)
+				continue
+			}
+
+			bw.Write(encodedKey)
+			bw.WriteByte(':')
+			if err := expectDelim(dec, '['); err != nil {
+				return 0, 0, err
+			}
+			if before, after, err = streamList(bw, dec, filter); err != nil {
+				return 0, 0, err
+			}
+		}
+		if err := expectDelim(dec, '}'); err != nil {
+			return 0, 0, err
+		}
+		bw.WriteByte('}')
+
+	default:
+		return 0, 0, errors.Errorf("expected an object or an array, got %v", tok)
+	}
+
+	// The fields following the data.
+	for dec.More() {
+		k, err := nextKey(dec)
+		if err != nil {
+			return 0, 0, err
+		}
+		v, err := readField(dec, k)
+		if err != nil {
+			return 0, 0, err
+		}
+		bw.WriteByte(',')
+		bw.Write(v)
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return 0, 0, err
+	}
+	bw.WriteString("}\n")
+
+	if err := bw.Flush(); err != nil {
+		return 0, 0, err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return before, after, nil
+}
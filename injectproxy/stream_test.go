@@ -0,0 +1,241 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStreamingResponses(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		upstream http.Handler
+		path     string
+		headers  map[string]string
+		opts     []Option
+
+		expCode      int
+		expStreaming bool
+	}{
+		{
+			name:         "rules",
+			upstream:     validRules(),
+			path:         "/api/v1/rules",
+			expCode:      http.StatusOK,
+			expStreaming: true,
+		},
+		{
+			name:         "rules with health filter and active alerts",
+			upstream:     rulesWithHealth(),
+			path:         "/api/v1/rules?health=ok",
+			opts:         []Option{WithRulesWithActiveAlerts()},
+			expCode:      http.StatusOK,
+			expStreaming: true,
+		},
+		{
+			name:         "gzipped rules",
+			upstream:     gzipHandler(validRules()),
+			path:         "/api/v1/rules",
+			headers:      map[string]string{"Accept-Encoding": "gzip"},
+			expCode:      http.StatusOK,
+			expStreaming: true,
+		},
+		{
+			name:         "recompressed rules",
+			upstream:     gzipHandler(validRules()),
+			path:         "/api/v1/rules",
+			headers:      map[string]string{"Accept-Encoding": "gzip"},
+			opts:         []Option{WithRecompressedResponses()},
+			expCode:      http.StatusOK,
+			expStreaming: true,
+		},
+		{
+			name:         "bare array rules",
+			upstream:     bareArrayRules(validRules()),
+			path:         "/api/v1/rules",
+			expCode:      http.StatusOK,
+			expStreaming: true,
+		},
+		{
+			name:         "alerts",
+			upstream:     validAlerts(),
+			path:         "/api/v1/alerts",
+			expCode:      http.StatusOK,
+			expStreaming: true,
+		},
+		{
+			name:     "filtered count header",
+			upstream: validRules(),
+			path:     "/api/v1/rules",
+			opts:     []Option{WithFilteredCountHeader()},
+			expCode:  http.StatusOK,
+		},
+		{
+			name: "error status",
+			upstream: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte(`{"status":"error","errorType":"internal","error":"boom"}`))
+			}),
+			path:    "/api/v1/rules",
+			expCode: http.StatusBadGateway,
+		},
+		{
+			name: "invalid data",
+			upstream: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte(`{"status":"success"}`))
+			}),
+			path:    "/api/v1/rules",
+			expCode: http.StatusBadGateway,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(tc.upstream)
+			defer m.Close()
+
+			get := func(opts ...Option) *http.Response {
+				r, err := NewRoutes(m.url, proxyLabel, append(tc.opts, opts...)...)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				sep := "?"
+				if strings.Contains(tc.path, "?") {
+					sep = "&"
+				}
+				req := httptest.NewRequest("GET", "http://prometheus.example.com"+tc.path+sep+proxyLabel+"=ns1", nil)
+				for k, v := range tc.headers {
+					req.Header.Set(k, v)
+				}
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+				return w.Result()
+			}
+
+			streamed := get(WithStreamingThreshold(1))
+			if streamed.StatusCode != tc.expCode {
+				body, _ := ioutil.ReadAll(streamed.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, streamed.StatusCode, string(body))
+			}
+			if tc.expCode != http.StatusOK {
+				return
+			}
+			if isStreamed := streamed.Header.Get("Content-Length") == ""; isStreamed != tc.expStreaming {
+				t.Fatalf("expected streaming to be %v, got %v", tc.expStreaming, isStreamed)
+			}
+
+			// The streamed response must be the same as the buffered one.
+			buffered := get()
+			if got, exp := streamed.Header.Get("Content-Encoding"), buffered.Header.Get("Content-Encoding"); got != exp {
+				t.Fatalf("expected Content-Encoding %q, got %q", exp, got)
+			}
+			if got, exp := decodeResponse(t, streamed), decodeResponse(t, buffered); !reflect.DeepEqual(got, exp) {
+				t.Fatalf("expected response\n%v\ngot\n%v", exp, got)
+			}
+		})
+	}
+}
+
+func decodeResponse(t *testing.T, resp *http.Response) interface{} {
+	t.Helper()
+
+	body := resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		body = gz
+	}
+	var v interface{}
+	if err := json.NewDecoder(body).Decode(&v); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return v
+}
+
+func TestStreamingThreshold(t *testing.T) {
+	// The upstream response has a known length below the threshold.
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"status":"success","data":{"groups":[]}}`))
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, WithStreamingThreshold(1<<20))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/rules?"+proxyLabel+"=ns1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if w.Header().Get("Content-Length") == "" {
+		t.Fatal("expected the response not to be streamed")
+	}
+}
+
+func TestFilteringTrailers(t *testing.T) {
+	m := newMockUpstream(validRules())
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, WithStreamingThreshold(1), WithFilteringTrailers())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		protoMajor int
+
+		expTrailers http.Header
+	}{
+		{
+			name:       "http2",
+			protoMajor: 2,
+			expTrailers: http.Header{
+				"X-Enforced-Label": []string{`namespace="ns1"`},
+				"X-Filtered-Count": []string{"8"},
+			},
+		},
+		{
+			name:       "http1",
+			protoMajor: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/rules?"+proxyLabel+"=ns1", nil)
+			req.ProtoMajor = tc.protoMajor
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+			ioutil.ReadAll(resp.Body)
+			if len(resp.Trailer) == 0 {
+				resp.Trailer = nil
+			}
+			if !reflect.DeepEqual(resp.Trailer, tc.expTrailers) {
+				t.Fatalf("expected trailers %v, got %v", tc.expTrailers, resp.Trailer)
+			}
+		})
+	}
+}
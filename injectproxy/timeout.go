@@ -0,0 +1,227 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	timeoutParam = "timeout"
+	timeParam    = "time"
+)
+
+// durationRe matches the duration strings accepted by Prometheus (e.g. 1m30s
+// or 500ms).
+var durationRe = regexp.MustCompile(`^(?:([0-9]+)y)?(?:([0-9]+)w)?(?:([0-9]+)d)?(?:([0-9]+)h)?(?:([0-9]+)m)?(?:([0-9]+)s)?(?:([0-9]+)ms)?$`)
+
+var durationUnits = []struct {
+	unit string
+	d    time.Duration
+}{
+	{"y", 365 * 24 * time.Hour},
+	{"w", 7 * 24 * time.Hour},
+	{"d", 24 * time.Hour},
+	{"h", time.Hour},
+	{"m", time.Minute},
+	{"s", time.Second},
+	{"ms", time.Millisecond},
+}
+
+// parseDuration parses a duration the same way as the Prometheus API: either
+// a number of seconds (e.g. 30 or 1.5) or a duration string with units.
+func parseDuration(s string) (time.Duration, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		d := f * float64(time.Second)
+		if d < 0 || d > math.MaxInt64 || math.IsNaN(d) {
+			return 0, errors.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(d), nil
+	}
+
+	m := durationRe.FindStringSubmatch(s)
+	if s == "" || m == nil {
+		return 0, errors.Errorf("invalid duration %q", s)
+	}
+
+	var d time.Duration
+	for i, u := range durationUnits {
+		if m[i+1] == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(m[i+1], 10, 64)
+		if err != nil || time.Duration(n) > (math.MaxInt64-d)/u.d {
+			return 0, errors.Errorf("invalid duration %q", s)
+		}
+		d += time.Duration(n) * u.d
+	}
+	return d, nil
+}
+
+// formatDuration returns the duration as a string accepted by Prometheus,
+// e.g. 1m30s. The duration is truncated to the millisecond.
+func formatDuration(d time.Duration) string {
+	if d < time.Millisecond {
+		return "0s"
+	}
+
+	var b strings.Builder
+	for _, u := range durationUnits {
+		if n := d / u.d; n > 0 {
+			fmt.Fprintf(&b, "%d%s", n, u.unit)
+			d -= n * u.d
+		}
+	}
+	return b.String()
+}
+
+// clampQueryTimeout caps the timeout parameter to max. The parameter is set to
+// max when it's missing.
+func clampQueryTimeout(v url.Values, max time.Duration) error {
+	if s := v.Get(timeoutParam); s != "" {
+		d, err := parseDuration(s)
+		if err != nil {
+			return errors.Wrapf(err, "invalid parameter %q", timeoutParam)
+		}
+		if d <= max {
+			return nil
+		}
+	}
+
+	v.Set(timeoutParam, formatDuration(max))
+	return nil
+}
+
+// parseTime parses a timestamp the same way as the Prometheus API: either a
+// Unix timestamp in seconds (e.g. 1580000000.5) or an RFC 3339 date.
+func parseTime(s string) (time.Time, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		// Beyond 2^53 seconds, the timestamp can't be represented anyway.
+		if math.IsNaN(f) || math.Abs(f) > 1<<53 {
+			return time.Time{}, errors.Errorf("invalid time %q", s)
+		}
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*float64(time.Second))).UTC(), nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid time %q", s)
+	}
+	return t, nil
+}
+
+// checkQueryTime returns an error if the time parameter is more than maxPast
+// before now or maxFuture after now. A zero duration means no limit. Requests
+// without time parameter are evaluated at the current time and always pass.
+func checkQueryTime(v url.Values, now time.Time, maxPast, maxFuture time.Duration) error {
+	s := v.Get(timeParam)
+	if s == "" {
+		return nil
+	}
+
+	t, err := parseTime(s)
+	if err != nil {
+		return errors.Wrapf(err, "invalid parameter %q", timeParam)
+	}
+	if maxPast > 0 && t.Before(now.Add(-maxPast)) {
+		return errors.Errorf("the %q parameter %q is more than %s in the past", timeParam, s, maxPast)
+	}
+	if maxFuture > 0 && t.After(now.Add(maxFuture)) {
+		return errors.Errorf("the %q parameter %q is more than %s in the future", timeParam, s, maxFuture)
+	}
+	return nil
+}
+
+// errProcessingTimeout is returned when the processing timeout of the request
+// expires while the response is being modified.
+var errProcessingTimeout = errors.New("processing timeout exceeded")
+
+// contextReader fails the reads once the context is done.
+type contextReader struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.ReadCloser.Read(p)
+}
+
+// modifyBeforeDeadline applies the m modifier to the response unless the
+// request context expires first. The modifier runs on a copy of the response
+// which is discarded once done. Its reads of the response body fail once the
+// context expires so that it stops decoding the response.
+func modifyBeforeDeadline(resp *http.Response, m func(*http.Response) error) error {
+	ctx := resp.Request.Context()
+	modified := *resp
+	modified.Header = resp.Header.Clone()
+	modified.Body = contextReader{ctx: ctx, ReadCloser: resp.Body}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m(&modified)
+	}()
+
+	select {
+	case err := <-done:
+		*resp = modified
+		return err
+	case <-ctx.Done():
+		go func() {
+			<-done
+			modified.Body.Close()
+		}()
+		return errProcessingTimeout
+	}
+}
+
+// proxyErrorHandler replies to the requests whose upstream request or
+// response modification failed. The requests exceeding their processing
+// timeout get a 504 error, the others a 502 error like with the default
+// handler of the reverse proxy.
+func (r *routes) proxyErrorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	if _, ok := r.processingTimeouts[req.URL.Path]; !ok || req.Context().Err() != context.DeadlineExceeded {
+		log.Printf("http: proxy error: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	r.metrics.observeProcessingTimeout(req.URL.Path)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusGatewayTimeout)
+	res := apiResponse{
+		Status:    "error",
+		ErrorType: "timeout",
+		Error:     fmt.Sprintf("processing timeout of %s exceeded", r.processingTimeouts[req.URL.Path]),
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Printf("error: Failed to encode json: %v", err)
+	}
+}
@@ -0,0 +1,472 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	for _, tc := range []struct {
+		in  string
+		exp time.Duration
+		err bool
+	}{
+		{in: "30", exp: 30 * time.Second},
+		{in: "1.5", exp: 1500 * time.Millisecond},
+		{in: "30s", exp: 30 * time.Second},
+		{in: "500ms", exp: 500 * time.Millisecond},
+		{in: "1m30s", exp: 90 * time.Second},
+		{in: "2h", exp: 2 * time.Hour},
+		{in: "1d2h", exp: 26 * time.Hour},
+		{in: "1m500ms", exp: time.Minute + 500*time.Millisecond},
+		{in: "", err: true},
+		{in: "-1", err: true},
+		{in: "1.5s", err: true},
+		{in: "30s1m", err: true},
+		{in: "10x", err: true},
+		{in: "1000000000y", err: true},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			d, err := parseDuration(tc.in)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error, got %v", d)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if d != tc.exp {
+				t.Fatalf("expected %v, got %v", tc.exp, d)
+			}
+		})
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	for _, tc := range []struct {
+		in  time.Duration
+		exp string
+	}{
+		{in: 0, exp: "0s"},
+		{in: 500 * time.Millisecond, exp: "500ms"},
+		{in: 90 * time.Second, exp: "1m30s"},
+		{in: 26 * time.Hour, exp: "1d2h"},
+		{in: time.Second + 1500*time.Microsecond, exp: "1s1ms"},
+	} {
+		t.Run(tc.exp, func(t *testing.T) {
+			got := formatDuration(tc.in)
+			if got != tc.exp {
+				t.Fatalf("expected %q, got %q", tc.exp, got)
+			}
+			d, err := parseDuration(got)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if d != tc.in.Truncate(time.Millisecond) {
+				t.Fatalf("expected %q to parse to %v, got %v", got, tc.in.Truncate(time.Millisecond), d)
+			}
+		})
+	}
+}
+
+func TestMaxQueryTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		timeout string
+		body    bool
+
+		expCode    int
+		expTimeout string
+	}{
+		{
+			name:       "no timeout",
+			expCode:    http.StatusOK,
+			expTimeout: "1m",
+		},
+		{
+			name:       "lower timeout in seconds",
+			timeout:    "30",
+			expCode:    http.StatusOK,
+			expTimeout: "30",
+		},
+		{
+			name:       "lower timeout with units",
+			timeout:    "500ms",
+			expCode:    http.StatusOK,
+			expTimeout: "500ms",
+		},
+		{
+			name:       "equal timeout with units",
+			timeout:    "1m",
+			expCode:    http.StatusOK,
+			expTimeout: "1m",
+		},
+		{
+			name:       "higher timeout with units",
+			timeout:    "1m30s",
+			expCode:    http.StatusOK,
+			expTimeout: "1m",
+		},
+		{
+			name:       "higher timeout in seconds",
+			timeout:    "120.5",
+			expCode:    http.StatusOK,
+			expTimeout: "1m",
+		},
+		{
+			name:       "higher timeout in body",
+			timeout:    "2h",
+			body:       true,
+			expCode:    http.StatusOK,
+			expTimeout: "1m",
+		},
+		{
+			name:    "invalid timeout",
+			timeout: "1 minute",
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			var expBody string
+			if tc.body {
+				expBody = url.Values{queryParam: []string{`up{namespace="default"}`}, timeoutParam: []string{tc.expTimeout}}.Encode()
+			}
+			m := newMockUpstream(checkQueryHandler(expBody, timeoutParam, tc.expTimeout))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, WithMaxQueryTimeout(time.Minute))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{queryParam: []string{"up"}}
+			if tc.timeout != "" {
+				q.Set(timeoutParam, tc.timeout)
+			}
+
+			var req *http.Request
+			if tc.body {
+				req = httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query?"+proxyLabel+"=default", strings.NewReader(q.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				q.Set(proxyLabel, "default")
+				req = httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+q.Encode(), nil)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestCheckQueryTime(t *testing.T) {
+	now := time.Unix(1600000000, 0).UTC()
+	for _, tc := range []struct {
+		name string
+		time string
+
+		expErr bool
+	}{
+		{
+			name: "no time",
+		},
+		{
+			name: "now",
+			time: "1600000000",
+		},
+		{
+			name: "past boundary",
+			time: "1599996400",
+		},
+		{
+			name:   "beyond past boundary",
+			time:   "1599996399.999",
+			expErr: true,
+		},
+		{
+			name: "past boundary in RFC 3339",
+			time: "2020-09-13T11:26:40Z",
+		},
+		{
+			name:   "beyond past boundary in RFC 3339",
+			time:   "2020-09-13T11:26:39Z",
+			expErr: true,
+		},
+		{
+			name: "future boundary",
+			time: "1600000300",
+		},
+		{
+			name:   "beyond future boundary",
+			time:   "1600000300.001",
+			expErr: true,
+		},
+		{
+			name:   "beyond future boundary in RFC 3339",
+			time:   "2020-09-13T12:31:41+00:00",
+			expErr: true,
+		},
+		{
+			name:   "invalid time",
+			time:   "yesterday",
+			expErr: true,
+		},
+		{
+			name:   "NaN",
+			time:   "NaN",
+			expErr: true,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			v := url.Values{}
+			if tc.time != "" {
+				v.Set(timeParam, tc.time)
+			}
+			err := checkQueryTime(v, now, time.Hour, 5*time.Minute)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	t.Run("no limit", func(t *testing.T) {
+		v := url.Values{timeParam: []string{"0"}}
+		if err := checkQueryTime(v, now, 0, 0); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestQueryTimeWindow(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, WithQueryTimeWindow(24*time.Hour, 5*time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	now := time.Now()
+	for _, tc := range []struct {
+		name string
+		time time.Time
+		body bool
+
+		expCode int
+	}{
+		{
+			name:    "recent time",
+			time:    now.Add(-time.Hour),
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "old time",
+			time:    now.Add(-25 * time.Hour),
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "old time in body",
+			time:    now.Add(-25 * time.Hour),
+			body:    true,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "future time within the skew",
+			time:    now.Add(time.Minute),
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "future time",
+			time:    now.Add(time.Hour),
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			q := url.Values{queryParam: []string{"up"}, timeParam: []string{tc.time.Format(time.RFC3339)}}
+
+			var req *http.Request
+			if tc.body {
+				req = httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query?"+proxyLabel+"=default", strings.NewReader(q.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				q.Set(proxyLabel, "default")
+				req = httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+q.Encode(), nil)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if tc.expCode == http.StatusBadRequest && !strings.Contains(string(body), "bad_data") {
+				t.Fatalf("expected a bad_data error, got %s", string(body))
+			}
+		})
+	}
+}
+
+func TestProcessingTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		upstreamDelay time.Duration
+		filterDelay   time.Duration
+
+		expCode int
+	}{
+		{
+			name:    "within the timeout",
+			expCode: http.StatusOK,
+		},
+		{
+			name:          "slow upstream",
+			upstreamDelay: time.Second,
+			expCode:       http.StatusGatewayTimeout,
+		},
+		{
+			name:        "slow filter",
+			filterDelay: time.Second,
+			expCode:     http.StatusGatewayTimeout,
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				select {
+				case <-time.After(tc.upstreamDelay):
+				case <-req.Context().Done():
+				}
+				w.Write([]byte(`{"status":"success","data":{"groups":[]}}`))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, WithProcessingTimeouts(map[string]time.Duration{"/api/v1/rules": 100 * time.Millisecond}))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			filter := r.modifiers["/api/v1/rules"]
+			r.modifiers["/api/v1/rules"] = func(resp *http.Response) error {
+				time.Sleep(tc.filterDelay)
+				return filter(resp)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/rules?"+proxyLabel+"=default", nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			metrics := httptest.NewRecorder()
+			r.metrics.ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+			timedOut := strings.Contains(metrics.Body.String(), `prom_label_proxy_processing_timeouts_total{path="/api/v1/rules"} 1`)
+			if timedOut != (tc.expCode == http.StatusGatewayTimeout) {
+				t.Fatalf("unexpected processing timeouts metric:\n%s", metrics.Body.String())
+			}
+			if tc.expCode != http.StatusGatewayTimeout {
+				return
+			}
+
+			if !strings.Contains(w.Body.String(), `"errorType":"timeout"`) {
+				t.Fatalf("expected a timeout error, got %s", w.Body.String())
+			}
+		})
+	}
+
+	t.Run("other_path", func(t *testing.T) {
+		m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte(`{"status":"success","data":{"alerts":[]}}`))
+		}))
+		defer m.Close()
+
+		r, err := NewRoutes(m.url, proxyLabel, WithProcessingTimeouts(map[string]time.Duration{"/api/v1/rules": 100 * time.Millisecond}))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/alerts?"+proxyLabel+"=default", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+	})
+}
+
+// endlessReader is a response body which never ends.
+type endlessReader struct{}
+
+func (endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = ' '
+	}
+	return len(p), nil
+}
+
+func TestModifyBeforeDeadlineStopsReading(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	resp := &http.Response{
+		Header:  http.Header{},
+		Body:    ioutil.NopCloser(endlessReader{}),
+		Request: httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/rules", nil).WithContext(ctx),
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	err := modifyBeforeDeadline(resp, func(resp *http.Response) error {
+		_, err := io.Copy(ioutil.Discard, resp.Body)
+		stopped <- err
+		return err
+	})
+	if err != errProcessingTimeout {
+		t.Fatalf("expected error %v, got %v", errProcessingTimeout, err)
+	}
+
+	select {
+	case err := <-stopped:
+		if err != context.Canceled {
+			t.Fatalf("expected error %v, got %v", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the modifier kept reading the response after the deadline")
+	}
+}
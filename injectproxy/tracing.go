@@ -0,0 +1,128 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/prometheus-community/prom-label-proxy/injectproxy"
+
+// tracePropagator reads the trace context of the incoming requests and writes
+// it on the upstream requests.
+var tracePropagator = propagation.TraceContext{}
+
+// startRequestSpan starts the server span of the request, child of the trace
+// context sent by the client if any.
+func (r *routes) startRequestSpan(req *http.Request, route string) (*http.Request, trace.Span) {
+	ctx := tracePropagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	ctx, span := r.tracer.Start(ctx, "prom-label-proxy "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.target", req.URL.Path),
+			attribute.String("http.route", route),
+		),
+	)
+	return req.WithContext(ctx), span
+}
+
+// endSpan records the status code and the error, if any, on the span and
+// ends it.
+func endSpan(span trace.Span, code int, err error) {
+	if code != 0 {
+		span.SetAttributes(attribute.Int("http.status_code", code))
+	}
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	case code >= http.StatusInternalServerError:
+		span.SetStatus(codes.Error, http.StatusText(code))
+	}
+	span.End()
+}
+
+// startExtractSpan starts the span of the label value extraction. The label
+// values are recorded on the span only when enabled as they may be sensitive.
+func (r *routes) startExtractSpan(ctx context.Context) trace.Span {
+	_, span := r.tracer.Start(ctx, "extract label values", trace.WithAttributes(
+		attribute.String("label", r.label),
+		attribute.String("source", extractionSource(r.el)),
+	))
+	return span
+}
+
+func (r *routes) recordLabelValues(span trace.Span, lvalues ...string) {
+	if r.spanLabelValues {
+		span.SetAttributes(attribute.StringSlice("label_values", lvalues))
+	}
+}
+
+// startInjectSpan starts the span of the label injection into the PromQL
+// expressions and the matchers. The span is ended by the tracingTransport when
+// the request is sent upstream or when the handler returns.
+func (r *routes) startInjectSpan(req *http.Request) (*http.Request, trace.Span) {
+	parent := trace.SpanFromContext(req.Context())
+	ctx, span := r.tracer.Start(req.Context(), "inject label")
+	return req.WithContext(context.WithValue(ctx, keyInjectSpan, &injectSpan{Span: span, parent: parent})), span
+}
+
+// injectSpan is the label injection span and the span of the request, parent
+// of both the injection and the upstream spans.
+type injectSpan struct {
+	trace.Span
+	parent trace.Span
+}
+
+// tracingTransport traces the round-trips to the upstream and propagates the
+// trace context to it.
+type tracingTransport struct {
+	next   http.RoundTripper
+	tracer trace.Tracer
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if span, ok := ctx.Value(keyInjectSpan).(*injectSpan); ok {
+		span.End()
+		ctx = trace.ContextWithSpan(ctx, span.parent)
+	}
+
+	// The query string isn't recorded since it holds the label values.
+	ctx, span := t.tracer.Start(ctx, "upstream "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.host", req.URL.Host),
+			attribute.String("http.target", req.URL.Path),
+		),
+	)
+	req = req.Clone(ctx)
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.next.RoundTrip(req)
+	var code int
+	if resp != nil {
+		code = resp.StatusCode
+	}
+	endSpan(span, code, err)
+	return resp, err
+}
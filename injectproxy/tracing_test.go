@@ -0,0 +1,151 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	const traceparent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+	for _, tc := range []struct {
+		name        string
+		url         string
+		labelValues bool
+
+		expCode       int
+		expSpans      []string
+		expLabelValue bool
+	}{
+		{
+			name:     "forwarded request",
+			url:      "http://prometheus.example.com/api/v1/query?query=up&" + proxyLabel + "=default",
+			expCode:  http.StatusOK,
+			expSpans: []string{"extract label values", "inject label", "upstream GET", "prom-label-proxy /api/v1/query"},
+		},
+		{
+			name:          "recorded label values",
+			url:           "http://prometheus.example.com/api/v1/query?query=up&" + proxyLabel + "=default",
+			labelValues:   true,
+			expCode:       http.StatusOK,
+			expSpans:      []string{"extract label values", "inject label", "upstream GET", "prom-label-proxy /api/v1/query"},
+			expLabelValue: true,
+		},
+		{
+			name:     "missing label value",
+			url:      "http://prometheus.example.com/api/v1/query?query=up",
+			expCode:  http.StatusBadRequest,
+			expSpans: []string{"extract label values", "prom-label-proxy /api/v1/query"},
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			var upstreamTraceparent string
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				upstreamTraceparent = req.Header.Get("traceparent")
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			sr := tracetest.NewSpanRecorder()
+			opts := []Option{WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))}
+			if tc.labelValues {
+				opts = append(opts, WithLabelValuesInSpans())
+			}
+			r, err := NewRoutes(m.url, proxyLabel, opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			req.Header.Set("traceparent", traceparent)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
+			}
+
+			spans := sr.Ended()
+			if len(spans) != len(tc.expSpans) {
+				t.Fatalf("expected %d spans, got %d", len(tc.expSpans), len(spans))
+			}
+			for i, s := range spans {
+				if s.Name() != tc.expSpans[i] {
+					t.Fatalf("expected span %d to be %q, got %q", i, tc.expSpans[i], s.Name())
+				}
+				if tid := s.SpanContext().TraceID().String(); tid != "0af7651916cd43dd8448eb211c80319c" {
+					t.Fatalf("expected span %q to belong to the incoming trace, got trace ID %s", s.Name(), tid)
+				}
+			}
+
+			var gotLabelValue bool
+			for _, kv := range spans[0].Attributes() {
+				if kv.Key == attribute.Key("label_values") {
+					gotLabelValue = true
+				}
+			}
+			if gotLabelValue != tc.expLabelValue {
+				t.Fatalf("expected label values recorded %v, got %v", tc.expLabelValue, gotLabelValue)
+			}
+
+			if tc.expCode != http.StatusOK {
+				return
+			}
+			upstream := spans[2].SpanContext()
+			if spans[2].Parent().SpanID() != spans[3].SpanContext().SpanID() {
+				t.Fatalf("expected the upstream span to be a child of the request span")
+			}
+			if !strings.Contains(upstreamTraceparent, upstream.TraceID().String()+"-"+upstream.SpanID().String()) {
+				t.Fatalf("expected the upstream span to be propagated, got traceparent %q", upstreamTraceparent)
+			}
+		})
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	const traceparent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+	var upstreamTraceparent string
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstreamTraceparent = req.Header.Get("traceparent")
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&"+proxyLabel+"=default", nil)
+	req.Header.Set("traceparent", traceparent)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if resp := w.Result(); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if upstreamTraceparent != traceparent {
+		t.Fatalf("expected traceparent %q forwarded unmodified, got %q", traceparent, upstreamTraceparent)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// LabelValueTransform maps the label value extracted from a request to the
+// value which is enforced, e.g. to match how the value is stored in the TSDB.
+type LabelValueTransform func(lvalue string) (string, error)
+
+// ParseLabelValueTransform returns the transform described by the given
+// specification in the op:argument form. The supported operations are:
+//
+//	prefix-strip:<prefix>  removes the prefix from the value (e.g. prefix-strip:tenant-).
+//	suffix-strip:<suffix>  removes the suffix from the value.
+//	replace:<old>=<new>    replaces all the occurrences of old by new in the value.
+//	template:<template>    executes the Go template with the value as data (e.g. template:{{.}}-prod).
+func ParseLabelValueTransform(spec string) (LabelValueTransform, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.Errorf("invalid label value transform %q, expected op:argument", spec)
+	}
+	op, arg := parts[0], parts[1]
+
+	switch op {
+	case "prefix-strip":
+		if arg == "" {
+			return nil, errors.Errorf("invalid label value transform %q: empty prefix", spec)
+		}
+		return func(lvalue string) (string, error) {
+			return strings.TrimPrefix(lvalue, arg), nil
+		}, nil
+
+	case "suffix-strip":
+		if arg == "" {
+			return nil, errors.Errorf("invalid label value transform %q: empty suffix", spec)
+		}
+		return func(lvalue string) (string, error) {
+			return strings.TrimSuffix(lvalue, arg), nil
+		}, nil
+
+	case "replace":
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.Errorf("invalid label value transform %q, expected replace:old=new", spec)
+		}
+		return func(lvalue string) (string, error) {
+			return strings.ReplaceAll(lvalue, kv[0], kv[1]), nil
+		}, nil
+
+	case "template":
+		tmpl, err := template.New(op).Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid label value transform %q", spec)
+		}
+		return func(lvalue string) (string, error) {
+			var b strings.Builder
+			if err := tmpl.Execute(&b, lvalue); err != nil {
+				return "", errors.Wrap(err, "can't transform the label value")
+			}
+			return b.String(), nil
+		}, nil
+	}
+
+	return nil, errors.Errorf("invalid label value transform %q: unknown operation %q, expected one of prefix-strip, suffix-strip, replace or template", spec, op)
+}
+
+// ChainLabelValueTransforms returns a transform applying the given transforms
+// in order.
+func ChainLabelValueTransforms(ts ...LabelValueTransform) LabelValueTransform {
+	return func(lvalue string) (string, error) {
+		for _, t := range ts {
+			var err error
+			if lvalue, err = t(lvalue); err != nil {
+				return "", err
+			}
+		}
+		return lvalue, nil
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseLabelValueTransform(t *testing.T) {
+	for _, tc := range []struct {
+		specs  []string
+		lvalue string
+
+		expValue    string
+		expParseErr bool
+		expErr      bool
+	}{
+		{
+			specs:    []string{"prefix-strip:tenant-"},
+			lvalue:   "tenant-foo",
+			expValue: "foo",
+		},
+		{
+			specs:    []string{"prefix-strip:tenant-"},
+			lvalue:   "foo",
+			expValue: "foo",
+		},
+		{
+			specs:       []string{"prefix-strip:"},
+			expParseErr: true,
+		},
+		{
+			specs:    []string{"suffix-strip:.example.com"},
+			lvalue:   "foo.example.com",
+			expValue: "foo",
+		},
+		{
+			specs:       []string{"suffix-strip:"},
+			expParseErr: true,
+		},
+		{
+			specs:    []string{"replace:_=-"},
+			lvalue:   "team_a_prod",
+			expValue: "team-a-prod",
+		},
+		{
+			specs:       []string{"replace:=x"},
+			lvalue:      "foo",
+			expParseErr: true,
+		},
+		{
+			specs:    []string{"replace:-="},
+			lvalue:   "foo-bar",
+			expValue: "foobar",
+		},
+		{
+			specs:       []string{"replace:_"},
+			expParseErr: true,
+		},
+		{
+			specs:    []string{"template:{{.}}-prod"},
+			lvalue:   "foo",
+			expValue: "foo-prod",
+		},
+		{
+			specs:    []string{`template:{{printf "%.3s" .}}`},
+			lvalue:   "foobar",
+			expValue: "foo",
+		},
+		{
+			specs:       []string{"template:{{.}"},
+			expParseErr: true,
+		},
+		{
+			specs:  []string{"template:{{.Name}}"},
+			lvalue: "foo",
+			expErr: true,
+		},
+		{
+			specs:    []string{"prefix-strip:tenant-", "replace:_=-", "template:{{.}}-prod"},
+			lvalue:   "tenant-team_a",
+			expValue: "team-a-prod",
+		},
+		{
+			specs:       []string{"lowercase:"},
+			expParseErr: true,
+		},
+		{
+			specs:       []string{"prefix-strip"},
+			expParseErr: true,
+		},
+	} {
+		t.Run(strings.Join(tc.specs, ","), func(t *testing.T) {
+			var ts []LabelValueTransform
+			for _, spec := range tc.specs {
+				tr, err := ParseLabelValueTransform(spec)
+				if err != nil {
+					if !tc.expParseErr {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					return
+				}
+				ts = append(ts, tr)
+			}
+			if tc.expParseErr {
+				t.Fatal("expected parse error, got none")
+			}
+
+			v, err := ChainLabelValueTransforms(ts...)(tc.lvalue)
+			if err != nil {
+				if !tc.expErr {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if tc.expErr {
+				t.Fatal("expected error, got none")
+			}
+			if v != tc.expValue {
+				t.Fatalf("expected value %q, got %q", tc.expValue, v)
+			}
+		})
+	}
+}
+
+func TestLabelValueTransform(t *testing.T) {
+	m := newMockUpstream(checkQueryHandler("", queryParam, `up{namespace="foo"}`))
+	defer m.Close()
+
+	prefix, err := ParseLabelValueTransform("prefix-strip:tenant-")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r, err := NewRoutes(m.url, proxyLabel, WithLabelValueTransform(prefix), WithAllowedLabelValues([]string{"foo"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		lvalue string
+
+		expCode int
+	}{
+		{
+			lvalue:  "tenant-foo",
+			expCode: http.StatusOK,
+		},
+		{
+			lvalue:  "foo",
+			expCode: http.StatusOK,
+		},
+		{
+			// The allowed values are checked once transformed.
+			lvalue:  "tenant-bar",
+			expCode: http.StatusForbidden,
+		},
+		{
+			// An empty value would match the series without the label.
+			lvalue:  "tenant-",
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.lvalue, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/query?query=up&"+proxyLabel+"="+tc.lvalue, nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// UpstreamTLSConfig holds the TLS settings of the connections to the upstream.
+type UpstreamTLSConfig struct {
+	// CertFile and KeyFile are the client certificate and key presented to
+	// the upstream (mutual TLS). They are read again when they change, e.g.
+	// when the certificate is rotated.
+	CertFile string
+	KeyFile  string
+	// CAFile holds the CA certificates verifying the upstream certificate
+	// instead of the system ones.
+	CAFile string
+	// ServerName overrides the name verified in the upstream certificate
+	// (e.g. when the upstream is reached by IP address).
+	ServerName string
+}
+
+func (c UpstreamTLSConfig) tlsConfig() (*tls.Config, error) {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, errors.New("both the upstream client certificate and key files are required")
+	}
+
+	cfg := &tls.Config{ServerName: c.ServerName}
+	if c.CAFile != "" {
+		b, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't read the upstream CA file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.Errorf("no certificate found in the upstream CA file %s", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if c.CertFile != "" {
+		kp := &keyPairFiles{certFile: c.CertFile, keyFile: c.KeyFile}
+		// Fail early when the files are invalid.
+		if _, err := kp.get(); err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return kp.get()
+		}
+	}
+	return cfg, nil
+}
+
+// keyPairFiles reads a certificate and its key from files. The files are read
+// again when they change, e.g. for rotated certificates.
+type keyPairFiles struct {
+	certFile string
+	keyFile  string
+
+	mtx     sync.Mutex
+	modTime [2]time.Time
+	cert    *tls.Certificate
+}
+
+func (f *keyPairFiles) get() (*tls.Certificate, error) {
+	var modTime [2]time.Time
+	for i, path := range []string{f.certFile, f.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't read the upstream client certificate")
+		}
+		modTime[i] = fi.ModTime()
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.cert != nil && modTime == f.modTime {
+		return f.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		if f.cert != nil {
+			// The files may be in the middle of an update, keep the
+			// previous certificate.
+			return f.cert, nil
+		}
+		return nil, errors.Wrap(err, "can't load the upstream client certificate")
+	}
+	f.cert, f.modTime = &cert, modTime
+	return f.cert, nil
+}
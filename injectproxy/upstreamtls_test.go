@@ -0,0 +1,190 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM-encoded certificate and key signed by the CA.
+func (ca *testCA) issue(t *testing.T, cn string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prom-label-proxy")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	caFile, certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeKeyPair := func(cn string, modTime time.Time) {
+		cert, key := ca.issue(t, cn, x509.ExtKeyUsageClientAuth)
+		for path, b := range map[string][]byte{certFile: cert, keyFile: key} {
+			if err := ioutil.WriteFile(path, b, 0600); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := os.Chtimes(path, modTime, modTime); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+	if err := ioutil.WriteFile(caFile, ca.pem, 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	writeKeyPair("proxy-1", time.Now().Add(-time.Minute))
+
+	serverCert, serverKey := ca.issue(t, "upstream.example.com", x509.ExtKeyUsageServerAuth)
+	kp, err := tls.X509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	var clientCN string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clientCN = req.TLS.PeerCertificates[0].Subject.CommonName
+		// Close the connection so that every request makes a handshake.
+		w.Header().Set("Connection", "close")
+		w.Write(okResponse)
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{kp},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	upstream, _ := url.Parse(srv.URL)
+
+	query := func(t *testing.T, c UpstreamTLSConfig) int {
+		r, err := NewRoutes(upstream, proxyLabel, WithUpstreamTLS(c))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&"+proxyLabel+"=default", nil))
+		return w.Code
+	}
+
+	t.Run("mutual_TLS", func(t *testing.T) {
+		c := UpstreamTLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: caFile, ServerName: "upstream.example.com"}
+		r, err := NewRoutes(upstream, proxyLabel, WithUpstreamTLS(c))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, exp := range []string{"proxy-1", "proxy-2"} {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&"+proxyLabel+"=default", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+			}
+			if clientCN != exp {
+				t.Fatalf("expected client certificate %q, got %q", exp, clientCN)
+			}
+			// The rotated certificate is used for the next connections.
+			writeKeyPair("proxy-2", time.Now())
+		}
+	})
+
+	t.Run("no_client_certificate", func(t *testing.T) {
+		if code := query(t, UpstreamTLSConfig{CAFile: caFile, ServerName: "upstream.example.com"}); code != http.StatusBadGateway {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadGateway, code)
+		}
+	})
+
+	t.Run("unknown_CA", func(t *testing.T) {
+		if code := query(t, UpstreamTLSConfig{CertFile: certFile, KeyFile: keyFile, ServerName: "upstream.example.com"}); code != http.StatusBadGateway {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadGateway, code)
+		}
+	})
+
+	t.Run("invalid_files", func(t *testing.T) {
+		if _, err := NewRoutes(upstream, proxyLabel, WithUpstreamTLS(UpstreamTLSConfig{CertFile: certFile})); err == nil {
+			t.Fatal("expected error, got none")
+		}
+		if _, err := NewRoutes(upstream, proxyLabel, WithUpstreamTLS(UpstreamTLSConfig{CAFile: filepath.Join(dir, "missing.pem")})); err == nil {
+			t.Fatal("expected error, got none")
+		}
+	})
+}
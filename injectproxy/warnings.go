@@ -0,0 +1,46 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+const (
+	// genericWarning replaces the upstream warnings with WithGenericWarnings.
+	genericWarning = "some data sources were unavailable"
+	// redactedWarning replaces the parts of the upstream warnings matching
+	// the expression of WithRedactedWarnings.
+	redactedWarning = "<redacted>"
+)
+
+// sanitizingWarnings returns true if the upstream warnings are sanitized.
+func (r *routes) sanitizingWarnings() bool {
+	return r.genericWarnings || r.redactWarnings != nil
+}
+
+// sanitizeWarnings returns the upstream warnings without the details which
+// may disclose the backend topology, e.g. the addresses of the Thanos stores
+// which failed to answer a partial response.
+func (r *routes) sanitizeWarnings(warnings []string) []string {
+	if len(warnings) == 0 || !r.sanitizingWarnings() {
+		return warnings
+	}
+
+	if r.genericWarnings {
+		return []string{genericWarning}
+	}
+
+	sanitized := make([]string, 0, len(warnings))
+	for _, w := range warnings {
+		sanitized = append(sanitized, r.redactWarnings.ReplaceAllLiteralString(w, redactedWarning))
+	}
+	return sanitized
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeWarnings(t *testing.T) {
+	const warnings = `["receive 10.0.0.1:10901: rpc error: code = Unavailable","store-gateway-1.thanos.svc:10901 timed out"]`
+
+	for _, tc := range []struct {
+		name string
+		path string
+		data string
+		opts []Option
+
+		expWarnings []string
+	}{
+		{
+			name: "pass-through",
+			path: "/api/v1/query",
+			data: `{"resultType":"vector","result":[]}`,
+			expWarnings: []string{
+				"receive 10.0.0.1:10901: rpc error: code = Unavailable",
+				"store-gateway-1.thanos.svc:10901 timed out",
+			},
+		},
+		{
+			name:        "generic",
+			path:        "/api/v1/query",
+			data:        `{"resultType":"vector","result":[]}`,
+			opts:        []Option{WithGenericWarnings()},
+			expWarnings: []string{"some data sources were unavailable"},
+		},
+		{
+			name: "redacted",
+			path: "/api/v1/query_range",
+			data: `{"resultType":"matrix","result":[]}`,
+			opts: []Option{WithRedactedWarnings(regexp.MustCompile(`[a-z0-9.-]+:\d+`))},
+			expWarnings: []string{
+				"receive <redacted>: rpc error: code = Unavailable",
+				"<redacted> timed out",
+			},
+		},
+		{
+			name:        "generic and redacted",
+			path:        "/api/v1/query",
+			data:        `{"resultType":"vector","result":[]}`,
+			opts:        []Option{WithGenericWarnings(), WithRedactedWarnings(regexp.MustCompile(`[a-z0-9.-]+:\d+`))},
+			expWarnings: []string{"some data sources were unavailable"},
+		},
+		{
+			name:        "rules",
+			path:        "/api/v1/rules",
+			data:        `{"groups":[]}`,
+			opts:        []Option{WithGenericWarnings()},
+			expWarnings: []string{"some data sources were unavailable"},
+		},
+	} {
+		t.Run(strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte(`{"status":"success","data":` + tc.data + `,"warnings":` + warnings + `}`))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com"+tc.path+"?query=up&"+proxyLabel+"=default", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			var apir apiResponse
+			if err := json.NewDecoder(w.Body).Decode(&apir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(apir.Warnings, tc.expWarnings) {
+				t.Fatalf("expected warnings %q, got %q", tc.expWarnings, apir.Warnings)
+			}
+		})
+	}
+}
@@ -14,47 +14,468 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
+	"sort"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
 )
 
 func main() {
 	var (
-		insecureListenAddress  string
-		upstream               string
-		label                  string
-		enableLabelAPIs        bool
-		unsafePassthroughPaths string // Comma-delimited string.
+		configFile              string
+		keepConfigOnReloadError bool
+		insecureListenAddress   string
+		secureListenAddress     string
+		tlsConfig               tlsListenerConfig
+		internalListenAddress   string
+		upstream                string
+		shadowUpstream          string
+		eventWebhookURL         string
+		label                   string
+		labelParameter          string
+		headerName              string
+		labelConflictPolicy     string
+		decodeBinaryHeader      bool
+		jwksURL                 string
+		jwtClaim                string
+		jwtIssuer               string
+		jwtAudience             string
+		jwksRefreshInterval     time.Duration
+		clientCertLabelField    string
+		clientCertLabelRegex    string
+		ldapURL                 string
+		ldapBindDN              string
+		ldapBindPasswordFile    string
+		ldapCAFile              string
+		ldapBaseDN              string
+		ldapFilter              string
+		ldapAttribute           string
+		ldapIdentityHeader      string
+		ldapCacheTTL            time.Duration
+		enableLabelAPIs         bool
+		enableGrafanaQueries    bool
+		enableGrafanaLive       bool
+		unsafePassthroughPaths  string // Comma-delimited string.
+		defaultRouteAction      string
+		matcherPosition         string
+		strictQueryResults      bool
+		partialQueryResults     bool
+		rulesWithActiveAlerts   bool
+		scopeRecordingQueries   bool
+		scopeAlertingQueries    bool
+		maxQuerySelectors       int
+		maxMatchSelectors       int
+		maxEstimatedSeries      int
+		maxQueryDepth           int
+		forbidBareNameRegex     bool
+		enforceVectorMatching   bool
+		enforceGrouping         bool
+		filterFederation        bool
+		nameRegexMinPrefix      int
+		queryCacheTTL           time.Duration
+		queryCacheSize          int
+		maxSilenceDuration      time.Duration
+		upstreamAuthorization   string
+		upstreamTokenFile       string
+		skipIfLabelPresent      bool
+		collapseMatchers        bool
+		noScopeStatusCode       int
+		upstreamHTTPProxy       string
+		upstreamTLS             injectproxy.UpstreamTLSConfig
+		upstreamNoProxy         bool
+		alertsByFingerprint     string
+		stripIntrospection      bool
+		stripQueryExplanation   bool
+		auditLogFile            string
+		maxHeaderBytes          int
+		maxHeaders              int
+		searchPath              string
+		rulesAlertsPath         string
+		noForwardedHeaders      bool
+		filteredCountHeader     bool
+		filteringTrailers       bool
+		filteringWarnings       bool
+		genericWarnings         bool
+		redactWarningsRegex     string
+		recompressResponses     bool
+		emptyResponseResults    bool
+		maxQueryTimeout         time.Duration
+		maxQueryTimePast        time.Duration
+		maxQueryTimeFuture      time.Duration
+		strictAlerts            bool
+		passthroughOptions      bool
+		scopedAlertReferences   bool
+		alertsErrorOnReplace    bool
+		matchErrorOnConflict    bool
+		silenceErrorOnReplace   bool
+		responseBufferLimit     int
+		streamingThreshold      int
+		injectionMarkerKeyFile  string
+		metricsConstLabels      = constLabels{}
+		jsonSelectorPaths       = selectorPaths{}
+		jsonExpressionPaths     = selectorPaths{}
+		allowedLabelValues      labelValues
+		allowedLabelValuesFile  string
+		labelValueTransforms    labelValueTransforms
+		additionalLabels        additionalLabels
+		labelMatchTypes         = labelMatchTypes{}
+		selectorPaths           = selectorPaths{}
+		pathRewrites            pathRewrites
+		processingTimeouts      = processingTimeouts{}
+		enableExplainEndpoint   bool
+		logFormat               string
+		logLevel                string
+		logRedactLabelValues    bool
+		tracingEndpoint         string
+		tracingInsecure         bool
+		tracingLabelValues      bool
+		debug                   bool
 	)
 
 	flagset := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flagset.StringVar(&configFile, "config.file", "", "A YAML file setting flags, the keys being the flag names (e.g. 'label: namespace'). The flags given on the command line take precedence over the file. "+
+		"The file supports the listen addresses, upstream, label, label-parameter, header-name, allowed-label-values (a list), enable-label-apis, rules-with-active-alerts, alerts-error-on-replace, silences-error-on-replace and match-error-on-conflict keys. The file is reloaded on SIGHUP, except the listen addresses and upstream which require a restart.")
+	flagset.BoolVar(&keepConfigOnReloadError, "keep-config-on-reload-error", false, "When specified, the current configuration is kept when reloading the configuration file fails. "+
+		"By default, the requests are denied with 503 until a valid configuration is loaded.")
 	flagset.StringVar(&insecureListenAddress, "insecure-listen-address", "", "The address the prom-label-proxy HTTP server should listen on.")
+	flagset.StringVar(&secureListenAddress, "secure-listen-address", "", "The address the prom-label-proxy HTTPS server should listen on. Requires the -tls-cert-file and -tls-key-file flags.")
+	flagset.StringVar(&tlsConfig.certFile, "tls-cert-file", "", "The file containing the certificate of the HTTPS server.")
+	flagset.StringVar(&tlsConfig.keyFile, "tls-key-file", "", "The file containing the private key of the HTTPS server.")
+	flagset.StringVar(&tlsConfig.alpnProtocols, "tls-alpn-protocols", "h2,http/1.1", "Comma delimited list of the protocols advertised by the HTTPS server with ALPN, in order of preference.")
+	flagset.StringVar(&tlsConfig.clientCAFile, "tls-client-ca-file", "", "The file containing the CA certificates verifying the TLS client certificates of the HTTPS server. When specified, the client certificates are verified if presented.")
+	flagset.StringVar(&tlsConfig.sessionTicketKeyFile, "tls-session-ticket-key-file", "", "The file containing the TLS session ticket keys, one key of 64 hexadecimal characters per line. "+
+		"The first key encrypts the new tickets and the others decrypt the tickets issued with previous keys. Sharing the file allows a fleet of proxies to resume the sessions of each other. "+
+		"The file is reloaded when it changes. By default, random keys are used.")
+	flagset.StringVar(&internalListenAddress, "internal-listen-address", "", "The address the HTTP server exposing the internal /metrics endpoint should listen on. Disabled if empty.")
+	flagset.Var(metricsConstLabels, "metrics-const-label", "A label added to all the metrics of the proxy in the key=value form (e.g. proxy_instance=a). Can be repeated.")
+	flagset.BoolVar(&enableExplainEndpoint, "enable-explain-endpoint", false, "When specified, the internal listener exposes the POST /-/explain endpoint returning the PromQL query of the 'query' parameter after injecting the label value of the 'value' parameter. "+
+		"Requires -internal-listen-address.")
 	flagset.StringVar(&upstream, "upstream", "", "The upstream URL to proxy to.")
+	flagset.StringVar(&shadowUpstream, "shadow-upstream", "", "When specified, the enforced read requests are mirrored to this upstream URL and its filtered responses are compared to the ones of the upstream, e.g. to validate a backend migration. "+
+		"Divergences are logged and counted in the metrics. The client only gets the responses of the -upstream URL.")
+	flagset.StringVar(&eventWebhookURL, "event-webhook-url", "", "When specified, an event describing each enforced request (label value, original and enforced query or selectors, number of filtered items) is posted as JSON to this URL, e.g. for security monitoring. "+
+		"The events are sent asynchronously and dropped if the webhook can't keep up.")
+	flagset.StringVar(&upstreamHTTPProxy, "upstream-http-proxy", "", "The URL of the HTTP proxy used to reach the upstream. When specified, it overrides the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables for the upstream connections.")
+	flagset.BoolVar(&upstreamNoProxy, "upstream-no-proxy", false, "When specified, the upstream is reached directly, ignoring the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.")
+	flagset.StringVar(&upstreamTLS.CertFile, "upstream-tls-cert-file", "", "The file containing the client certificate presented to the upstream (mutual TLS). Requires -upstream-tls-key-file. "+
+		"The certificate and key files are read again when they change, e.g. when the certificate is rotated.")
+	flagset.StringVar(&upstreamTLS.KeyFile, "upstream-tls-key-file", "", "The file containing the private key of -upstream-tls-cert-file.")
+	flagset.StringVar(&upstreamTLS.CAFile, "upstream-tls-ca-file", "", "The file containing the CA certificates verifying the upstream certificate instead of the system ones.")
+	flagset.StringVar(&upstreamTLS.ServerName, "upstream-tls-server-name", "", "The server name verified in the upstream certificate when it differs from the host of the -upstream URL (e.g. when reached by IP address).")
+	flagset.StringVar(&upstreamAuthorization, "upstream-authorization", "passthrough", "How the Authorization header of the requests is sent to the upstream. One of 'passthrough' (forwarded as-is), "+
+		"'strip' (removed, e.g. when the upstream shouldn't see the credentials of the tenants) or 'replace' (replaced with the bearer token of -upstream-bearer-token-file so that the proxy authenticates to the upstream with its own identity).")
+	flagset.StringVar(&upstreamTokenFile, "upstream-bearer-token-file", "", "The file containing the bearer token sent to the upstream with -upstream-authorization=replace (e.g. a service account token). The file is read again when it changes.")
 	flagset.StringVar(&label, "label", "", "The label to enforce in all proxied PromQL queries. "+
 		"This label will be also required as the URL parameter to get the value to be injected. For example: -label=tenant will"+
 		" make it required for this proxy to have URL in form of: <URL>?tenant=abc&other_params...")
+	flagset.StringVar(&labelParameter, "label-parameter", "", "The URL parameter providing the label value when it differs from the -label flag. "+
+		"For example, -label=__tenant__ -label-parameter=tenant enforces the __tenant__ label (e.g. set by relabeling) with the value of the 'tenant' parameter.")
+	flagset.StringVar(&headerName, "header-name", "", "When specified, the label value is read from this HTTP header instead of the URL query parameter. "+
+		"This can be used with gRPC-Web clients sending the value as custom metadata (e.g. grpc-metadata-tenant).")
+	flagset.StringVar(&labelConflictPolicy, "label-conflict-policy", "reject", "When both -header-name and -label-parameter are specified, how the label values of the header and the parameter are reconciled when they differ. "+
+		"One of 'reject' (the request is rejected), 'prefer' (the header value is used) or 'intersect' (the value common to both sources is used, the request is forbidden if there is none).")
+	flagset.Var(&allowedLabelValues, "allowed-label-value", "When specified, only the requests with this label value (once extracted and transformed) are proxied, the others are rejected with 403. "+
+		"This is a safeguard against extraction sources producing unexpected values (e.g. a misconfigured authenticating proxy). Can be repeated.")
+	flagset.Var(&labelValueTransforms, "label-value-transform", "A transform applied to the label value once extracted, before it's checked against the allowed values and enforced, in the op:argument form. "+
+		"The operations are prefix-strip:<prefix>, suffix-strip:<suffix>, replace:<old>=<new> and template:<Go template of the value> (e.g. prefix-strip:tenant- or template:{{.}}-prod). Can be repeated, the transforms are applied in order.")
+	flagset.Var(&additionalLabels, "additional-label", "Another label enforced along with the -label flag (e.g. for multi-dimensional tenancy) in the name, name=param:<parameter> or name=header:<header> form, "+
+		"the value being read from the query parameter named after the label by default. All the enforced labels are required. Can be repeated.")
+	flagset.Var(labelMatchTypes, "label-match-type", "The type of the matcher enforcing a label (the -label flag or an additional label) in the name:type form where type is one of =, != or !~ (e.g. namespace:!= enforces namespace!=\"<value>\"). "+
+		"With a negative matcher, the proxy gives access to the series which don't match the value and the Alertmanager APIs are disabled. Can be repeated.")
+	flagset.StringVar(&allowedLabelValuesFile, "allowed-label-values-file", "", "A file containing allowed label values, one per line (lines starting with # are ignored). Combined with the -allowed-label-value flags.")
+	flagset.BoolVar(&decodeBinaryHeader, "decode-binary-header", false, "When specified and the -header-name flag ends with \"-bin\", the header value is base64-decoded "+
+		"following the gRPC conventions for binary metadata.")
+	flagset.StringVar(&jwksURL, "jwt-jwks-url", "", "When specified, the label value is read from a claim of the JWT bearer token of the Authorization header (e.g. issued by an OpenID provider) "+
+		"whose signature is verified with the keys of this JSON Web Key Set URL. The requests without valid token are rejected with 401. "+
+		"Requires -jwt-claim, -jwt-issuer and -jwt-audience.")
+	flagset.StringVar(&jwtIssuer, "jwt-issuer", "", "The issuer which the 'iss' claim of the JWT bearer tokens must match with -jwt-jwks-url.")
+	flagset.StringVar(&jwtAudience, "jwt-audience", "", "The audience which the 'aud' claim of the JWT bearer tokens must contain with -jwt-jwks-url.")
+	flagset.StringVar(&jwtClaim, "jwt-claim", "", "The claim of the JWT bearer token holding the label value(s) with -jwt-jwks-url, e.g. tenant, groups[] or realm_access.roles. "+
+		"When the claim holds several values, the request may select one of them with the -label-parameter query parameter (or the -label flag), otherwise all of them are enforced.")
+	flagset.DurationVar(&jwksRefreshInterval, "jwt-jwks-refresh-interval", time.Hour, "How often the keys of -jwt-jwks-url are fetched again. The keys are fetched too when a token is signed by an unknown key.")
+	flagset.StringVar(&clientCertLabelField, "client-cert-label-field", "", "When specified, the label value is read from this field of the TLS client certificate verified with -tls-client-ca-file, one of 'cn' (subject common name), 'dns' (SAN DNS name) or 'uri' (SAN URI). "+
+		"The requests without client certificate are rejected with 401.")
+	flagset.StringVar(&clientCertLabelRegex, "client-cert-label-regex", "", "A regular expression selecting the first value of -client-cert-label-field matching it. When it has a capturing group, the label value is the first submatch "+
+		"(e.g. ^spiffe://cluster\\.local/ns/([^/]+)/ extracts the namespace of a SPIFFE ID).")
+	flagset.StringVar(&ldapURL, "ldap-url", "", "When specified, the label values are the values of -ldap-attribute of the entries returned by an LDAP search "+
+		"for the identity read from the -ldap-identity-header header (e.g. the groups of the user). The URL scheme is ldap or ldaps. "+
+		"The requests are rejected with 503 when the LDAP server can't be reached. Requires -ldap-base-dn, -ldap-filter and -ldap-identity-header.")
+	flagset.StringVar(&ldapBindDN, "ldap-bind-dn", "", "The DN used to bind to the LDAP server. The bind is anonymous when empty.")
+	flagset.StringVar(&ldapBindPasswordFile, "ldap-bind-password-file", "", "The file containing the password used to bind to the LDAP server with -ldap-bind-dn.")
+	flagset.StringVar(&ldapCAFile, "ldap-ca-file", "", "The file containing the CA certificates verifying the certificate of the LDAP server with an ldaps URL. "+
+		"Defaults to the system CA certificates.")
+	flagset.StringVar(&ldapBaseDN, "ldap-base-dn", "", "The base DN of the LDAP search, e.g. ou=groups,dc=example,dc=com.")
+	flagset.StringVar(&ldapFilter, "ldap-filter", "", "The filter of the LDAP search in which %s is replaced by the escaped identity, "+
+		"e.g. (&(objectClass=groupOfNames)(member=uid=%s,ou=users,dc=example,dc=com)).")
+	flagset.StringVar(&ldapAttribute, "ldap-attribute", "cn", "The attribute of the LDAP entries holding the label values.")
+	flagset.StringVar(&ldapIdentityHeader, "ldap-identity-header", "", "The HTTP header holding the identity looked up with -ldap-url (e.g. X-Forwarded-User set by an authenticating proxy).")
+	flagset.DurationVar(&ldapCacheTTL, "ldap-cache-ttl", time.Minute, "How long the label values resolved with -ldap-url are cached for an identity.")
 	flagset.BoolVar(&enableLabelAPIs, "enable-label-apis", false, "When specified proxy allows to inject label to label APIs like /api/v1/labels and /api/v1/label/<name>/values."+
 		"NOTE: Enable with care. Selection of matcher is still in development, see https://github.com/thanos-io/thanos/issues/3351 and https://github.com/prometheus/prometheus/issues/6178. If enabled and"+
 		"any labels endpoint does not support selectors, injected matcher will be silently dropped.")
+	flagset.BoolVar(&enableGrafanaQueries, "enable-grafana-ds-query", false, "When specified, the label is enforced on the Grafana datasource query endpoint (POST /api/ds/query) for a Grafana instance proxied through prom-label-proxy. "+
+		"The label is injected into the PromQL expression (expr field) of every query and the requests with queries without expression are rejected.")
+	flagset.BoolVar(&enableGrafanaLive, "enable-grafana-live", false, "When specified, the WebSocket connections of Grafana Live (/api/live/ws) are forwarded once the label value is validated on the upgrade request. "+
+		"The messages exchanged over the connections aren't enforced.")
 	flagset.StringVar(&unsafePassthroughPaths, "unsafe-passthrough-paths", "", "Comma delimited allow list of exact HTTP path segments should be allowed to hit upstream URL without any enforcement."+
 		"This option is checked after Prometheus APIs, you can cannot override enforced API to be not enforced with this option. Use carefully as it can easily cause a data leak if the provided path is an important"+
 		"API like targets or configuration. NOTE: \"all\" matching paths like \"/\" or \"\" and regex are not allowed.")
+	flagset.StringVar(&defaultRouteAction, "default-route-action", "deny", "What happens to the requests to the paths the proxy has no route for. "+
+		"One of 'deny' (the request is rejected with 404) or 'proxy' (the request is forwarded to the upstream without any enforcement). The disabled endpoints of the proxy (e.g. the label APIs) are always denied.")
+
+	flagset.BoolVar(&strictQueryResults, "strict-query-results", false, "When specified, the proxy verifies that every series returned by the /api/v1/query and /api/v1/query_range "+
+		"endpoints carries the enforced label value and returns an error instead of the result if any series doesn't (e.g. series produced by functions dropping the label).")
+	flagset.BoolVar(&partialQueryResults, "partial-query-results", false, "When specified, the series which don't carry the enforced label value are removed from the partial results of the /api/v1/query and /api/v1/query_range endpoints "+
+		"(successful responses with warnings, e.g. Thanos partial responses) and a warning is appended, instead of the request failing with -strict-query-results. The warnings of the upstream are preserved.")
+	flagset.BoolVar(&rulesWithActiveAlerts, "rules-with-active-alerts", false, "When true, the proxy will return alerting rules with active alerts matching the tenant label even when the tenant label isn't present in the rule's labels. "+
+		"This has no effect on requests asking to exclude the alerts from the /api/v1/rules response (exclude_alerts=true): only rules with the tenant label are returned in this case.")
+	flagset.BoolVar(&scopeRecordingQueries, "scope-recording-rule-queries", false, "When specified, the proxy injects the label matcher into the query expressions of the recording rules returned by the /api/v1/rules endpoint.")
+	flagset.BoolVar(&scopeAlertingQueries, "scope-alerting-rule-queries", false, "When specified, the proxy injects the label matcher into the query expressions of the alerting rules returned by the /api/v1/rules endpoint.")
+	flagset.BoolVar(&passthroughOptions, "passthrough-options", false, "When specified, the OPTIONS requests (e.g. CORS preflight requests) are forwarded to the upstream without label enforcement, the query string and body being dropped. Otherwise they are rejected like other requests without label value.")
+	flagset.BoolVar(&strictAlerts, "strict-alerts", false, "When specified, the alerts whose annotations or generator URL reference another value of the label than the alert's value (e.g. 'namespace=\"other\"' in the expression) are also dropped.")
+	flagset.BoolVar(&scopedAlertReferences, "scoped-alert-references", false, "When specified, the IDs of the silences and inhibiting alerts which don't match the label are removed from the silencedBy and inhibitedBy fields of the Alertmanager alerts.")
+	flagset.BoolVar(&alertsErrorOnReplace, "alerts-error-on-replace", false, "When specified, the alerts pushed to Alertmanager (POST /api/v2/alerts) with another value of the label are rejected. Otherwise the value is replaced by the enforced one.")
+	flagset.BoolVar(&matchErrorOnConflict, "match-error-on-conflict", false, "When specified, the requests with a 'match[]' selector having a matcher on the label which doesn't match the enforced value are rejected. Otherwise the enforced matcher is added and the selector matches nothing.")
+	flagset.BoolVar(&silenceErrorOnReplace, "silences-error-on-replace", false, "When specified, the silences created or updated through Alertmanager (POST /api/v2/silences) with another matcher on the label than the enforced one are rejected. Otherwise the matcher is replaced by the enforced one.")
+	flagset.BoolVar(&filteredCountHeader, "filtered-count-header", false, "When specified, the number of rules or alerts removed from the response by the proxy is returned in the X-Filtered-Count header.")
+	flagset.BoolVar(&filteringTrailers, "filtering-trailers", false, "When specified, the label value and the number of items removed from the streamed responses by the proxy are returned in the X-Enforced-Label and X-Filtered-Count trailers to HTTP/2 clients.")
+	flagset.BoolVar(&emptyResponseResults, "empty-response-as-empty-result", false, "When specified, a 200 response without body from the upstream is returned as an empty result for the endpoints filtered by the proxy. Otherwise the proxy returns a 502 error.")
+	flagset.BoolVar(&filteringWarnings, "filtering-warnings", false, "When specified, a warning is added to the rules and alerts responses when none of the items returned by the upstream match the label value.")
+	flagset.BoolVar(&genericWarnings, "generic-warnings", false, "When specified, the warnings of the upstream responses filtered by the proxy (including the query responses) are replaced with a single generic warning, "+
+		"since the warnings of partial responses (e.g. of Thanos) may name the failed stores and disclose the backend topology.")
+	flagset.StringVar(&redactWarningsRegex, "redact-warnings-regex", "", "When specified, the parts of the warnings of the upstream responses filtered by the proxy (including the query responses) matching this regular expression "+
+		"(e.g. the addresses of the Thanos stores) are replaced with '<redacted>'.")
+	flagset.BoolVar(&recompressResponses, "recompress-responses", false, "When specified, the responses modified by the proxy (e.g. filtered rules and alerts) are gzip-encoded if the upstream response was compressed and the client accepts gzip.")
+	flagset.IntVar(&maxEstimatedSeries, "max-estimated-series", 0, "When specified, the number of series selected by each range query is estimated with a cheap instant query counting the series of its (enforced) selectors at the end of the range, "+
+		"and the range queries selecting more series are rejected. This adds a request to the upstream per range query. 0 disables the estimate.")
+	flagset.IntVar(&maxMatchSelectors, "max-match-selectors", 0, "Maximum number of match[] selectors allowed in a request (e.g. to /api/v1/series). Requests with more selectors are rejected. 0 means no limit.")
+	flagset.IntVar(&maxQuerySelectors, "max-query-selectors", 0, "Maximum number of selectors allowed in a PromQL query. Queries with more selectors are rejected. 0 means no limit.")
+	flagset.IntVar(&maxQueryDepth, "max-query-depth", 0, "Maximum nesting depth allowed in a PromQL query (e.g. 'sum(rate(up[5m]))' has a depth of 4). Deeper queries are rejected. 0 means no limit.")
+	flagset.BoolVar(&forbidBareNameRegex, "forbid-bare-name-regex", false, "When specified, selectors with a matcher on the metric name which is too broad (e.g. '{__name__=~\".+\"}' or '{__name__!=\"\"}') are rejected. "+
+		"Negative matchers on the metric name are always rejected and regular expressions are only accepted when they match a finite set of names (e.g. 'foo|bar'), unless -name-regex-min-prefix is set.")
+	flagset.IntVar(&nameRegexMinPrefix, "name-regex-min-prefix", 0, "With -forbid-bare-name-regex, the minimum length of the literal prefix of the regular expressions on the metric name (e.g. 'node_.*' has a prefix of 5 characters). 0 means that only alternations of metric names are allowed.")
+	flagset.BoolVar(&enforceVectorMatching, "enforce-vector-matching", false, "When specified, the label is added to the 'on()' clauses and removed from the 'ignoring()' clauses of the binary operations between vectors, so that the series are only matched when they have the same label value.")
+	flagset.BoolVar(&enforceGrouping, "enforce-grouping", false, "When specified, the label is added to the 'by()' clauses and removed from the 'without()' clauses of the aggregations, so that their results keep the label (e.g. when they are federated). This changes the grouping of the results.")
+	flagset.BoolVar(&filterFederation, "filter-federation", false, "When specified, the samples of the /federate responses without the label value are dropped, in case the upstream ignores the injected selectors. The text exposition format is then always requested from the upstream.")
+	flagset.DurationVar(&queryCacheTTL, "query-cache-ttl", 0, "When specified, the responses of the /api/v1/query and /api/v1/query_range endpoints are cached for this duration by label value and query, "+
+		"the time parameters being rounded to this duration. The Cache-Control header of the requests and responses is honored. 0 disables the cache.")
+	flagset.IntVar(&queryCacheSize, "query-cache-size", 1000, "Maximum number of responses kept in the query cache.")
+	flagset.DurationVar(&maxQueryTimeout, "max-query-timeout", 0, "Maximum evaluation timeout of the query and range query requests. Greater 'timeout' parameters are lowered to this value and the parameter is set when missing. 0 means no limit.")
+	flagset.DurationVar(&maxQueryTimePast, "max-query-time-past", 0, "Maximum duration between the 'time' parameter of the /api/v1/query requests and the current time for the times in the past (e.g. the retention). Older times are rejected. 0 means no limit.")
+	flagset.DurationVar(&maxQueryTimeFuture, "max-query-time-future", 0, "Maximum duration between the current time and the 'time' parameter of the /api/v1/query requests for the times in the future (e.g. the allowed clock skew). Later times are rejected. 0 means no limit.")
+	flagset.BoolVar(&skipIfLabelPresent, "skip-if-label-present", false, "When specified, the label isn't injected into the selectors which already have a matcher on the label, whatever its value. "+
+		"WARNING: the existing matcher is trusted, use only when the requests were already enforced by another proxy (e.g. chained prom-label-proxy instances).")
+	flagset.BoolVar(&collapseMatchers, "collapse-identical-matchers", false, "When specified, the enforced matcher isn't injected into the match[] selectors which already have an identical matcher, avoiding duplicated matchers in the selectors sent upstream.")
+	flagset.StringVar(&matcherPosition, "enforced-matcher-position", "", "The position of the enforced matchers in the selectors sent upstream, e.g. for tools parsing the upstream query logs. "+
+		"One of 'first' or 'last'. By default, the matchers of the PromQL queries are sorted and the enforced matchers are appended to the match[] selectors.")
+	flagset.DurationVar(&maxSilenceDuration, "max-silence-duration", 0, "Maximum duration of the Alertmanager silences created or updated through the proxy. Longer silences are rejected. 0 means no limit.")
+	flagset.IntVar(&noScopeStatusCode, "no-scope-status-code", http.StatusBadRequest, "The HTTP status code returned when the request carries no label value. "+
+		"One of 400, 401 or 403, allowing clients to distinguish this case from authentication and authorization failures.")
+	flagset.StringVar(&alertsByFingerprint, "alerts-by-fingerprint-path", "", "When specified, the label is enforced on this Alertmanager path taking a list of alert fingerprints in the 'fingerprint' query parameter. "+
+		"The fingerprints of alerts which don't match the label are removed from the request.")
+	flagset.Var(selectorPaths, "selector-path", "An additional endpoint taking series selectors on which the label is enforced in the path=param form (e.g. /custom/selectors=sel[]). "+
+		"The label is injected into each value of the parameter before forwarding the request. Can be repeated.")
+	flagset.Var(jsonSelectorPaths, "json-selector-path", "An additional POST endpoint taking series selectors in a JSON body on which the label is enforced in the path=JSONPath form "+
+		"(e.g. /custom/batch=$[*][\"match[]\"] for a body like [{\"match[]\": [\"up\"]}]). The JSONPath expression selects the selectors or arrays of selectors in the body, "+
+		"it supports the child (.name or [\"name\"]) and wildcard ([*]) operators. The label is injected into every selector and the requests for which the expression selects nothing are rejected. Can be repeated.")
+	flagset.Var(jsonExpressionPaths, "json-expression-path", "An additional POST endpoint taking PromQL expressions in a JSON body on which the label is enforced in the path=JSONPath form, "+
+		"e.g. a rule test or preview endpoint (/api/v1/rule/test=$.rules[*].expr). The label is injected into every expression selected like for the query endpoints "+
+		"and the requests for which the expression selects nothing are rejected. Can be repeated.")
+	flagset.Var(processingTimeouts, "processing-timeout", "A timeout of the total processing of the requests to an endpoint in the path=duration form (e.g. /api/v1/rules=10s), "+
+		"covering both the upstream request and the filtering of the response. The requests exceeding it get a 504 error. Can be repeated.")
+	flagset.Var(&pathRewrites, "rewrite-path", "A rewrite of the request paths in the from:to form where from is a regular expression matching the whole path and to can reference its capture groups (e.g. ^/prometheus/(.*):/$1). "+
+		"The first matching rewrite is applied before routing the request, so that the label is enforced according to the rewritten path. Can be repeated.")
+	flagset.StringVar(&searchPath, "search-path", "", "When specified, the label is enforced on this search endpoint returning metric names (e.g. for autocompletion). "+
+		"Only the metric names having series matching the label are returned.")
+	flagset.StringVar(&rulesAlertsPath, "rules-alerts-path", "", "When specified, the label is enforced on this endpoint returning both the rule groups and the alerts in the same response (e.g. for dashboards). "+
+		"The groups and alerts fields of the data are filtered like the /api/v1/rules and /api/v1/alerts responses.")
+	flagset.BoolVar(&stripIntrospection, "strip-query-introspection", false, "When specified, the 'stats', 'explain' and 'analyze' parameters are removed from the query requests and the query statistics and plans from the responses. "+
+		"Query statistics reveal the backend timings and cardinalities while Thanos query plans may reveal the store topology and the external labels of other tenants.")
+	flagset.BoolVar(&stripQueryExplanation, "strip-query-explanation", false, "Deprecated: use -strip-query-introspection.")
+	flagset.StringVar(&auditLogFile, "audit-log-file", "", "When specified, an audit record is appended to this file for every query, range query and series request forwarded upstream. "+
+		"The record contains the exact query string and body sent upstream, the label value and where it was read from.")
+	flagset.IntVar(&maxHeaderBytes, "max-header-bytes", 0, "When specified, maximum size in bytes of the request headers, including the request line. Defaults to the 1MiB limit of the Go HTTP server.")
+	flagset.IntVar(&maxHeaders, "max-headers", 0, "When specified, maximum number of header values in a request. Requests with more headers are rejected with 431. 0 means no limit.")
+	flagset.BoolVar(&noForwardedHeaders, "disable-forwarded-headers", false, "When specified, the X-Forwarded-For, X-Forwarded-Host and X-Forwarded-Proto headers aren't sent upstream (e.g. to not disclose the client IP addresses).")
+	flagset.IntVar(&streamingThreshold, "streaming-threshold", 0, "Size in bytes above which the rules and alerts responses are filtered while being streamed to the client instead of being decoded as a whole (the responses of unknown size are always streamed). "+
+		"Streamed responses don't support the -filtered-count-header flag. 0 disables streaming.")
+	flagset.IntVar(&responseBufferLimit, "response-buffer-limit", 32<<20, "Size in bytes above which the responses filtered by the proxy are buffered in a temporary file instead of memory.")
+	flagset.StringVar(&injectionMarkerKeyFile, "injection-marker-key-file", "", "Path to a file containing the key authenticating the queries already enforced by another prom-label-proxy instance sharing the same key. "+
+		"When specified, the forwarded query requests are marked with the enforced labels and the query requests marked with the label and value are forwarded without re-enforcing them "+
+		"(e.g. for the sub-queries of a Thanos query-frontend placed between two instances or for instances chained to enforce different labels).")
+	flagset.StringVar(&logFormat, "log-format", "", "The format of the logs, one of 'logfmt' or 'json'. When specified, the logs are structured and a line is logged for every request with its ID, method, path, route, label value, status code, upstream status code, duration and error. "+
+		"The ID is read from the X-Request-Id header of the request or generated, and set on the upstream request and the response.")
+	flagset.StringVar(&logLevel, "log-level", "info", "The minimum level of the structured logs, one of 'debug', 'info', 'warn' or 'error'. The requests rejected with a 4xx status code are logged at warn level and with a 5xx status code at error level.")
+	flagset.BoolVar(&logRedactLabelValues, "log-redact-label-values", false, "When specified, the label values of the request logs are replaced by a hash of the value.")
+	flagset.StringVar(&tracingEndpoint, "tracing-otlp-endpoint", "", "The host:port of the OTLP/HTTP endpoint receiving the traces. When specified, the requests are traced with a span for the label value extraction, "+
+		"one for the label injection and one for the upstream request, and the trace context of the requests is propagated to the upstream.")
+	flagset.BoolVar(&tracingInsecure, "tracing-otlp-insecure", false, "When specified, the traces are sent to the OTLP endpoint over plain HTTP.")
+	flagset.BoolVar(&tracingLabelValues, "tracing-record-label-values", false, "When specified, the enforced label values are recorded on the label value extraction span.")
+	flagset.BoolVar(&debug, "debug", false, "When specified, debug logs are enabled.")
 
 	//nolint: errcheck // Parse() will exit on error.
 	flagset.Parse(os.Args[1:])
-	if label == "" {
+
+	var logger *injectproxy.Logger
+	if logFormat != "" {
+		level, err := injectproxy.ParseLogLevel(logLevel)
+		if err != nil {
+			log.Fatalf("Invalid -log-level flag: %v", err)
+		}
+		if debug {
+			level = injectproxy.LogLevelDebug
+		}
+		logger, err = injectproxy.NewLogger(os.Stderr, injectproxy.LogFormat(logFormat), level)
+		if err != nil {
+			log.Fatalf("Invalid -log-format flag: %v", err)
+		}
+		log.SetFlags(0)
+		log.SetOutput(logger)
+	}
+
+	cmdline := map[string]struct{}{}
+	flagset.Visit(func(f *flag.Flag) {
+		cmdline[f.Name] = struct{}{}
+	})
+	base := reloadableConfig{
+		label:                  label,
+		labelParameter:         labelParameter,
+		headerName:             headerName,
+		allowedLabelValues:     allowedLabelValues,
+		enableLabelAPIs:        enableLabelAPIs,
+		rulesWithActiveAlerts:  rulesWithActiveAlerts,
+		alertsErrorOnReplace:   alertsErrorOnReplace,
+		silencesErrorOnReplace: silenceErrorOnReplace,
+		matchErrorOnConflict:   matchErrorOnConflict,
+	}
+	file, current := &fileConfig{}, base
+	if configFile != "" {
+		var err error
+		if file, err = loadConfig(configFile); err != nil {
+			log.Fatalf("Failed to load the configuration file: %v", err)
+		}
+		if err := file.apply(flagset, cmdline); err != nil {
+			log.Fatalf("Failed to load the configuration file: %v", err)
+		}
+		if current, err = base.merge(file, cmdline); err != nil {
+			log.Fatalf("Failed to load the configuration file: %v", err)
+		}
+	}
+	if current.label == "" {
 		log.Fatalf("-label flag cannot be empty")
 	}
 
+	var jwks *injectproxy.JWKS
+	if jwksURL != "" {
+		if jwtClaim == "" {
+			log.Fatalf("-jwt-jwks-url flag requires -jwt-claim")
+		}
+		if jwtIssuer == "" || jwtAudience == "" {
+			log.Fatalf("-jwt-jwks-url flag requires -jwt-issuer and -jwt-audience")
+		}
+		if headerName != "" {
+			log.Fatalf("-jwt-jwks-url and -header-name flags are mutually exclusive")
+		}
+		jwks = injectproxy.NewJWKS(jwksURL)
+		jwks.RefreshInterval = jwksRefreshInterval
+	}
+
+	var clientCert *injectproxy.ClientCertEnforcer
+	if clientCertLabelField != "" {
+		switch f := injectproxy.ClientCertField(clientCertLabelField); f {
+		case injectproxy.ClientCertCommonName, injectproxy.ClientCertDNSName, injectproxy.ClientCertURI:
+			clientCert = &injectproxy.ClientCertEnforcer{Field: f}
+		default:
+			log.Fatalf("Invalid -client-cert-label-field %q, expected cn, dns or uri", clientCertLabelField)
+		}
+		if secureListenAddress == "" || tlsConfig.clientCAFile == "" {
+			log.Fatalf("-client-cert-label-field flag requires -secure-listen-address and -tls-client-ca-file")
+		}
+		if jwks != nil || headerName != "" {
+			log.Fatalf("-client-cert-label-field flag is mutually exclusive with -jwt-jwks-url and -header-name")
+		}
+		if clientCertLabelRegex != "" {
+			re, err := regexp.Compile(clientCertLabelRegex)
+			if err != nil {
+				log.Fatalf("Invalid -client-cert-label-regex: %v", err)
+			}
+			clientCert.Regexp = re
+		}
+	}
+
+	var ldapResolver injectproxy.LabelValueResolver
+	if ldapURL != "" {
+		if ldapBaseDN == "" || ldapFilter == "" || ldapIdentityHeader == "" {
+			log.Fatalf("-ldap-url flag requires -ldap-base-dn, -ldap-filter and -ldap-identity-header")
+		}
+		if !strings.Contains(ldapFilter, "%s") {
+			log.Fatalf("-ldap-filter flag must contain %%s")
+		}
+		if err := injectproxy.CheckLDAPFilter(fmt.Sprintf(ldapFilter, "x")); err != nil {
+			log.Fatalf("Invalid -ldap-filter: %v", err)
+		}
+		if jwks != nil || clientCert != nil || headerName != "" {
+			log.Fatalf("-ldap-url flag is mutually exclusive with -jwt-jwks-url, -client-cert-label-field and -header-name")
+		}
+		u, err := url.Parse(ldapURL)
+		if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			log.Fatalf("Invalid -ldap-url %q, expected ldap://<host>[:<port>] or ldaps://<host>[:<port>]", ldapURL)
+		}
+
+		dialer := &injectproxy.LDAPDialer{URL: ldapURL, BindDN: ldapBindDN}
+		if ldapBindPasswordFile != "" {
+			b, err := ioutil.ReadFile(ldapBindPasswordFile)
+			if err != nil {
+				log.Fatalf("Failed to read -ldap-bind-password-file: %v", err)
+			}
+			dialer.BindPassword = strings.TrimSpace(string(b))
+		}
+		if ldapCAFile != "" {
+			pool, err := readCAFile(ldapCAFile)
+			if err != nil {
+				log.Fatalf("Failed to read -ldap-ca-file: %v", err)
+			}
+			dialer.TLSConfig = &tls.Config{RootCAs: pool}
+		}
+		ldapResolver = injectproxy.NewCachingResolver(&injectproxy.LDAPResolver{
+			Dial:         dialer.Dial,
+			BaseDN:       ldapBaseDN,
+			Filter:       ldapFilter,
+			Attribute:    ldapAttribute,
+			MaxIdleConns: 4,
+		}, ldapCacheTTL)
+	}
+
+	if secureListenAddress != "" && (tlsConfig.certFile == "" || tlsConfig.keyFile == "") {
+		log.Fatalf("-secure-listen-address flag requires -tls-cert-file and -tls-key-file")
+	}
+
+	if enableExplainEndpoint && internalListenAddress == "" {
+		log.Fatalf("-enable-explain-endpoint flag requires -internal-listen-address")
+	}
+
 	upstreamURL, err := url.Parse(upstream)
 	if err != nil {
 		log.Fatalf("Failed to build parse upstream URL: %v", err)
@@ -64,33 +485,410 @@ func main() {
 		log.Fatalf("Invalid scheme for upstream URL %q, only 'http' and 'https' are supported", upstream)
 	}
 
-	var opts []injectproxy.Option
-	if enableLabelAPIs {
-		opts = append(opts, injectproxy.WithEnabledLabelsAPI())
+	metrics := injectproxy.NewMetrics(metricsConstLabels)
+	opts := []injectproxy.Option{injectproxy.WithMetrics(metrics)}
+	conflictPolicy, err := injectproxy.ParseConflictPolicy(labelConflictPolicy)
+	if err != nil {
+		log.Fatalf("Invalid -label-conflict-policy flag: %v", err)
+	}
+	var fileLabelValues []string
+	if allowedLabelValuesFile != "" {
+		if fileLabelValues, err = readLabelValues(allowedLabelValuesFile); err != nil {
+			log.Fatalf("Failed to read allowed label values file: %v", err)
+		}
+	}
+	for _, l := range additionalLabels {
+		opts = append(opts, injectproxy.WithAdditionalLabel(l.name, l.el))
+	}
+	for name, t := range labelMatchTypes {
+		opts = append(opts, injectproxy.WithEnforcedMatchType(name, t))
+	}
+	if len(labelValueTransforms.transforms) > 0 {
+		opts = append(opts, injectproxy.WithLabelValueTransform(injectproxy.ChainLabelValueTransforms(labelValueTransforms.transforms...)))
+	}
+	if enableGrafanaQueries {
+		opts = append(opts, injectproxy.WithGrafanaQueries())
+	}
+	if enableGrafanaLive {
+		opts = append(opts, injectproxy.WithGrafanaLive())
 	}
 	if len(unsafePassthroughPaths) > 0 {
 		opts = append(opts, injectproxy.WithPassthroughPaths(strings.Split(unsafePassthroughPaths, ",")))
 	}
-	routes, err := injectproxy.NewRoutes(upstreamURL, label, opts...)
-	if err != nil {
+	switch defaultRouteAction {
+	case "deny":
+	case "proxy":
+		opts = append(opts, injectproxy.WithUnknownPathsProxied())
+	default:
+		log.Fatalf("Invalid -default-route-action flag: %q, expected 'deny' or 'proxy'", defaultRouteAction)
+	}
+	switch matcherPosition {
+	case "":
+	case "first":
+		opts = append(opts, injectproxy.WithEnforcedMatcherPosition(injectproxy.MatcherPositionFirst))
+	case "last":
+		opts = append(opts, injectproxy.WithEnforcedMatcherPosition(injectproxy.MatcherPositionLast))
+	default:
+		log.Fatalf("Invalid -enforced-matcher-position flag: %q, expected 'first' or 'last'", matcherPosition)
+	}
+	if partialQueryResults {
+		opts = append(opts, injectproxy.WithPartialQueryResults())
+	}
+	if strictQueryResults {
+		opts = append(opts, injectproxy.WithStrictQueryResults())
+	}
+	if scopeRecordingQueries {
+		opts = append(opts, injectproxy.WithScopedRecordingRuleQueries())
+	}
+	if scopeAlertingQueries {
+		opts = append(opts, injectproxy.WithScopedAlertingRuleQueries())
+	}
+	if passthroughOptions {
+		opts = append(opts, injectproxy.WithOptionsPassthrough())
+	}
+	if strictAlerts {
+		opts = append(opts, injectproxy.WithStrictAlerts())
+	}
+	if scopedAlertReferences {
+		opts = append(opts, injectproxy.WithScopedAlertReferences())
+	}
+	if emptyResponseResults {
+		opts = append(opts, injectproxy.WithEmptyResponsesAsEmptyResults())
+	}
+	if recompressResponses {
+		opts = append(opts, injectproxy.WithRecompressedResponses())
+	}
+	if filteredCountHeader {
+		opts = append(opts, injectproxy.WithFilteredCountHeader())
+	}
+	if filteringTrailers {
+		opts = append(opts, injectproxy.WithFilteringTrailers())
+	}
+	if filteringWarnings {
+		opts = append(opts, injectproxy.WithFilteringWarnings())
+	}
+	if genericWarnings {
+		opts = append(opts, injectproxy.WithGenericWarnings())
+	}
+	if redactWarningsRegex != "" {
+		re, err := regexp.Compile(redactWarningsRegex)
+		if err != nil {
+			log.Fatalf("Invalid -redact-warnings-regex flag: %v", err)
+		}
+		opts = append(opts, injectproxy.WithRedactedWarnings(re))
+	}
+	if maxEstimatedSeries > 0 {
+		opts = append(opts, injectproxy.WithMaxEstimatedSeries(maxEstimatedSeries))
+	}
+	if maxMatchSelectors > 0 {
+		opts = append(opts, injectproxy.WithMaxMatchSelectors(maxMatchSelectors))
+	}
+	if maxQuerySelectors > 0 || maxQueryDepth > 0 {
+		opts = append(opts, injectproxy.WithQueryComplexityLimits(maxQuerySelectors, maxQueryDepth))
+	}
+	if forbidBareNameRegex {
+		opts = append(opts, injectproxy.WithForbiddenBroadNameMatchers(nameRegexMinPrefix))
+	}
+	if enforceVectorMatching {
+		opts = append(opts, injectproxy.WithEnforcedVectorMatching())
+	}
+	if enforceGrouping {
+		opts = append(opts, injectproxy.WithEnforcedGrouping())
+	}
+	if filterFederation {
+		opts = append(opts, injectproxy.WithFederationFiltering())
+	}
+	if queryCacheTTL > 0 {
+		opts = append(opts, injectproxy.WithQueryCache(queryCacheTTL, queryCacheSize))
+	}
+	if maxSilenceDuration > 0 {
+		opts = append(opts, injectproxy.WithMaxSilenceDuration(maxSilenceDuration))
+	}
+	if maxQueryTimeout > 0 {
+		opts = append(opts, injectproxy.WithMaxQueryTimeout(maxQueryTimeout))
+	}
+	if maxQueryTimePast > 0 || maxQueryTimeFuture > 0 {
+		opts = append(opts, injectproxy.WithQueryTimeWindow(maxQueryTimePast, maxQueryTimeFuture))
+	}
+	if skipIfLabelPresent {
+		opts = append(opts, injectproxy.WithSkipIfLabelPresent())
+	}
+	if collapseMatchers {
+		opts = append(opts, injectproxy.WithCollapsedMatchers())
+	}
+	opts = append(opts, injectproxy.WithNoScopeStatusCode(noScopeStatusCode))
+	if upstreamHTTPProxy != "" && upstreamNoProxy {
+		log.Fatalf("-upstream-http-proxy and -upstream-no-proxy flags are mutually exclusive")
+	}
+	if upstreamHTTPProxy != "" {
+		proxyURL, err := url.Parse(upstreamHTTPProxy)
+		if err != nil {
+			log.Fatalf("Failed to parse upstream HTTP proxy URL: %v", err)
+		}
+		opts = append(opts, injectproxy.WithUpstreamProxy(http.ProxyURL(proxyURL)))
+	}
+	if upstreamNoProxy {
+		opts = append(opts, injectproxy.WithUpstreamProxy(func(*http.Request) (*url.URL, error) { return nil, nil }))
+	}
+	if upstreamTLS != (injectproxy.UpstreamTLSConfig{}) {
+		opts = append(opts, injectproxy.WithUpstreamTLS(upstreamTLS))
+	}
+	for _, rw := range pathRewrites {
+		opts = append(opts, injectproxy.WithPathRewrite(rw[0], rw[1]))
+	}
+	if len(selectorPaths) > 0 {
+		opts = append(opts, injectproxy.WithSelectorPaths(selectorPaths))
+	}
+	if len(jsonSelectorPaths) > 0 {
+		opts = append(opts, injectproxy.WithJSONSelectorPaths(jsonSelectorPaths))
+	}
+	if len(jsonExpressionPaths) > 0 {
+		opts = append(opts, injectproxy.WithJSONExpressionPaths(jsonExpressionPaths))
+	}
+	if len(processingTimeouts) > 0 {
+		opts = append(opts, injectproxy.WithProcessingTimeouts(processingTimeouts))
+	}
+	switch upstreamAuthorization {
+	case "passthrough":
+	case "strip":
+		opts = append(opts, injectproxy.WithStrippedAuthorization())
+	case "replace":
+		if upstreamTokenFile == "" {
+			log.Fatalf("-upstream-authorization=replace requires -upstream-bearer-token-file")
+		}
+		opts = append(opts, injectproxy.WithUpstreamBearerTokenFile(upstreamTokenFile))
+	default:
+		log.Fatalf("Invalid -upstream-authorization flag %q, expected one of passthrough, strip or replace", upstreamAuthorization)
+	}
+	if shadowUpstream != "" {
+		shadowURL, err := url.Parse(shadowUpstream)
+		if err != nil {
+			log.Fatalf("Failed to parse shadow upstream URL: %v", err)
+		}
+		if shadowURL.Scheme != "http" && shadowURL.Scheme != "https" {
+			log.Fatalf("Invalid scheme for shadow upstream URL %q, only 'http' and 'https' are supported", shadowUpstream)
+		}
+		opts = append(opts, injectproxy.WithShadowUpstream(shadowURL))
+	}
+	if eventWebhookURL != "" {
+		u, err := url.Parse(eventWebhookURL)
+		if err != nil {
+			log.Fatalf("Failed to parse event webhook URL: %v", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			log.Fatalf("Invalid scheme for event webhook URL %q, only 'http' and 'https' are supported", eventWebhookURL)
+		}
+		opts = append(opts, injectproxy.WithEventSink(&injectproxy.WebhookSink{URL: eventWebhookURL}))
+	}
+	if searchPath != "" {
+		opts = append(opts, injectproxy.WithSearchPath(searchPath))
+	}
+	if rulesAlertsPath != "" {
+		opts = append(opts, injectproxy.WithRulesAndAlertsPath(rulesAlertsPath))
+	}
+	if alertsByFingerprint != "" {
+		opts = append(opts, injectproxy.WithAlertsByFingerprintPath(alertsByFingerprint))
+	}
+	if stripIntrospection || stripQueryExplanation {
+		opts = append(opts, injectproxy.WithStripQueryIntrospection())
+	}
+	if auditLogFile != "" {
+		f, err := os.OpenFile(auditLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatalf("Failed to open audit log file: %v", err)
+		}
+		defer f.Close()
+		opts = append(opts, injectproxy.WithAuditLog(f))
+	}
+	if maxHeaders > 0 {
+		opts = append(opts, injectproxy.WithMaxHeaders(maxHeaders))
+	}
+	if noForwardedHeaders {
+		opts = append(opts, injectproxy.WithDisabledForwardedHeaders())
+	}
+	opts = append(opts, injectproxy.WithResponseBufferLimit(responseBufferLimit))
+	if streamingThreshold > 0 {
+		opts = append(opts, injectproxy.WithStreamingThreshold(streamingThreshold))
+	}
+	if injectionMarkerKeyFile != "" {
+		key, err := ioutil.ReadFile(injectionMarkerKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to read injection marker key file: %v", err)
+		}
+		key = bytes.TrimSpace(key)
+		if len(key) == 0 {
+			log.Fatalf("Injection marker key file %q is empty", injectionMarkerKeyFile)
+		}
+		opts = append(opts, injectproxy.WithInjectionMarker(key))
+	}
+	if debug {
+		opts = append(opts, injectproxy.WithDebugLogging())
+	}
+	if logger != nil {
+		opts = append(opts, injectproxy.WithRequestLog(logger, logRedactLabelValues))
+	}
+	var tp *sdktrace.TracerProvider
+	if tracingEndpoint != "" {
+		tp, err = newTracerProvider(tracingEndpoint, tracingInsecure)
+		if err != nil {
+			log.Fatalf("Failed to create the tracer provider: %v", err)
+		}
+		opts = append(opts, injectproxy.WithTracerProvider(tp))
+		if tracingLabelValues {
+			opts = append(opts, injectproxy.WithLabelValuesInSpans())
+		}
+	}
+
+	// The routes are built again with the settings which can be reloaded
+	// from the configuration file.
+	extract := func(c reloadableConfig) (injectproxy.ExtractLabeler, error) {
+		switch {
+		case clientCert != nil:
+			return *clientCert, nil
+		case jwks != nil:
+			param := c.labelParameter
+			if param == "" {
+				param = c.label
+			}
+			return injectproxy.JWTEnforcer{Keys: jwks, Issuer: jwtIssuer, Audience: jwtAudience, Claim: jwtClaim, ParameterName: param}, nil
+		case ldapResolver != nil:
+			param := c.labelParameter
+			if param == "" {
+				param = c.label
+			}
+			return injectproxy.ResolvingEnforcer{
+				Identity:      injectproxy.HTTPHeaderEnforcer{Name: ldapIdentityHeader},
+				Resolver:      ldapResolver,
+				ParameterName: param,
+			}, nil
+		case c.headerName != "" && c.labelParameter != "":
+			return injectproxy.MultiSourceEnforcer{
+				Sources: []injectproxy.ExtractLabeler{
+					injectproxy.HTTPHeaderEnforcer{Name: c.headerName, DecodeBinary: decodeBinaryHeader},
+					injectproxy.HTTPFormEnforcer{ParameterName: c.labelParameter},
+				},
+				Policy: conflictPolicy,
+			}, nil
+		case c.headerName != "":
+			return injectproxy.HTTPHeaderEnforcer{Name: c.headerName, DecodeBinary: decodeBinaryHeader}, nil
+		case c.labelParameter != "":
+			return injectproxy.HTTPFormEnforcer{ParameterName: c.labelParameter}, nil
+		}
+		return injectproxy.HTTPFormEnforcer{ParameterName: c.label}, nil
+	}
+	build := func(c reloadableConfig, el injectproxy.ExtractLabeler) (proxyRoutes, error) {
+		opts := append([]injectproxy.Option(nil), opts...)
+		if values := append(append([]string(nil), c.allowedLabelValues...), fileLabelValues...); values != nil {
+			opts = append(opts, injectproxy.WithAllowedLabelValues(values))
+		}
+		opts = append(opts, injectproxy.WithExtractLabeler(el))
+		if c.enableLabelAPIs {
+			opts = append(opts, injectproxy.WithEnabledLabelsAPI())
+		}
+		if c.rulesWithActiveAlerts {
+			opts = append(opts, injectproxy.WithRulesWithActiveAlerts())
+		}
+		if c.alertsErrorOnReplace {
+			opts = append(opts, injectproxy.WithAlertsErrorOnReplace())
+		}
+		if c.matchErrorOnConflict {
+			opts = append(opts, injectproxy.WithSelectorsErrorOnConflict())
+		}
+		if c.silencesErrorOnReplace {
+			opts = append(opts, injectproxy.WithSilencesErrorOnReplace())
+		}
+		return injectproxy.NewRoutes(upstreamURL, c.label, opts...)
+	}
+	extractor := injectproxy.NewReloadableExtractLabeler(nil)
+	extractor.KeepPrevious = keepConfigOnReloadError
+	routes := &reloadableRoutes{path: configFile, cmdline: cmdline, base: base, extract: extract, build: build, extractor: extractor}
+	if err := routes.swap(file, current); err != nil {
 		log.Fatalf("Failed to create injectproxy Routes: %v", err)
 	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/", routes)
 
-	srv := &http.Server{Handler: mux}
+	srv := &http.Server{Handler: mux, MaxHeaderBytes: maxHeaderBytes}
 
-	l, err := net.Listen("tcp", insecureListenAddress)
-	if err != nil {
-		log.Fatalf("Failed to listen on insecure address: %v", err)
+	errCh := make(chan error)
+	if insecureListenAddress != "" || secureListenAddress == "" {
+		l, err := net.Listen("tcp", insecureListenAddress)
+		if err != nil {
+			log.Fatalf("Failed to listen on insecure address: %v", err)
+		}
+
+		go func() {
+			log.Printf("Listening insecurely on %v", l.Addr())
+			errCh <- srv.Serve(l)
+		}()
 	}
 
-	errCh := make(chan error)
-	go func() {
-		log.Printf("Listening insecurely on %v", l.Addr())
-		errCh <- srv.Serve(l)
-	}()
+	if secureListenAddress != "" {
+		done := make(chan struct{})
+		defer close(done)
+		cfg, err := newTLSConfig(tlsConfig, done)
+		if err != nil {
+			log.Fatalf("Failed to configure TLS: %v", err)
+		}
+
+		secureSrv := &http.Server{Handler: mux, MaxHeaderBytes: maxHeaderBytes}
+		defer secureSrv.Close()
+
+		l, err := net.Listen("tcp", secureListenAddress)
+		if err != nil {
+			log.Fatalf("Failed to listen on secure address: %v", err)
+		}
+
+		go func() {
+			log.Printf("Listening securely on %v", l.Addr())
+			errCh <- secureSrv.Serve(tls.NewListener(l, cfg))
+		}()
+	}
+
+	if internalListenAddress != "" {
+		internalMux := http.NewServeMux()
+		internalMux.Handle("/metrics", metrics)
+		if enableExplainEndpoint {
+			internalMux.Handle("/-/explain", routes.ExplainHandler())
+		}
+
+		internalSrv := &http.Server{Handler: internalMux}
+		defer internalSrv.Close()
+
+		il, err := net.Listen("tcp", internalListenAddress)
+		if err != nil {
+			log.Fatalf("Failed to listen on internal address: %v", err)
+		}
+
+		go func() {
+			log.Printf("Listening on %v for metrics", il.Addr())
+			errCh <- internalSrv.Serve(il)
+		}()
+	}
+
+	if configFile != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				changes, err := routes.reload()
+				if err != nil {
+					if keepConfigOnReloadError || errors.Is(err, errRestartRequired) {
+						log.Printf("Failed to reload the configuration file, keeping the current configuration: %v", err)
+					} else {
+						log.Printf("Failed to reload the configuration file, denying the requests until a valid configuration is loaded: %v", err)
+					}
+					continue
+				}
+				if len(changes) == 0 {
+					log.Print("Reloaded the configuration file without changes")
+					continue
+				}
+				log.Printf("Reloaded the configuration file: %s", strings.Join(changes, ", "))
+			}
+		}()
+	}
 
 	term := make(chan os.Signal, 1)
 	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
@@ -99,6 +897,13 @@ func main() {
 	case <-term:
 		log.Print("Received SIGTERM, exiting gracefully...")
 		srv.Close()
+		if tp != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := tp.Shutdown(ctx); err != nil {
+				log.Printf("Failed to flush the traces: %v", err)
+			}
+		}
 	case err := <-errCh:
 		if err != http.ErrServerClosed {
 			log.Printf("Server stopped with %v", err)
@@ -106,3 +911,265 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// newTracerProvider returns a tracer provider exporting the spans in batches
+// to the OTLP/HTTP endpoint.
+func newTracerProvider(endpoint string, insecure bool) (*sdktrace.TracerProvider, error) {
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("prom-label-proxy"))),
+	), nil
+}
+
+var labelNameRe = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// constLabels is a flag.Value accumulating key=value labels.
+type constLabels map[string]string
+
+func (c constLabels) String() string {
+	pairs := make([]string, 0, len(c))
+	for k, v := range c {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (c constLabels) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid label %q, expected key=value", s)
+	}
+	if !labelNameRe.MatchString(parts[0]) {
+		return fmt.Errorf("invalid label name %q", parts[0])
+	}
+	if _, ok := c[parts[0]]; ok {
+		return fmt.Errorf("duplicate label %q", parts[0])
+	}
+	c[parts[0]] = parts[1]
+	return nil
+}
+
+// additionalLabels is a flag.Value accumulating the additional labels to
+// enforce with the source of their value.
+type additionalLabels []additionalLabel
+
+type additionalLabel struct {
+	spec string
+	name string
+	el   injectproxy.ExtractLabeler
+}
+
+func (a *additionalLabels) String() string {
+	specs := make([]string, 0, len(*a))
+	for _, l := range *a {
+		specs = append(specs, l.spec)
+	}
+	return strings.Join(specs, ",")
+}
+
+func (a *additionalLabels) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if !labelNameRe.MatchString(parts[0]) {
+		return fmt.Errorf("invalid label name %q", parts[0])
+	}
+	l := additionalLabel{spec: v, name: parts[0]}
+	if len(parts) == 2 {
+		source := strings.SplitN(parts[1], ":", 2)
+		if len(source) != 2 || source[1] == "" {
+			return fmt.Errorf("invalid additional label %q, expected name=param:<parameter> or name=header:<header>", v)
+		}
+		switch source[0] {
+		case "param":
+			l.el = injectproxy.HTTPFormEnforcer{ParameterName: source[1]}
+		case "header":
+			l.el = injectproxy.HTTPHeaderEnforcer{Name: source[1]}
+		default:
+			return fmt.Errorf("invalid additional label %q, expected name=param:<parameter> or name=header:<header>", v)
+		}
+	}
+	*a = append(*a, l)
+	return nil
+}
+
+// labelMatchTypes is a flag.Value accumulating name:type matcher types.
+type labelMatchTypes map[string]labels.MatchType
+
+func (l labelMatchTypes) String() string {
+	pairs := make([]string, 0, len(l))
+	for k, v := range l {
+		pairs = append(pairs, k+":"+v.String())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (l labelMatchTypes) Set(v string) error {
+	parts := strings.SplitN(v, ":", 2)
+	if len(parts) != 2 || !labelNameRe.MatchString(parts[0]) {
+		return fmt.Errorf("invalid label match type %q, expected name:type", v)
+	}
+	var t labels.MatchType
+	switch parts[1] {
+	case "=":
+		t = labels.MatchEqual
+	case "!=":
+		t = labels.MatchNotEqual
+	case "!~":
+		t = labels.MatchNotRegexp
+	default:
+		return fmt.Errorf("invalid label match type %q, expected one of =, != or !~", v)
+	}
+	if _, ok := l[parts[0]]; ok {
+		return fmt.Errorf("duplicate label match type %q", parts[0])
+	}
+	l[parts[0]] = t
+	return nil
+}
+
+// labelValues is a flag.Value accumulating label values.
+type labelValues []string
+
+func (l *labelValues) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *labelValues) Set(v string) error {
+	if v == "" {
+		return fmt.Errorf("empty label value")
+	}
+	*l = append(*l, v)
+	return nil
+}
+
+// labelValueTransforms is a flag.Value accumulating label value transforms.
+type labelValueTransforms struct {
+	specs      []string
+	transforms []injectproxy.LabelValueTransform
+}
+
+func (l *labelValueTransforms) String() string {
+	return strings.Join(l.specs, ",")
+}
+
+func (l *labelValueTransforms) Set(v string) error {
+	t, err := injectproxy.ParseLabelValueTransform(v)
+	if err != nil {
+		return err
+	}
+	l.specs = append(l.specs, v)
+	l.transforms = append(l.transforms, t)
+	return nil
+}
+
+// readCAFile returns a pool of the PEM-encoded certificates of the file.
+func readCAFile(file string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificate found in %q", file)
+	}
+	return pool, nil
+}
+
+// readLabelValues returns the label values of the given file, one per line.
+// Empty lines and lines starting with # are ignored.
+func readLabelValues(file string) ([]string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	values := []string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		values = append(values, line)
+	}
+	return values, nil
+}
+
+// selectorPaths is a flag.Value accumulating path=param mappings.
+type selectorPaths map[string]string
+
+func (s selectorPaths) String() string {
+	pairs := make([]string, 0, len(s))
+	for k, v := range s {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (s selectorPaths) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") || parts[1] == "" {
+		return fmt.Errorf("invalid selector path %q, expected /path=param", v)
+	}
+	if _, ok := s[parts[0]]; ok {
+		return fmt.Errorf("duplicate selector path %q", parts[0])
+	}
+	s[parts[0]] = parts[1]
+	return nil
+}
+
+// processingTimeouts is a flag.Value accumulating path=duration timeouts.
+type processingTimeouts map[string]time.Duration
+
+func (p processingTimeouts) String() string {
+	pairs := make([]string, 0, len(p))
+	for k, v := range p {
+		pairs = append(pairs, k+"="+v.String())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (p processingTimeouts) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+		return fmt.Errorf("invalid processing timeout %q, expected /path=duration", v)
+	}
+	d, err := time.ParseDuration(parts[1])
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid processing timeout %q, expected a positive duration", v)
+	}
+	if _, ok := p[parts[0]]; ok {
+		return fmt.Errorf("duplicate processing timeout %q", parts[0])
+	}
+	p[parts[0]] = d
+	return nil
+}
+
+// pathRewrites is a flag.Value accumulating from:to path rewrites.
+type pathRewrites [][2]string
+
+func (p *pathRewrites) String() string {
+	rws := make([]string, 0, len(*p))
+	for _, rw := range *p {
+		rws = append(rws, rw[0]+":"+rw[1])
+	}
+	return strings.Join(rws, ",")
+}
+
+func (p *pathRewrites) Set(v string) error {
+	// The regular expression may contain colons, the target path doesn't.
+	i := strings.LastIndex(v, ":")
+	if i <= 0 || !strings.HasPrefix(v[i+1:], "/") {
+		return fmt.Errorf("invalid path rewrite %q, expected from:/to", v)
+	}
+	*p = append(*p, [2]string{v[:i], v[i+1:]})
+	return nil
+}
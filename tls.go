@@ -0,0 +1,142 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+)
+
+// sessionTicketKeysReloadInterval is the interval at which the session ticket
+// keys file is checked for changes.
+const sessionTicketKeysReloadInterval = time.Minute
+
+// tlsListenerConfig holds the TLS settings of the secure listener.
+type tlsListenerConfig struct {
+	certFile             string
+	keyFile              string
+	alpnProtocols        string // Comma-delimited string.
+	sessionTicketKeyFile string
+	clientCAFile         string
+}
+
+// newTLSConfig returns the TLS configuration of the secure listener. When a
+// session ticket keys file is configured, the keys are reloaded when the file
+// changes until done is closed.
+func newTLSConfig(c tlsListenerConfig, done <-chan struct{}) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the TLS certificate: %w", err)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.clientCAFile != "" {
+		b, err := ioutil.ReadFile(c.clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate found in the client CA file %q", c.clientCAFile)
+		}
+		// The requests without certificate are rejected by the routes
+		// extracting the label value from the certificate.
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	for _, p := range strings.Split(c.alpnProtocols, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			cfg.NextProtos = append(cfg.NextProtos, p)
+		}
+	}
+
+	if c.sessionTicketKeyFile == "" {
+		return cfg, nil
+	}
+
+	b, err := ioutil.ReadFile(c.sessionTicketKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the session ticket keys file: %w", err)
+	}
+	keys, err := parseSessionTicketKeys(b)
+	if err != nil {
+		return nil, err
+	}
+	cfg.SetSessionTicketKeys(keys)
+
+	go func() {
+		ticker := time.NewTicker(sessionTicketKeysReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			nb, err := ioutil.ReadFile(c.sessionTicketKeyFile)
+			if err != nil {
+				log.Printf("error: Failed to read the session ticket keys file: %v", err)
+				continue
+			}
+			if bytes.Equal(nb, b) {
+				continue
+			}
+			keys, err := parseSessionTicketKeys(nb)
+			if err != nil {
+				log.Printf("error: Failed to reload the session ticket keys: %v", err)
+				continue
+			}
+			cfg.SetSessionTicketKeys(keys)
+			b = nb
+			log.Printf("Reloaded %d session ticket key(s)", len(keys))
+		}
+	}()
+
+	return cfg, nil
+}
+
+// parseSessionTicketKeys parses session ticket keys encoded as 64 hexadecimal
+// characters, one key per line. The first key encrypts the new tickets, the
+// others are only used to decrypt the tickets issued before a rotation.
+func parseSessionTicketKeys(b []byte) ([][32]byte, error) {
+	var keys [][32]byte
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var key [32]byte
+		n, err := hex.Decode(key[:], []byte(line))
+		if err != nil || n != len(key) || len(line) != 2*len(key) {
+			return nil, fmt.Errorf("invalid session ticket key on line %d: expected 64 hexadecimal characters", i+1)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no session ticket key found")
+	}
+	return keys, nil
+}